@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagAckEvents = kingpin.
+			Flag("ack-events", "answer events api posts with an empty 200 no matter what the backend returns").
+			Envar("ACK_EVENTS").Bool()
+	flagAckBackendTimeout = kingpin.
+				Flag("ack-backend-timeout", "time the backend has for an event after it has been acked").
+				Envar("ACK_BACKEND_TIMEOUT").Default("30s").Duration()
+)
+
+var metricEventAcks = NewCounterVec("slack_event_acks_total",
+	"events acked before the backend answered, by backend status class", "backend")
+
+// AckEventsHandler answers events api posts with an empty 200 as soon as it
+// has them, then hands them to child. Slack ignores the body of an event
+// response, and this keeps backend errors from triggering slack retries.
+// url_verification still goes to child, as slack needs the challenge back.
+func AckEventsHandler(child http.Handler, parser PayloadParser, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.Type == "url_verification" {
+			child.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		// slack may hang up now it has its answer, which must not cancel
+		// the forward to the backend, but the request's values still apply
+		ctx, cancel := context.WithTimeout(ackedContext(r.Context()), timeout)
+		defer cancel()
+		resp := NewResponseBuffer()
+		child.ServeHTTP(resp, r.WithContext(ctx))
+
+		class := strconv.Itoa(resp.StatusCode()/100) + "xx"
+		metricEventAcks.Inc(class)
+		if resp.StatusCode() >= 300 {
+			log.Printf("acked event %s, backend returned %d", p.ID, resp.StatusCode())
+		}
+	})
+}
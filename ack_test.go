@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ackTestKey struct{}
+
+func TestAckEventsHandler(t *testing.T) {
+	done := make(chan string, 1)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if strings.Contains(string(body), "url_verification") {
+			w.Write([]byte("challenge"))
+			return
+		}
+		if strings.Contains(string(body), "slow") {
+			time.Sleep(100 * time.Millisecond)
+			assert.NoError(t, r.Context().Err(), "forward must outlive the ack")
+			assert.Equal(t, "kept", r.Context().Value(ackTestKey{}), "forward keeps the request's values")
+		}
+		http.Error(w, "backend broke", http.StatusInternalServerError)
+		done <- string(body)
+	})
+	ack := AckEventsHandler(backend, PayloadParserFunc(ParseSlackPayload), time.Second)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ack.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ackTestKey{}, "kept")))
+	}))
+	defer ts.Close()
+
+	post := func(contentType, body string) (*http.Response, string) {
+		resp, err := http.Post(ts.URL, contentType, strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(respBody)
+	}
+
+	before := metricEventAcks.Get("5xx")
+	event := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message","text":"slow"}}`
+	start := time.Now()
+	resp, body := post("application/json", event)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "ack should not wait on the backend")
+	assert.Equal(t, event, <-done)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, before+1, metricEventAcks.Get("5xx"))
+
+	// challenges and everything but events get the backend answer
+	resp, body = post("application/json", `{"type":"url_verification","challenge":"abc"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "challenge", body)
+
+	resp, _ = post("application/x-www-form-urlencoded", "command=%2Fops")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	<-done
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"golang.org/x/crypto/acme"
+)
+
+var (
+	flagACMEDomains = kingpin.
+			Flag("acme-domain", "domain to get a certificate for over ACME, repeatable, serving https with it").
+			Envar("ACME_DOMAIN").Strings()
+	flagACMEEmail = kingpin.
+			Flag("acme-email", "contact address for the ACME account").
+			Envar("ACME_EMAIL").String()
+	flagACMEDirectory = kingpin.
+				Flag("acme-directory", "ACME directory to get certificates from").
+				Envar("ACME_DIRECTORY").Default("https://acme-v02.api.letsencrypt.org/directory").String()
+	flagACMEDNS = kingpin.
+			Flag("acme-dns", "dns provider to answer DNS-01 challenges with, like route53://<hosted zone id> or cloudflare://<zone id>").
+			Envar("ACME_DNS").String()
+	flagACMEDNSWait = kingpin.
+			Flag("acme-dns-wait", "how long a challenge record is given to reach every name server").
+			Envar("ACME_DNS_WAIT").Default("30s").Duration()
+	flagACMECache = kingpin.
+			Flag("acme-cache", "directory the ACME account key and certificate are kept in").
+			Envar("ACME_CACHE").String()
+	flagACMERenewBefore = kingpin.
+				Flag("acme-renew-before", "how long before it expires the certificate is renewed").
+				Envar("ACME_RENEW_BEFORE").Default("720h").Duration()
+)
+
+var metricACMECertificates = NewCounterVec("acme_certificates_total",
+	"certificates asked for over ACME, by result", "result")
+
+// acmeIssuer gets certificates over ACME, proving the domains with DNS-01,
+// so the proxy needs no inbound access for it. The certificate and its key
+// are written to the cache, where a certReloader picks them up.
+type acmeIssuer struct {
+	Domains     []string
+	Email       string
+	Directory   string
+	DNS         DNSProvider
+	DNSWait     time.Duration
+	Cache       string
+	RenewBefore time.Duration
+}
+
+func (a *acmeIssuer) certFile() string { return filepath.Join(a.Cache, "tls.crt") }
+func (a *acmeIssuer) keyFile() string  { return filepath.Join(a.Cache, "tls.key") }
+
+// due is true when the cached certificate is missing, does not cover every
+// domain, or expires within RenewBefore
+func (a *acmeIssuer) due(now time.Time) bool {
+	pair, err := tls.LoadX509KeyPair(a.certFile(), a.keyFile())
+	if err != nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || now.Add(a.RenewBefore).After(cert.NotAfter) {
+		return true
+	}
+	for _, domain := range a.Domains {
+		if !containsString(cert.DNSNames, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountKey loads the account key from the cache, making one the first
+// time
+func (a *acmeIssuer) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(a.Cache, "account.key")
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pemKey, err := encodeECKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeFileAtomic(path, pemKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no pem key", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// issue gets a new certificate for every domain and writes it to the cache
+func (a *acmeIssuer) issue(ctx context.Context) error {
+	key, err := a.accountKey()
+	if err != nil {
+		return fmt.Errorf("loading account key: %v", err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: a.Directory}
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("registering account: %v", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(a.Domains...))
+	if err != nil {
+		return fmt.Errorf("ordering: %v", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("waiting on order: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: a.Domains[0]},
+		DNSNames: a.Domains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing order: %v", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err := encodeECKey(certKey)
+	if err != nil {
+		return err
+	}
+	// the key goes first, a reload in between fails to pair and is retried
+	if err := writeFileAtomic(a.keyFile(), keyPEM); err != nil {
+		return err
+	}
+	return writeFileAtomic(a.certFile(), certPEM)
+}
+
+// authorize proves one domain with a DNS-01 challenge, unless it already is
+func (a *acmeIssuer) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("getting authorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s has no dns-01 challenge", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// wildcards are proven on the domain under them
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	if err := a.DNS.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("setting %s: %v", fqdn, err)
+	}
+	defer func() {
+		if err := a.DNS.CleanUp(context.Background(), fqdn, value); err != nil {
+			log.Printf("removing %s: %v", fqdn, err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(a.DNSWait):
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accepting challenge for %s: %v", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorizing %s: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// renew checks the certificate every interval, issuing a new one when it
+// is due, and refreshes the certReloader after
+func (a *acmeIssuer) renew(interval time.Duration, refresh chan<- struct{}) {
+	for range time.Tick(interval) {
+		if !a.due(time.Now()) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		err := a.issue(ctx)
+		cancel()
+		if err != nil {
+			metricACMECertificates.Inc("failed")
+			log.Printf("renewing certificate for %s: %v", strings.Join(a.Domains, ","), err)
+			continue
+		}
+		metricACMECertificates.Inc("issued")
+		log.Printf("renewed certificate for %s", strings.Join(a.Domains, ","))
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// acmeFromFlags sets up --acme-domain and friends, getting a certificate
+// right away when there is none cached, or returns nil when no domains are
+// set
+func acmeFromFlags() (*acmeIssuer, error) {
+	if len(*flagACMEDomains) == 0 {
+		return nil, nil
+	}
+	switch {
+	case *flagTLSCert != "" || *flagTLSKey != "":
+		return nil, errors.New("--acme-domain and --tls-cert can not both be used")
+	case *flagACMEDNS == "":
+		return nil, errors.New("--acme-domain needs --acme-dns")
+	case *flagACMECache == "":
+		return nil, errors.New("--acme-domain needs --acme-cache")
+	case *flagWorkers > 0:
+		return nil, errors.New("--acme-domain can not be shared between --workers")
+	}
+	dns, err := OpenDNSProvider(*flagACMEDNS)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(*flagACMECache, 0700); err != nil {
+		return nil, err
+	}
+	a := &acmeIssuer{
+		Domains:     *flagACMEDomains,
+		Email:       *flagACMEEmail,
+		Directory:   *flagACMEDirectory,
+		DNS:         dns,
+		DNSWait:     *flagACMEDNSWait,
+		Cache:       *flagACMECache,
+		RenewBefore: *flagACMERenewBefore,
+	}
+	if a.due(time.Now()) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		if err := a.issue(ctx); err != nil {
+			metricACMECertificates.Inc("failed")
+			return nil, err
+		}
+		metricACMECertificates.Inc("issued")
+	}
+	return a, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
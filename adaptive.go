@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagAdaptiveConcurrency = kingpin.
+				Flag("adaptive-concurrency", "limit forwards in flight to what the backend is found to handle, shedding the rest with a 503").
+				Envar("ADAPTIVE_CONCURRENCY").Bool()
+	flagAdaptiveConcurrencyMin = kingpin.
+					Flag("adaptive-concurrency-min", "lowest the --adaptive-concurrency limit goes").
+					Envar("ADAPTIVE_CONCURRENCY_MIN").Default("1").Int()
+	flagAdaptiveConcurrencyMax = kingpin.
+					Flag("adaptive-concurrency-max", "highest the --adaptive-concurrency limit goes").
+					Envar("ADAPTIVE_CONCURRENCY_MAX").Default("1000").Int()
+	flagAdaptiveConcurrencyWait = kingpin.
+					Flag("adaptive-concurrency-wait", "time a forward waits for a slot before it is shed, 0 to shed at once").
+					Envar("ADAPTIVE_CONCURRENCY_WAIT").Default("500ms").Duration()
+)
+
+var (
+	metricConcurrencyLimit = NewGaugeVec("backend_concurrency_limit",
+		"forwards allowed in flight by --adaptive-concurrency")
+	metricConcurrencyInFlight = NewGaugeVec("backend_concurrency_in_flight",
+		"forwards in flight under --adaptive-concurrency")
+	metricConcurrencyShed = NewCounterVec("backend_concurrency_shed_total",
+		"forwards turned away by --adaptive-concurrency")
+)
+
+// backendLimiter is set up in main when --adaptive-concurrency is on. It
+// outlives config reloads, so what was learned about the backend is kept.
+var backendLimiter *AdaptiveLimiter
+
+// the limit an AdaptiveLimiter starts from, before anything is learned
+const adaptiveInitialLimit = 10
+
+// AdaptiveLimiter finds how many requests a backend handles at once with
+// AIMD: the limit grows by about one for each limit's worth of forwards
+// that go well, and is cut by a tenth when the backend fails, or answers
+// much slower than the fastest it was recently seen to.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	min, max float64
+	inFlight int
+	wake     chan struct{}
+
+	// a forward slower than tolerance times the fastest latency counts as
+	// the backend being overloaded. The fastest is forgotten every window,
+	// so it follows the backend when it gets slower for good.
+	tolerance    float64
+	window       time.Duration
+	fastest      time.Duration
+	fastestSince time.Time
+	lastCut      time.Time
+
+	now func() time.Time
+}
+
+func NewAdaptiveLimiter(min, max int) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	initial := adaptiveInitialLimit
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+	l := &AdaptiveLimiter{
+		limit:     float64(initial),
+		min:       float64(min),
+		max:       float64(max),
+		wake:      make(chan struct{}),
+		tolerance: 2,
+		window:    time.Minute,
+		now:       time.Now,
+	}
+	metricConcurrencyLimit.Set(l.limit)
+	return l
+}
+
+// Limit is the number of forwards currently allowed in flight
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Acquire takes a slot, waiting up to wait for one to free up. It is false
+// if none did, or ctx was done first.
+func (l *AdaptiveLimiter) Acquire(ctx context.Context, wait time.Duration) bool {
+	var timeout <-chan time.Time
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			metricConcurrencyInFlight.Add(1)
+			return true
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		if wait <= 0 {
+			return false
+		}
+		if timeout == nil {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-wake:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Release gives back a slot, and moves the limit by how the forward went
+func (l *AdaptiveLimiter) Release(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	metricConcurrencyInFlight.Add(-1)
+
+	now := l.now()
+	if l.fastest == 0 || latency < l.fastest || now.Sub(l.fastestSince) > l.window {
+		l.fastest, l.fastestSince = latency, now
+	}
+	overloaded := failed || float64(latency) > l.tolerance*float64(l.fastest)
+
+	switch {
+	case !overloaded:
+		l.limit += 1 / l.limit
+	case now.Sub(l.lastCut) > latency:
+		// forwards that were already in flight when the backend slowed down
+		// all see it, they are one signal rather than many
+		l.limit *= 0.9
+		l.lastCut = now
+	}
+	if l.limit < l.min {
+		l.limit = l.min
+	}
+	if l.limit > l.max {
+		l.limit = l.max
+	}
+	metricConcurrencyLimit.Set(l.limit)
+
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// AdaptiveConcurrencyHandler forwards to child within the limit of l,
+// waiting up to wait for a slot, but never past the time left for slack's
+// answer. Requests that get no slot are answered with a 503. 5xx and 429
+// answers count against the backend, except those from a backend's
+// schedule holding an event back.
+func AdaptiveConcurrencyHandler(child http.Handler, l *AdaptiveLimiter, wait time.Duration) http.Handler {
+	if l == nil {
+		return child
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := wait
+		if left, ok := remainingBudget(r, time.Now()); ok && left < limit {
+			limit = left
+		}
+		if !l.Acquire(r.Context(), limit) {
+			metricConcurrencyShed.Inc()
+			http.Error(w, "backend at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		child.ServeHTTP(sw, r)
+		status := sw.Status()
+		deferred := sw.Header().Get(HeaderProxyDeferred) != ""
+		l.Release(time.Since(start), !deferred && (status >= 500 || status == http.StatusTooManyRequests))
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewAdaptiveLimiter(2, 20)
+	l.now = func() time.Time { return now }
+	assert.Equal(t, adaptiveInitialLimit, l.Limit())
+
+	// healthy forwards grow the limit by about one per limit's worth
+	for i := 0; i < 11; i++ {
+		require.True(t, l.Acquire(context.Background(), 0))
+		l.Release(10*time.Millisecond, false)
+	}
+	assert.Equal(t, 11, l.Limit())
+
+	// a failure cuts it, but the rest of the same burst does not
+	now = now.Add(time.Second)
+	for i := 0; i < 5; i++ {
+		require.True(t, l.Acquire(context.Background(), 0))
+		l.Release(10*time.Millisecond, true)
+	}
+	assert.Equal(t, 9, l.Limit())
+
+	// so does a latency well past the fastest seen
+	now = now.Add(time.Second)
+	require.True(t, l.Acquire(context.Background(), 0))
+	l.Release(50*time.Millisecond, false)
+	assert.Equal(t, 8, l.Limit())
+
+	// it stays within min and max
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Second)
+		require.True(t, l.Acquire(context.Background(), 0))
+		l.Release(10*time.Millisecond, true)
+	}
+	assert.Equal(t, 2, l.Limit())
+	for i := 0; i < 1000; i++ {
+		require.True(t, l.Acquire(context.Background(), 0))
+		l.Release(10*time.Millisecond, false)
+	}
+	assert.Equal(t, 20, l.Limit())
+}
+
+func TestAdaptiveLimiterAcquire(t *testing.T) {
+	l := NewAdaptiveLimiter(1, 1)
+	require.True(t, l.Acquire(context.Background(), 0))
+	assert.False(t, l.Acquire(context.Background(), 0))
+	assert.False(t, l.Acquire(context.Background(), 10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, l.Acquire(ctx, time.Minute))
+
+	// a waiting forward gets the slot as soon as it is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Release(time.Millisecond, false)
+	}()
+	assert.True(t, l.Acquire(context.Background(), time.Minute))
+}
+
+func TestAdaptiveConcurrencyHandler(t *testing.T) {
+	l := NewAdaptiveLimiter(1, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	h := AdaptiveConcurrencyHandler(backend, l, 10*time.Millisecond)
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "backend at capacity\n", w.Body.String())
+
+	close(release)
+	assert.Equal(t, http.StatusServiceUnavailable, <-done)
+	assert.True(t, l.Acquire(context.Background(), 0))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagAdminListen = kingpin.
+	Flag("admin-listen", "address for the admin listener, disabled if empty").
+	Envar("ADMIN_LISTEN").String()
+
+// buildAdminHandler serves operator endpoints, which must never be exposed
+// on the slack facing listener. Replayed events are sent through forward.
+func buildAdminHandler(forward http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	id, _ := replicaID()
+	mux.Handle("/admin/cluster", ClusterHandler(clusterStore, id))
+	if reloader != nil {
+		mux.Handle("/admin/config", ConfigFingerprintHandler(reloader.currentFingerprint))
+		mux.Handle("/admin/reload", ReloadHandler(reloader))
+	}
+	mux.Handle("/admin/secrets", SecretStatsHandler(slackSecretStats, slackSecrets.Get))
+	mux.Handle("/admin/secrets/pending", PendingSecretsHandler(slackPendingSecrets))
+	mux.Handle("/admin/silences", SilenceAdminHandler(silences))
+	mux.Handle("/admin/usage", UsageStatsHandler(usage))
+	mux.Handle("/admin/verify/failures", verifyFailures)
+	if *flagVerifyDebugToken != "" {
+		mux.Handle("/admin/verify/debug", SignatureDebugHandler(slackSecrets.Get, *flagVerifyDebugToken))
+	}
+	mux.Handle("/version", VersionHandler())
+	mux.Handle("/readyz", ReadyHandler(*flagReadyChecks, readyChecks, *flagReadyTimeout))
+	if *flagAuditLog != "" {
+		mux.Handle("/admin/audit", AuditExportHandler(*flagAuditLog))
+	}
+	if archives := replayArchives(); len(archives) > 0 {
+		var candidate http.Handler
+		if *flagReplayCandidate != nil {
+			candidate = newBackendProxy(*flagReplayCandidate)
+		}
+		mux.Handle("/admin/replay", ReplayHandler(archives, forward, candidate, *flagAckBackendTimeout))
+	}
+	return mux
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type amqpPublished struct {
+	Exchange  string
+	Key       string
+	MessageID string
+	Body      []byte
+}
+
+// fakeBroker speaks just enough amqp to accept publishes in confirm mode.
+// answer decides how each publish is confirmed: nil acks it, anything else
+// closes the channel with that error.
+type fakeBroker struct {
+	t         *testing.T
+	l         net.Listener
+	auth      chan string
+	published chan amqpPublished
+	answer    func(p amqpPublished) *amqpError
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := &fakeBroker{
+		t:         t,
+		l:         l,
+		auth:      make(chan string, 10),
+		published: make(chan amqpPublished, 10),
+		answer:    func(p amqpPublished) *amqpError { return nil },
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &amqpConn{conn: conn, r: bufio.NewReader(conn), frameMax: amqpDefaultFrameMax}
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	assert.Equal(b.t, amqpProtocolHeader, header)
+
+	send := func(channel uint16, m amqpMethod, args func(w *amqpWriter)) {
+		var w amqpWriter
+		w.method(m)
+		if args != nil {
+			args(&w)
+		}
+		c.writeFrame(amqpFrameMethod, channel, w.Bytes())
+	}
+
+	send(0, amqpConnectionStart, func(w *amqpWriter) {
+		w.octet(0)
+		w.octet(9)
+		w.table(nil)
+		w.longstr("PLAIN AMQPLAIN")
+		w.longstr("en_US")
+	})
+	args, err := c.expect(amqpConnectionStartOk)
+	if err != nil {
+		return
+	}
+	args.next(int(args.long()))
+	assert.Equal(b.t, "PLAIN", args.shortstr())
+	b.auth <- args.longstr()
+
+	send(0, amqpConnectionTune, func(w *amqpWriter) {
+		w.short(2047)
+		w.long(4096)
+		w.short(60)
+	})
+	if args, err = c.expect(amqpConnectionTuneOk); err != nil {
+		return
+	}
+	args.short()
+	assert.Equal(b.t, uint32(4096), args.long())
+	if args, err = c.expect(amqpConnectionOpen); err != nil {
+		return
+	}
+	b.auth <- "vhost " + args.shortstr()
+	send(0, amqpConnectionOpenOk, func(w *amqpWriter) { w.shortstr("") })
+	if _, err = c.expect(amqpChannelOpen); err != nil {
+		return
+	}
+	send(1, amqpChannelOpenOk, func(w *amqpWriter) { w.longstr("") })
+	if _, err = c.expect(amqpConfirmSelect); err != nil {
+		return
+	}
+	send(1, amqpConfirmSelectOk, nil)
+
+	var tag uint64
+	for {
+		args, err := c.expect(amqpBasicPublish)
+		if err != nil {
+			return
+		}
+		args.short()
+		p := amqpPublished{Exchange: args.shortstr(), Key: args.shortstr()}
+
+		_, _, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		header := &amqpReader{b: payload}
+		header.short()
+		header.short()
+		size := header.longlong()
+		assert.Equal(b.t, uint16(1<<15|1<<12|1<<7|1<<6), header.short())
+		assert.Equal(b.t, "application/json", header.shortstr())
+		assert.Equal(b.t, byte(amqpPersistentDelivery), header.octet())
+		p.MessageID = header.shortstr()
+
+		for uint64(len(p.Body)) < size {
+			typ, _, payload, err := c.readFrame()
+			if err != nil {
+				return
+			}
+			assert.Equal(b.t, byte(amqpFrameBody), typ)
+			p.Body = append(p.Body, payload...)
+		}
+		tag++
+
+		if e := b.answer(p); e != nil {
+			send(1, amqpChannelClose, func(w *amqpWriter) {
+				w.short(e.Code)
+				w.shortstr(e.Text)
+				w.short(60)
+				w.short(40)
+			})
+			return
+		}
+		b.published <- p
+		send(1, amqpBasicAck, func(w *amqpWriter) {
+			w.longlong(tag)
+			w.octet(0)
+		})
+	}
+}
+
+func TestAMQPSink(t *testing.T) {
+	b := newFakeBroker(t)
+	defer b.l.Close()
+
+	key, err := parseKeyTemplate("routing key", "slack.{kind}.{type}")
+	require.NoError(t, err)
+	sink := &AMQPSink{
+		URL:        &url.URL{Scheme: "amqp", User: url.UserPassword("proxy", "pw"), Host: b.l.Addr().String(), Path: "/slack"},
+		Exchange:   "events",
+		RoutingKey: key,
+		Timeout:    time.Second,
+	}
+
+	// big enough to need more than one body frame
+	text := make([]byte, 6000)
+	for i := range text {
+		text[i] = 'x'
+	}
+	d := &Delivery{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   []byte(`{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message","text":"` + string(text) + `"}}`),
+	}
+	before := metricAMQPDeliveries.Get("confirmed")
+	require.NoError(t, sink.Send(context.Background(), d))
+	assert.Equal(t, "\x00proxy\x00pw", <-b.auth)
+	assert.Equal(t, "vhost slack", <-b.auth)
+
+	p := <-b.published
+	assert.Equal(t, "events", p.Exchange)
+	assert.Equal(t, "slack.event.message", p.Key)
+	assert.Equal(t, "Ev1", p.MessageID)
+	var got Delivery
+	require.NoError(t, json.Unmarshal(p.Body, &got))
+	assert.Equal(t, d.Body, got.Body)
+
+	// the connection is reused
+	require.NoError(t, sink.Send(context.Background(), &Delivery{Body: []byte("junk")}))
+	p = <-b.published
+	assert.Equal(t, "slack..", p.Key)
+	assert.Equal(t, before+2, metricAMQPDeliveries.Get("confirmed"))
+
+	// a channel closed by the broker fails the delivery, once the retry
+	// on a fresh connection fails too
+	b.answer = func(p amqpPublished) *amqpError {
+		return &amqpError{404, "NOT_FOUND - no exchange 'events' in vhost 'slack'"}
+	}
+	assert.EqualError(t, sink.Send(context.Background(), d),
+		"amqp 404 NOT_FOUND - no exchange 'events' in vhost 'slack'")
+	assert.Nil(t, sink.conn)
+}
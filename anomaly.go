@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagAnomalyFactor = kingpin.
+				Flag("anomaly-factor", "warn when a team sends this many times its usual events per minute of a type, 0 to disable").
+				Envar("ANOMALY_FACTOR").Default("0").Float64()
+	flagAnomalyFloor = kingpin.
+				Flag("anomaly-floor", "events per minute that never count as an anomaly").
+				Envar("ANOMALY_FLOOR").Default("60").Float64()
+	flagAnomalyThrottle = kingpin.
+				Flag("anomaly-throttle", "ack but do not forward events over the anomaly limit").
+				Envar("ANOMALY_THROTTLE").Bool()
+)
+
+var (
+	metricEventAnomalies = NewCounterVec("event_volume_anomalies_total",
+		"minutes a team sent far more events of a type than usual", "team", "type")
+	metricEventsThrottled = NewCounterVec("event_volume_throttled_total",
+		"events acked without forwarding during an anomaly", "team", "type")
+)
+
+// minutes of history before a baseline is trusted, and how much each new
+// minute moves it
+const (
+	anomalyWarmup = 10
+	anomalyAlpha  = 0.1
+)
+
+// eventVolumes is set up in main with --anomaly-factor. It is kept across
+// config reloads, so baselines do not have to warm up again.
+var eventVolumes *volumeTracker
+
+// volumeTracker keeps a moving average of events per minute for each team
+// and event type, and flags minutes that go well past it
+type volumeTracker struct {
+	factor float64
+	floor  float64
+	now    func() time.Time
+
+	mu      sync.Mutex
+	volumes map[[2]string]*volume
+}
+
+type volume struct {
+	minute    int64
+	count     float64
+	baseline  float64
+	minutes   int
+	anomalous bool
+}
+
+func newVolumeTracker(factor, floor float64) *volumeTracker {
+	return &volumeTracker{
+		factor:  factor,
+		floor:   floor,
+		now:     time.Now,
+		volumes: map[[2]string]*volume{},
+	}
+}
+
+// observe counts one event, and reports whether it is over the limit
+func (t *volumeTracker) observe(team, eventType string) (over bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	minute := t.now().Unix() / 60
+	v, ok := t.volumes[[2]string{team, eventType}]
+	if !ok {
+		v = &volume{minute: minute}
+		t.volumes[[2]string{team, eventType}] = v
+	}
+	if minute != v.minute {
+		// fold in the minute that ended, and any quiet ones since
+		for m := v.minute; m < minute && m < v.minute+60; m++ {
+			if v.minutes == 0 {
+				v.baseline = v.count
+			} else {
+				v.baseline += anomalyAlpha * (v.count - v.baseline)
+			}
+			v.minutes++
+			v.count = 0
+		}
+		v.minute, v.count, v.anomalous = minute, 0, false
+	}
+
+	v.count++
+	limit := v.baseline * t.factor
+	if limit < t.floor {
+		limit = t.floor
+	}
+	if v.minutes < anomalyWarmup || v.count <= limit {
+		return false
+	}
+	if !v.anomalous {
+		v.anomalous = true
+		metricEventAnomalies.Inc(team, eventType)
+		log.Printf("team %s sent %.0f %s events this minute, usually %.1f",
+			team, v.count, eventType, v.baseline)
+	}
+	return true
+}
+
+// AnomalyHandler watches event volume, and with throttle set acks events
+// over the limit without handing them to child.
+func AnomalyHandler(child http.Handler, parser PayloadParser, t *volumeTracker, throttle bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.Type == "url_verification" {
+			child.ServeHTTP(w, r)
+			return
+		}
+		if t.observe(p.TeamID, p.Type) && throttle {
+			metricEventsThrottled.Inc(p.TeamID, p.Type)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		child.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeTracker(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tracker := newVolumeTracker(3, 5)
+	tracker.now = func() time.Time { return now }
+
+	// build up a baseline of 4 a minute
+	for minute := 0; minute < anomalyWarmup; minute++ {
+		for i := 0; i < 4; i++ {
+			assert.False(t, tracker.observe("T1", "message"))
+		}
+		now = now.Add(time.Minute)
+	}
+
+	before := metricEventAnomalies.Get("T1", "message")
+	over := 0
+	for i := 0; i < 20; i++ {
+		if tracker.observe("T1", "message") {
+			over++
+		}
+	}
+	assert.Equal(t, 8, over, "4 a minute with a factor of 3 allows 12")
+	assert.Equal(t, before+1, metricEventAnomalies.Get("T1", "message"), "warned once per minute")
+
+	// other teams and types have their own baselines
+	assert.False(t, tracker.observe("T2", "message"))
+	assert.False(t, tracker.observe("T1", "reaction_added"))
+
+	// the floor covers teams that are usually quiet
+	now = now.Add(time.Minute)
+	for i := 0; i < 5; i++ {
+		assert.False(t, tracker.observe("T1", "message"))
+	}
+}
+
+func TestAnomalyHandler(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tracker := newVolumeTracker(2, 1)
+	tracker.now = func() time.Time { return now }
+	for minute := 0; minute < anomalyWarmup; minute++ {
+		tracker.observe("T1", "message")
+		now = now.Add(time.Minute)
+	}
+
+	forwarded := 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := AnomalyHandler(backend, PayloadParserFunc(ParseSlackPayload), tracker, true)
+
+	before := metricEventsThrottled.Get("T1", "message")
+	event := `{"type":"event_callback","team_id":"T1","event":{"type":"message"}}`
+	for i := 0; i < 4; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(event))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+	}
+	assert.Equal(t, 2, forwarded)
+	assert.Equal(t, before+2, metricEventsThrottled.Get("T1", "message"))
+
+	// commands are never throttled
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("command=%2Fops&team_id=T1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AppConfig is one slack app served under its own path prefix, with its
+// own signing secret and backend, for hosting several apps behind one
+// proxy.
+type AppConfig struct {
+	// Path is the prefix of the app's request urls, like /app-a/
+	Path string `json:"path"`
+	// Secret checks requests under Path in place of --slack-token
+	Secret string `json:"secret"`
+	// Expire stands in for --slack-expire, when set
+	Expire Duration `json:"expire"`
+	// Backend gets requests under Path, unless a route sends them elsewhere
+	Backend string `json:"backend"`
+}
+
+func (ac AppConfig) validate() error {
+	if !strings.HasPrefix(ac.Path, "/") {
+		return fmt.Errorf("path %q does not start with /", ac.Path)
+	}
+	if ac.Secret == "" {
+		return fmt.Errorf("needs a secret")
+	}
+	if ac.Expire < 0 {
+		return fmt.Errorf("negative expire")
+	}
+	if ac.Backend != "" {
+		target, err := url.Parse(ac.Backend)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("bad backend %q", ac.Backend)
+		}
+	}
+	return nil
+}
+
+// validateApps checks each app, and that no two share a path
+func validateApps(apps map[string]AppConfig) error {
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	paths := map[string]string{}
+	for _, name := range names {
+		ac := apps[name]
+		if name == "" {
+			return fmt.Errorf("app with no name")
+		}
+		if err := ac.validate(); err != nil {
+			return fmt.Errorf("app %s: %v", name, err)
+		}
+		if other, ok := paths[ac.Path]; ok {
+			return fmt.Errorf("apps %s and %s share path %s", other, name, ac.Path)
+		}
+		paths[ac.Path] = name
+	}
+	return nil
+}
+
+// configSecrets is true when the config has signing secrets of its own,
+// so the proxy can run without --slack-token
+func configSecrets(config *Config) bool {
+	return teamSecrets(config) || len(config.Apps) > 0
+}
+
+// sortedApps are the names of apps, longest path first so the most
+// specific app wins, like --uri-route
+func sortedApps(apps map[string]AppConfig) []string {
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := apps[names[i]].Path, apps[names[j]].Path
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return names
+}
+
+// AppVerifyHandler checks requests under each app's path against only that
+// app's secret and expiry. Requests on no app's path go to fallback.
+func AppVerifyHandler(fallback http.Handler, apps map[string]AppConfig, verify func(secret string, expire time.Duration) http.Handler) http.Handler {
+	names := sortedApps(apps)
+	if len(names) == 0 {
+		return fallback
+	}
+	routes := make([]PathRoute, len(names))
+	for i, name := range names {
+		ac := apps[name]
+		expire := time.Duration(ac.Expire)
+		if expire == 0 {
+			expire = *flagSlackExpire
+		}
+		routes[i] = PathRoute{Prefix: ac.Path, Handler: verify(ac.Secret, expire)}
+	}
+	return PathRouteHandler(fallback, routes...)
+}
+
+// appRoutes send requests under each app's path to the app's backend
+func appRoutes(apps map[string]AppConfig) []PathRoute {
+	var routes []PathRoute
+	for _, name := range sortedApps(apps) {
+		if apps[name].Backend == "" {
+			continue
+		}
+		// validated on load
+		target, _ := url.Parse(apps[name].Backend)
+		routes = append(routes, PathRoute{Prefix: apps[name].Path, Handler: newBackendProxy(target)})
+	}
+	return routes
+}
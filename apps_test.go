@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppVerifyHandler(t *testing.T) {
+	apps := map[string]AppConfig{
+		"a":     {Path: "/app-a/", Secret: "one"},
+		"b":     {Path: "/app-b/", Secret: "two", Expire: Duration(time.Hour)},
+		"b-old": {Path: "/app-b/old/", Secret: "old"},
+	}
+	verify := func(expire time.Duration, secrets ...string) http.Handler {
+		return (&SlackVerifier{Secrets: secrets, Expire: expire}).Handler(StatusHandler(http.StatusOK, "ok"))
+	}
+	defer func(expire time.Duration) { *flagSlackExpire = expire }(*flagSlackExpire)
+	*flagSlackExpire = 5 * time.Minute
+	h := AppVerifyHandler(verify(time.Minute, "shared"), apps, func(secret string, expire time.Duration) http.Handler {
+		return verify(expire, secret)
+	})
+
+	for name, tc := range map[string]struct {
+		path, secret string
+		age          time.Duration
+		code         int
+	}{
+		"own secret":          {"/app-a/events", "one", 0, http.StatusOK},
+		"shared secret":       {"/app-a/events", "shared", 0, http.StatusUnauthorized},
+		"other app's secret":  {"/app-a/events", "two", 0, http.StatusUnauthorized},
+		"default expire":      {"/app-a/events", "one", 10 * time.Minute, http.StatusUnauthorized},
+		"own expire":          {"/app-b/events", "two", 30 * time.Minute, http.StatusOK},
+		"longest path wins":   {"/app-b/old/events", "old", 0, http.StatusOK},
+		"shorter path secret": {"/app-b/old/events", "two", 0, http.StatusUnauthorized},
+		"no app":              {"/slack/events", "shared", 0, http.StatusOK},
+		"no app, app secret":  {"/slack/events", "one", 0, http.StatusUnauthorized},
+	} {
+		body := `{"type":"event_callback","team_id":"T1","event":{"type":"message"}}`
+		r := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		SignSlackRequest(r, tc.secret, time.Now().Add(-tc.age), []byte(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.code, w.Code, name)
+	}
+}
+
+func TestAppRoutes(t *testing.T) {
+	a := namedBackend(t, "a")
+	defer a.Close()
+
+	routes := appRoutes(map[string]AppConfig{
+		"a": {Path: "/app-a/", Secret: "one", Backend: a.URL},
+		"b": {Path: "/app-b/", Secret: "two"},
+	})
+	require.Len(t, routes, 1)
+	h := PathRouteHandler(StatusHandler(http.StatusTeapot, "default"), routes...)
+
+	for path, want := range map[string]int{"/app-a/events": http.StatusOK, "/app-b/events": http.StatusTeapot} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		assert.Equal(t, want, w.Code, path)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagArchiveResponses = kingpin.
+				Flag("archive-responses", "record the backend's status and latency alongside each archived event").
+				Envar("ARCHIVE_RESPONSES").Bool()
+	flagArchiveResponseBody = kingpin.
+				Flag("archive-response-body", "with --archive-responses, how much of the backend's response body to keep").
+				Envar("ARCHIVE_RESPONSE_BODY").Default("0").Bytes()
+)
+
+// ArchiveSink appends each delivery to a file as a line of json, so it can be
+// read back later.
+type ArchiveSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenArchiveSink(path string) (*ArchiveSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveSink{file: f}, nil
+}
+
+func (a *ArchiveSink) Send(ctx context.Context, d *Delivery) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(line)
+	return err
+}
+
+func (a *ArchiveSink) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// ReadArchive calls fn for each delivery in an archive, in the order they
+// were written.
+func ReadArchive(r io.Reader, fn func(d *Delivery) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var d Delivery
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return err
+		}
+		if err := fn(&d); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.ndjson")
+
+	in := []*Delivery{
+		{
+			Method:     http.MethodPost,
+			RequestURI: "/slack/events",
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       []byte(`{"type":"event_callback"}`),
+			ReceivedAt: time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Method:     http.MethodPost,
+			RequestURI: "/slack/commands",
+			Body:       []byte("command=%2Fops\x00\xff"),
+			ReceivedAt: time.Date(2020, 9, 1, 12, 0, 1, 0, time.UTC),
+		},
+	}
+
+	archive, err := OpenArchiveSink(path)
+	require.NoError(t, err)
+	require.NoError(t, archive.Send(context.Background(), in[0]))
+	require.NoError(t, archive.Close())
+	// reopening appends
+	archive, err = OpenArchiveSink(path)
+	require.NoError(t, err)
+	require.NoError(t, archive.Send(context.Background(), in[1]))
+	require.NoError(t, archive.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var out []*Delivery
+	require.NoError(t, ReadArchive(f, func(d *Delivery) error {
+		out = append(out, d)
+		return nil
+	}))
+	assert.Equal(t, in, out)
+}
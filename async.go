@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagAsyncAck = kingpin.
+			Flag("async-ack", "answer events with a 200 once verified, and forward them from a background queue").
+			Envar("ASYNC_ACK").Bool()
+	flagAsyncAckWorkers = kingpin.
+				Flag("async-ack-workers", "forwards run at once from the --async-ack queue").
+				Envar("ASYNC_ACK_WORKERS").Default("4").Int()
+	flagAsyncAckQueue = kingpin.
+				Flag("async-ack-queue", "events waiting to be forwarded before new ones are forwarded inline").
+				Envar("ASYNC_ACK_QUEUE").Default("1000").Int()
+	flagAsyncAckRetries = kingpin.
+				Flag("async-ack-retries", "times an event the backend fails with a 5xx or 429 is retried").
+				Envar("ASYNC_ACK_RETRIES").Default("3").Int()
+	flagAsyncAckInteractive = kingpin.
+				Flag("async-ack-interactive", "also ack commands and interactions at once, and forward them ahead of events, for backends that answer through response_url").
+				Envar("ASYNC_ACK_INTERACTIVE").Bool()
+	flagAsyncAckAging = kingpin.
+				Flag("async-ack-aging", "time waiting in the --async-ack queue that counts as much as one priority level, 0 for strict priority").
+				Envar("ASYNC_ACK_AGING").Default("5s").Duration()
+)
+
+var (
+	metricAsyncAcks = NewCounterVec("slack_async_acks_total",
+		"events acked by --async-ack, by how they were forwarded", "outcome")
+	metricAsyncQueue = NewGaugeVec("slack_async_ack_queue",
+		"requests waiting in the --async-ack queue, by priority", "priority")
+)
+
+// asyncAcks is set up in main when --async-ack is on. It outlives config
+// reloads, each queued event carries the handler it is forwarded with.
+var asyncAcks *asyncQueue
+
+// priorities in the --async-ack queue, a person waiting on an
+// interaction comes before a command, which comes before events
+const (
+	asyncPriorityEvent = iota
+	asyncPriorityCommand
+	asyncPriorityInteraction
+	asyncPriorities
+)
+
+var asyncPriorityNames = [asyncPriorities]string{"event", "command", "interaction"}
+
+func asyncPriority(p *Payload) int {
+	switch p.Kind {
+	case PayloadInteraction:
+		return asyncPriorityInteraction
+	case PayloadCommand:
+		return asyncPriorityCommand
+	}
+	return asyncPriorityEvent
+}
+
+type asyncJob struct {
+	// the values of the request the job came from, without its cancel or
+	// slack's window
+	ctx      context.Context
+	d        *Delivery
+	child    http.Handler
+	priority int
+	queued   time.Time
+}
+
+// asyncQueue forwards acked events in the background, highest priority
+// first. A job gains a priority level for each aging it waits, so a steady
+// stream of interactions can not hold events back forever. Events still
+// queued when the proxy exits are lost, slack does not retry what was
+// acked.
+type asyncQueue struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	jobs   [asyncPriorities][]asyncJob
+	queued int
+	size   int
+	aging  time.Duration
+	now    func() time.Time
+
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+}
+
+func newAsyncQueue(size, workers, retries int, timeout time.Duration) *asyncQueue {
+	q := &asyncQueue{
+		size:    size,
+		aging:   5 * time.Second,
+		now:     time.Now,
+		retries: retries,
+		backoff: time.Second,
+		timeout: timeout,
+	}
+	q.ready = sync.NewCond(&q.mu)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// add queues the job, false if the queue is full
+func (q *asyncQueue) add(job asyncJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued >= q.size {
+		return false
+	}
+	job.queued = q.now()
+	q.jobs[job.priority] = append(q.jobs[job.priority], job)
+	q.queued++
+	metricAsyncQueue.Add(1, asyncPriorityNames[job.priority])
+	q.ready.Signal()
+	return true
+}
+
+// full is true when add would turn jobs away
+func (q *asyncQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued >= q.size
+}
+
+// depth is how many jobs are waiting, across every priority
+func (q *asyncQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued
+}
+
+// next waits for a job and takes the one with the highest priority once
+// aged. Within a priority the oldest comes first, so only the head of each
+// needs to be looked at.
+func (q *asyncQueue) next() asyncJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.queued == 0 {
+		q.ready.Wait()
+	}
+	now := q.now()
+	best, bestScore := -1, 0.0
+	for priority := asyncPriorities - 1; priority >= 0; priority-- {
+		if len(q.jobs[priority]) == 0 {
+			continue
+		}
+		score := float64(priority)
+		if q.aging > 0 {
+			score += float64(now.Sub(q.jobs[priority][0].queued)) / float64(q.aging)
+		}
+		if best < 0 || score > bestScore {
+			best, bestScore = priority, score
+		}
+	}
+	job := q.jobs[best][0]
+	q.jobs[best] = q.jobs[best][1:]
+	q.queued--
+	metricAsyncQueue.Add(-1, asyncPriorityNames[best])
+	return job
+}
+
+func (q *asyncQueue) work() {
+	for {
+		q.forward(q.next())
+	}
+}
+
+func (q *asyncQueue) forward(job asyncJob) {
+	backoff := q.backoff
+	for attempt := 0; ; attempt++ {
+		status, err := q.attempt(job)
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retry {
+			metricAsyncAcks.Inc("forwarded")
+			if status >= 300 {
+				log.Printf("async acked event, backend returned %d", status)
+			}
+			return
+		}
+		if attempt >= q.retries {
+			metricAsyncAcks.Inc("failed")
+			log.Printf("async acked event failed after %d attempts, backend returned %d: %v",
+				attempt+1, status, err)
+			return
+		}
+		time.Sleep(jitter(backoff))
+		backoff *= 2
+	}
+}
+
+func (q *asyncQueue) attempt(job asyncJob) (int, error) {
+	parent := job.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, q.timeout)
+	defer cancel()
+	r, err := job.d.Request(ctx)
+	if err != nil {
+		return 0, err
+	}
+	resp := NewResponseBuffer()
+	job.child.ServeHTTP(resp, r)
+	return resp.StatusCode(), nil
+}
+
+// AsyncAckHandler answers events api posts with an empty 200 and queues them
+// to be forwarded to child, retrying backend failures. Unlike
+// AckEventsHandler nothing is held open per event. When the queue is full
+// events are forwarded inline, so a backlog slows slack down rather than
+// losing events. Commands and interactions go straight to child unless
+// interactive is set, as does url_verification, which needs the backend's
+// answer. Options requests for menus always need it.
+func AsyncAckHandler(child http.Handler, parser PayloadParser, q *asyncQueue, interactive bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Type == "url_verification" || p.Type == "block_suggestion" ||
+			(p.Kind != PayloadEvent && !(interactive && (p.Kind == PayloadCommand || p.Kind == PayloadInteraction))) {
+			child.ServeHTTP(w, r)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		job := asyncJob{
+			ctx:      ackedContext(r.Context()),
+			d:        NewDelivery(r, body),
+			child:    child,
+			priority: asyncPriority(p),
+		}
+		if !q.add(job) {
+			metricAsyncAcks.Inc("inline")
+			child.ServeHTTP(w, r)
+			return
+		}
+		metricAsyncAcks.Inc("queued")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	})
+}
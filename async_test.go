@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncAckHandler(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	forwarded := make(chan string, 10)
+	failures := map[string]int{"flaky": 2}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		switch {
+		case strings.Contains(string(body), "url_verification"):
+			w.Write([]byte("challenge"))
+			return
+		case strings.Contains(string(body), "command"):
+			w.Write([]byte("command answer"))
+			return
+		case strings.Contains(string(body), "slow"):
+			close(started)
+			<-release
+		case strings.Contains(string(body), "flaky") && failures["flaky"] > 0:
+			failures["flaky"]--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if !strings.Contains(string(body), "inline") {
+			assert.NotEmpty(t, r.Header.Get(HeaderProxyAttempt))
+		}
+		assert.Equal(t, "kept", r.Context().Value(ackTestKey{}), "forward keeps the request's values")
+		forwarded <- string(body)
+	})
+
+	// one worker and room for one more, so the queue can be filled
+	q := newAsyncQueue(1, 1, 3, time.Second)
+	q.backoff = time.Millisecond
+	h := AsyncAckHandler(backend, PayloadParserFunc(ParseSlackPayload), q, false)
+
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ackTestKey{}, "kept"))
+		r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		// slack hanging up after the ack must not stop the queued forward
+		cancel()
+		return w
+	}
+	event := func(text string) string {
+		return `{"type":"event_callback","event":{"type":"message","text":"` + text + `"}}`
+	}
+
+	// challenges and commands get the backend answer
+	w := post("application/json", `{"type":"url_verification","challenge":"abc"}`)
+	assert.Equal(t, "challenge", w.Body.String())
+	w = post("application/x-www-form-urlencoded", "command=%2Fops&text=command")
+	assert.Equal(t, "command answer", w.Body.String())
+
+	// backend failures are retried after the ack
+	w = post("application/json", event("flaky"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, event("flaky"), <-forwarded)
+
+	// the worker is held up by slow, the queue holds queued, so the next
+	// event is forwarded inline
+	before := metricAsyncAcks.Get("inline")
+	post("application/json", event("slow"))
+	<-started
+	post("application/json", event("queued"))
+	done := make(chan struct{})
+	go func() {
+		post("application/json", event("inline"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("inline forward should not wait on the queue")
+	}
+	assert.Equal(t, event("inline"), <-forwarded)
+	assert.Equal(t, before+1, metricAsyncAcks.Get("inline"))
+
+	close(release)
+	assert.Equal(t, event("slow"), <-forwarded)
+	assert.Equal(t, event("queued"), <-forwarded)
+}
+
+func TestAsyncQueuePriority(t *testing.T) {
+	now := time.Now()
+	q := newAsyncQueue(10, 0, 0, time.Second)
+	q.now = func() time.Time { return now }
+	add := func(name string, priority int) {
+		require.True(t, q.add(asyncJob{d: &Delivery{RequestURI: name}, priority: priority}))
+	}
+	next := func() string { return q.next().d.RequestURI }
+
+	before := metricAsyncQueue.Get("event")
+	add("event 1", asyncPriorityEvent)
+	add("event 2", asyncPriorityEvent)
+	add("command", asyncPriorityCommand)
+	add("interaction", asyncPriorityInteraction)
+	assert.Equal(t, before+2, metricAsyncQueue.Get("event"))
+
+	assert.Equal(t, "interaction", next())
+	assert.Equal(t, "command", next())
+	assert.Equal(t, "event 1", next())
+
+	// an event that waited long enough goes ahead of a new interaction
+	now = now.Add(11 * time.Second)
+	add("late interaction", asyncPriorityInteraction)
+	assert.Equal(t, "event 2", next())
+	assert.Equal(t, "late interaction", next())
+	assert.Equal(t, before, metricAsyncQueue.Get("event"))
+
+	// without aging priority is strict
+	q.aging = 0
+	add("old event", asyncPriorityEvent)
+	now = now.Add(time.Hour)
+	add("command", asyncPriorityCommand)
+	assert.Equal(t, "command", next())
+	assert.Equal(t, "old event", next())
+}
+
+func TestAsyncAckHandlerInteractive(t *testing.T) {
+	forwarded := make(chan string, 10)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write([]byte("answer"))
+		forwarded <- string(body)
+	})
+	q := newAsyncQueue(10, 1, 0, time.Second)
+	h := AsyncAckHandler(backend, PayloadParserFunc(ParseSlackPayload), q, true)
+
+	for _, body := range []string{
+		"command=%2Fops",
+		"payload=" + `{"type":"block_actions","actions":[]}`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Empty(t, w.Body.String(), body)
+		assert.Equal(t, body, <-forwarded)
+	}
+
+	// menus need their options back
+	body := "payload=" + `{"type":"block_suggestion","value":"a"}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "answer", w.Body.String())
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagAuditLog = kingpin.
+	Flag("audit-log", "append a hash chained record of every accepted request to this file").
+	Envar("AUDIT_LOG").String()
+
+// AuditRecord is one accepted request. Hash covers the record and the hash
+// of the record before it, so changing or dropping any record breaks every
+// hash after it.
+type AuditRecord struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	EventID    string    `json:"event_id"`
+	TeamID     string    `json:"team_id"`
+	Type       string    `json:"type"`
+	Timestamp  string    `json:"timestamp"`
+	Signature  string    `json:"signature"`
+	BodySHA256 string    `json:"body_sha256"`
+	Status     int       `json:"status"`
+	Prev       string    `json:"prev"`
+	Hash       string    `json:"hash,omitempty"`
+}
+
+func (rec *AuditRecord) sum() (string, error) {
+	unhashed := *rec
+	unhashed.Hash = ""
+	raw, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog appends records to a file, chaining each to the last.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+	last string
+}
+
+// OpenAuditLog checks the chain already in the file before appending to it,
+// refusing to extend a log that has been tampered with.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := VerifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("verifying %s: %v", path, err)
+	}
+	return &AuditLog{file: f, seq: last.Seq, last: last.Hash}, nil
+}
+
+func (a *AuditLog) Append(rec AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.Seq = a.seq + 1
+	rec.Prev = a.last
+	rec.Hash = ""
+	hash, err := rec.sum()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.seq, a.last = rec.Seq, rec.Hash
+	return nil
+}
+
+// VerifyAuditLog walks the chain in r, returning the last record.
+func VerifyAuditLog(r io.Reader) (AuditRecord, error) {
+	var last AuditRecord
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return last, fmt.Errorf("record after %d: %v", last.Seq, err)
+		}
+		if rec.Seq != last.Seq+1 || rec.Prev != last.Hash {
+			return last, fmt.Errorf("record %d does not follow record %d", rec.Seq, last.Seq)
+		}
+		if sum, err := rec.sum(); err != nil || sum != rec.Hash {
+			return last, fmt.Errorf("record %d has been altered", rec.Seq)
+		}
+		last = rec
+	}
+	return last, scanner.Err()
+}
+
+// AuditHandler records every request child handles, with the status the
+// backend answered it with.
+func AuditHandler(child http.Handler, audit *AuditLog, parser PayloadParser) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		rec := AuditRecord{
+			Time:      time.Now().UTC(),
+			Timestamp: r.Header.Get(SlackHeaderTimestamp),
+			Signature: r.Header.Get(SlackHeaderSignature),
+		}
+		sum := sha256.Sum256(body)
+		rec.BodySHA256 = hex.EncodeToString(sum[:])
+		if p, err := parser.ParsePayload(r, body); err == nil {
+			rec.EventID, rec.TeamID, rec.Type = p.ID, p.TeamID, p.Type
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		child.ServeHTTP(sw, r)
+		rec.Status = sw.Status()
+		if err := audit.Append(rec); err != nil {
+			log.Printf("writing audit record for %s: %v", rec.EventID, err)
+		}
+	})
+}
+
+// statusWriter remembers the status written through it, and when
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written time.Time
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.written = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.written = time.Now()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// AuditExportHandler serves the audit log file as is, or with ?verify the
+// result of checking its chain.
+func AuditExportHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "audit log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer f.Close()
+
+		if _, ok := r.URL.Query()["verify"]; !ok {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			io.Copy(w, f)
+			return
+		}
+
+		last, err := VerifyAuditLog(f)
+		result := struct {
+			Records uint64 `json:"records"`
+			Last    string `json:"last_hash"`
+			Error   string `json:"error,omitempty"`
+		}{Records: last.Seq, Last: last.Hash}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err := OpenAuditLog(path)
+	require.NoError(t, err)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := AuditHandler(backend, audit, PayloadParserFunc(ParseSlackPayload))
+
+	send := func(eventID string) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(
+			`{"type":"event_callback","team_id":"T1","event_id":"`+eventID+`","event":{"type":"message"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(SlackHeaderTimestamp, "1531420618")
+		r.Header.Set(SlackHeaderSignature, "v0=abcd")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	send("Ev1")
+	send("Ev2")
+
+	// reopening continues the chain
+	audit, err = OpenAuditLog(path)
+	require.NoError(t, err)
+	h = AuditHandler(backend, audit, PayloadParserFunc(ParseSlackPayload))
+	send("Ev3")
+
+	w := httptest.NewRecorder()
+	AuditExportHandler(path).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	var rec AuditRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &rec))
+	assert.Equal(t, uint64(3), rec.Seq)
+	assert.Equal(t, "Ev3", rec.EventID)
+	assert.Equal(t, "T1", rec.TeamID)
+	assert.Equal(t, "message", rec.Type)
+	assert.Equal(t, "v0=abcd", rec.Signature)
+	assert.Equal(t, http.StatusAccepted, rec.Status)
+
+	w = httptest.NewRecorder()
+	AuditExportHandler(path).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit?verify", nil))
+	assert.Contains(t, w.Body.String(), `"records":3`)
+	assert.NotContains(t, w.Body.String(), `"error"`)
+
+	// altering an old record is caught
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path,
+		[]byte(strings.Replace(string(raw), `"status":202`, `"status":500`, 1)), 0600))
+	_, err = OpenAuditLog(path)
+	assert.EqualError(t, err, "verifying "+path+": record 1 has been altered")
+
+	// so is dropping one
+	require.NoError(t, ioutil.WriteFile(path, []byte(lines[0]+"\n"+lines[2]+"\n"), 0600))
+	w = httptest.NewRecorder()
+	AuditExportHandler(path).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/audit?verify", nil))
+	assert.Contains(t, w.Body.String(), `"error":"record 3 does not follow record 1"`)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Credentials lets fixed credentials be used as a provider.
+func (c awsCredentials) Credentials(ctx context.Context) (awsCredentials, error) { return c, nil }
+
+// awsCredentialsProvider hands out credentials, which may be refreshed as
+// they expire
+type awsCredentialsProvider interface {
+	Credentials(ctx context.Context) (awsCredentials, error)
+}
+
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	c := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return c, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+// newAWSCredentialsProvider uses the AWS_* environment variables when they
+// are set, then an ecs task role, then an ec2 instance role.
+func newAWSCredentialsProvider() awsCredentialsProvider {
+	if c, err := awsCredentialsFromEnv(); err == nil {
+		return c
+	}
+	return &awsRoleCredentials{
+		ECSURI:  os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"),
+		ECSHost: "http://169.254.170.2",
+		IMDS:    "http://169.254.169.254",
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// awsRoleCredentials fetches temporary credentials for the role the proxy
+// runs as, and caches them until shortly before they expire.
+type awsRoleCredentials struct {
+	ECSURI  string // set by ecs on tasks with a role
+	ECSHost string
+	IMDS    string
+	Client  *http.Client
+
+	mu      sync.Mutex
+	creds   awsCredentials
+	expires time.Time
+}
+
+type awsRoleResponse struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (p *awsRoleCredentials) Credentials(ctx context.Context) (awsCredentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().Add(5 * time.Minute).Before(p.expires) {
+		return p.creds, nil
+	}
+
+	var role awsRoleResponse
+	var err error
+	if p.ECSURI != "" {
+		err = p.get(ctx, p.ECSHost+p.ECSURI, nil, &role)
+	} else {
+		err = p.fromIMDS(ctx, &role)
+	}
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("aws role credentials: %v", err)
+	}
+	p.creds = awsCredentials{
+		AccessKeyID:     role.AccessKeyID,
+		SecretAccessKey: role.SecretAccessKey,
+		SessionToken:    role.Token,
+	}
+	p.expires = role.Expiration
+	return p.creds, nil
+}
+
+// fromIMDS asks the ec2 instance metadata service, with a v2 session token
+func (p *awsRoleCredentials) fromIMDS(ctx context.Context, role *awsRoleResponse) error {
+	req, err := http.NewRequest(http.MethodPut, p.IMDS+"/latest/api/token", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	token, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("imds token returned %d", resp.StatusCode)
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+
+	var name string
+	if err := p.get(ctx, p.IMDS+"/latest/meta-data/iam/security-credentials/", header, &name); err != nil {
+		return err
+	}
+	if name = strings.TrimSpace(strings.SplitN(name, "\n", 2)[0]); name == "" {
+		return errors.New("no role attached to this instance")
+	}
+	return p.get(ctx, p.IMDS+"/latest/meta-data/iam/security-credentials/"+name, header, role)
+}
+
+// get fetches target into out, as json unless out is a *string
+func (p *awsRoleCredentials) get(ctx context.Context, target string, header http.Header, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", req.URL.Path, resp.StatusCode)
+	}
+	if s, ok := out.(*string); ok {
+		*s = string(raw)
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signAWS adds a signature version 4 Authorization header to r, covering
+// every header already set on it along with host and the date.
+func signAWS(r *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	r.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": r.Host}
+	if r.Host == "" {
+		headers["host"] = r.URL.Host
+	}
+	for name, values := range r.Header {
+		if strings.EqualFold(name, "Authorization") {
+			continue
+		}
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		path,
+		strings.Replace(r.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+// awsCall makes a call to an aws json 1.1 api, like kinesis or secrets
+// manager, decoding the response into out.
+func awsCall(
+	ctx context.Context,
+	client *http.Client,
+	creds awsCredentialsProvider,
+	endpoint, region, service, target string,
+	in, out interface{},
+) error {
+	return awsJSONCall(ctx, client, creds, endpoint, region, service, "application/x-amz-json-1.1", target, in, out)
+}
+
+// awsJSONCall is awsCall for apis on another version of the json
+// protocol, like sqs on 1.0
+func awsJSONCall(
+	ctx context.Context,
+	client *http.Client,
+	creds awsCredentialsProvider,
+	endpoint, region, service, contentType, target string,
+	in, out interface{},
+) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	raw, err := awsPost(ctx, client, creds, endpoint, region, service, contentType, target, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// awsPost signs and posts body, returning the response body of a 200
+func awsPost(
+	ctx context.Context,
+	client *http.Client,
+	creds awsCredentialsProvider,
+	endpoint, region, service, contentType, target string,
+	body []byte,
+) ([]byte, error) {
+	c, err := creds.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if target != "" {
+		req.Header.Set("X-Amz-Target", target)
+	}
+	signAWS(req, body, c, region, service, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(raw, &e) == nil && e.Type != "" {
+			return nil, fmt.Errorf("%s returned %d: %s: %s", service, resp.StatusCode, e.Type, e.Message)
+		}
+		return nil, fmt.Errorf("%s returned %d: %s", service, resp.StatusCode, bytes.TrimSpace(raw))
+	}
+	return raw, nil
+}
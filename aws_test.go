@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAWS(t *testing.T) {
+	// get-vanilla from the signature version 4 test suite
+	r, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	creds := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	signAWS(r, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", r.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		r.Header.Get("Authorization"))
+}
+
+func TestAWSRoleCredentials(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	role := `{"AccessKeyId":"ASIA","SecretAccessKey":"secret","Token":"session","Expiration":"` + expires + `"}`
+	calls := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/v2/credentials/task":
+			w.Write([]byte(role))
+		case "/latest/api/token":
+			assert.Equal(t, http.MethodPut, r.Method)
+			w.Write([]byte("imds-token"))
+		case "/latest/meta-data/iam/security-credentials/":
+			assert.Equal(t, "imds-token", r.Header.Get("X-aws-ec2-metadata-token"))
+			w.Write([]byte("proxy-role"))
+		case "/latest/meta-data/iam/security-credentials/proxy-role":
+			assert.Equal(t, "imds-token", r.Header.Get("X-aws-ec2-metadata-token"))
+			w.Write([]byte(role))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer metadata.Close()
+
+	exp := awsCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session"}
+	ecs := &awsRoleCredentials{ECSURI: "/v2/credentials/task", ECSHost: metadata.URL, Client: metadata.Client()}
+	creds, err := ecs.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, exp, creds)
+
+	ec2 := &awsRoleCredentials{IMDS: metadata.URL, Client: metadata.Client()}
+	creds, err = ec2.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, exp, creds)
+	assert.Equal(t, 4, calls)
+
+	// cached until close to expiring
+	_, err = ec2.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, calls)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AWSSecretsManagerSource loads secrets from aws secrets manager. The
+// secret string holds one secret per line, or is a json object when Key is
+// set. With Previous, the AWSPREVIOUS version is accepted too, to ride out
+// a rotation.
+type AWSSecretsManagerSource struct {
+	SecretID string
+	Key      string
+	Previous bool
+	Region   string
+	Endpoint string
+	Creds    awsCredentialsProvider
+	Client   *http.Client
+}
+
+// openAWSSecretsManagerSource takes a secret name or arn, with optional key,
+// previous, region and endpoint query parameters, like
+// awssm://arn:aws:secretsmanager:us-east-1:123456789012:secret:slack?key=signing_secret
+func openAWSSecretsManagerSource(spec string) (SecretSource, error) {
+	id, query := spec, url.Values{}
+	if i := strings.Index(spec, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(spec[i+1:]); err != nil {
+			return nil, fmt.Errorf("awssm %q: %v", spec, err)
+		}
+		id = spec[:i]
+	}
+	if id == "" {
+		return nil, errors.New("awssm needs a secret name or arn")
+	}
+
+	region := query.Get("region")
+	if parts := strings.Split(id, ":"); region == "" && len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		region = awsRegion()
+	}
+	if region == "" {
+		return nil, fmt.Errorf("awssm %q: no region in the arn, a region parameter or AWS_REGION", id)
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com/"
+	}
+
+	return &AWSSecretsManagerSource{
+		SecretID: id,
+		Key:      query.Get("key"),
+		Previous: query.Get("previous") == "true",
+		Region:   region,
+		Endpoint: endpoint,
+		Creds:    newAWSCredentialsProvider(),
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *AWSSecretsManagerSource) Secrets(ctx context.Context) ([]string, error) {
+	secrets, err := s.get(ctx, "AWSCURRENT")
+	if err != nil || !s.Previous {
+		return secrets, err
+	}
+	previous, err := s.get(ctx, "AWSPREVIOUS")
+	if err != nil {
+		// a secret that was never rotated has no previous version
+		if strings.Contains(err.Error(), "ResourceNotFoundException") {
+			return secrets, nil
+		}
+		return nil, err
+	}
+	for _, secret := range previous {
+		if !containsString(secrets, secret) {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets, nil
+}
+
+func (s *AWSSecretsManagerSource) get(ctx context.Context, stage string) ([]string, error) {
+	in := map[string]string{"SecretId": s.SecretID, "VersionStage": stage}
+	var out struct {
+		SecretString string
+	}
+	if err := awsCall(ctx, s.Client, s.Creds, s.Endpoint, s.Region, "secretsmanager",
+		"secretsmanager.GetSecretValue", in, &out); err != nil {
+		return nil, err
+	}
+
+	value := out.SecretString
+	if s.Key != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return nil, fmt.Errorf("%s %s is not a json object: %v", s.SecretID, stage, err)
+		}
+		field, ok := fields[s.Key].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s %s has no string %q", s.SecretID, stage, s.Key)
+		}
+		value = field
+	}
+	secrets, err := parseSecrets(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", s.SecretID, stage, err)
+	}
+	return secrets, nil
+}
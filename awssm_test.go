@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSSecretsManagerSource(t *testing.T) {
+	versions := map[string]string{
+		"AWSCURRENT":  `{"signing_secret":"new","other":"x"}`,
+		"AWSPREVIOUS": `{"signing_secret":"old"}`,
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request")
+		var in struct{ SecretId, VersionStage string }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+		assert.Equal(t, "arn:aws:secretsmanager:eu-west-1:123456789012:secret:slack-AbCdEf", in.SecretId)
+
+		value, ok := versions[in.VersionStage]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret value for staging label: AWSPREVIOUS"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": value})
+	}))
+	defer api.Close()
+
+	src, err := OpenSecretSource("awssm://arn:aws:secretsmanager:eu-west-1:123456789012:secret:slack-AbCdEf" +
+		"?key=signing_secret&previous=true&endpoint=" + api.URL)
+	require.NoError(t, err)
+	sm := src.(*AWSSecretsManagerSource)
+	assert.Equal(t, "eu-west-1", sm.Region, "region comes from the arn")
+	sm.Creds = awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+
+	secrets, err := sm.Secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "old"}, secrets)
+
+	// never rotated
+	delete(versions, "AWSPREVIOUS")
+	secrets, err = sm.Secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new"}, secrets)
+
+	sm.Key = "missing"
+	_, err = sm.Secrets(context.Background())
+	assert.EqualError(t, err, `arn:aws:secretsmanager:eu-west-1:123456789012:secret:slack-AbCdEf AWSCURRENT has no string "missing"`)
+
+	// plain secret strings hold one secret per line
+	sm.Key = ""
+	versions["AWSCURRENT"] = "new\nnewer\n"
+	secrets, err = sm.Secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "newer"}, secrets)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagBackendRetries = kingpin.
+				Flag("backend-retries", "times a forward the backend fails with a 5xx, or never answers, is retried while slack waits").
+				Envar("BACKEND_RETRIES").Default("0").Int()
+	flagBackendRetryBackoff = kingpin.
+				Flag("backend-retry-backoff", "wait before the first --backend-retries retry, doubled after each, with jitter").
+				Envar("BACKEND_RETRY_BACKOFF").Default("100ms").Duration()
+)
+
+var metricBackendRetries = NewCounterVec("backend_retries_total",
+	"forwards retried by --backend-retries, by outcome: retried, recovered or failed", "outcome")
+
+// jitter picks a wait between half of d and d, so retries from many
+// requests failing together do not hit a backend at the same moment
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// BackendRetryHandler retries requests child answers with a 5xx, which
+// includes the 502 of a backend that can not be reached, up to retries
+// times, waiting backoff doubled each time with jitter. It never waits past
+// the time left for slack's answer or the request's deadline, the last
+// response is passed on instead so slack retries, or the failure is mapped,
+// as without retries. Responses are buffered to be able to drop them.
+func BackendRetryHandler(child http.Handler, retries int, backoff time.Duration) http.Handler {
+	if retries <= 0 {
+		return child
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rewind, err := bodyRewinder(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		wait := backoff
+		for attempt := 0; ; attempt++ {
+			if err := rewind(); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			resp := NewResponseBuffer()
+			child.ServeHTTP(resp, r)
+			if resp.StatusCode() < 500 {
+				if attempt > 0 {
+					metricBackendRetries.Inc("recovered")
+				}
+				resp.CopyTo(w)
+				return
+			}
+
+			sleep := jitter(wait)
+			if left, ok := remainingBudget(r, time.Now()); attempt >= retries || (ok && left <= sleep) {
+				if attempt > 0 {
+					metricBackendRetries.Inc("failed")
+					log.Printf("backend returned %d after %d attempts", resp.StatusCode(), attempt+1)
+				}
+				resp.CopyTo(w)
+				return
+			}
+			metricBackendRetries.Inc("retried")
+			select {
+			case <-time.After(sleep):
+			case <-r.Context().Done():
+				resp.CopyTo(w)
+				return
+			}
+			wait *= 2
+		}
+	})
+}
+
+// bodyRewinder reads r's body once, and gives a func that puts it back in
+// place before each attempt. Spooled bodies are seeked rather than read into
+// memory.
+func bodyRewinder(r *http.Request) (func() error, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() error { return nil }, nil
+	}
+	if spooled, ok := r.Body.(spooledBody); ok {
+		return func() error {
+			_, err := spooled.Seek(0, io.SeekStart)
+			return err
+		}, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	return func() error {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBackend fails the first fails requests with a 503, and records the
+// bodies it was sent
+func flakyBackend(fails int) (http.Handler, *[]string) {
+	var bodies []string
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) <= fails {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}), &bodies
+}
+
+func TestBackendRetryHandler(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fails, retries int
+		ctx            func() context.Context
+		code, attempts int
+	}{
+		"no failure":  {0, 3, context.Background, http.StatusOK, 1},
+		"recovers":    {2, 3, context.Background, http.StatusOK, 3},
+		"gives up":    {5, 2, context.Background, http.StatusServiceUnavailable, 3},
+		"retries off": {1, 0, context.Background, http.StatusServiceUnavailable, 1},
+		"window used up": {1, 3, func() context.Context {
+			return context.WithValue(context.Background(), arrivalKey{}, time.Now().Add(-slackResponseWindow))
+		}, http.StatusServiceUnavailable, 1},
+	} {
+		backend, bodies := flakyBackend(tc.fails)
+		h := BackendRetryHandler(backend, tc.retries, time.Millisecond)
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")).WithContext(tc.ctx())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.code, w.Code, name)
+		assert.Len(t, *bodies, tc.attempts, name)
+		for _, body := range *bodies {
+			assert.Equal(t, "payload", body, name)
+		}
+	}
+}
+
+func TestBackendRetryHandlerAcked(t *testing.T) {
+	parser := PayloadParserFunc(ParseSlackPayload)
+	event := `{"type":"event_callback","event":{"type":"message"}}`
+	for name, ack := range map[string]func(http.Handler) http.Handler{
+		"ack events": func(h http.Handler) http.Handler {
+			return AckEventsHandler(h, parser, 10*time.Second)
+		},
+		"async ack": func(h http.Handler) http.Handler {
+			return AsyncAckHandler(h, parser, newAsyncQueue(1, 1, 0, 10*time.Second), false)
+		},
+	} {
+		backend, bodies := flakyBackend(2)
+		done := make(chan struct{})
+		h := ack(BackendRetryHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backend.ServeHTTP(w, r)
+			if len(*bodies) == 3 {
+				close(done)
+			}
+		}), 3, time.Millisecond))
+
+		// slack's window is used up, but once acked the retries have the
+		// ack timeout to work with
+		ctx := context.WithValue(context.Background(), arrivalKey{}, time.Now().Add(-time.Minute))
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(event)).WithContext(ctx)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, name)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: retried %d times", name, len(*bodies)-1)
+		}
+	}
+}
+
+func TestBackendRetryHandlerSpooled(t *testing.T) {
+	f, err := ioutil.TempFile("", "spool")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.WriteString("payload")
+	require.NoError(t, err)
+
+	backend, bodies := flakyBackend(1)
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Body = spooledBody{f}
+	w := httptest.NewRecorder()
+	BackendRetryHandler(backend, 1, time.Millisecond).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"payload", "payload"}, *bodies)
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d >= time.Second/2 && d <= time.Second, d)
+	}
+	assert.Equal(t, time.Duration(0), jitter(0))
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+var metricBackendSelections = NewCounterVec("backend_selections_total",
+	"requests sent to each backend by the backend_select expression", "backend")
+
+// selectVars are the names an expression can look at, besides labels.name
+// for the label rules and the names of backends
+var selectVars = map[string]func(r *http.Request, p *Payload) string{
+	"path":        func(r *http.Request, p *Payload) string { return r.URL.Path },
+	"kind":        func(r *http.Request, p *Payload) string { return p.Kind },
+	"type":        func(r *http.Request, p *Payload) string { return p.Type },
+	"team_id":     func(r *http.Request, p *Payload) string { return p.TeamID },
+	"app_id":      func(r *http.Request, p *Payload) string { return p.AppID },
+	"channel_id":  func(r *http.Request, p *Payload) string { return p.ChannelID },
+	"user_id":     func(r *http.Request, p *Payload) string { return p.UserID },
+	"callback_id": func(r *http.Request, p *Payload) string { return p.CallbackID },
+}
+
+type exprType int
+
+const (
+	exprString exprType = iota
+	exprList
+	exprBool
+)
+
+func (t exprType) String() string {
+	return [...]string{"string", "list", "bool"}[t]
+}
+
+// exprNode is one piece of a parsed expression. Types are checked when
+// parsing, so eval returns a string, a []string or a bool as promised.
+type exprNode interface {
+	eval(r *http.Request, p *Payload) interface{}
+}
+
+type (
+	exprLiteral struct{ v interface{} }
+	exprVar     struct {
+		get func(r *http.Request, p *Payload) string
+	}
+	exprNot    struct{ x exprNode }
+	exprBinary struct {
+		op   string
+		l, r exprNode
+	}
+	exprTernary struct{ cond, yes, no exprNode }
+)
+
+func (e exprLiteral) eval(r *http.Request, p *Payload) interface{} { return e.v }
+func (e exprVar) eval(r *http.Request, p *Payload) interface{}     { return e.get(r, p) }
+func (e exprNot) eval(r *http.Request, p *Payload) interface{}     { return !e.x.eval(r, p).(bool) }
+
+func (e exprBinary) eval(r *http.Request, p *Payload) interface{} {
+	switch e.op {
+	case "&&":
+		return e.l.eval(r, p).(bool) && e.r.eval(r, p).(bool)
+	case "||":
+		return e.l.eval(r, p).(bool) || e.r.eval(r, p).(bool)
+	case "==":
+		return e.l.eval(r, p).(string) == e.r.eval(r, p).(string)
+	case "!=":
+		return e.l.eval(r, p).(string) != e.r.eval(r, p).(string)
+	case "in", "not in":
+		in := containsString(e.r.eval(r, p).([]string), e.l.eval(r, p).(string))
+		return in == (e.op == "in")
+	}
+	panic("unknown operator " + e.op)
+}
+
+func (e exprTernary) eval(r *http.Request, p *Payload) interface{} {
+	if e.cond.eval(r, p).(bool) {
+		return e.yes.eval(r, p)
+	}
+	return e.no.eval(r, p)
+}
+
+// BackendSelector picks a backend by name for each request
+type BackendSelector struct {
+	root exprNode
+}
+
+// ParseBackendSelector parses an expression like
+//
+//	team_id in ['T1','T2'] ? new : labels.tier == 'bulk' ? bulk : ''
+//
+// which must come out as the name of one of backends, or be empty for the
+// default backend. It has ==, !=, in, not in, &&, ||, ! and ?:, over quoted
+// strings, [lists], payload fields, labels.name and backend names.
+func ParseBackendSelector(raw string, backends map[string]string) (*BackendSelector, error) {
+	toks, err := lexExpr(raw)
+	if err != nil {
+		return nil, err
+	}
+	ep := &exprParser{toks: toks, backends: backends}
+	root, typ, err := ep.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if ep.pos < len(ep.toks) {
+		return nil, fmt.Errorf("unexpected %q", ep.toks[ep.pos])
+	}
+	if typ != exprString {
+		return nil, fmt.Errorf("expression is a %s, not a backend", typ)
+	}
+	return &BackendSelector{root: root}, nil
+}
+
+// Select is the name of the backend for r, or "" for the default
+func (s *BackendSelector) Select(r *http.Request, p *Payload) string {
+	return s.root.eval(r, p).(string)
+}
+
+func lexExpr(raw string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(raw[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, raw[i:i+end+2])
+			i += end + 2
+		case strings.HasPrefix(raw[i:], "&&"), strings.HasPrefix(raw[i:], "||"),
+			strings.HasPrefix(raw[i:], "=="), strings.HasPrefix(raw[i:], "!="):
+			toks = append(toks, raw[i:i+2])
+			i += 2
+		case strings.IndexByte("[](),?:!", c) >= 0:
+			toks = append(toks, raw[i:i+1])
+			i++
+		case isIdentRune(rune(c)):
+			start := i
+			for i < len(raw) && isIdentRune(rune(raw[i])) {
+				i++
+			}
+			toks = append(toks, raw[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return toks, nil
+}
+
+func isIdentRune(c rune) bool {
+	return c == '_' || c == '.' || c == '-' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+type exprParser struct {
+	toks     []string
+	pos      int
+	backends map[string]string
+}
+
+func (ep *exprParser) peek() string {
+	if ep.pos < len(ep.toks) {
+		return ep.toks[ep.pos]
+	}
+	return ""
+}
+
+func (ep *exprParser) expect(tok string) error {
+	if ep.peek() != tok {
+		if ep.pos >= len(ep.toks) {
+			return fmt.Errorf("expected %q at the end", tok)
+		}
+		return fmt.Errorf("expected %q, got %q", tok, ep.peek())
+	}
+	ep.pos++
+	return nil
+}
+
+func (ep *exprParser) ternary() (exprNode, exprType, error) {
+	cond, typ, err := ep.or()
+	if err != nil || ep.peek() != "?" {
+		return cond, typ, err
+	}
+	ep.pos++
+	if typ != exprBool {
+		return nil, 0, fmt.Errorf("condition before ? is a %s, not a bool", typ)
+	}
+	yes, yesTyp, err := ep.ternary()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := ep.expect(":"); err != nil {
+		return nil, 0, err
+	}
+	no, noTyp, err := ep.ternary()
+	if err != nil {
+		return nil, 0, err
+	}
+	if yesTyp != noTyp {
+		return nil, 0, fmt.Errorf("branches of ?: are a %s and a %s", yesTyp, noTyp)
+	}
+	return exprTernary{cond, yes, no}, yesTyp, nil
+}
+
+func (ep *exprParser) or() (exprNode, exprType, error) {
+	return ep.logical("||", ep.and)
+}
+
+func (ep *exprParser) and() (exprNode, exprType, error) {
+	return ep.logical("&&", ep.not)
+}
+
+func (ep *exprParser) logical(op string, next func() (exprNode, exprType, error)) (exprNode, exprType, error) {
+	l, typ, err := next()
+	for err == nil && ep.peek() == op {
+		ep.pos++
+		var r exprNode
+		var rTyp exprType
+		if r, rTyp, err = next(); err != nil {
+			break
+		}
+		if typ != exprBool || rTyp != exprBool {
+			return nil, 0, fmt.Errorf("%s needs bools, got a %s and a %s", op, typ, rTyp)
+		}
+		l = exprBinary{op, l, r}
+	}
+	return l, typ, err
+}
+
+func (ep *exprParser) not() (exprNode, exprType, error) {
+	if ep.peek() != "!" {
+		return ep.compare()
+	}
+	ep.pos++
+	x, typ, err := ep.not()
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != exprBool {
+		return nil, 0, fmt.Errorf("! needs a bool, got a %s", typ)
+	}
+	return exprNot{x}, exprBool, nil
+}
+
+func (ep *exprParser) compare() (exprNode, exprType, error) {
+	l, lTyp, err := ep.operand()
+	if err != nil {
+		return nil, 0, err
+	}
+	op := ep.peek()
+	if op == "not" {
+		ep.pos++
+		if err := ep.expect("in"); err != nil {
+			return nil, 0, err
+		}
+		op = "not in"
+	} else if op == "==" || op == "!=" || op == "in" {
+		ep.pos++
+	} else {
+		return l, lTyp, nil
+	}
+	r, rTyp, err := ep.operand()
+	if err != nil {
+		return nil, 0, err
+	}
+	want := exprString
+	if op == "in" || op == "not in" {
+		want = exprList
+	}
+	if lTyp != exprString || rTyp != want {
+		return nil, 0, fmt.Errorf("%s needs a string and a %s, got a %s and a %s", op, want, lTyp, rTyp)
+	}
+	return exprBinary{op, l, r}, exprBool, nil
+}
+
+func (ep *exprParser) operand() (exprNode, exprType, error) {
+	tok := ep.peek()
+	switch {
+	case tok == "":
+		return nil, 0, fmt.Errorf("expression ends early")
+	case tok == "(":
+		ep.pos++
+		x, typ, err := ep.ternary()
+		if err == nil {
+			err = ep.expect(")")
+		}
+		return x, typ, err
+	case tok == "[":
+		ep.pos++
+		var list []string
+		for ep.peek() != "]" {
+			if len(list) > 0 {
+				if err := ep.expect(","); err != nil {
+					return nil, 0, err
+				}
+			}
+			s, ok := unquote(ep.peek())
+			if !ok {
+				return nil, 0, fmt.Errorf("lists hold quoted strings, got %q", ep.peek())
+			}
+			list = append(list, s)
+			ep.pos++
+		}
+		ep.pos++
+		return exprLiteral{list}, exprList, nil
+	}
+	ep.pos++
+	if s, ok := unquote(tok); ok {
+		return exprLiteral{s}, exprString, nil
+	}
+	if get, ok := selectVars[tok]; ok {
+		return exprVar{get}, exprString, nil
+	}
+	if strings.HasPrefix(tok, "labels.") {
+		label := strings.TrimPrefix(tok, "labels.")
+		return exprVar{func(r *http.Request, p *Payload) string {
+			return RequestLabels(r)[label]
+		}}, exprString, nil
+	}
+	if _, ok := ep.backends[tok]; ok {
+		return exprLiteral{tok}, exprString, nil
+	}
+	return nil, 0, fmt.Errorf("unknown name %q", tok)
+}
+
+func unquote(tok string) (string, bool) {
+	if len(tok) >= 2 && (tok[0] == '\'' || tok[0] == '"') && tok[len(tok)-1] == tok[0] {
+		return tok[1 : len(tok)-1], true
+	}
+	return "", false
+}
+
+// BackendSelectHandler sends each request to the backend in backends the
+// selector names, or to fallback when it names none or the payload does
+// not parse.
+func BackendSelectHandler(fallback http.Handler, parser PayloadParser,
+	selector *BackendSelector, backends map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		name := selector.Select(r, p)
+		h, ok := backends[name]
+		if !ok {
+			metricBackendSelections.Inc("default")
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		metricBackendSelections.Inc(name)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// buildBackendSelect wraps the default backend h in the config's
+// backend_select, if it has one
+func buildBackendSelect(config *Config, h http.Handler) (http.Handler, error) {
+	if config.BackendSelect == "" {
+		return h, nil
+	}
+	selector, err := ParseBackendSelector(config.BackendSelect, config.Backends)
+	if err != nil {
+		return nil, err
+	}
+	backends := map[string]http.Handler{}
+	for name, raw := range config.Backends {
+		// validated on load
+		target, _ := url.Parse(raw)
+		backends[name] = newBackendProxy(target)
+	}
+	return BackendSelectHandler(h, PayloadParserFunc(ParseSlackPayload), selector, backends), nil
+}
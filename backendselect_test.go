@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackendSelector(t *testing.T) {
+	backends := map[string]string{"new": "http://new", "old": "http://old", "bulk": "http://bulk"}
+	for _, tc := range []struct {
+		expr string
+		p    Payload
+		exp  string
+	}{
+		{`team_id in ['T1','T2'] ? new : old`, Payload{TeamID: "T2"}, "new"},
+		{`team_id in ['T1','T2'] ? new : old`, Payload{TeamID: "T3"}, "old"},
+		{`team_id not in ["T1"] ? new : ''`, Payload{TeamID: "T1"}, ""},
+		{`kind == 'command' && !(type == '/ops') ? bulk : new`, Payload{Kind: PayloadCommand, Type: "/deploy"}, "bulk"},
+		{`type != 'message' || team_id == 'T1' ? new : old`, Payload{Type: "message", TeamID: "T9"}, "old"},
+		{`labels.tier == 'bulk' ? bulk : team_id == 'T1' ? new : old`, Payload{TeamID: "T1"}, "new"},
+		{`path == '/slack/events' ? new : old`, Payload{}, "new"},
+		{`old`, Payload{}, "old"},
+	} {
+		s, err := ParseBackendSelector(tc.expr, backends)
+		require.NoError(t, err, tc.expr)
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+		assert.Equal(t, tc.exp, s.Select(r, &tc.p), tc.expr)
+	}
+
+	for expr, expErr := range map[string]string{
+		`team_id in ['T1' ? new : old`:    `expected ",", got "?"`,
+		`team_id ? new : old`:             `condition before ? is a string, not a bool`,
+		`team_id == 'T1'`:                 `expression is a bool, not a backend`,
+		`team_id in 'T1' ? new : old`:     `in needs a string and a list, got a string and a string`,
+		`team_id == 'T1' ? new : ['old']`: `branches of ?: are a string and a list`,
+		`team_id == 'T1' ? newer : old`:   `unknown name "newer"`,
+		`team_id == 'T1' ? new`:           `expected ":" at the end`,
+		`team_id == 'T1 ? new : old`:      `unterminated string at 11`,
+		`team_id = 'T1' ? new : old`:      `unexpected '=' at 8`,
+		`new old`:                         `unexpected "old"`,
+		`!team_id ? new : old`:            `! needs a bool, got a string`,
+	} {
+		_, err := ParseBackendSelector(expr, backends)
+		assert.EqualError(t, err, expErr, expr)
+	}
+}
+
+func TestBackendSelectHandler(t *testing.T) {
+	backend := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	s, err := ParseBackendSelector(`team_id == 'T1' ? new : labels.tier == 'bulk' ? missing : ''`,
+		map[string]string{"new": "http://new", "missing": "http://missing"})
+	require.NoError(t, err)
+	h := BackendSelectHandler(backend("default"), PayloadParserFunc(ParseSlackPayload), s,
+		map[string]http.Handler{"new": backend("new")})
+	h = LabelHandler(h, PayloadParserFunc(ParseSlackPayload),
+		[]LabelRule{{Label: "tier", Value: "bulk", TeamID: "T2"}})
+
+	send := func(contentType, body string) string {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	before := metricBackendSelections.Get("new")
+	assert.Equal(t, "new", send("application/json", `{"type":"event_callback","team_id":"T1","event":{"type":"message"}}`))
+	assert.Equal(t, before+1, metricBackendSelections.Get("new"))
+	// named backends that were not built, '' and payloads that do not parse
+	// all go to the default
+	assert.Equal(t, "default", send("application/json", `{"type":"event_callback","team_id":"T2","event":{"type":"message"}}`))
+	assert.Equal(t, "default", send("application/json", `{"type":"event_callback","team_id":"T3","event":{"type":"message"}}`))
+	assert.Equal(t, "default", send("text/plain", "hello"))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagBackendCA = kingpin.
+			Flag("backend-ca", "pem bundle of CAs to trust for https backends, in place of the system ones").
+			Envar("BACKEND_CA").String()
+	flagBackendCert = kingpin.
+			Flag("backend-cert", "pem client certificate to show https backends, reread as it changes").
+			Envar("BACKEND_CERT").String()
+	flagBackendKey = kingpin.
+			Flag("backend-key", "pem private key for --backend-cert").
+			Envar("BACKEND_KEY").String()
+	flagBackendInsecure = kingpin.
+				Flag("backend-insecure-skip-verify", "do not verify the certificates of https backends").
+				Envar("BACKEND_INSECURE_SKIP_VERIFY").Bool()
+)
+
+// backendTransport carries requests to backends, set up in main from the
+// --backend-* flags. nil is the default transport.
+var backendTransport *http.Transport
+
+// backendTLSRefresh has the backend client keypair read again right away
+var backendTLSRefresh = make(chan struct{}, 1)
+
+// newBackendProxy forwards to target over backendTransport, keeping to its
+// schedule
+func newBackendProxy(target *url.URL) http.Handler {
+	p := httputil.NewSingleHostReverseProxy(target)
+	director := p.Director
+	p.Director = func(r *http.Request) {
+		director(r)
+		noteBackend(r.Context(), target)
+	}
+	if backendTransport != nil {
+		p.Transport = backendTransport
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !holdBack(w, r, target) {
+			p.ServeHTTP(w, r)
+		}
+	})
+}
+
+// backendClient makes requests to backends over backendTransport
+func backendClient() *http.Client {
+	if backendTransport == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: backendTransport}
+}
+
+// newBackendTransport builds the transport for the --backend-* flags, or
+// returns nil when none are set
+func newBackendTransport() (*http.Transport, error) {
+	if *flagBackendCA == "" && *flagBackendCert == "" && *flagBackendKey == "" && !*flagBackendInsecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: *flagBackendInsecure}
+	if *flagBackendCA != "" {
+		raw, err := ioutil.ReadFile(*flagBackendCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificates in %s", *flagBackendCA)
+		}
+	}
+	if *flagBackendCert != "" || *flagBackendKey != "" {
+		if *flagBackendCert == "" || *flagBackendKey == "" {
+			return nil, errors.New("--backend-cert and --backend-key have to be used together")
+		}
+		if *flagTLSInterval <= 0 {
+			return nil, errors.New("--tls-interval must be above 0 to watch --backend-cert")
+		}
+		certs, err := newCertReloader(*flagBackendCert, *flagBackendKey)
+		if err != nil {
+			return nil, err
+		}
+		go certs.watch(*flagTLSInterval, backendTLSRefresh)
+		cfg.GetClientCertificate = certs.GetClientCertificate
+	}
+	if *flagFIPS {
+		if *flagBackendInsecure {
+			return nil, errors.New("fips: --backend-insecure-skip-verify can not be used")
+		}
+		if err := checkFIPSTLS(cfg); err != nil {
+			return nil, err
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return transport, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backendtls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	writeKeyPair(t, file("server.crt"), file("server.key"), "server")
+	writeKeyPair(t, file("client.crt"), file("client.key"), "client")
+	clientPEM, err := ioutil.ReadFile(file("client.crt"))
+	require.NoError(t, err)
+
+	backend := httptest.NewUnstartedServer(StatusHandler(http.StatusOK, "ok"))
+	serverPair, err := tls.LoadX509KeyPair(file("server.crt"), file("server.key"))
+	require.NoError(t, err)
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{serverPair}, ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: x509.NewCertPool()}
+	backend.TLS.ClientCAs.AppendCertsFromPEM(clientPEM)
+	backend.StartTLS()
+	defer backend.Close()
+	target, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	defer func(old *http.Transport) { backendTransport = old }(backendTransport)
+	defer func(old time.Duration) { *flagTLSInterval = old }(*flagTLSInterval)
+	proxied := func() int {
+		w := httptest.NewRecorder()
+		newBackendProxy(target).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		name          string
+		ca, cert, key string
+		insecure      bool
+		unwatched     bool
+		err           string
+		code          int
+	}{
+		{name: "system CAs", code: http.StatusBadGateway},
+		{name: "private CA without a client cert", ca: file("server.crt"), code: http.StatusBadGateway},
+		{name: "private CA", ca: file("server.crt"), cert: file("client.crt"), key: file("client.key"), code: http.StatusOK},
+		{name: "skip verify", insecure: true, cert: file("client.crt"), key: file("client.key"), code: http.StatusOK},
+		{name: "cert without key", cert: file("client.crt"), err: "--backend-cert and --backend-key have to be used together"},
+		{name: "not a bundle", ca: file("client.key"), err: "no certificates in " + file("client.key")},
+		{name: "unwatched cert", cert: file("client.crt"), key: file("client.key"), unwatched: true,
+			err: "--tls-interval must be above 0 to watch --backend-cert"},
+	} {
+		*flagBackendCA, *flagBackendCert, *flagBackendKey, *flagBackendInsecure = tc.ca, tc.cert, tc.key, tc.insecure
+		*flagTLSInterval = time.Hour
+		if tc.unwatched {
+			*flagTLSInterval = 0
+		}
+		backendTransport, err = newBackendTransport()
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.code, proxied(), tc.name)
+	}
+	*flagBackendCA, *flagBackendCert, *flagBackendKey, *flagBackendInsecure = "", "", "", false
+	transport, err := newBackendTransport()
+	require.NoError(t, err)
+	assert.Nil(t, transport, "the default transport is used without flags")
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagBackfillStateFile = kingpin.
+				Flag("backfill-state-file", "file recording when the proxy was last up, enables backfill after downtime").
+				Envar("BACKFILL_STATE_FILE").String()
+	flagBackfillChannels = kingpin.
+				Flag("backfill-channel", "channel to backfill missed messages for").
+				Envar("BACKFILL_CHANNEL").Strings()
+	flagBackfillToken = kingpin.
+				Flag("backfill-token", "slack bot token used to read channel history").
+				Envar("BACKFILL_TOKEN").String()
+	flagBackfillMinGap = kingpin.
+				Flag("backfill-min-gap", "downtime shorter than this is not backfilled").
+				Envar("BACKFILL_MIN_GAP").Default("1m").Duration()
+	flagBackfillURI = kingpin.
+			Flag("backfill-uri", "uri backfilled events are delivered to").
+			Envar("BACKFILL_URI").Default("/").String()
+)
+
+// HeaderProxyBackfill marks events made up from channel history
+const HeaderProxyBackfill = "X-Proxy-Backfill"
+
+var slackAPIURL = "https://slack.com/api/"
+
+// heartbeat is a file holding the last time the proxy was known to be up
+type heartbeat string
+
+func (hb heartbeat) last() (time.Time, error) {
+	raw, err := ioutil.ReadFile(string(hb))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(raw)))
+}
+
+func (hb heartbeat) beat(now time.Time) error {
+	return writeFileAtomic(string(hb), []byte(now.UTC().Format(time.RFC3339Nano)+"\n"))
+}
+
+func (hb heartbeat) run(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			if err := hb.beat(now); err != nil {
+				log.Printf("writing heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+// runBackfill checks for a gap since the proxy was last up, then keeps the
+// heartbeat current until ctx is done
+func runBackfill(ctx context.Context, forward http.Handler) {
+	hb := heartbeat(*flagBackfillStateFile)
+	last, err := hb.last()
+	now := time.Now()
+	if err := hb.beat(now); err != nil {
+		log.Printf("writing heartbeat: %v", err)
+	}
+
+	every := *flagBackfillMinGap / 2
+	if every > 30*time.Second || every <= 0 {
+		every = 30 * time.Second
+	}
+	go hb.run(ctx, every)
+
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("reading heartbeat: %v", err)
+		return
+	}
+	if now.Sub(last) < *flagBackfillMinGap {
+		return
+	}
+
+	log.Printf("backfilling %s of downtime since %s", now.Sub(last), last)
+	b := &Backfiller{
+		Token:    *flagBackfillToken,
+		Secret:   slackSecrets.Get()[0],
+		URI:      *flagBackfillURI,
+		Channels: *flagBackfillChannels,
+		Forward:  forward,
+	}
+	n, err := b.Run(ctx, last, now)
+	if err != nil {
+		log.Printf("backfill: %v", err)
+	}
+	log.Printf("backfilled %d events", n)
+}
+
+// Backfiller fetches messages posted while the proxy was down and delivers
+// them as if slack had sent the events.
+type Backfiller struct {
+	Token    string
+	Secret   string
+	URI      string
+	Channels []string
+	Forward  http.Handler
+	Client   *http.Client
+}
+
+func (b *Backfiller) Run(ctx context.Context, oldest, latest time.Time) (int, error) {
+	delivered := 0
+	for _, channel := range b.Channels {
+		messages, err := b.history(ctx, channel, oldest, latest)
+		if err != nil {
+			return delivered, fmt.Errorf("fetching history for %s: %v", channel, err)
+		}
+
+		// history comes newest first
+		for i := len(messages) - 1; i >= 0; i-- {
+			if err := b.deliver(ctx, channel, messages[i]); err != nil {
+				log.Printf("backfill of %s: %v", channel, err)
+				continue
+			}
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+type slackHistory struct {
+	OK               bool                     `json:"ok"`
+	Error            string                   `json:"error"`
+	Messages         []map[string]interface{} `json:"messages"`
+	HasMore          bool                     `json:"has_more"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+func (b *Backfiller) history(
+	ctx context.Context,
+	channel string,
+	oldest, latest time.Time,
+) ([]map[string]interface{}, error) {
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var messages []map[string]interface{}
+	cursor := ""
+	for {
+		q := url.Values{
+			"channel": {channel},
+			"oldest":  {slackTimestamp(oldest)},
+			"latest":  {slackTimestamp(latest)},
+			"limit":   {"200"},
+		}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		req, err := http.NewRequest(http.MethodGet,
+			slackAPIURL+"conversations.history?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			wait, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			select {
+			case <-time.After(time.Duration(wait+1) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		var page slackHistory
+		dec := json.NewDecoder(resp.Body)
+		dec.UseNumber()
+		err = dec.Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !page.OK {
+			return nil, fmt.Errorf("slack api error: %s", page.Error)
+		}
+
+		messages = append(messages, page.Messages...)
+		cursor = page.ResponseMetadata.NextCursor
+		if !page.HasMore || cursor == "" {
+			return messages, nil
+		}
+	}
+}
+
+func (b *Backfiller) deliver(ctx context.Context, channel string, msg map[string]interface{}) error {
+	msg["channel"] = channel
+	ts, _ := msg["ts"].(string)
+	team, _ := msg["team"].(string)
+	eventTime, _ := strconv.ParseFloat(ts, 64)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type":       "event_callback",
+		"team_id":    team,
+		"event_id":   "Bf" + channel + strings.Replace(ts, ".", "", 1),
+		"event_time": int64(eventTime),
+		"event":      msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, b.URI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.RequestURI = b.URI
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(HeaderProxyBackfill, "true")
+	SignSlackRequest(r, b.Secret, time.Now(), body)
+
+	req, err := NewDelivery(r, body).Request(ctx)
+	if err != nil {
+		return err
+	}
+	resp := NewResponseBuffer()
+	b.Forward.ServeHTTP(resp, req)
+	if resp.StatusCode() >= 300 {
+		return fmt.Errorf("backend returned %d for %s", resp.StatusCode(), ts)
+	}
+	return nil
+}
+
+func slackTimestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 6, 64)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackfiller(t *testing.T) {
+	pages := map[string]string{
+		"": `{"ok":true,"has_more":true,"response_metadata":{"next_cursor":"page2"},"messages":[
+			{"type":"message","user":"U2","text":"newest","ts":"1600000300.000200","team":"T1"},
+			{"type":"message","user":"U1","text":"middle","ts":"1600000200.000100","team":"T1"}]}`,
+		"page2": `{"ok":true,"has_more":false,"messages":[
+			{"type":"message","user":"U1","text":"oldest","ts":"1600000100.000100","team":"T1"}]}`,
+	}
+	limited := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/conversations.history", r.URL.Path)
+		assert.Equal(t, "Bearer xoxb-test", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("channel") != "C1" {
+			w.Write([]byte(`{"ok":false,"error":"not_in_channel"}`))
+			return
+		}
+		if !limited && r.URL.Query().Get("cursor") == "page2" {
+			limited = true
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(pages[r.URL.Query().Get("cursor")]))
+	}))
+	defer api.Close()
+	defer func(old string) { slackAPIURL = old }(slackAPIURL)
+	slackAPIURL = api.URL + "/"
+
+	var got []map[string]interface{}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/slack/events", r.URL.Path)
+		assert.Equal(t, "true", r.Header.Get(HeaderProxyBackfill))
+		assert.Equal(t, "1", r.Header.Get(HeaderProxyAttempt))
+		var env map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&env))
+		got = append(got, env)
+	})
+	// backfilled events must pass the same verification real ones do
+	verified := (&SlackVerifier{Secrets: []string{"shh"}, Expire: time.Minute}).Handler(backend)
+
+	b := &Backfiller{
+		Token:    "xoxb-test",
+		Secret:   "shh",
+		URI:      "/slack/events",
+		Channels: []string{"C1"},
+		Forward:  verified,
+	}
+	n, err := b.Run(context.Background(), time.Unix(1600000000, 0), time.Unix(1600000400, 0))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	require.Len(t, got, 3)
+	for i, text := range []string{"oldest", "middle", "newest"} {
+		event := got[i]["event"].(map[string]interface{})
+		assert.Equal(t, text, event["text"])
+		assert.Equal(t, "C1", event["channel"])
+		assert.Equal(t, "T1", got[i]["team_id"])
+		assert.Equal(t, "event_callback", got[i]["type"])
+	}
+	assert.Equal(t, "BfC11600000100000100", got[0]["event_id"])
+
+	b.Channels = []string{"C2"}
+	_, err = b.Run(context.Background(), time.Unix(1600000000, 0), time.Unix(1600000400, 0))
+	assert.EqualError(t, err, "fetching history for C2: slack api error: not_in_channel")
+}
+
+func TestHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heartbeat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hb := heartbeat(filepath.Join(dir, "heartbeat"))
+
+	_, err = hb.last()
+	assert.True(t, os.IsNotExist(err))
+
+	now := time.Now()
+	require.NoError(t, hb.beat(now))
+	last, err := hb.last()
+	require.NoError(t, err)
+	assert.True(t, now.Equal(last))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+var metricBalancedRequests = NewCounterVec("backend_balanced_requests_total",
+	"requests spread across the default backends, by target", "target")
+
+// RoundRobinHandler sends each request to the next of its targets in turn
+type RoundRobinHandler struct {
+	targets []string
+	proxies []http.Handler
+	next    uint64
+}
+
+// newBalancedProxy forwards to targets round robin, or straight to the one
+// target if there is only one
+func newBalancedProxy(targets []*url.URL) http.Handler {
+	if len(targets) == 1 {
+		return newBackendProxy(targets[0])
+	}
+	h := &RoundRobinHandler{}
+	for _, target := range targets {
+		h.targets = append(h.targets, redactURLPassword(target.String()))
+		h.proxies = append(h.proxies, newBackendProxy(target))
+	}
+	return h
+}
+
+func (h *RoundRobinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := (atomic.AddUint64(&h.next, 1) - 1) % uint64(len(h.proxies))
+	metricBalancedRequests.Inc(h.targets[i])
+	h.proxies[i].ServeHTTP(w, r)
+}
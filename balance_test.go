@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalancedProxy(t *testing.T) {
+	var targets []*url.URL
+	for _, name := range []string{"a", "b", "c"} {
+		backend := httptest.NewServer(StatusHandler(http.StatusOK, name))
+		defer backend.Close()
+		target, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		targets = append(targets, target)
+	}
+
+	served := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/slack/events", nil))
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	h := newBalancedProxy(targets)
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, served(h))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+	assert.Equal(t, float64(2), metricBalancedRequests.Get(targets[1].String()))
+
+	h = newBalancedProxy(targets[2:])
+	assert.IsType(t, newBackendProxy(targets[2]), h, "one target goes straight to it")
+	assert.Equal(t, "c", served(h))
+}
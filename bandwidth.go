@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+var (
+	metricRequestBytes = NewCounterVec("forwarded_request_bytes_total",
+		"request body bytes forwarded, by route, slack team and backend", "route", "team", "backend")
+	metricResponseBytes = NewCounterVec("forwarded_response_bytes_total",
+		"response body bytes passed back to slack, by route, slack team and backend", "route", "team", "backend")
+	metricRequestBodySize = NewHistogramVec("forwarded_request_body_bytes",
+		"size of request bodies forwarded, by payload kind", sizeBuckets, "kind")
+)
+
+// sizeBuckets are in bytes, up to the default --max-body
+var sizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// bandwidth is filled in further down the chain with where a request went
+type bandwidth struct {
+	mu      sync.Mutex
+	route   string
+	backend string
+}
+
+type bandwidthKey struct{}
+
+// noteRoute records the route r was sent down, for BandwidthHandler
+func noteRoute(r *http.Request, name string) {
+	if b, ok := r.Context().Value(bandwidthKey{}).(*bandwidth); ok {
+		b.mu.Lock()
+		b.route = name
+		b.mu.Unlock()
+	}
+}
+
+// noteBackend records the backend r was sent to, for BandwidthHandler
+func noteBackend(ctx context.Context, target *url.URL) {
+	if b, ok := ctx.Value(bandwidthKey{}).(*bandwidth); ok {
+		b.mu.Lock()
+		b.backend = target.Host
+		b.mu.Unlock()
+	}
+}
+
+// BandwidthHandler counts the bytes of each request body and response by
+// the route and backend they went to and the team they came from.
+func BandwidthHandler(child http.Handler, parser PayloadParser) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var kind, team string
+		if p, err := parser.ParsePayload(r, body); err == nil {
+			kind, team = p.Kind, p.TeamID
+		}
+
+		size := float64(len(body))
+		b := &bandwidth{route: "default"}
+		cw := &countingWriter{ResponseWriter: w}
+		child.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), bandwidthKey{}, b)))
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		metricRequestBytes.Add(size, b.route, team, b.backend)
+		metricResponseBytes.Add(float64(cw.n), b.route, team, b.backend)
+		metricRequestBodySize.Observe(size, kind)
+	})
+}
+
+// countingWriter counts the bytes of the body written through it
+type countingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += n
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *countingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
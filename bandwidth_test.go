@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthHandler(t *testing.T) {
+	backend := httptest.NewServer(StatusHandler(http.StatusOK, "answered"))
+	defer backend.Close()
+	target, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	ops := Route{
+		Name:    "ops",
+		Match:   func(r *http.Request, p *Payload) bool { return p.Kind == PayloadCommand },
+		Handler: newBackendProxy(target),
+	}
+	quiet := StatusHandler(http.StatusOK, "")
+	h := BandwidthHandler(RouteHandler(quiet, PayloadParserFunc(ParseSlackPayload), ops),
+		PayloadParserFunc(ParseSlackPayload))
+
+	event := `{"type":"event_callback","team_id":"T9","event":{"type":"message"}}`
+	command := "command=%2Fops&team_id=T9&text=deploy"
+	beforeEvents := metricRequestBytes.Get("default", "T9", "")
+	beforeOps := metricRequestBytes.Get("ops", "T9", target.Host)
+	beforeAnswers := metricResponseBytes.Get("ops", "T9", target.Host)
+	beforeSizes := metricRequestBodySize.Count(PayloadCommand)
+
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(event))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest(http.MethodPost, "/slack/commands", strings.NewReader(command))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, beforeEvents+float64(len(event)), metricRequestBytes.Get("default", "T9", ""))
+	assert.Equal(t, beforeOps+float64(len(command)), metricRequestBytes.Get("ops", "T9", target.Host))
+	assert.Equal(t, beforeAnswers+float64(w.Body.Len()), metricResponseBytes.Get("ops", "T9", target.Host))
+	assert.Equal(t, beforeSizes+1, metricRequestBodySize.Count(PayloadCommand))
+}
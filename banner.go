@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/alecthomas/kingpin"
+)
+
+// flags whose values must never be logged or fingerprinted
+var secretFlags = map[string]bool{
+	"slack-token":        true,
+	"backfill-token":     true,
+	"otlp-header":        true,
+	"vault-token":        true,
+	"cloudflare-token":   true,
+	"verify-debug-token": true,
+}
+
+// StartupBanner is logged as one json line on startup, so a fleet can be
+// checked for what each instance is running with.
+type StartupBanner struct {
+	Version           string   `json:"version"`
+	Listeners         []string `json:"listeners"`
+	Backends          []string `json:"backends"`
+	Features          []string `json:"features"`
+	ConfigFingerprint string   `json:"config_fingerprint"`
+}
+
+// effectiveFlags lists every flag as name=value, sorted by name, leaving out
+// secrets and passwords in urls
+func effectiveFlags(app *kingpin.Application) []string {
+	var out []string
+	for _, flag := range app.Model().Flags {
+		if secretFlags[flag.Name] || flag.Value == nil {
+			continue
+		}
+		out = append(out, flag.Name+"="+redactURLPassword(flag.Value.String()))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func redactURLPassword(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	return u.String()
+}
+
+// fingerprintConfig hashes the flags and parsed config file, so two
+// instances with the same effective config match however the config file is
+// laid out.
+func fingerprintConfig(flags []string, config *Config) (string, error) {
+	raw, err := json.Marshal(struct {
+		Flags  []string `json:"flags"`
+		Config *Config  `json:"config"`
+	}{flags, config})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func newStartupBanner(app *kingpin.Application, config *Config) (StartupBanner, error) {
+	fp, err := fingerprintConfig(effectiveFlags(app), config)
+	if err != nil {
+		return StartupBanner{}, err
+	}
+
+	b := StartupBanner{
+		Version:           version,
+		Listeners:         []string{},
+		Backends:          []string{},
+		Features:          []string{},
+		ConfigFingerprint: fp,
+	}
+	for _, target := range config.backendTargets() {
+		b.Backends = append(b.Backends, redactURLPassword(target.String()))
+	}
+	for _, addr := range listenAddrs() {
+		b.Listeners = append(b.Listeners, addr.String())
+	}
+	if *flagHTTP3 {
+		for _, addr := range listenAddrs() {
+			b.Listeners = append(b.Listeners, "http3 "+addr.String())
+		}
+	}
+	if *flagListenUnix != "" {
+		b.Listeners = append(b.Listeners, "unix "+*flagListenUnix)
+	}
+	if *flagAdminListen != "" {
+		b.Listeners = append(b.Listeners, "admin "+*flagAdminListen)
+	}
+	if *flagRespondListen != "" {
+		b.Listeners = append(b.Listeners, "respond "+*flagRespondListen)
+	}
+	names := make([]string, 0, len(config.Backends))
+	for name := range config.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.Backends = append(b.Backends, redactURLPassword(config.Backends[name]))
+	}
+	for _, rc := range config.Routes {
+		if rc.Backend != "" {
+			b.Backends = append(b.Backends, redactURLPassword(rc.Backend))
+		}
+	}
+	teams := make([]string, 0, len(config.Teams))
+	for team := range config.Teams {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+	for _, team := range teams {
+		if backend := config.Teams[team].Backend; backend != "" {
+			b.Backends = append(b.Backends, redactURLPassword(backend))
+		}
+	}
+	for _, name := range sortedApps(config.Apps) {
+		if backend := config.Apps[name].Backend; backend != "" {
+			b.Backends = append(b.Backends, redactURLPassword(backend))
+		}
+	}
+	for _, raw := range *flagCommandRoutes {
+		if rule, err := ParseCommandRule(raw); err == nil {
+			b.Backends = append(b.Backends, redactURLPassword(rule.Target.String()))
+		}
+	}
+	for _, raw := range *flagViewRoutes {
+		if rule, err := ParseViewRule(raw); err == nil {
+			b.Backends = append(b.Backends, redactURLPassword(rule.Target.String()))
+		}
+	}
+	for _, raw := range *flagEventRoutes {
+		if rule, err := ParseEventRule(raw); err == nil && !rule.Drop {
+			b.Backends = append(b.Backends, redactURLPassword(rule.Target.String()))
+		}
+	}
+	for _, raw := range *flagURIRoutes {
+		if rule, err := ParseURIRule(raw); err == nil {
+			b.Backends = append(b.Backends, redactURLPassword(rule.Target.String()))
+		}
+	}
+
+	for _, feature := range []struct {
+		name string
+		on   bool
+	}{
+		{"ack-events", *flagAckEvents},
+		{"adaptive-concurrency", *flagAdaptiveConcurrency},
+		{"amqp", containsString(*flagSinks, "amqp")},
+		{"anomaly", *flagAnomalyFactor > 0},
+		{"acme", len(*flagACMEDomains) > 0},
+		{"answer-challenges", *flagAnswerChallenges},
+		{"apps", len(config.Apps) > 0},
+		{"archive-responses", *flagShadowArchive != "" && *flagArchiveResponses},
+		{"async-ack", *flagAsyncAck},
+		{"audit-log", *flagAuditLog != ""},
+		{"backend-retries", *flagBackendRetries > 0},
+		{"backend-select", config.BackendSelect != ""},
+		{"backend-tls", *flagBackendCA != "" || *flagBackendCert != "" || *flagBackendInsecure},
+		{"backfill", *flagBackfillStateFile != ""},
+		{"body-sha256", *flagBodySHA256},
+		{"body-spool", *flagBodySpoolThreshold > 0},
+		{"cluster-store", *flagClusterStore != ""},
+		{"deadline-header", *flagDeadlineHeader},
+		{"exec", containsString(*flagSinks, "exec")},
+		{"fips", *flagFIPS},
+		{"forward-deadline", *flagForwardDeadline > 0 || len(*flagTypeDeadlines) > 0},
+		{"harden", *flagHarden},
+		{"http3", *flagHTTP3},
+		{"jwt", hasJWTRoutes(config)},
+		{"kafka", containsString(*flagSinks, "kafka") || *flagOutput == "kafka"},
+		{"kinesis", containsString(*flagSinks, "kinesis")},
+		{"labels", len(config.Labels) > 0},
+		{"leader-election", *flagLeaderElection != ""},
+		{"mqtt", containsString(*flagSinks, "mqtt")},
+		{"outbox", *flagOutbox != nil},
+		{"outbox-counters", *flagOutbox != nil && *flagOutboxCounters},
+		{"output", *flagOutput != "" && *flagOutput != "http"},
+		{"park", *flagParkDir != ""},
+		{"pipeline", len(config.Pipeline) > 0},
+		{"proxy-protocol", *flagProxyProtocol},
+		{"rate-limits", len(config.RateLimits) > 0},
+		{"receipts", *flagReceiptURL != nil},
+		{"replay-cache", *flagSlackReplayCache > 0},
+		{"retry-classify", *flagRetryHistory > 0},
+		{"schedules", len(config.Schedules) > 0},
+		{"sequence", *flagSequence},
+		{"sequence-store", *flagSequence && *flagSequenceStore != ""},
+		{"shadow", *flagShadowArchive != ""},
+		{"silences", len(config.Silences) > 0},
+		{"sns", containsString(*flagSinks, "sns") || *flagOutput == "sns"},
+		{"spool", containsString(*flagSinks, "spool")},
+		{"sqs", containsString(*flagSinks, "sqs") || *flagOutput == "sqs"},
+		{"teams", len(config.Teams) > 0},
+		{"tls", *flagTLSCert != "" || len(*flagACMEDomains) > 0},
+		{"tls-client-ca", *flagTLSClientCA != ""},
+		{"tracing", *flagOTLPEndpoint != nil},
+		{"usage-export", *flagUsageExport != ""},
+		{"verify-debug", *flagVerifyDebugToken != ""},
+		{"warehouse", *flagWarehouse != nil},
+		{"workers", *flagWorkers > 0},
+	} {
+		if feature.on {
+			b.Features = append(b.Features, feature.name)
+		}
+	}
+	return b, nil
+}
+
+func hasJWTRoutes(config *Config) bool {
+	for _, rc := range config.Routes {
+		if rc.JWT != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigFingerprintHandler serves the config fingerprint, to spot drift
+// across a fleet.
+func ConfigFingerprintHandler(fingerprint func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"version":            version,
+			"config_fingerprint": fingerprint(),
+		})
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEffectiveFlags(t *testing.T) {
+	app := kingpin.New("test", "")
+	app.Flag("slack-token", "").Strings()
+	app.Flag("warehouse", "").URL()
+	app.Flag("max-headers", "").Default("64").Int()
+	_, err := app.Parse([]string{"--slack-token=hunter2",
+		"--warehouse=clickhouse://loader:hunter2@db:8123/events.slack"})
+	require.NoError(t, err)
+
+	flags := effectiveFlags(app)
+	assert.Contains(t, flags, "max-headers=64")
+	assert.Contains(t, flags, "warehouse=clickhouse://loader:redacted@db:8123/events.slack")
+	for _, each := range flags {
+		assert.NotContains(t, each, "hunter2")
+	}
+}
+
+func TestFingerprintConfig(t *testing.T) {
+	var a, b, c Config
+	require.NoError(t, json.Unmarshal([]byte(`{"routes":[{"name":"x","type":"message"}]}`), &a))
+	require.NoError(t, json.Unmarshal([]byte(`{ "routes": [ {"type":"message", "name":"x"} ] }`), &b))
+	require.NoError(t, json.Unmarshal([]byte(`{"routes":[{"name":"x","type":"reaction_added"}]}`), &c))
+	flags := []string{"max-headers=64"}
+
+	fpA, err := fingerprintConfig(flags, &a)
+	require.NoError(t, err)
+	fpB, err := fingerprintConfig(flags, &b)
+	require.NoError(t, err)
+	fpC, err := fingerprintConfig(flags, &c)
+	require.NoError(t, err)
+	fpFlags, err := fingerprintConfig([]string{"max-headers=32"}, &a)
+	require.NoError(t, err)
+
+	assert.Len(t, fpA, 64)
+	assert.Equal(t, fpA, fpB, "layout of the config file does not matter")
+	assert.NotEqual(t, fpA, fpC)
+	assert.NotEqual(t, fpA, fpFlags)
+}
+
+func TestStartupBanner(t *testing.T) {
+	*flagProxyTarget = []*url.URL{{Scheme: "http", Host: "127.0.0.1:80"}}
+	config := &Config{Routes: []RouteConfig{
+		{Name: "ops", Backend: "http://ops:8080"},
+		{Name: "openid", Path: "/openid", JWT: &JWTConfig{JWKSURL: "https://slack.com/openid/connect/keys", Issuer: "https://slack.com", Audience: "A123"}},
+	}}
+
+	b, err := newStartupBanner(kingpin.New("test", ""), config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://127.0.0.1:80", "http://ops:8080"}, b.Backends)
+	assert.Contains(t, b.Features, "jwt")
+	assert.NotEmpty(t, b.ConfigFingerprint)
+
+	w := httptest.NewRecorder()
+	ConfigFingerprintHandler(func() string { return b.ConfigFingerprint }).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+	assert.JSONEq(t, `{"version":"dev","config_fingerprint":"`+b.ConfigFingerprint+`"}`,
+		w.Body.String())
+}
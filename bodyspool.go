@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagBodySpoolThreshold = kingpin.
+				Flag("body-spool-threshold", "request bodies larger than this are kept in a temp file instead of memory, 0 to disable").
+				Envar("BODY_SPOOL_THRESHOLD").Default("0").Bytes()
+	flagBodySpoolDir = kingpin.
+				Flag("body-spool-dir", "directory for --body-spool-threshold temp files, the system temp dir if empty").
+				Envar("BODY_SPOOL_DIR").String()
+)
+
+var metricSpooledBodies = NewCounterVec("spooled_bodies_total",
+	"request bodies over --body-spool-threshold, by outcome: spooled or error", "outcome")
+
+// spooledBody is a request body kept in a temp file. Close leaves it be,
+// SpoolBodyHandler removes it once the request is done.
+type spooledBody struct{ *os.File }
+
+func (b spooledBody) Close() error { return nil }
+
+// SpoolBodyHandler copies bodies over threshold bytes to a temp file in
+// dir, so they are not held in memory while verified and forwarded. Smaller
+// bodies are left alone. Bodies of an unknown length are read up to the
+// threshold, and spooled once they turn out to be over it.
+func SpoolBodyHandler(child http.Handler, threshold int64, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength >= 0 && r.ContentLength <= threshold {
+			child.ServeHTTP(w, r)
+			return
+		}
+		in := io.Reader(r.Body)
+		if r.ContentLength < 0 {
+			head, err := ioutil.ReadAll(io.LimitReader(r.Body, threshold+1))
+			if err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if int64(len(head)) <= threshold {
+				r.Body.Close()
+				r.Body = ioutil.NopCloser(bytes.NewReader(head))
+				child.ServeHTTP(w, r)
+				return
+			}
+			in = io.MultiReader(bytes.NewReader(head), r.Body)
+		}
+		f, err := ioutil.TempFile(dir, "slack-body-")
+		if err != nil {
+			metricSpooledBodies.Inc("error")
+			log.Printf("spooling body: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := io.Copy(f, in); err != nil {
+			metricSpooledBodies.Inc("error")
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			metricSpooledBodies.Inc("error")
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		metricSpooledBodies.Inc("spooled")
+		r.Body.Close()
+		r.Body = spooledBody{f}
+		child.ServeHTTP(w, r)
+	})
+}
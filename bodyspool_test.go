@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolBodyHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var got []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		got = append(got, string(body))
+	}))
+	defer backend.Close()
+	target, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	var spooled []bool
+	inspect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Body.(spooledBody)
+		spooled = append(spooled, ok)
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, files, map[bool]int{true: 1, false: 0}[ok])
+		// reading it here still leaves it for the backend
+		_, err = RequestPayload(r, PayloadParserFunc(ParseSlackPayload))
+		require.NoError(t, err)
+		newBackendProxy(target).ServeHTTP(w, r)
+	})
+	verifier := &SlackVerifier{Secrets: []string{"shh"}, Expire: time.Minute}
+	h := SpoolBodyHandler(verifier.Handler(inspect), 64, dir)
+
+	before := metricSpooledBodies.Get("spooled")
+	small := `{"type":"event_callback","event":{"type":"message"}}`
+	large := `{"type":"event_callback","event":{"type":"message","text":"` + strings.Repeat("x", 128) + `"}}`
+	for i, body := range []string{small, large, small, large} {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+		if i >= 2 {
+			// chunked, with no length up front
+			r.ContentLength = -1
+			r.Body = ioutil.NopCloser(strings.NewReader(body))
+		}
+		r.Header.Set("Content-Type", "application/json")
+		SignSlackRequest(r, "shh", time.Now(), []byte(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, []bool{false, true, false, true}, spooled)
+	assert.Equal(t, []string{small, large, small, large}, got)
+	assert.Equal(t, before+2, metricSpooledBodies.Get("spooled"))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "temp files are removed")
+
+	// a forged body is still turned away
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(large))
+	SignSlackRequest(r, "other", time.Now(), []byte(large))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+var (
+	metricCacheRequests = NewCounterVec("cache_requests_total",
+		"cache lookups, by cache and result: hit, miss or stale", "cache", "result")
+	metricCacheEvictions = NewCounterVec("cache_evictions_total",
+		"entries dropped from a cache, by cache and reason: size or expired", "cache", "reason")
+	metricCacheEntries = NewGaugeVec("cache_entries",
+		"entries held in each cache", "cache")
+)
+
+// Cache holds up to max values, dropping the least recently used first, for
+// ttl after each is set. 0 means no limit and no expiry. Caches sharing a
+// name are counted together in the metrics.
+type Cache struct {
+	name string
+	max  int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	loading map[string]*cacheLoad
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// cacheLoad is a Load in progress, which other callers wait on
+type cacheLoad struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func NewCache(name string, max int, ttl time.Duration) *Cache {
+	return &Cache{
+		name:    name,
+		max:     max,
+		ttl:     ttl,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		loading: map[string]*cacheLoad{},
+	}
+}
+
+// expired is called with mu held
+func (c *Cache) expired(e *cacheEntry) bool {
+	return !e.expires.IsZero() && !c.now().Before(e.expires)
+}
+
+// remove is called with mu held
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	metricCacheEntries.Add(-1, c.name)
+}
+
+// Get is the value for key, unless it was never set or has expired
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		metricCacheRequests.Inc(c.name, "miss")
+		return nil, false
+	}
+	if e := el.Value.(*cacheEntry); c.expired(e) {
+		c.remove(el)
+		metricCacheEvictions.Inc(c.name, "expired")
+		metricCacheRequests.Inc(c.name, "miss")
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	metricCacheRequests.Inc(c.name, "hit")
+	return el.Value.(*cacheEntry).value, true
+}
+
+// Set stores value for key, dropping the least recently used entry if the
+// cache is full
+func (c *Cache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value)
+}
+
+// set is called with mu held
+func (c *Cache) set(key string, value interface{}) {
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.now().Add(c.ttl)
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key, value, expires}
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, value, expires})
+	metricCacheEntries.Add(1, c.name)
+	for c.max > 0 && c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		reason := "size"
+		if c.expired(oldest.Value.(*cacheEntry)) {
+			reason = "expired"
+		}
+		c.remove(oldest)
+		metricCacheEvictions.Inc(c.name, reason)
+	}
+}
+
+// Delete forgets key
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Len is how many entries are held, counting any expired ones not yet
+// dropped
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Load is the value for key, calling load to fill it in when missing or
+// expired. Callers asking for the same key at once share one call to load.
+// If load fails, an expired value still held is returned in its place.
+func (c *Cache) Load(key string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok && !c.expired(el.Value.(*cacheEntry)) {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		metricCacheRequests.Inc(c.name, "hit")
+		return el.Value.(*cacheEntry).value, nil
+	}
+	if l, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		<-l.done
+		metricCacheRequests.Inc(c.name, "hit")
+		return l.value, l.err
+	}
+	l := &cacheLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	c.mu.Unlock()
+
+	l.value, l.err = load()
+
+	c.mu.Lock()
+	delete(c.loading, key)
+	result := "miss"
+	if l.err == nil {
+		c.set(key, l.value)
+	} else if el, ok := c.entries[key]; ok {
+		l.value, l.err = el.Value.(*cacheEntry).value, nil
+		result = "stale"
+	}
+	c.mu.Unlock()
+	close(l.done)
+	metricCacheRequests.Inc(c.name, result)
+	return l.value, l.err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewCache("test_lru", 2, time.Minute)
+	c.now = func() time.Time { return now }
+	evictions := func(reason string) float64 { return metricCacheEvictions.Get("test_lru", reason) }
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	// b is the least recently used
+	c.Set("c", 3)
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, float64(1), evictions("size"))
+	assert.Equal(t, float64(2), metricCacheEntries.Get("test_lru"))
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, float64(1), evictions("expired"))
+	c.Delete("c")
+	assert.Equal(t, 0, c.Len())
+	assert.Equal(t, float64(0), metricCacheEntries.Get("test_lru"))
+	assert.Equal(t, float64(1), metricCacheRequests.Get("test_lru", "hit"))
+	assert.Equal(t, float64(2), metricCacheRequests.Get("test_lru", "miss"))
+
+	// without a ttl or max nothing goes
+	c = NewCache("test_unbounded", 0, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, key)
+	}
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestCacheLoad(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewCache("test_load", 0, time.Minute)
+	c.now = func() time.Time { return now }
+
+	var calls int32
+	release := make(chan struct{})
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "fresh", nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Load("key", load)
+			assert.NoError(t, err)
+			assert.Equal(t, "fresh", v)
+		}()
+	}
+	// let the callers pile up on the first load
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	v, err := c.Load("key", func() (interface{}, error) { return nil, errors.New("down") })
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", v, "fresh values are not loaded again")
+
+	now = now.Add(time.Hour)
+	v, err = c.Load("key", func() (interface{}, error) { return nil, errors.New("down") })
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", v, "expired values stand in when loading fails")
+	assert.Equal(t, float64(1), metricCacheRequests.Get("test_load", "stale"))
+
+	_, err = c.Load("other", func() (interface{}, error) { return nil, errors.New("down") })
+	assert.EqualError(t, err, "down")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagAnswerChallenges = kingpin.
+	Flag("answer-challenges", "answer slack url_verification challenges in the proxy instead of the backend").
+	Envar("ANSWER_CHALLENGES").Bool()
+
+// ChallengeHandler answers url_verification posts itself, so an app can be
+// pointed at the proxy before there is a backend to answer them. It only
+// sees verified requests, so it never echoes a challenge for anyone else.
+func ChallengeHandler(child http.Handler, parser PayloadParser) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.Type != "url_verification" {
+			child.ServeHTTP(w, r)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var challenge struct {
+			Challenge string `json:"challenge"`
+		}
+		if err := json.Unmarshal(body, &challenge); err != nil || challenge.Challenge == "" {
+			http.Error(w, "missing challenge", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChallengeHandler(t *testing.T) {
+	forwarded := 0
+	h := ChallengeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(http.StatusAccepted)
+	}), PayloadParserFunc(ParseSlackPayload))
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		exp    string
+	}{
+		{`{"type":"url_verification","challenge":"abc","token":"x"}`, http.StatusOK, `{"challenge":"abc"}` + "\n"},
+		{`{"type":"url_verification","token":"x"}`, http.StatusBadRequest, "missing challenge\n"},
+		{`{"type":"event_callback","event":{"type":"message"}}`, http.StatusAccepted, ""},
+		{`junk`, http.StatusAccepted, ""},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, tc.body)
+		assert.Equal(t, tc.exp, w.Body.String(), tc.body)
+	}
+	assert.Equal(t, 2, forwarded)
+}
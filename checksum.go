@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagBodySHA256 = kingpin.
+	Flag("body-sha256", "forward the sha256 of the verified body in "+HeaderBodySHA256).
+	Envar("BODY_SHA256").Bool()
+
+const HeaderBodySHA256 = "X-Body-SHA256"
+
+// BodyChecksumHandler sets X-Body-SHA256 to the hex sha256 of the body, so
+// backends can dedupe and check integrity without hashing it again. Any
+// value the client sent is replaced. Sinks after it keep the header with
+// each delivery, so archives record the sum of the body as verified, even
+// where the archived body is redacted.
+func BodyChecksumHandler(child http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(body)
+		r.Header.Set(HeaderBodySHA256, hex.EncodeToString(sum[:]))
+		child.ServeHTTP(w, r)
+	})
+}
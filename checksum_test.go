@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyChecksumHandler(t *testing.T) {
+	var got string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(HeaderBodySHA256)
+	})
+	var archived *Delivery
+	sink := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		archived = d
+		return nil
+	})
+	h := BodyChecksumHandler(SinkHandler(backend, "test", sink))
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	r.Header.Set(HeaderBodySHA256, "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	assert.Equal(t, sum, got)
+	require.NotNil(t, archived)
+	assert.Equal(t, sum, archived.Header.Get(HeaderBodySHA256))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagClusterStore = kingpin.
+				Flag("cluster-store", "redis every replica reports its status to, so /admin/cluster shows them all, like redis://redis:6379/0?key=slack_events_proxy:replicas").
+				Envar("CLUSTER_STORE").String()
+	flagClusterInterval = kingpin.
+				Flag("cluster-interval", "how often each replica reports its status to --cluster-store").
+				Envar("CLUSTER_INTERVAL").Default("10s").Duration()
+)
+
+// when this process started, for /admin/cluster
+var startedAt = time.Now()
+
+// clusterStore is set up in main from --cluster-store
+var clusterStore ClusterStore
+
+// ReplicaStatus is what a replica reports about itself: who it is, how much
+// it is holding on to and whether it leads.
+type ReplicaStatus struct {
+	ID         string         `json:"id"`
+	Version    string         `json:"version"`
+	StartedAt  time.Time      `json:"started_at"`
+	ReportedAt time.Time      `json:"reported_at"`
+	Leader     bool           `json:"leader"`
+	Queues     map[string]int `json:"queues"`
+}
+
+// replicaStatus is the status of this replica now. Queues holds the async
+// ack queue and each sink's queue, of this process only when there are
+// --workers.
+func replicaStatus(id string) ReplicaStatus {
+	status := ReplicaStatus{
+		ID:         id,
+		Version:    version,
+		StartedAt:  startedAt,
+		ReportedAt: time.Now(),
+		Leader:     leader != nil && leader.Leading(),
+		Queues:     map[string]int{},
+	}
+	if asyncAcks != nil {
+		status.Queues["async_ack"] = asyncAcks.depth()
+	}
+	for _, each := range sinks {
+		if s, ok := each.sink.(*IsolatedSink); ok {
+			status.Queues["sink:"+each.name] = len(s.queue)
+		}
+	}
+	return status
+}
+
+// ClusterStore is shared by every replica, each reporting its status to it
+// and reading back the others'.
+type ClusterStore interface {
+	Report(ctx context.Context, status ReplicaStatus, ttl time.Duration) error
+	// Replicas are those that reported within their ttl
+	Replicas(ctx context.Context) ([]ReplicaStatus, error)
+}
+
+// RedisClusterStore keeps each replica's status in one redis hash, by id.
+// Replicas that stop reporting are left out once their ttl is up, and
+// cleared the next time a live one reports.
+type RedisClusterStore struct {
+	URL *url.URL
+	Key string
+}
+
+// OpenClusterStore takes a redis url like the redis leader lock does,
+// redis://:password@redis:6379/0?key=slack_events_proxy:replicas
+func OpenClusterStore(raw string) (ClusterStore, error) {
+	u, key, err := parseRedisURL(raw, "slack_events_proxy:replicas")
+	if err != nil {
+		return nil, fmt.Errorf("cluster store: %v", err)
+	}
+	return &RedisClusterStore{URL: u, Key: key}, nil
+}
+
+// clusterEntry is how a status is kept, with when it runs out
+type clusterEntry struct {
+	ReplicaStatus
+	Expires time.Time `json:"expires"`
+}
+
+func (s *RedisClusterStore) Report(ctx context.Context, status ReplicaStatus, ttl time.Duration) error {
+	raw, err := json.Marshal(clusterEntry{status, status.ReportedAt.Add(ttl)})
+	if err != nil {
+		return err
+	}
+	if _, err := redisDo(ctx, s.URL, "HSET", s.Key, status.ID, string(raw)); err != nil {
+		return err
+	}
+	// the whole hash goes once every replica is gone
+	_, err = redisDo(ctx, s.URL, "PEXPIRE", s.Key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.entries(ctx)
+	if err != nil {
+		return err
+	}
+	for id, entry := range entries {
+		if entry.Expires.Before(status.ReportedAt) {
+			if _, err := redisDo(ctx, s.URL, "HDEL", s.Key, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *RedisClusterStore) Replicas(ctx context.Context) ([]ReplicaStatus, error) {
+	entries, err := s.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var out []ReplicaStatus
+	for _, entry := range entries {
+		if entry.Expires.After(now) {
+			out = append(out, entry.ReplicaStatus)
+		}
+	}
+	return out, nil
+}
+
+func (s *RedisClusterStore) entries(ctx context.Context) (map[string]clusterEntry, error) {
+	reply, err := redisDo(ctx, s.URL, "HGETALL", s.Key)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	entries := map[string]clusterEntry{}
+	for i := 0; i+1 < len(items); i += 2 {
+		id, _ := items[i].(string)
+		raw, _ := items[i+1].(string)
+		var entry clusterEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			log.Printf("cluster store: replica %s: %v", id, err)
+			continue
+		}
+		entries[id] = entry
+	}
+	return entries, nil
+}
+
+// runClusterReports reports this replica's status to store every
+// interval, until the process exits
+func runClusterReports(store ClusterStore, id string, interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		// missing two reports in a row drops a replica from the list
+		if err := store.Report(ctx, replicaStatus(id), 3*interval); err != nil {
+			log.Printf("cluster store: %v", err)
+		}
+		cancel()
+		time.Sleep(interval)
+	}
+}
+
+// ClusterHandler answers with the status of every replica in store, or
+// only this one without a store. If store can not be read this replica's
+// status is still given, along with the error.
+func ClusterHandler(store ClusterStore, id string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var out struct {
+			Replicas []ReplicaStatus `json:"replicas"`
+			Error    string          `json:"error,omitempty"`
+		}
+		self := replicaStatus(id)
+		out.Replicas = []ReplicaStatus{self}
+		if store != nil {
+			replicas, err := store.Replicas(r.Context())
+			if err != nil {
+				out.Error = err.Error()
+			}
+			for _, replica := range replicas {
+				// this replica's own report may be a while old
+				if replica.ID != self.ID {
+					out.Replicas = append(out.Replicas, replica)
+				}
+			}
+		}
+		sort.Slice(out.Replicas, func(i, j int) bool { return out.Replicas[i].ID < out.Replicas[j].ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisClusterStore(t *testing.T) {
+	addr, _, done := fakeRedis(t, "hunter2")
+	defer done()
+	store, err := OpenClusterStore("redis://:hunter2@" + addr + "/1?key=replicas")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	now := time.Now()
+	gone := ReplicaStatus{ID: "a", ReportedAt: now.Add(-time.Minute)}
+	require.NoError(t, store.Report(ctx, gone, 30*time.Second))
+	replicas, err := store.Replicas(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, replicas, "a report past its ttl is left out")
+
+	live := ReplicaStatus{ID: "b", ReportedAt: now, Leader: true, Queues: map[string]int{"async_ack": 3}}
+	require.NoError(t, store.Report(ctx, live, 30*time.Second))
+	replicas, err = store.Replicas(ctx)
+	require.NoError(t, err)
+	require.Len(t, replicas, 1)
+	assert.Equal(t, "b", replicas[0].ID)
+	assert.True(t, replicas[0].Leader)
+	assert.Equal(t, map[string]int{"async_ack": 3}, replicas[0].Queues)
+
+	entries, err := store.(*RedisClusterStore).entries(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, entries, "a", "and cleared by the next report")
+}
+
+func TestOpenClusterStore(t *testing.T) {
+	for raw, want := range map[string]string{
+		"redis://":         "cluster store: redis needs a host",
+		"etcd://etcd:2379": `cluster store: "etcd://etcd:2379" must be redis:// or rediss://`,
+	} {
+		_, err := OpenClusterStore(raw)
+		assert.EqualError(t, err, want, raw)
+	}
+	store, err := OpenClusterStore("rediss://redis.internal")
+	require.NoError(t, err)
+	assert.Equal(t, "slack_events_proxy:replicas", store.(*RedisClusterStore).Key)
+}
+
+type fakeClusterStore struct {
+	replicas []ReplicaStatus
+	err      error
+}
+
+func (s *fakeClusterStore) Report(ctx context.Context, status ReplicaStatus, ttl time.Duration) error {
+	return nil
+}
+
+func (s *fakeClusterStore) Replicas(ctx context.Context) ([]ReplicaStatus, error) {
+	return s.replicas, s.err
+}
+
+func TestClusterHandler(t *testing.T) {
+	defer func(old *asyncQueue) { asyncAcks = old }(asyncAcks)
+	asyncAcks = newAsyncQueue(4, 0, 0, time.Second)
+	require.True(t, asyncAcks.add(asyncJob{priority: asyncPriorityEvent}))
+
+	get := func(h http.Handler) (out struct {
+		Replicas []ReplicaStatus `json:"replicas"`
+		Error    string          `json:"error"`
+	}) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/cluster", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		return out
+	}
+
+	// on its own a replica reports just itself
+	out := get(ClusterHandler(nil, "b"))
+	require.Len(t, out.Replicas, 1)
+	assert.Equal(t, "b", out.Replicas[0].ID)
+	assert.Equal(t, 1, out.Replicas[0].Queues["async_ack"])
+	assert.False(t, out.Replicas[0].Leader)
+
+	store := &fakeClusterStore{replicas: []ReplicaStatus{
+		{ID: "c", Leader: true},
+		{ID: "b", Queues: map[string]int{"async_ack": 9}},
+		{ID: "a"},
+	}}
+	out = get(ClusterHandler(store, "b"))
+	require.Len(t, out.Replicas, 3)
+	for i, id := range []string{"a", "b", "c"} {
+		assert.Equal(t, id, out.Replicas[i].ID)
+	}
+	assert.Equal(t, 1, out.Replicas[1].Queues["async_ack"], "its own status is fresh")
+	assert.True(t, out.Replicas[2].Leader)
+
+	store.err = errors.New("redis: connection refused")
+	out = get(ClusterHandler(store, "b"))
+	assert.Len(t, out.Replicas, 3)
+	assert.Equal(t, "redis: connection refused", out.Error)
+}
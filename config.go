@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagConfigFile = kingpin.
+	Flag("config", "json file with per route configuration").
+	Envar("CONFIG").String()
+
+// Config is everything that is too structured to live in flags.
+type Config struct {
+	Routes     []RouteConfig     `json:"routes"`
+	Silences   []SilenceWindow   `json:"silences"`
+	Labels     []LabelRule       `json:"labels"`
+	RateLimits []RateLimitConfig `json:"rate_limits"`
+
+	// Pipeline orders the stages requests pass through before being
+	// forwarded, or leaves the default order when empty
+	Pipeline []PipelineStage `json:"pipeline"`
+
+	// Backend, AllowedURIs and AllowedMethods stand in for --proxy-host,
+	// --uri and --method, so they can be changed with a reload
+	Backend        string   `json:"backend"`
+	AllowedURIs    []string `json:"allowed_uris"`
+	AllowedMethods []string `json:"allowed_methods"`
+
+	// Backends are named backends for BackendSelect to pick from, by an
+	// expression over the payload and labels, for everything no route
+	// sends elsewhere
+	Backends      map[string]string `json:"backends"`
+	BackendSelect string            `json:"backend_select"`
+
+	// Teams are per workspace secrets and backends, by team_id
+	Teams map[string]TeamConfig `json:"teams"`
+
+	// Apps are slack apps with their own secret and backend, by path
+	Apps map[string]AppConfig `json:"apps"`
+
+	// Schedules cap how fast and when events reach a backend
+	Schedules []BackendSchedule `json:"schedules"`
+}
+
+// backendTargets are the default backends requests are spread across, from
+// the config or else --proxy-host
+func (c *Config) backendTargets() []*url.URL {
+	if c.Backend != "" {
+		// validated on load
+		target, _ := url.Parse(c.Backend)
+		return []*url.URL{target}
+	}
+	return *flagProxyTarget
+}
+
+// RouteConfig matches payloads on every field that is set, and sends them
+// to Backend, or the default backend if it is empty.
+type RouteConfig struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Kind       string `json:"kind"`
+	Type       string `json:"type"`
+	Arg        string `json:"arg"`
+	CallbackID string `json:"callback_id"`
+	// Labels match labels given by the label rules
+	Labels map[string]string `json:"labels"`
+
+	Backend  string         `json:"backend"`
+	Response ResponseConfig `json:"response"`
+
+	// JWT verifies requests on Path with a bearer token instead of a slack
+	// signature
+	JWT *JWTConfig `json:"jwt"`
+
+	// Skip leaves pipeline stages out for requests on Path, and Stages are
+	// run for them ahead of the pipeline
+	Skip   []string        `json:"skip"`
+	Stages []PipelineStage `json:"stages"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	if path == "" {
+		return &Config{}, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if c.Backend != "" {
+		if target, err := url.Parse(c.Backend); err != nil || target.Host == "" {
+			return nil, fmt.Errorf("bad backend %q", c.Backend)
+		}
+	}
+	for name, raw := range c.Backends {
+		if _, ok := selectVars[name]; ok || strings.HasPrefix(name, "labels.") {
+			return nil, fmt.Errorf("backend name %q is taken by a field", name)
+		}
+		if target, err := url.Parse(raw); err != nil || target.Host == "" {
+			return nil, fmt.Errorf("backend %s: bad backend %q", name, raw)
+		}
+	}
+	for team, tc := range c.Teams {
+		if team == "" {
+			return nil, fmt.Errorf("team with no team_id")
+		}
+		if err := tc.validate(); err != nil {
+			return nil, fmt.Errorf("team %s: %v", team, err)
+		}
+	}
+	if err := validateApps(c.Apps); err != nil {
+		return nil, err
+	}
+	if c.BackendSelect != "" {
+		if _, err := ParseBackendSelector(c.BackendSelect, c.Backends); err != nil {
+			return nil, fmt.Errorf("backend_select: %v", err)
+		}
+	}
+	for i, route := range c.Routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("route %d %s: %v", i, route.Name, err)
+		}
+	}
+	for i, rule := range c.Labels {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("label rule %d: %v", i, err)
+		}
+	}
+	for i, rl := range c.RateLimits {
+		if err := rl.validate(); err != nil {
+			return nil, fmt.Errorf("rate limit %d %s: %v", i, rl.Name, err)
+		}
+	}
+	if len(c.Pipeline) > 0 {
+		if err := validatePipeline(c.Pipeline, &c); err != nil {
+			return nil, err
+		}
+	}
+	scheduled := map[string]bool{}
+	for i := range c.Schedules {
+		bs := &c.Schedules[i]
+		if err := bs.validate(c.Backends); err != nil {
+			return nil, fmt.Errorf("schedule %d %s: %v", i, bs.Backend, err)
+		}
+		target, _ := bs.target(c.Backends)
+		if scheduled[target] {
+			return nil, fmt.Errorf("schedule %d %s: backend already has a schedule", i, bs.Backend)
+		}
+		scheduled[target] = true
+	}
+	for i := range c.Silences {
+		if err := c.Silences[i].init(); err != nil {
+			return nil, fmt.Errorf("silence %d %s: %v", i, c.Silences[i].ID, err)
+		}
+	}
+	return &c, nil
+}
+
+func (rc RouteConfig) validate() error {
+	switch rc.Kind {
+	case "", PayloadEvent, PayloadCommand, PayloadInteraction:
+	default:
+		return fmt.Errorf("unknown kind %q", rc.Kind)
+	}
+	if rc.Backend != "" {
+		target, err := url.Parse(rc.Backend)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("bad backend %q", rc.Backend)
+		}
+	}
+	if rc.JWT != nil {
+		// auth is picked before the body can be trusted, so only by path
+		if rc.Path == "" {
+			return fmt.Errorf("jwt auth needs a path")
+		}
+		if err := rc.JWT.validate(); err != nil {
+			return err
+		}
+	}
+	if len(rc.Skip) > 0 || len(rc.Stages) > 0 {
+		// like auth, stages are picked before the body can be trusted
+		if rc.Path == "" {
+			return fmt.Errorf("skipping or adding stages needs a path")
+		}
+		for _, stage := range rc.Skip {
+			if _, ok := pipelineStages[stage]; !ok {
+				return fmt.Errorf("unknown pipeline stage %q", stage)
+			}
+			if stage == "verify_signature" {
+				return fmt.Errorf("verify_signature cannot be skipped, use jwt auth instead")
+			}
+		}
+		for _, stage := range rc.Stages {
+			if _, ok := pipelineStages[stage.Stage]; !ok {
+				return fmt.Errorf("unknown pipeline stage %q", stage.Stage)
+			}
+		}
+	}
+	return rc.Response.validate()
+}
+
+func (rc RouteConfig) Match(r *http.Request, p *Payload) bool {
+	if rc.Path != "" && !strings.HasPrefix(r.URL.Path, rc.Path) {
+		return false
+	}
+	if rc.Kind != "" && rc.Kind != p.Kind {
+		return false
+	}
+	if rc.Type != "" && rc.Type != p.Type {
+		return false
+	}
+	if rc.CallbackID != "" && rc.CallbackID != p.CallbackID {
+		return false
+	}
+	if !RequestLabels(r).Match(rc.Labels) {
+		return false
+	}
+	if rc.Arg != "" {
+		words := strings.Fields(p.Text)
+		if len(words) < 1 || !strings.EqualFold(words[0], rc.Arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Route builds the route, using fallback when no backend is set.
+func (rc RouteConfig) Route(fallback http.Handler) Route {
+	h := fallback
+	if rc.Backend != "" {
+		// validated on load
+		target, _ := url.Parse(rc.Backend)
+		h = newBackendProxy(target)
+	}
+
+	name := rc.Name
+	if name == "" {
+		name = strings.Join(strings.Fields(strings.Join(
+			[]string{rc.Path, rc.Kind, rc.Type, rc.Arg, rc.CallbackID}, " ")), " ")
+	}
+	h = ResponseModeHandler(h, name, rc.Response)
+	return Route{
+		Name:    name,
+		Match:   rc.Match,
+		Handler: ResponseHeaderHandler(h, rc.Response.Headers),
+	}
+}
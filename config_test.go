@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, tc := range testdataLoadConfig {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(name, " ", "_", -1)+".json")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.config), 0600))
+
+			_, err := loadConfig(path)
+			if tc.err != "" {
+				assert.EqualError(t, err, strings.Replace(tc.err, "CONFIG", path, 1))
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	c, err := loadConfig("")
+	require.NoError(t, err)
+	assert.Empty(t, c.Routes)
+
+	_, err = loadConfig(filepath.Join(dir, "missing.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRouteConfigMatch(t *testing.T) {
+	for name, tc := range testdataRouteConfigMatch {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			assert.Equal(t, tc.exp, tc.rc.Match(r, &tc.p))
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+var testdataLoadConfig = map[string]struct {
+	config string
+	err    string
+}{
+	"empty": {config: `{}`},
+	"routes": {config: `{"routes":[
+		{"name":"deploys","kind":"command","type":"/ops","arg":"deploy","backend":"http://deployer"},
+		{"kind":"event","response":{"mode":"mapped"}},
+		{"kind":"command","response":{"mode":"replaced","status":200,"body":"on it"}}
+	]}`},
+	"bad json":    {config: `{"routes":`, err: "parsing CONFIG: unexpected end of JSON input"},
+	"bad kind":    {config: `{"routes":[{"kind":"webhook"}]}`, err: `route 0 : unknown kind "webhook"`},
+	"bad backend": {config: `{"routes":[{"name":"x","backend":"deployer"}]}`, err: `route 0 x: bad backend "deployer"`},
+	"bad mode":    {config: `{"routes":[{"response":{"mode":"loud"}}]}`, err: `route 0 : unknown response mode "loud"`},
+	"bad status":  {config: `{"routes":[{"response":{"mode":"replaced","status":1000}}]}`, err: `route 0 : bad replacement status 1000`},
+	"bad header":  {config: `{"routes":[{"response":{"headers":[{"name":"X-Slack-No-Retry","value":"1","when":"sometimes"}]}}]}`, err: `route 0 : unknown response header condition "sometimes"`},
+	"jwt": {config: `{"routes":[
+		{"path":"/openid","jwt":{"jwks_url":"https://slack.com/openid/connect/keys","issuer":"https://slack.com","audience":"A123"}}
+	]}`},
+	"jwt no audience": {config: `{"routes":[{"name":"x","path":"/x","jwt":{"jwks_url":"https://slack.com/openid/connect/keys","issuer":"https://slack.com"}}]}`, err: `route 0 x: jwt needs an issuer and an audience`},
+	"jwt no issuer":   {config: `{"routes":[{"name":"x","path":"/x","jwt":{"jwks_url":"https://slack.com/openid/connect/keys","audience":"A123"}}]}`, err: `route 0 x: jwt needs an issuer and an audience`},
+	"jwt no path":     {config: `{"routes":[{"name":"x","jwt":{"jwks_url":"https://slack.com/openid/connect/keys"}}]}`, err: `route 0 x: jwt auth needs a path`},
+	"jwt bad url":     {config: `{"routes":[{"name":"x","path":"/x","jwt":{"jwks_url":"keys"}}]}`, err: `route 0 x: bad jwks_url "keys"`},
+	"route stages": {config: `{"routes":[
+		{"path":"/internal","skip":["body_limit"],"stages":[{"stage":"restrict_method","params":{"methods":["POST"]}}]}
+	]}`},
+	"stages no path":    {config: `{"routes":[{"name":"x","skip":["body_limit"]}]}`, err: `route 0 x: skipping or adding stages needs a path`},
+	"skip unknown":      {config: `{"routes":[{"name":"x","path":"/x","skip":["gzip"]}]}`, err: `route 0 x: unknown pipeline stage "gzip"`},
+	"skip verify":       {config: `{"routes":[{"name":"x","path":"/x","skip":["verify_signature"]}]}`, err: `route 0 x: verify_signature cannot be skipped, use jwt auth instead`},
+	"unknown stage":     {config: `{"routes":[{"name":"x","path":"/x","stages":[{"stage":"gzip"}]}]}`, err: `route 0 x: unknown pipeline stage "gzip"`},
+	"backend select":    {config: `{"backends":{"new":"http://new"},"backend_select":"team_id in ['T1'] ? new : ''"}`},
+	"bad select":        {config: `{"backends":{"new":"http://new"},"backend_select":"team_id ? new : ''"}`, err: `backend_select: condition before ? is a string, not a bool`},
+	"backend clash":     {config: `{"backends":{"team_id":"http://new"}}`, err: `backend name "team_id" is taken by a field`},
+	"bad named backend": {config: `{"backends":{"new":"new"}}`, err: `backend new: bad backend "new"`},
+	"bad silence":       {config: `{"silences":[{"id":"x","schedule":"0 2 * *","duration":"1h"}]}`, err: `silence 0 x: cron schedule "0 2 * *" needs five fields`},
+	"teams": {config: `{"teams":{
+		"T1":{"secret":"one","backend":"http://one"},
+		"T2":{"secret":"two","path":"/slack/two"}
+	}}`},
+	"empty team":       {config: `{"teams":{"T1":{}}}`, err: `team T1: needs a secret or a backend`},
+	"bad team backend": {config: `{"teams":{"T1":{"backend":"one"}}}`, err: `team T1: bad backend "one"`},
+	"bad team path":    {config: `{"teams":{"T1":{"secret":"one","path":"slack"}}}`, err: `team T1: path "slack" does not start with /`},
+	"apps": {config: `{"apps":{
+		"a":{"path":"/app-a/","secret":"one","backend":"http://one","expire":"10m"},
+		"b":{"path":"/app-b/","secret":"two"}
+	}}`},
+	"app without secret": {config: `{"apps":{"a":{"path":"/app-a/"}}}`, err: `app a: needs a secret`},
+	"bad app path":       {config: `{"apps":{"a":{"path":"app-a","secret":"one"}}}`, err: `app a: path "app-a" does not start with /`},
+	"bad app backend":    {config: `{"apps":{"a":{"path":"/app-a/","secret":"one","backend":"one"}}}`, err: `app a: bad backend "one"`},
+	"shared app path":    {config: `{"apps":{"a":{"path":"/app/","secret":"one"},"b":{"path":"/app/","secret":"two"}}}`, err: `apps a and b share path /app/`},
+}
+
+var testdataRouteConfigMatch = map[string]struct {
+	rc   RouteConfig
+	path string
+	p    Payload
+	exp  bool
+}{
+	"match all": {
+		path: "/",
+		p:    Payload{Kind: PayloadEvent, Type: "message"},
+		exp:  true,
+	},
+	"path": {
+		rc:   RouteConfig{Path: "/slack/events"},
+		path: "/slack/events/app",
+		p:    Payload{Kind: PayloadEvent, Type: "message"},
+		exp:  true,
+	},
+	"wrong path": {
+		rc:   RouteConfig{Path: "/slack/events"},
+		path: "/slack/commands",
+		p:    Payload{Kind: PayloadEvent, Type: "message"},
+	},
+	"kind": {
+		rc:   RouteConfig{Kind: PayloadEvent},
+		path: "/",
+		p:    Payload{Kind: PayloadEvent, Type: "message"},
+		exp:  true,
+	},
+	"wrong kind": {
+		rc:   RouteConfig{Kind: PayloadCommand},
+		path: "/",
+		p:    Payload{Kind: PayloadEvent, Type: "message"},
+	},
+	"type": {
+		rc:   RouteConfig{Type: "app_mention"},
+		path: "/",
+		p:    Payload{Kind: PayloadEvent, Type: "app_mention"},
+		exp:  true,
+	},
+	"wrong type": {
+		rc:   RouteConfig{Type: "app_mention"},
+		path: "/",
+		p:    Payload{Kind: PayloadEvent, Type: "message"},
+	},
+	"arg": {
+		rc:   RouteConfig{Kind: PayloadCommand, Type: "/ops", Arg: "deploy"},
+		path: "/",
+		p:    Payload{Kind: PayloadCommand, Type: "/ops", Text: "Deploy api"},
+		exp:  true,
+	},
+	"wrong arg": {
+		rc:   RouteConfig{Kind: PayloadCommand, Type: "/ops", Arg: "deploy"},
+		path: "/",
+		p:    Payload{Kind: PayloadCommand, Type: "/ops", Text: "status"},
+	},
+	"callback": {
+		rc:   RouteConfig{CallbackID: "new-ticket"},
+		path: "/",
+		p:    Payload{Kind: PayloadInteraction, Type: "view_submission", CallbackID: "new-ticket"},
+		exp:  true,
+	},
+	"wrong callback": {
+		rc:   RouteConfig{CallbackID: "new-ticket"},
+		path: "/",
+		p:    Payload{Kind: PayloadInteraction, Type: "view_submission", CallbackID: "survey"},
+	},
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagReplayCandidate = kingpin.
+	Flag("replay-candidate", "backend /admin/replay?compare=true also sends each event to, to check it answers like the current one").
+	Envar("REPLAY_CANDIDATE").URL()
+
+var metricContractChecks = NewCounterVec("replay_contract_checks_total",
+	"events compared between the backend and --replay-candidate, by outcome", "outcome")
+
+// the most differences listed for one event
+const contractMaxDiffs = 20
+
+// ContractMismatch is an event the candidate answered differently.
+// Diffs are the json paths where the bodies differ, or body when either is
+// not json.
+type ContractMismatch struct {
+	EventID         string   `json:"event_id"`
+	Type            string   `json:"type"`
+	Status          int      `json:"status"`
+	CandidateStatus int      `json:"candidate_status"`
+	Diffs           []string `json:"diffs,omitempty"`
+}
+
+// ContractReport sums up a replay sent to both backends
+type ContractReport struct {
+	Compared   int                `json:"compared"`
+	Matched    int                `json:"matched"`
+	Mismatched int                `json:"mismatched"`
+	Mismatches []ContractMismatch `json:"mismatches"`
+}
+
+// contractCheck sends each replayed event on to a candidate backend as well,
+// and compares its answer with what the current one said. Bodies are only
+// compared when asked, as they often carry timestamps and ids.
+type contractCheck struct {
+	Candidate http.Handler
+	Bodies    bool
+	Timeout   time.Duration
+	Report    ContractReport
+}
+
+func newContractCheck(candidate http.Handler, bodies bool, timeout time.Duration) *contractCheck {
+	return &contractCheck{
+		Candidate: candidate,
+		Bodies:    bodies,
+		Timeout:   timeout,
+		Report:    ContractReport{Mismatches: []ContractMismatch{}},
+	}
+}
+
+// compare sends r to the candidate and records how its answer differs from
+// current. r must not have been read yet.
+func (c *contractCheck) compare(r *http.Request, event ReplayedEvent, current *ResponseBuffer) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	candidate := NewResponseBuffer()
+	c.Candidate.ServeHTTP(candidate, r.WithContext(ctx))
+
+	c.Report.Compared++
+	mismatch := ContractMismatch{
+		EventID:         event.EventID,
+		Type:            event.Type,
+		Status:          current.StatusCode(),
+		CandidateStatus: candidate.StatusCode(),
+	}
+	if c.Bodies {
+		mismatch.Diffs = diffBodies(current.Body.Bytes(), candidate.Body.Bytes())
+	}
+	if mismatch.Status == mismatch.CandidateStatus && len(mismatch.Diffs) == 0 {
+		c.Report.Matched++
+		metricContractChecks.Inc("matched")
+		return
+	}
+	c.Report.Mismatched++
+	metricContractChecks.Inc("mismatched")
+	c.Report.Mismatches = append(c.Report.Mismatches, mismatch)
+	log.Printf("contract check: candidate answered event %s with %d, backend with %d, bodies differ at %v",
+		event.EventID, mismatch.CandidateStatus, mismatch.Status, mismatch.Diffs)
+}
+
+// diffBodies lists where two response bodies differ, as json paths when
+// both are json
+func diffBodies(a, b []byte) []string {
+	var aJSON, bJSON interface{}
+	if json.Unmarshal(a, &aJSON) != nil || json.Unmarshal(b, &bJSON) != nil {
+		if bytes.Equal(bytes.TrimSpace(a), bytes.TrimSpace(b)) {
+			return nil
+		}
+		return []string{"body"}
+	}
+	diffs := jsonDiff("$", aJSON, bJSON, nil)
+	if len(diffs) > contractMaxDiffs {
+		diffs = append(diffs[:contractMaxDiffs], fmt.Sprintf("and %d more", len(diffs)-contractMaxDiffs))
+	}
+	return diffs
+}
+
+// jsonDiff appends every path under which a and b differ to diffs. A path
+// where the type or the length of an array differs is not looked into.
+func jsonDiff(path string, a, b interface{}, diffs []string) []string {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			return append(diffs, path)
+		}
+		var keys []string
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffs = jsonDiff(path+"."+k, a[k], b[k], diffs)
+		}
+		return diffs
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return append(diffs, path)
+		}
+		for i := range a {
+			diffs = jsonDiff(path+"["+strconv.Itoa(i)+"]", a[i], b[i], diffs)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(a, b) {
+		diffs = append(diffs, path)
+	}
+	return diffs
+}
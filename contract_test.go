@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBodies(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		exp  []string
+	}{
+		{"", "", nil},
+		{"ok", "ok\n", nil},
+		{"ok", "fine", []string{"body"}},
+		{`{"ok":true}`, "ok", []string{"body"}},
+		{`{"ok":true,"n":1}`, `{"n":1,"ok":true}`, nil},
+		{`{"ok":true,"n":1}`, `{"ok":false,"n":1,"extra":"x"}`, []string{"$.extra", "$.ok"}},
+		{`{"blocks":[{"type":"section"},{"type":"divider"}]}`, `{"blocks":[{"type":"section"},{"type":"header"}]}`,
+			[]string{"$.blocks[1].type"}},
+		{`{"blocks":[1,2]}`, `{"blocks":[1]}`, []string{"$.blocks"}},
+		{`{"blocks":[1,2]}`, `{"blocks":{"a":1}}`, []string{"$.blocks"}},
+		{`[1]`, `{"a":1}`, []string{"$"}},
+	} {
+		assert.Equal(t, test.exp, diffBodies([]byte(test.a), []byte(test.b)), "%s vs %s", test.a, test.b)
+	}
+
+	// long lists of differences are cut short
+	var a, b []int
+	for i := 0; i < contractMaxDiffs+5; i++ {
+		a, b = append(a, i), append(b, -i-1)
+	}
+	rawA, _ := json.Marshal(a)
+	rawB, _ := json.Marshal(b)
+	diffs := diffBodies(rawA, rawB)
+	require.Len(t, diffs, contractMaxDiffs+1)
+	assert.Equal(t, "and 5 more", diffs[contractMaxDiffs])
+}
+
+func TestReplayHandlerCompare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contract")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.ndjson")
+
+	archive, err := OpenArchiveSink(path)
+	require.NoError(t, err)
+	for i, id := range []string{"Ev1", "Ev2", "Ev3"} {
+		require.NoError(t, archive.Send(context.Background(), &Delivery{
+			Method:     http.MethodPost,
+			RequestURI: "/slack/events",
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       []byte(`{"type":"event_callback","event_id":"` + id + `","event":{"type":"message"}}`),
+			ReceivedAt: time.Date(2020, 9, 1, 0, 0, i, 0, time.UTC),
+		}))
+	}
+	require.NoError(t, archive.Close())
+
+	answer := func(rewrite bool) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "true", r.Header.Get(HeaderProxyReplay))
+			p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload))
+			require.NoError(t, err)
+			switch {
+			case rewrite && p.ID == "Ev2":
+				http.Error(w, "not implemented yet", http.StatusNotImplemented)
+			case rewrite && p.ID == "Ev3":
+				w.Write([]byte(`{"ok":true,"handled_by":"v2"}`))
+			default:
+				w.Write([]byte(`{"ok":true,"handled_by":"v1"}`))
+			}
+		})
+	}
+	h := ReplayHandler([]string{path}, answer(false), answer(true), time.Second)
+
+	for _, test := range []struct {
+		query string
+		exp   ContractReport
+	}{
+		{"compare=true", ContractReport{Compared: 3, Matched: 2, Mismatched: 1, Mismatches: []ContractMismatch{
+			{EventID: "Ev2", Type: "message", Status: http.StatusOK, CandidateStatus: http.StatusNotImplemented},
+		}}},
+		{"compare=true&compare_bodies=true", ContractReport{Compared: 3, Matched: 1, Mismatched: 2, Mismatches: []ContractMismatch{
+			{EventID: "Ev2", Type: "message", Status: http.StatusOK, CandidateStatus: http.StatusNotImplemented,
+				Diffs: []string{"body"}},
+			{EventID: "Ev3", Type: "message", Status: http.StatusOK, CandidateStatus: http.StatusOK,
+				Diffs: []string{"$.handled_by"}},
+		}}},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/replay?"+test.query, nil))
+		require.Equal(t, http.StatusOK, w.Code, test.query)
+		var got replayResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+		require.NotNil(t, got.Contract, test.query)
+		assert.Equal(t, test.exp, *got.Contract, test.query)
+	}
+
+	// a dry run sends nothing anywhere
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/replay?compare=true&dry_run=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var got replayResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Nil(t, got.Contract)
+
+	w = httptest.NewRecorder()
+	ReplayHandler([]string{path}, answer(false), nil, time.Second).ServeHTTP(w,
+		httptest.NewRequest(http.MethodPost, "/admin/replay?compare=true", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagBodyReadTimeout = kingpin.
+	Flag("body-read-timeout", "max time to read a request body, 0 to disable").
+	Envar("BODY_READ_TIMEOUT").Default("10s").Duration()
+
+var (
+	flagForwardDeadline = kingpin.
+				Flag("forward-deadline", "time the backend has to answer, 0 for no limit").
+				Envar("FORWARD_DEADLINE").Duration()
+	flagTypeDeadlines = kingpin.
+				Flag("type-deadline", "override the forward deadline for an event, command, or interaction type, like 'block_actions=2s'").
+				Envar("TYPE_DEADLINE").Strings()
+	flagDeadlineHeader = kingpin.
+				Flag("deadline-header", "tell backends the milliseconds left to answer in "+HeaderDeadline).
+				Envar("DEADLINE_HEADER").Bool()
+)
+
+// HeaderDeadline carries the milliseconds a backend has left to answer
+// before slack, or the forward deadline, gives up on the request
+const HeaderDeadline = "X-Deadline-Ms"
+
+var metricBodyReadTimeouts = NewCounterVec("body_read_timeouts_total",
+	"requests whose body was not read in time")
+
+// BodyReadTimeoutHandler puts a read deadline on the request while the
+// body is read. Unlike the server wide ReadTimeout it only covers this
+// request, so a client trickling in a body can not hold the handler and its
+// buffer forever, while slow backends on keep-alive connections are fine.
+func BodyReadTimeoutHandler(child http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if r.Body == nil || r.Body == http.NoBody || rc.SetReadDeadline(time.Now().Add(timeout)) != nil {
+			child.ServeHTTP(w, r)
+			return
+		}
+		// over http/2 the deadline is the stream's, and is cleared however
+		// the request ends. Over http/1 it is left in place if the body is
+		// not read to the end, so the server gives up discarding the rest,
+		// and it resets deadlines itself before reading the next request.
+		if r.ProtoMajor >= 2 {
+			defer rc.SetReadDeadline(time.Time{})
+		}
+
+		in := r.Body
+		read := func(p []byte) (int, error) {
+			n, err := in.Read(p)
+			if err == io.EOF {
+				// the server keeps reading in the background once the body is
+				// done, the deadline must not cut that off
+				rc.SetReadDeadline(time.Time{})
+			} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				metricBodyReadTimeouts.Inc()
+			}
+			return n, err
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{reader(read), in}
+
+		child.ServeHTTP(w, r)
+	})
+}
+
+func parseTypeDeadlines(raw []string) (map[string]time.Duration, error) {
+	deadlines := make(map[string]time.Duration, len(raw))
+	for _, each := range raw {
+		parts := strings.SplitN(each, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad type deadline %q, want type=duration", each)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad type deadline %q, want type=duration", each)
+		}
+		deadlines[parts[0]] = d
+	}
+	return deadlines, nil
+}
+
+// ForwardDeadlineHandler gives child deadline to answer, or the deadline
+// for the payload type in byType. Latency tolerances differ a lot between
+// slack surfaces, interactivity has to be quick while file events can wait.
+// A missed deadline is answered with a 503, as for view routes.
+func ForwardDeadlineHandler(child http.Handler, parser PayloadParser,
+	deadline time.Duration, byType map[string]time.Duration) http.Handler {
+	limit := func(d time.Duration) http.Handler {
+		if d <= 0 {
+			return child
+		}
+		return http.TimeoutHandler(child, d, "backend missed the forward deadline")
+	}
+	fallback := limit(deadline)
+	if len(byType) < 1 {
+		return fallback
+	}
+	handlers := make(map[string]http.Handler, len(byType))
+	for t, d := range byType {
+		handlers[t] = limit(d)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, err := RequestPayload(r, parser); err == nil {
+			if h, ok := handlers[p.Type]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+type arrivalKey struct{}
+
+// ArrivalHandler notes when each request came in, so later handlers know
+// how much of slack's window is used up
+func ArrivalHandler(child http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		child.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), arrivalKey{}, time.Now())))
+	})
+}
+
+// ackedContext is ctx for an event slack already has its answer for. It is
+// no longer cancelled with the request, and slack's window no longer
+// counts, so only the deadline the forward is then given limits it.
+func ackedContext(ctx context.Context) context.Context {
+	return context.WithValue(context.WithoutCancel(ctx), arrivalKey{}, nil)
+}
+
+// remainingBudget is the time left before slack gives up on r, or its
+// context deadline passes, whichever is first. It is false for requests
+// with neither, like deliveries from the outbox.
+func remainingBudget(r *http.Request, now time.Time) (time.Duration, bool) {
+	var left time.Duration
+	ok := false
+	if arrived, found := r.Context().Value(arrivalKey{}).(time.Time); found {
+		left, ok = slackResponseWindow-now.Sub(arrived), true
+	}
+	if deadline, found := r.Context().Deadline(); found {
+		if d := deadline.Sub(now); !ok || d < left {
+			left, ok = d, true
+		}
+	}
+	if left < 0 {
+		left = 0
+	}
+	return left, ok
+}
+
+// DeadlineHeaderHandler sets HeaderDeadline on requests to child, so a
+// backend can answer with less, or defer the work, when the proxy has
+// already spent part of the window. Whatever the client sent in the header
+// is dropped.
+func DeadlineHeaderHandler(child http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(HeaderDeadline)
+		if left, ok := remainingBudget(r, time.Now()); ok {
+			r.Header.Set(HeaderDeadline, strconv.FormatInt(int64(left/time.Millisecond), 10))
+		}
+		child.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyReadTimeoutHandler(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "timed out", http.StatusRequestTimeout)
+			return
+		}
+		w.Write(body)
+	})
+	ts := httptest.NewServer(BodyReadTimeoutHandler(backend, 100*time.Millisecond))
+	defer ts.Close()
+
+	// the deadline is lifted once the body is in, so a kept alive connection
+	// idling past it is still usable
+	for i := 0; i < 2; i++ {
+		resp, err := ts.Client().Post(ts.URL, "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(body))
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	before := metricBodyReadTimeouts.Get()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nhel"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, time.Since(start) < time.Second, "trickled body should be cut off")
+	assert.Equal(t, before+1, metricBodyReadTimeouts.Get())
+}
+
+func TestBodyReadTimeoutHandlerHTTP2(t *testing.T) {
+	h := BodyReadTimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("ok"))
+			return
+		}
+		// turned away without reading the body
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}), 100*time.Millisecond)
+	ts := httptest.NewUnstartedServer(h)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	client := ts.Client()
+
+	// the rejected stream's deadline must not end the others on the
+	// connection
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := client.Post(ts.URL+"/slow", "text/plain", strings.NewReader("hello"))
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	body, pw := io.Pipe()
+	defer pw.Close()
+	resp, err := client.Post(ts.URL+"/reject", "text/plain", body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NoError(t, <-slow)
+}
+
+func TestParseTypeDeadlines(t *testing.T) {
+	deadlines, err := parseTypeDeadlines([]string{"block_actions=2s", "file_shared=30s"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{
+		"block_actions": 2 * time.Second,
+		"file_shared":   30 * time.Second,
+	}, deadlines)
+
+	for _, bad := range []string{"block_actions", "=2s", "block_actions=soon", "block_actions=-1s"} {
+		_, err := parseTypeDeadlines([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestForwardDeadlineHandler(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(50 * time.Millisecond):
+			w.Write([]byte("ok"))
+		case <-r.Context().Done():
+		}
+	})
+	h := ForwardDeadlineHandler(backend, PayloadParserFunc(ParseSlackPayload), time.Second,
+		map[string]time.Duration{"block_actions": 10 * time.Millisecond})
+
+	for name, tc := range map[string]struct {
+		body   string
+		ctype  string
+		status int
+	}{
+		"default": {body: `{"type":"event_callback","event":{"type":"file_shared"}}`,
+			ctype: "application/json", status: http.StatusOK},
+		"override": {body: "payload=" + `{"type":"block_actions"}`,
+			ctype: "application/x-www-form-urlencoded", status: http.StatusServiceUnavailable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.ctype)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestRemainingBudget(t *testing.T) {
+	now := time.Now()
+	arrived := func(ctx context.Context, d time.Duration) context.Context {
+		return context.WithValue(ctx, arrivalKey{}, now.Add(-d))
+	}
+	withDeadline := func(ctx context.Context, d time.Duration) context.Context {
+		ctx, cancel := context.WithDeadline(ctx, now.Add(d))
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	for name, tc := range map[string]struct {
+		ctx  context.Context
+		left time.Duration
+		ok   bool
+	}{
+		"nothing known":      {context.Background(), 0, false},
+		"slack window":       {arrived(context.Background(), time.Second), 2 * time.Second, true},
+		"window used up":     {arrived(context.Background(), 5*time.Second), 0, true},
+		"forward deadline":   {withDeadline(context.Background(), time.Second), time.Second, true},
+		"deadline is sooner": {withDeadline(arrived(context.Background(), 0), time.Second), time.Second, true},
+		"window is sooner":   {withDeadline(arrived(context.Background(), 2500*time.Millisecond), time.Second), 500 * time.Millisecond, true},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(tc.ctx)
+		left, ok := remainingBudget(r, now)
+		assert.Equal(t, tc.ok, ok, name)
+		assert.Equal(t, tc.left, left, name)
+	}
+}
+
+func TestDeadlineHeaderHandler(t *testing.T) {
+	var got []string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header[HeaderDeadline]
+	})
+
+	h := ArrivalHandler(DeadlineHeaderHandler(backend))
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(HeaderDeadline, "999999")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Len(t, got, 1)
+	ms, err := strconv.Atoi(got[0])
+	require.NoError(t, err)
+	assert.True(t, ms > 2900 && ms <= 3000, ms)
+
+	// a request that never came over http only has its forward deadline
+	h = DeadlineHeaderHandler(backend)
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(HeaderDeadline, "999999")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Empty(t, got)
+}
+
+func TestDeadlineHeaderAfterAck(t *testing.T) {
+	got := make(chan string, 1)
+	backend := DeadlineHeaderHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get(HeaderDeadline)
+	}))
+	parser := PayloadParserFunc(ParseSlackPayload)
+	q := newAsyncQueue(1, 1, 0, 10*time.Second)
+
+	for name, h := range map[string]http.Handler{
+		"ack events": AckEventsHandler(backend, parser, 10*time.Second),
+		"async ack":  AsyncAckHandler(backend, parser, q, false),
+	} {
+		// slack's window is long gone, as it is for an event that sat in
+		// the queue, but slack has its answer so only the timeout counts
+		ctx := context.WithValue(context.Background(), arrivalKey{}, time.Now().Add(-time.Minute))
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"type":"event_callback","event":{"type":"message"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+		ms, err := strconv.Atoi(<-got)
+		require.NoError(t, err, name)
+		assert.True(t, ms > 9000 && ms <= 10000, "%s: %d", name, ms)
+	}
+}
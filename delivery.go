@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// headers describing a delivery made outside of the request that carried the
+// event in, so backends can reason about how stale it is
+const (
+	HeaderProxyAttempt         = "X-Proxy-Attempt"
+	HeaderProxyFirstReceivedAt = "X-Proxy-First-Received-At"
+	HeaderProxyDeliveryDelay   = "X-Proxy-Delivery-Delay-Ms"
+	HeaderIdempotencyKey       = "Idempotency-Key"
+)
+
+// Delivery is a verified request held on to so it can be delivered to the
+// backend later, possibly more than once.
+type Delivery struct {
+	Method     string      `json:"method"`
+	RequestURI string      `json:"request_uri"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ReceivedAt time.Time   `json:"received_at"`
+	Attempts   int         `json:"attempts"`
+
+	// Response is how the backend answered, for sinks that record it
+	Response *DeliveryResponse `json:"response,omitempty"`
+}
+
+// DeliveryResponse is the backend's answer to one attempt at a delivery.
+// Body holds at most as much of the response as was asked for.
+type DeliveryResponse struct {
+	Status    int    `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Body      string `json:"body,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// NewDelivery copies what is needed out of r, as r is done once the
+// handler that received it returns.
+func NewDelivery(r *http.Request, body []byte) *Delivery {
+	return &Delivery{
+		Method:     r.Method,
+		RequestURI: r.RequestURI,
+		Header:     r.Header.Clone(),
+		Body:       append([]byte(nil), body...),
+		ReceivedAt: time.Now().UTC(),
+	}
+}
+
+// Request builds the next attempt at this delivery, annotated with the
+// attempt metadata headers.
+func (d *Delivery) Request(ctx context.Context) (*http.Request, error) {
+	r, err := http.NewRequest(d.Method, d.RequestURI, bytes.NewReader(d.Body))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+	r.RequestURI = d.RequestURI
+	r.Header = d.Header.Clone()
+
+	d.Attempts++
+	r.Header.Set(HeaderProxyAttempt, strconv.Itoa(d.Attempts))
+	r.Header.Set(HeaderProxyFirstReceivedAt, d.ReceivedAt.Format(time.RFC3339Nano))
+	r.Header.Set(HeaderProxyDeliveryDelay,
+		strconv.FormatInt(int64(time.Since(d.ReceivedAt)/time.Millisecond), 10))
+	r.Header.Set(HeaderIdempotencyKey, d.IdempotencyKey())
+	return r, nil
+}
+
+// Payload parses the body of the delivery.
+func (d *Delivery) Payload(parser PayloadParser) (*Payload, error) {
+	return parser.ParsePayload(&http.Request{Header: d.Header}, d.Body)
+}
+
+// IdempotencyKey is the same for every delivery of one slack request, so
+// brokers and backends that dedupe can drop repeats. It is the event_id for
+// events, which slack keeps across its retries, the trigger_id for
+// commands and interactions, and otherwise the sha256 of the body.
+func (d *Delivery) IdempotencyKey() string {
+	if p, err := d.Payload(PayloadParserFunc(ParseSlackPayload)); err == nil && p.ID != "" {
+		return p.ID
+	}
+	if sum := d.Header.Get(HeaderBodySHA256); sum != "" {
+		return sum
+	}
+	sum := sha256.Sum256(d.Body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelivery(t *testing.T) {
+	in := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader("hello"))
+	in.Header.Set("Content-Type", "application/json")
+	d := NewDelivery(in, []byte("hello"))
+	d.ReceivedAt = d.ReceivedAt.Add(-1500 * time.Millisecond)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		r, err := d.Request(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/slack/events", r.RequestURI)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+
+		assert.Equal(t, strconv.Itoa(attempt), r.Header.Get(HeaderProxyAttempt))
+		assert.Equal(t, d.ReceivedAt.Format(time.RFC3339Nano),
+			r.Header.Get(HeaderProxyFirstReceivedAt))
+		delay, err := time.ParseDuration(r.Header.Get(HeaderProxyDeliveryDelay) + "ms")
+		require.NoError(t, err)
+		assert.True(t, delay >= 1500*time.Millisecond, "delay %s", delay)
+	}
+
+	// the captured request is never annotated itself
+	assert.Empty(t, in.Header.Get(HeaderProxyAttempt))
+}
+
+func TestDeliveryIdempotencyKey(t *testing.T) {
+	for name, tc := range map[string]struct {
+		contentType string
+		body        string
+		key         string
+	}{
+		"event": {contentType: "application/json", key: "Ev123",
+			body: `{"type":"event_callback","event_id":"Ev123","event":{"type":"message"}}`},
+		"command": {contentType: "application/x-www-form-urlencoded", key: "13345224609.738474920.8088930838d88f008e0",
+			body: "command=%2Fops&trigger_id=13345224609.738474920.8088930838d88f008e0"},
+		"unknown": {contentType: "text/plain", body: "hello",
+			key: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			in := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			in.Header.Set("Content-Type", tc.contentType)
+			d := NewDelivery(in, []byte(tc.body))
+			assert.Equal(t, tc.key, d.IdempotencyKey())
+
+			r, err := d.Request(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tc.key, r.Header.Get(HeaderIdempotencyKey))
+		})
+	}
+}
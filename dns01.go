@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagCloudflareToken = kingpin.
+	Flag("cloudflare-token", "cloudflare api token for --acme-dns cloudflare://, with dns edit on the zone").
+	Envar("CLOUDFLARE_API_TOKEN").String()
+
+// DNSProvider sets the TXT records ACME asks for to prove a domain is ours.
+// Present returns once the provider has taken the record, which may still
+// take a while to reach every name server.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// DNSProviderDriver opens a provider from what follows scheme:// in its url.
+type DNSProviderDriver func(spec string) (DNSProvider, error)
+
+var (
+	dnsProviderDriversMu sync.RWMutex
+	dnsProviderDrivers   = map[string]DNSProviderDriver{
+		"cloudflare": openCloudflareDNS,
+		"route53":    openRoute53DNS,
+	}
+)
+
+// RegisterDNSProvider adds a driver for providers with the given scheme.
+func RegisterDNSProvider(scheme string, driver DNSProviderDriver) {
+	dnsProviderDriversMu.Lock()
+	defer dnsProviderDriversMu.Unlock()
+	dnsProviderDrivers[scheme] = driver
+}
+
+// OpenDNSProvider opens a provider like route53://Z0123456789ABC
+func OpenDNSProvider(raw string) (DNSProvider, error) {
+	i := strings.Index(raw, "://")
+	if i < 1 {
+		return nil, fmt.Errorf("dns provider %q needs a scheme", raw)
+	}
+	dnsProviderDriversMu.RLock()
+	driver, ok := dnsProviderDrivers[raw[:i]]
+	dnsProviderDriversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no dns provider driver for %q", raw[:i])
+	}
+	return driver(raw[i+3:])
+}
+
+// Route53DNS sets records in one route53 hosted zone
+type Route53DNS struct {
+	ZoneID   string
+	Endpoint string
+	Creds    awsCredentialsProvider
+	Client   *http.Client
+	// Poll is how often a change is checked on until it is in sync
+	Poll time.Duration
+}
+
+// openRoute53DNS takes a hosted zone id, with an optional endpoint query
+// parameter, like route53://Z0123456789ABC
+func openRoute53DNS(spec string) (DNSProvider, error) {
+	u, err := url.Parse("route53://" + spec)
+	if err != nil {
+		return nil, fmt.Errorf("route53 %q: %v", spec, err)
+	}
+	if u.Host == "" {
+		return nil, errors.New("route53 needs a hosted zone id")
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://route53.amazonaws.com"
+	}
+	return &Route53DNS{
+		ZoneID:   u.Host,
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Creds:    newAWSCredentialsProvider(),
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		Poll:     5 * time.Second,
+	}, nil
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+func (d *Route53DNS) Present(ctx context.Context, fqdn, value string) error {
+	return d.change(ctx, "UPSERT", fqdn, value)
+}
+
+func (d *Route53DNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return d.change(ctx, "DELETE", fqdn, value)
+}
+
+// change makes one change to a TXT record and waits for it to be in sync
+func (d *Route53DNS) change(ctx context.Context, action, fqdn, value string) error {
+	var in struct {
+		XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+		Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+		Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+		TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+		Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+	}
+	in.Action, in.Name, in.Type, in.TTL, in.Value = action, fqdn, "TXT", 60, strconv.Quote(value)
+	body, err := xml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var info route53ChangeInfo
+	if err := d.call(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+d.ZoneID+"/rrset", body, &info); err != nil {
+		return err
+	}
+	for info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.Poll):
+		}
+		if err := d.call(ctx, http.MethodGet, "/2013-04-01/change/"+strings.TrimPrefix(info.ID, "/change/"), nil, &info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call makes a signed call to the route53 rest api, decoding the xml
+// response into out
+func (d *Route53DNS) call(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	c, err := d.Creds.Credentials(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, d.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	// route53 is global, and signed for us-east-1
+	signAWS(req, body, c, "us-east-1", "route53", time.Now())
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(raw, &e) == nil && e.Code != "" {
+			return fmt.Errorf("route53 returned %d: %s: %s", resp.StatusCode, e.Code, e.Message)
+		}
+		return fmt.Errorf("route53 returned %d: %s", resp.StatusCode, bytes.TrimSpace(raw))
+	}
+	return xml.Unmarshal(raw, out)
+}
+
+// CloudflareDNS sets records in one cloudflare zone
+type CloudflareDNS struct {
+	ZoneID   string
+	Token    string
+	Endpoint string
+	Client   *http.Client
+
+	mu sync.Mutex
+	// records are the ids of records made by Present, by name and value
+	records map[string]string
+}
+
+// openCloudflareDNS takes a zone id, with an optional endpoint query
+// parameter, like cloudflare://023e105f4ecef8ad9ca31a8372d0c353
+func openCloudflareDNS(spec string) (DNSProvider, error) {
+	u, err := url.Parse("cloudflare://" + spec)
+	if err != nil {
+		return nil, fmt.Errorf("cloudflare %q: %v", spec, err)
+	}
+	if u.Host == "" {
+		return nil, errors.New("cloudflare needs a zone id")
+	}
+	if *flagCloudflareToken == "" {
+		return nil, errors.New("cloudflare needs --cloudflare-token")
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://api.cloudflare.com/client/v4"
+	}
+	return &CloudflareDNS{
+		ZoneID:   u.Host,
+		Token:    *flagCloudflareToken,
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (d *CloudflareDNS) Present(ctx context.Context, fqdn, value string) error {
+	in := map[string]interface{}{
+		"type":    "TXT",
+		"name":    strings.TrimSuffix(fqdn, "."),
+		"content": value,
+		"ttl":     120,
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := d.call(ctx, http.MethodPost, "/zones/"+d.ZoneID+"/dns_records", in, &out); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.records == nil {
+		d.records = map[string]string{}
+	}
+	d.records[fqdn+" "+value] = out.ID
+	return nil
+}
+
+func (d *CloudflareDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	id, ok := d.records[fqdn+" "+value]
+	delete(d.records, fqdn+" "+value)
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return d.call(ctx, http.MethodDelete, "/zones/"+d.ZoneID+"/dns_records/"+id, nil, nil)
+}
+
+// call makes a call to the cloudflare api, decoding the result into out
+func (d *CloudflareDNS) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, d.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("cloudflare returned %d: %v", resp.StatusCode, err)
+	}
+	if !result.Success {
+		var msgs []string
+		for _, e := range result.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("cloudflare returned %d: %s", resp.StatusCode, strings.Join(msgs, ", "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(result.Result, out)
+}
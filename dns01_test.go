@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenDNSProvider(t *testing.T) {
+	for raw, err := range map[string]string{
+		"route53://Z0123456789ABC":    "",
+		"route53://":                  "route53 needs a hosted zone id",
+		"cloudflare://023e105f4ecef8": "cloudflare needs --cloudflare-token",
+		"Z0123456789ABC":              `dns provider "Z0123456789ABC" needs a scheme`,
+		"gandi://zone":                `no dns provider driver for "gandi"`,
+	} {
+		_, got := OpenDNSProvider(raw)
+		if err == "" {
+			assert.NoError(t, got, raw)
+		} else {
+			assert.EqualError(t, got, err, raw)
+		}
+	}
+}
+
+func TestRoute53DNS(t *testing.T) {
+	var changes []string
+	polls := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/route53/aws4_request")
+		switch r.URL.Path {
+		case "/2013-04-01/hostedzone/Z0123456789ABC/rrset":
+			raw, _ := ioutil.ReadAll(r.Body)
+			changes = append(changes, string(raw))
+			w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+		case "/2013-04-01/change/C1":
+			polls++
+			status := "PENDING"
+			if polls%2 == 0 {
+				status = "INSYNC"
+			}
+			w.Write([]byte(`<GetChangeResponse><ChangeInfo><Id>/change/C1</Id><Status>` + status + `</Status></ChangeInfo></GetChangeResponse>`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Code>InvalidInput</Code><Message>bad path</Message></Error></ErrorResponse>`))
+		}
+	}))
+	defer api.Close()
+
+	p, err := OpenDNSProvider("route53://Z0123456789ABC?endpoint=" + api.URL)
+	require.NoError(t, err)
+	d := p.(*Route53DNS)
+	d.Creds = awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	d.Poll = time.Millisecond
+
+	ctx := context.Background()
+	require.NoError(t, d.Present(ctx, "_acme-challenge.example.com.", "token"))
+	require.NoError(t, d.CleanUp(ctx, "_acme-challenge.example.com.", "token"))
+	assert.Equal(t, 4, polls, "each change waits to be in sync")
+	require.Len(t, changes, 2)
+	assert.Contains(t, changes[0], "<Action>UPSERT</Action><ResourceRecordSet><Name>_acme-challenge.example.com.</Name><Type>TXT</Type><TTL>60</TTL>"+
+		"<ResourceRecords><ResourceRecord><Value>&#34;token&#34;</Value>")
+	assert.Contains(t, changes[1], "<Action>DELETE</Action>")
+
+	d.ZoneID = "missing"
+	assert.EqualError(t, d.Present(ctx, "_acme-challenge.example.com.", "token"),
+		"route53 returned 400: InvalidInput: bad path")
+}
+
+func TestCloudflareDNS(t *testing.T) {
+	records := map[string]string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/zones/zone/dns_records":
+			var in struct{ Type, Name, Content string }
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+			assert.Equal(t, "TXT", in.Type)
+			records["rec1"] = in.Name + " " + in.Content
+			w.Write([]byte(`{"success":true,"result":{"id":"rec1"}}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/zones/zone/dns_records/rec1":
+			delete(records, "rec1")
+			w.Write([]byte(`{"success":true,"result":{"id":"rec1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"Could not route"}]}`))
+		}
+	}))
+	defer api.Close()
+
+	d := &CloudflareDNS{ZoneID: "zone", Token: "token", Endpoint: api.URL, Client: http.DefaultClient}
+	ctx := context.Background()
+	require.NoError(t, d.Present(ctx, "_acme-challenge.example.com.", "value"))
+	assert.Equal(t, map[string]string{"rec1": "_acme-challenge.example.com value"}, records)
+	require.NoError(t, d.CleanUp(ctx, "_acme-challenge.example.com.", "value"))
+	assert.Empty(t, records)
+	// nothing was made for this one
+	require.NoError(t, d.CleanUp(ctx, "_acme-challenge.example.com.", "value"))
+
+	d.ZoneID = "missing"
+	assert.EqualError(t, d.Present(ctx, "_acme-challenge.example.com.", "value"),
+		"cloudflare returned 404: Could not route")
+}
+
+func TestACMEIssuerDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	a := &acmeIssuer{Cache: dir}
+	now := time.Now()
+	assert.True(t, a.due(now), "nothing cached")
+
+	// the test keypair is for 127.0.0.1 and expires in an hour
+	writeKeyPair(t, filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "cached")
+	assert.False(t, a.due(now))
+	a.RenewBefore = 2 * time.Hour
+	assert.True(t, a.due(now), "expiring")
+	a.RenewBefore = 0
+	a.Domains = []string{"example.com"}
+	assert.True(t, a.due(now), "domain not covered")
+
+	key, err := a.accountKey()
+	require.NoError(t, err)
+	again, err := a.accountKey()
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), again.Public(), "account key is kept")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagExecCommand = kingpin.
+			Flag("exec-command", "command --sink exec runs with sh -c, given the json delivery on stdin").
+			Envar("EXEC_COMMAND").String()
+	flagExecWorker = kingpin.
+			Flag("exec-worker", "run --exec-command once and write each delivery to it as a line of json").
+			Envar("EXEC_WORKER").Bool()
+	flagExecConcurrency = kingpin.
+				Flag("exec-concurrency", "--exec-command runs at once, deliveries past this are dropped").
+				Envar("EXEC_CONCURRENCY").Default("4").Int()
+	flagExecTimeout = kingpin.
+			Flag("exec-timeout", "time each --exec-command run has before it is killed").
+			Envar("EXEC_TIMEOUT").Default("10s").Duration()
+)
+
+var metricExecDeliveries = NewCounterVec("exec_deliveries_total",
+	"deliveries handed to --exec-command by outcome", "outcome")
+
+// deliveries waiting on an --exec-worker before new ones are dropped
+const execWorkerQueue = 1000
+
+var errExecBusy = errors.New("exec sink busy, delivery dropped")
+
+func openExecSink() (Sink, error) {
+	if *flagExecCommand == "" {
+		return nil, errors.New("--sink exec needs --exec-command")
+	}
+	// the seccomp filter denies execve, every run would fail
+	if *flagHarden {
+		return nil, errors.New("--sink exec can not be used with --harden, which stops commands from running")
+	}
+	if *flagExecWorker {
+		s := NewExecWorkerSink(*flagExecCommand)
+		go s.Run()
+		return s, nil
+	}
+	return NewExecSink(*flagExecCommand, *flagExecConcurrency, *flagExecTimeout), nil
+}
+
+// ExecSink runs Command for each delivery, in the background, with the
+// delivery on stdin and its payload fields in SLACK_* environment
+// variables. Output goes to the proxy's stderr.
+type ExecSink struct {
+	Command string
+	Timeout time.Duration
+
+	slots chan struct{}
+}
+
+func NewExecSink(command string, concurrency int, timeout time.Duration) *ExecSink {
+	return &ExecSink{
+		Command: command,
+		Timeout: timeout,
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+func (s *ExecSink) Send(ctx context.Context, d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		metricExecDeliveries.Inc("dropped")
+		return errExecBusy
+	}
+
+	env := execEnv(d)
+	go func() {
+		defer func() { <-s.slots }()
+		if err := s.run(data, env); err != nil {
+			metricExecDeliveries.Inc("failed")
+			log.Printf("exec sink: %v", err)
+			return
+		}
+		metricExecDeliveries.Inc("ok")
+	}()
+	return nil
+}
+
+func (s *ExecSink) run(data []byte, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	// straight to the file, so a stray child holding them open can not keep
+	// run waiting past the timeout
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Run()
+}
+
+// execEnv describes d for scripts that only need to know what it is
+func execEnv(d *Delivery) []string {
+	env := []string{"SLACK_IDEMPOTENCY_KEY=" + d.IdempotencyKey()}
+	p, err := d.Payload(PayloadParserFunc(ParseSlackPayload))
+	if err != nil {
+		return env
+	}
+	return append(env,
+		"SLACK_KIND="+p.Kind,
+		"SLACK_TYPE="+p.Type,
+		"SLACK_TEAM_ID="+p.TeamID,
+		"SLACK_CHANNEL_ID="+p.ChannelID,
+		"SLACK_USER_ID="+p.UserID,
+	)
+}
+
+// ExecWorkerSink keeps one Command running and writes each delivery to its
+// stdin as a line of json. The command is restarted if it exits, losing
+// whatever it had read but not yet handled.
+type ExecWorkerSink struct {
+	Command string
+	Backoff time.Duration
+
+	lines   chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	close   sync.Once
+}
+
+func NewExecWorkerSink(command string) *ExecWorkerSink {
+	return &ExecWorkerSink{
+		Command: command,
+		Backoff: time.Second,
+		lines:   make(chan []byte, execWorkerQueue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (s *ExecWorkerSink) Send(ctx context.Context, d *Delivery) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.lines <- append(line, '\n'):
+		return nil
+	default:
+		metricExecDeliveries.Inc("dropped")
+		return errExecBusy
+	}
+}
+
+func (s *ExecWorkerSink) Run() {
+	defer close(s.stopped)
+	var pending []byte
+	for {
+		var err error
+		if pending, err = s.work(pending); err != nil {
+			log.Printf("exec worker: %v, restarting in %s", err, s.Backoff)
+		}
+		select {
+		case <-time.After(s.Backoff):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops Run, closing stdin of the running command and waiting for
+// it to exit. Run must have been started.
+func (s *ExecWorkerSink) Close() error {
+	s.close.Do(func() { close(s.done) })
+	<-s.stopped
+	return nil
+}
+
+// work runs the command until it exits, returning the line it could not
+// take so the next one gets it
+func (s *ExecWorkerSink) work(pending []byte) ([]byte, error) {
+	cmd := exec.Command("/bin/sh", "-c", s.Command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return pending, err
+	}
+	if err := cmd.Start(); err != nil {
+		return pending, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	// a command that stopped reading must not keep a write, and Close, hanging
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-s.done:
+			stdin.Close()
+		case <-finished:
+		}
+	}()
+
+	for {
+		if pending == nil {
+			select {
+			case pending = <-s.lines:
+			case err := <-exited:
+				return nil, exitError(err)
+			case <-s.done:
+				stdin.Close()
+				return nil, <-exited
+			}
+		}
+		if _, err := stdin.Write(pending); err != nil {
+			stdin.Close()
+			return pending, exitError(<-exited)
+		}
+		metricExecDeliveries.Inc("ok")
+		pending = nil
+	}
+}
+
+func exitError(err error) error {
+	if err == nil {
+		return errors.New("command exited")
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForFile polls until path has want lines
+func waitForFile(t *testing.T, path string, want int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		raw, err := ioutil.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+		if err == nil && len(lines) >= want {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never got %d lines: %q", path, want, raw)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := &Delivery{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   []byte(`{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message","channel":"C1"}}`),
+	}
+
+	s := NewExecSink(`cat > "$OUT/$SLACK_IDEMPOTENCY_KEY"; echo "$SLACK_KIND $SLACK_TYPE $SLACK_CHANNEL_ID" >> "$OUT/env"`,
+		1, time.Second)
+	os.Setenv("OUT", dir)
+	defer os.Unsetenv("OUT")
+	require.NoError(t, s.Send(context.Background(), d))
+	assert.Equal(t, []string{"event message C1"}, waitForFile(t, filepath.Join(dir, "env"), 1))
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "Ev1"))
+	require.NoError(t, err)
+	var got Delivery
+	require.NoError(t, json.Unmarshal(raw, &got))
+	assert.Equal(t, d.Body, got.Body)
+
+	// past the concurrency limit deliveries are dropped
+	slow := NewExecSink("sleep 5", 1, 100*time.Millisecond)
+	require.NoError(t, slow.Send(context.Background(), d))
+	assert.Equal(t, errExecBusy, slow.Send(context.Background(), d))
+
+	// and the timeout frees the slot again
+	before := metricExecDeliveries.Get("failed")
+	deadline := time.Now().Add(5 * time.Second)
+	for slow.Send(context.Background(), d) == errExecBusy {
+		require.True(t, time.Now().Before(deadline), "slot never freed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, metricExecDeliveries.Get("failed") > before)
+}
+
+func TestExecWorkerSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	s := NewExecWorkerSink(`cat >> "` + out + `"`)
+	defer s.Close()
+	go s.Run()
+	for _, id := range []string{"Ev1", "Ev2", "Ev3"} {
+		require.NoError(t, s.Send(context.Background(), &Delivery{
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   []byte(`{"type":"event_callback","event_id":"` + id + `","event":{"type":"message"}}`),
+		}))
+	}
+	lines := waitForFile(t, out, 3)
+	for i, id := range []string{"Ev1", "Ev2", "Ev3"} {
+		var got Delivery
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &got))
+		assert.Contains(t, string(got.Body), id)
+	}
+
+	// a worker that exits is started again
+	starts := filepath.Join(dir, "starts")
+	crashing := NewExecWorkerSink(`echo started >> "` + starts + `"; exit 1`)
+	crashing.Backoff = 10 * time.Millisecond
+	defer crashing.Close()
+	go crashing.Run()
+	waitForFile(t, starts, 3)
+
+	// close waits for the command to finish up
+	stopped := filepath.Join(dir, "stopped")
+	slow := NewExecWorkerSink(`cat > /dev/null; sleep 0.2; echo stopped > "` + stopped + `"`)
+	go slow.Run()
+	require.NoError(t, slow.Send(context.Background(), &Delivery{Body: []byte(`{}`)}))
+	require.NoError(t, slow.Close())
+	_, err = os.Stat(stopped)
+	assert.NoError(t, err)
+	require.NoError(t, slow.Close())
+}
+
+func TestOpenExecSink(t *testing.T) {
+	defer func(command string, harden bool) {
+		*flagExecCommand, *flagHarden = command, harden
+	}(*flagExecCommand, *flagHarden)
+
+	*flagExecCommand, *flagHarden = "", false
+	_, err := OpenSink("exec")
+	assert.EqualError(t, err, "--sink exec needs --exec-command")
+
+	*flagExecCommand, *flagHarden = "cat", true
+	_, err = OpenSink("exec")
+	assert.EqualError(t, err, "--sink exec can not be used with --harden, which stops commands from running")
+
+	*flagHarden = false
+	s, err := OpenSink("exec")
+	require.NoError(t, err)
+	assert.IsType(t, &ExecSink{}, s)
+}
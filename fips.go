@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagFIPS = kingpin.
+	Flag("fips", "refuse to start without a FIPS validated crypto backend or with TLS settings outside of FIPS").
+	Envar("FIPS").Bool()
+
+// checkFIPS makes sure the binary was built against a validated backend,
+// which takes building with GOEXPERIMENT=boringcrypto
+func checkFIPS() error {
+	if !fipsBackendEnabled() {
+		return errors.New("built without a FIPS crypto backend, build with GOEXPERIMENT=boringcrypto")
+	}
+	return nil
+}
+
+var fipsCipherSuites = map[uint16]bool{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+	tls.TLS_AES_128_GCM_SHA256:                  true,
+	tls.TLS_AES_256_GCM_SHA384:                  true,
+}
+
+// checkFIPSTLS rejects TLS settings a FIPS deployment may not use. Every
+// tls.Config the proxy builds from flags goes through it with --fips.
+func checkFIPSTLS(cfg *tls.Config) error {
+	if cfg.MinVersion < tls.VersionTLS12 {
+		return errors.New("fips: tls minimum version must be 1.2 or later")
+	}
+	for _, suite := range cfg.CipherSuites {
+		if !fipsCipherSuites[suite] {
+			return fmt.Errorf("fips: cipher suite %s is not approved", tls.CipherSuiteName(suite))
+		}
+	}
+	for _, curve := range cfg.CurvePreferences {
+		if curve != tls.CurveP256 && curve != tls.CurveP384 {
+			return fmt.Errorf("fips: curve %d is not approved", curve)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+	// limits every tls config in the process to FIPS settings
+	_ "crypto/tls/fipsonly"
+)
+
+func fipsBackendEnabled() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,8 @@
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package main
+
+func fipsBackendEnabled() bool {
+	return false
+}
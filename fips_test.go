@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFIPSTLS(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg *tls.Config
+		err string
+	}{
+		"approved": {cfg: &tls.Config{
+			MinVersion:       tls.VersionTLS12,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+		}},
+		"tls 1.3": {cfg: &tls.Config{MinVersion: tls.VersionTLS13}},
+		"default version": {
+			cfg: &tls.Config{},
+			err: "fips: tls minimum version must be 1.2 or later",
+		},
+		"chacha": {
+			cfg: &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+			},
+			err: "fips: cipher suite TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256 is not approved",
+		},
+		"x25519": {
+			cfg: &tls.Config{
+				MinVersion:       tls.VersionTLS12,
+				CurvePreferences: []tls.CurveID{tls.X25519},
+			},
+			err: "fips: curve 29 is not approved",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := checkFIPSTLS(tc.cfg)
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCheckFIPS(t *testing.T) {
+	assert.Equal(t, fipsBackendEnabled(), checkFIPS() == nil)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagHarden = kingpin.
+			Flag("harden", "restrict filesystem access and dangerous syscalls, like running commands, once started, linux only. Can not be used with --sink exec").
+			Envar("HARDEN").Bool()
+	flagHardenRead = kingpin.
+			Flag("harden-read", "extra path readable once hardened, repeatable").
+			Envar("HARDEN_READ").Strings()
+	flagHardenWrite = kingpin.
+			Flag("harden-write", "extra path writable once hardened, repeatable").
+			Envar("HARDEN_WRITE").Strings()
+)
+
+// hardenPaths lists what the proxy still needs to touch after startup.
+// Files are written by replacing them, so their whole directory has to be
+// writable, and files that are watched for such replacements need their
+// directory readable.
+func hardenPaths() (read, write []string) {
+	read = append([]string{"/etc"}, *flagHardenRead...)
+	for _, file := range []string{
+		*flagConfigFile,
+		*flagTLSCert,
+		*flagTLSKey,
+		*flagTLSClientCA,
+		*flagBackendCA,
+		*flagBackendCert,
+		*flagBackendKey,
+	} {
+		if file != "" {
+			read = append(read, file)
+		}
+	}
+	if *flagSlackTokenFile != "" {
+		read = append(read, filepath.Dir(*flagSlackTokenFile))
+	}
+	// the vault client is made on first use, and logs in again as tokens
+	// expire
+	if *flagVaultAddr != "" {
+		if *flagVaultCACert != "" {
+			read = append(read, *flagVaultCACert)
+		}
+		switch {
+		case *flagVaultKubernetesRole != "":
+			read = append(read, filepath.Dir(kubernetesServiceAccountToken))
+		case *flagVaultTokenFile != "":
+			read = append(read, filepath.Dir(*flagVaultTokenFile))
+		}
+	}
+	write = append(write, *flagHardenWrite...)
+	if *flagACMECache != "" {
+		write = append(write, *flagACMECache)
+	}
+	if *flagParkDir != "" {
+		write = append(write, *flagParkDir)
+	}
+	if *flagSpoolDir != "" {
+		write = append(write, *flagSpoolDir)
+	}
+	if *flagBodySpoolThreshold > 0 {
+		dir := *flagBodySpoolDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		write = append(write, dir)
+	}
+	for _, file := range []string{
+		*flagSecretStatsFile,
+		*flagBackfillStateFile,
+		*flagShadowArchive,
+		*flagAuditLog,
+		*flagUsageExport,
+	} {
+		if file != "" {
+			write = append(write, filepath.Dir(file))
+		}
+	}
+	return read, write
+}
+
+// preloadForHarden loads what the standard library would otherwise read
+// lazily from disk, from places that are not allowed once hardened
+func preloadForHarden() {
+	x509.SystemCertPool()
+	time.Now().Local().Zone()
+}
@@ -0,0 +1,188 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// harden locks the process down: once it returns the process can only read
+// and write below the given paths, and can no longer exec, ptrace, load
+// modules, mount and the like. There is no undoing it.
+func harden(read, write []string) error {
+	preloadForHarden()
+
+	// needed for unprivileged seccomp and landlock, and keeps any exec
+	// that slips through from gaining privileges
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL,
+		prSetNoNewPrivs, 1, 0); errno == syscall.ENOTSUP {
+		// cgo builds can not change every thread, seccomp syncs it below
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return fmt.Errorf("setting no_new_privs: %v", errno)
+		}
+	} else if errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %v", errno)
+	}
+
+	if err := landlock(read, write); err != nil {
+		return err
+	}
+	return seccompDeny(deniedSyscalls)
+}
+
+const (
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000 // same on amd64 and arm64
+
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockRulePathBeneath = 1
+)
+
+// landlock filesystem rights from the first version of the abi
+const (
+	llExecute = 1 << iota
+	llWriteFile
+	llReadFile
+	llReadDir
+	llRemoveDir
+	llRemoveFile
+	llMakeChar
+	llMakeDir
+	llMakeReg
+	llMakeSock
+	llMakeFifo
+	llMakeBlock
+	llMakeSym
+
+	llAll       = 1<<13 - 1
+	llFileRead  = llReadFile
+	llFileWrite = llReadFile | llWriteFile
+	llDirRead   = llReadFile | llReadDir
+	llDirWrite  = llDirRead | llWriteFile | llRemoveFile | llMakeReg
+)
+
+// landlock limits the filesystem to the given paths. Kernels without
+// landlock, and cgo builds that can not restrict every thread, are left
+// unrestricted with a warning.
+func landlock(read, write []string) error {
+	handled := uint64(llAll)
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+		log.Printf("harden: kernel has no landlock, filesystem is not restricted")
+		return nil
+	} else if errno != 0 {
+		return fmt.Errorf("creating landlock ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, rule := range []struct {
+		paths     []string
+		dir, file uint64
+	}{
+		{read, llDirRead, llFileRead},
+		{write, llDirWrite, llFileWrite},
+	} {
+		for _, path := range rule.paths {
+			if err := landlockAllow(int(fd), path, rule.dir, rule.file); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, _, errno = syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0)
+	if errno == syscall.ENOTSUP {
+		log.Printf("harden: landlock needs a build with CGO_ENABLED=0, filesystem is not restricted")
+		return nil
+	} else if errno != 0 {
+		return fmt.Errorf("enforcing landlock: %v", errno)
+	}
+	return nil
+}
+
+func landlockAllow(rulesetFD int, path string, dirAccess, fileAccess uint64) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	access := fileAccess
+	if info.IsDir() {
+		access = dirAccess
+	}
+
+	pathFD, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer syscall.Close(pathFD)
+
+	// struct landlock_path_beneath_attr is packed, 12 bytes
+	var attr [12]byte
+	binary.LittleEndian.PutUint64(attr[:8], access)
+	binary.LittleEndian.PutUint32(attr[8:], uint32(pathFD))
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFD),
+		landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("allowing %s: %v", path, errno)
+	}
+	return nil
+}
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+
+	// offsets into struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// syscall numbers at or above this are the x32 abi on amd64
+	x32SyscallBit = 0x40000000
+)
+
+// seccompDeny makes the listed syscalls fail with EPERM on every thread.
+func seccompDeny(denied []uintptr) error {
+	deny := uint8(len(denied) + 1)
+	prog := []syscall.SockFilter{
+		// other architectures and abis get nothing
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataArch},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: auditArch, Jt: 1},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataNr},
+		{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, K: x32SyscallBit, Jt: deny},
+	}
+	for i, nr := range denied {
+		prog = append(prog, syscall.SockFilter{
+			Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K,
+			K:    uint32(nr),
+			Jt:   deny - uint8(i) - 1,
+		})
+	}
+	prog = append(prog,
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)},
+	)
+
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, errno := syscall.Syscall(sysSeccomp, seccompSetModeFilter,
+		seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("installing seccomp filter: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+const (
+	auditArch  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp = 317
+)
+
+// deniedSyscalls are never needed by a running proxy, but are what an
+// attacker who got code running in it would reach for
+var deniedSyscalls = []uintptr{
+	59,  // execve
+	322, // execveat
+	101, // ptrace
+	310, // process_vm_readv
+	311, // process_vm_writev
+	165, // mount
+	166, // umount2
+	155, // pivot_root
+	161, // chroot
+	272, // unshare
+	308, // setns
+	175, // init_module
+	313, // finit_module
+	176, // delete_module
+	246, // kexec_load
+	320, // kexec_file_load
+	321, // bpf
+	298, // perf_event_open
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	169, // reboot
+	167, // swapon
+	168, // swapoff
+}
@@ -0,0 +1,35 @@
+package main
+
+const (
+	auditArch  = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp = 277
+)
+
+// deniedSyscalls are never needed by a running proxy, but are what an
+// attacker who got code running in it would reach for
+var deniedSyscalls = []uintptr{
+	221, // execve
+	281, // execveat
+	117, // ptrace
+	270, // process_vm_readv
+	271, // process_vm_writev
+	40,  // mount
+	39,  // umount2
+	41,  // pivot_root
+	51,  // chroot
+	97,  // unshare
+	268, // setns
+	105, // init_module
+	273, // finit_module
+	106, // delete_module
+	104, // kexec_load
+	294, // kexec_file_load
+	280, // bpf
+	241, // perf_event_open
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	142, // reboot
+	224, // swapon
+	225, // swapoff
+}
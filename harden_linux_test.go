@@ -0,0 +1,46 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHardenedProcess is not a real test, hardening can not be undone so
+// TestHarden runs it in a process of its own
+func TestHardenedProcess(t *testing.T) {
+	dir := os.Getenv("GO_TEST_HARDEN")
+	if dir == "" {
+		t.Skip("only run hardened")
+	}
+	require.NoError(t, harden(nil, []string{dir}))
+
+	assert.NoError(t, writeFileAtomic(filepath.Join(dir, "state"), []byte("ok")))
+	err := exec.Command("/bin/true").Run()
+	assert.True(t, os.IsPermission(err), "exec should be denied, got %v", err)
+}
+
+func TestHarden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harden")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHardenedProcess$", "-test.v")
+	cmd.Env = append(os.Environ(), "GO_TEST_HARDEN="+dir)
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	assert.Contains(t, string(out), "--- PASS: TestHardenedProcess")
+
+	state, err := ioutil.ReadFile(filepath.Join(dir, "state"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(state))
+}
@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import "errors"
+
+func harden(read, write []string) error {
+	return errors.New("--harden is only supported on linux amd64 and arm64")
+}
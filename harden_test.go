@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardenPaths(t *testing.T) {
+	defer func(tokens, addr, ca, role, vaultToken string) {
+		*flagSlackTokenFile, *flagVaultAddr, *flagVaultCACert = tokens, addr, ca
+		*flagVaultKubernetesRole, *flagVaultTokenFile = role, vaultToken
+	}(*flagSlackTokenFile, *flagVaultAddr, *flagVaultCACert, *flagVaultKubernetesRole, *flagVaultTokenFile)
+	defer func(clientCA, backendCA string) {
+		*flagTLSClientCA, *flagBackendCA = clientCA, backendCA
+	}(*flagTLSClientCA, *flagBackendCA)
+	*flagTLSClientCA, *flagBackendCA = "/etc/ssl/clients.pem", "/srv/backend/ca.pem"
+	*flagSlackTokenFile = "/run/secrets/slack/tokens"
+	*flagVaultAddr, *flagVaultCACert = "https://vault:8200", "/etc/vault/ca.pem"
+	*flagVaultKubernetesRole, *flagVaultTokenFile = "", "/run/vault/agent/token"
+
+	read, _ := hardenPaths()
+	// the directory, so a replaced file is still readable
+	assert.Contains(t, read, "/run/secrets/slack")
+	assert.Contains(t, read, "/etc/ssl/clients.pem")
+	assert.Contains(t, read, "/srv/backend/ca.pem")
+	assert.Contains(t, read, "/etc/vault/ca.pem")
+	assert.Contains(t, read, "/run/vault/agent")
+
+	*flagVaultKubernetesRole = "proxy"
+	read, _ = hardenPaths()
+	assert.Contains(t, read, "/var/run/secrets/kubernetes.io/serviceaccount")
+}
+
+func TestHardenPathsWrite(t *testing.T) {
+	defer func(spool string) { *flagSpoolDir = spool }(*flagSpoolDir)
+	*flagSpoolDir = "/var/spool/slack"
+
+	_, write := hardenPaths()
+	assert.Contains(t, write, "/var/spool/slack")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var flagHTTP3 = kingpin.
+	Flag("http3", "also serve HTTP/3 over QUIC on the udp side of each --listen address, experimental, needs tls").
+	Envar("HTTP3").Bool()
+
+// listenHTTP3 opens a udp socket for each tcp address
+func listenHTTP3(addrs []*net.TCPAddr) ([]net.PacketConn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("--http3 needs a --listen address")
+	}
+	var conns []net.PacketConn
+	for _, addr := range addrs {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+		if err != nil {
+			for _, each := range conns {
+				each.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// newHTTP3Server serves h over QUIC, with the keypair and client
+// certificate checks of cfg
+func newHTTP3Server(h http.Handler, cfg *tls.Config) *http3.Server {
+	return &http3.Server{Handler: h, TLSConfig: http3.ConfigureTLSConfig(cfg)}
+}
+
+// AltSvcHandler tells clients coming in over tcp that HTTP/3 is served on
+// port as well
+func AltSvcHandler(child http.Handler, port int) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		child.ServeHTTP(w, r)
+	})
+}
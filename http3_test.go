@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAltSvcHandler(t *testing.T) {
+	h := AltSvcHandler(StatusHandler(http.StatusOK, "ok"), 8443)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, `h3=":8443"; ma=86400`, w.Header().Get("Alt-Svc"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.ProtoMajor = 3
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Empty(t, w.Header().Get("Alt-Svc"))
+}
+
+func TestHTTP3Server(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http3")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "http3")
+
+	certs, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	cfg, err := tlsConfig(certs, nil, false)
+	require.NoError(t, err)
+
+	conns, err := listenHTTP3([]*net.TCPAddr{{IP: net.ParseIP("127.0.0.1")}})
+	require.NoError(t, err)
+	require.Len(t, conns, 1)
+	srv := newHTTP3Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), cfg)
+	go srv.Serve(conns[0])
+	defer srv.Close()
+
+	pem, err := ioutil.ReadFile(certFile)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(pem))
+	rt := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer rt.Close()
+
+	resp, err := (&http.Client{Transport: rt}).Get("https://" + conns[0].LocalAddr().String() + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/3.0", string(body))
+
+	_, err = listenHTTP3(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagSinkQueue = kingpin.
+			Flag("sink-queue", "deliveries each sink holds while it is slow or down, before new ones are dropped").
+			Envar("SINK_QUEUE").Default("1000").Int()
+	flagSinkRetries = kingpin.
+			Flag("sink-retries", "times a sink is retried on a delivery before it is given up on").
+			Envar("SINK_RETRIES").Default("3").Int()
+	flagSinkTimeout = kingpin.
+			Flag("sink-timeout", "time a sink has to take each delivery").
+			Envar("SINK_TIMEOUT").Default("10s").Duration()
+	flagSinkBreakerFailures = kingpin.
+				Flag("sink-breaker-failures", "failures in a row that stop sending to a sink for --sink-breaker-cooldown").
+				Envar("SINK_BREAKER_FAILURES").Default("5").Int()
+	flagSinkBreakerCooldown = kingpin.
+				Flag("sink-breaker-cooldown", "time a broken sink is left alone before it is tried again").
+				Envar("SINK_BREAKER_COOLDOWN").Default("30s").Duration()
+)
+
+var (
+	metricSinkDeliveries = NewCounterVec("sink_deliveries_total",
+		"deliveries to each sink by outcome", "sink", "outcome")
+	metricSinkQueueDepth = NewGaugeVec("sink_queue_depth",
+		"deliveries waiting on each sink", "sink")
+	metricSinkBreakerOpen = NewGaugeVec("sink_breaker_open",
+		"1 while a sink's circuit breaker is holding deliveries back", "sink")
+)
+
+var errSinkQueueFull = errors.New("sink queue full, delivery dropped")
+
+// IsolatedSink gives Sink its own queue and worker, so a slow or broken
+// sink never holds up the request that fed it or the other sinks. Failed
+// deliveries are retried with a backoff, and a sink that keeps failing is
+// left alone for a cooldown rather than being hammered.
+type IsolatedSink struct {
+	Name    string
+	Sink    Sink
+	Retries int
+	Timeout time.Duration
+	Breaker *circuitBreaker
+	Backoff time.Duration
+
+	queue    chan *Delivery
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewIsolatedSink(name string, sink Sink, queue, retries int, timeout time.Duration, breaker *circuitBreaker) *IsolatedSink {
+	return &IsolatedSink{
+		Name:    name,
+		Sink:    sink,
+		Retries: retries,
+		Timeout: timeout,
+		Breaker: breaker,
+		Backoff: 100 * time.Millisecond,
+		queue:   make(chan *Delivery, queue),
+		done:    make(chan struct{}),
+	}
+}
+
+// isolateSink wraps sink with the --sink-* flags
+func isolateSink(name string, sink Sink) *IsolatedSink {
+	s := NewIsolatedSink(name, sink, *flagSinkQueue, *flagSinkRetries, *flagSinkTimeout,
+		newCircuitBreaker(*flagSinkBreakerFailures, *flagSinkBreakerCooldown))
+	go s.Run()
+	return s
+}
+
+// Send queues d and returns straight away. Every sink is handed the same
+// delivery, so each queues its own copy.
+func (s *IsolatedSink) Send(ctx context.Context, d *Delivery) error {
+	copied := *d
+	select {
+	case s.queue <- &copied:
+		metricSinkQueueDepth.Set(float64(len(s.queue)), s.Name)
+		return nil
+	case <-s.done:
+		return errors.New("sink closed")
+	default:
+		metricSinkDeliveries.Inc(s.Name, "dropped")
+		return errSinkQueueFull
+	}
+}
+
+func (s *IsolatedSink) Run() {
+	for {
+		select {
+		case d := <-s.queue:
+			metricSinkQueueDepth.Set(float64(len(s.queue)), s.Name)
+			s.deliver(d)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops Run, dropping whatever is still queued.
+func (s *IsolatedSink) Close() error {
+	s.stopOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *IsolatedSink) deliver(d *Delivery) {
+	for attempt := 0; ; attempt++ {
+		if wait := s.Breaker.wait(time.Now()); wait > 0 {
+			metricSinkBreakerOpen.Set(1, s.Name)
+			if !s.sleep(wait) {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		err := s.Sink.Send(ctx, d)
+		cancel()
+		if err == nil {
+			s.Breaker.success()
+			metricSinkBreakerOpen.Set(0, s.Name)
+			metricSinkDeliveries.Inc(s.Name, "sent")
+			return
+		}
+		if s.Breaker.failure(time.Now()) {
+			log.Printf("sink %s: %v, holding deliveries for %s", s.Name, err, s.Breaker.cooldown)
+		}
+		if attempt >= s.Retries {
+			metricSinkDeliveries.Inc(s.Name, "failed")
+			log.Printf("sink %s: %v, giving up after %d attempts", s.Name, err, attempt+1)
+			return
+		}
+		metricSinkDeliveries.Inc(s.Name, "retried")
+		if !s.sleep(s.Backoff << uint(attempt)) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, returning false if the sink was closed meanwhile
+func (s *IsolatedSink) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// circuitBreaker opens after threshold failures in a row, and lets one
+// attempt through once cooldown has passed. That attempt failing opens it
+// again straight away.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// wait is how long until the next attempt is allowed
+func (b *circuitBreaker) wait(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now)
+	}
+	return 0
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// failure records a failed attempt, and returns true if it opened the
+// breaker
+func (b *circuitBreaker) failure(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold < 1 || b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsolatedSinkStuck(t *testing.T) {
+	release := make(chan struct{})
+	stuck := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		<-release
+		return nil
+	})
+	s := NewIsolatedSink("stuck", stuck, 2, 0, time.Second, newCircuitBreaker(5, time.Minute))
+	go s.Run()
+	defer s.Close()
+	defer close(release)
+
+	// one being sent, two queued, and then the queue is full
+	errs := make(chan error, 4)
+	go func() {
+		for i := 0; i < 4; i++ {
+			errs <- s.Send(context.Background(), &Delivery{})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	var got []error
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-errs:
+			got = append(got, err)
+		case <-time.After(time.Second):
+			t.Fatal("a stuck sink blocked Send")
+		}
+	}
+	assert.Equal(t, []error{nil, nil, nil, errSinkQueueFull}, got)
+}
+
+func TestIsolatedSinkRetries(t *testing.T) {
+	attempts := make(chan int, 10)
+	failures := 2
+	flaky := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		attempts <- 1
+		if failures > 0 {
+			failures--
+			return errors.New("flaky")
+		}
+		return nil
+	})
+	s := NewIsolatedSink("flaky", flaky, 10, 3, time.Second, newCircuitBreaker(0, time.Minute))
+	s.Backoff = time.Millisecond
+	before := metricSinkDeliveries.Get("flaky", "sent")
+
+	s.deliver(&Delivery{})
+	assert.Len(t, attempts, 3)
+	assert.Equal(t, before+1, metricSinkDeliveries.Get("flaky", "sent"))
+	assert.Equal(t, float64(2), metricSinkDeliveries.Get("flaky", "retried"))
+}
+
+func TestIsolatedSinkBreaker(t *testing.T) {
+	calls := 0
+	broken := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		calls++
+		return errors.New("broken")
+	})
+	s := NewIsolatedSink("broken", broken, 10, 1, time.Second, newCircuitBreaker(2, time.Hour))
+	s.Backoff = time.Millisecond
+
+	s.deliver(&Delivery{})
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, float64(1), metricSinkDeliveries.Get("broken", "failed"))
+
+	// the next delivery waits out the cooldown rather than trying again
+	done := make(chan struct{})
+	go func() {
+		s.deliver(&Delivery{})
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	<-done
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, float64(1), metricSinkBreakerOpen.Get("broken"))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute)
+	assert.False(t, b.failure(now))
+	assert.False(t, b.failure(now))
+	b.success()
+	assert.False(t, b.failure(now))
+	assert.False(t, b.failure(now))
+	assert.Zero(t, b.wait(now))
+
+	require.True(t, b.failure(now))
+	assert.Equal(t, time.Minute, b.wait(now))
+	assert.Equal(t, 30*time.Second, b.wait(now.Add(30*time.Second)))
+	assert.Zero(t, b.wait(now.Add(time.Minute)))
+
+	// the attempt let through after the cooldown opens it again
+	later := now.Add(time.Minute)
+	assert.True(t, b.failure(later))
+	assert.Equal(t, time.Minute, b.wait(later))
+}
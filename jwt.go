@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagJWKSCacheTTL = kingpin.
+	Flag("jwks-cache-ttl", "how long fetched json web key sets are trusted").
+	Envar("JWKS_CACHE_TTL").Default("1h").Duration()
+
+var metricJWTFailures = NewCounterVec("jwt_verify_failures_total",
+	"requests that failed jwt verification", "reason")
+
+// JWTConfig verifies bearer tokens against a json web key set, as used by
+// slack's openid flows. Tokens must be for Issuer and Audience.
+type JWTConfig struct {
+	JWKSURL  string `json:"jwks_url"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+}
+
+func (jc *JWTConfig) validate() error {
+	u, err := url.Parse(jc.JWKSURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("bad jwks_url %q", jc.JWKSURL)
+	}
+	// without them any token the key set ever signed, for anything, would do
+	if jc.Issuer == "" || jc.Audience == "" {
+		return fmt.Errorf("jwt needs an issuer and an audience")
+	}
+	return nil
+}
+
+// JWKSCache fetches a key set and keeps it for TTL. A token signed by a key
+// it has not seen triggers a refetch, at most once a minute. While the set
+// can not be fetched the last one is kept.
+type JWKSCache struct {
+	URL    string
+	TTL    time.Duration
+	Client *http.Client
+
+	sets        *Cache
+	mu          sync.Mutex
+	lastAttempt time.Time
+}
+
+func NewJWKSCache(u string, ttl time.Duration) *JWKSCache {
+	return &JWKSCache{
+		URL:    u,
+		TTL:    ttl,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		sets:   NewCache("jwks", 1, ttl),
+	}
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *JWKSCache) Key(kid string) (crypto.PublicKey, error) {
+	set, err := c.sets.Load(c.URL, c.fetch)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := set.(map[string]crypto.PublicKey)[kid]; ok {
+		return key, nil
+	}
+
+	c.mu.Lock()
+	retry := time.Since(c.lastAttempt) > time.Minute
+	c.mu.Unlock()
+	if retry {
+		if fetched, err := c.fetch(); err == nil {
+			c.sets.Set(c.URL, fetched)
+			set = fetched
+		}
+	}
+	if key, ok := set.(map[string]crypto.PublicKey)[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (c *JWKSCache) fetch() (interface{}, error) {
+	c.mu.Lock()
+	c.lastAttempt = time.Now()
+	c.mu.Unlock()
+	resp, err := c.Client.Get(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks returned %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			// skip key types we can not use rather than failing the set
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+var (
+	errJWTMalformed = errors.New("malformed token")
+	errJWTSignature = errors.New("bad token signature")
+	errJWTExpired   = errors.New("token expired")
+	errJWTClaims    = errors.New("token issuer or audience mismatch")
+)
+
+// JWTVerifier checks tokens against the keys in Keys.
+type JWTVerifier struct {
+	Keys     *JWKSCache
+	Issuer   string
+	Audience string
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+// Verify returns the claims of a valid token.
+func (v *JWTVerifier) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	key, err := v.Keys.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" ||
+			rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errJWTSignature
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 || !ecdsa.Verify(key, digest[:],
+			new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errJWTSignature
+		}
+	default:
+		return nil, errJWTSignature
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt || now.Unix() < claims.NotBefore {
+		return nil, errJWTExpired
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, errJWTClaims
+	}
+	if v.Audience != "" && !audienceContains(claims.Audience, v.Audience) {
+		return nil, errJWTClaims
+	}
+
+	var all map[string]interface{}
+	decodeJWTPart(parts[1], &all)
+	return all, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// audiences may be a single string or a list
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		return containsString(many, audience)
+	}
+	return false
+}
+
+// JWTHandler only lets requests with a valid bearer token through to child.
+func JWTHandler(child http.Handler, v *JWTVerifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			metricJWTFailures.Inc("missing")
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+
+		_, err := v.Verify(strings.TrimPrefix(auth, "Bearer "), time.Now())
+		switch err {
+		case nil:
+			child.ServeHTTP(w, r)
+		case errJWTMalformed:
+			metricJWTFailures.Inc("malformed")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errJWTSignature:
+			metricJWTFailures.Inc("signature")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errJWTExpired:
+			metricJWTFailures.Inc("expired")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errJWTClaims:
+			metricJWTFailures.Inc("claims")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			metricJWTFailures.Inc("key")
+			http.Error(w, "verification failed", http.StatusUnauthorized)
+		}
+	})
+}
+
+// jwtRoutes picks out routes verified by jwt, each wrapping the shared
+// forward handler in place of slack signature verification
+func jwtRoutes(config *Config, forward http.Handler) []PathRoute {
+	var routes []PathRoute
+	for _, rc := range config.Routes {
+		if rc.JWT == nil {
+			continue
+		}
+		routes = append(routes, PathRoute{
+			Prefix: rc.Path,
+			Handler: JWTHandler(forward, &JWTVerifier{
+				Keys:     NewJWKSCache(rc.JWT.JWKSURL, *flagJWKSCacheTTL),
+				Issuer:   rc.JWT.Issuer,
+				Audience: rc.JWT.Audience,
+			}),
+		})
+	}
+	return routes
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(raw []byte) string {
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func signJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := b64(header) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJWTHandler(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA",
+				"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec", "kty": "EC", "crv": "P-256",
+				"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kid": "okp", "kty": "OKP", "crv": "Ed25519", "x": "AAAA"},
+		}})
+	}))
+	defer jwks.Close()
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	h := JWTHandler(backend, &JWTVerifier{
+		Keys:     NewJWKSCache(jwks.URL, time.Hour),
+		Issuer:   "https://slack.com",
+		Audience: "A123",
+	})
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"iss": "https://slack.com", "aud": "A123", "exp": now + 60}
+
+	for _, tc := range []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{name: "rsa", auth: "Bearer " + signJWT(t, rsaKey, "RS256", "rsa", valid),
+			status: http.StatusOK},
+		{name: "ec", auth: "Bearer " + signJWT(t, ecKey, "ES256", "ec", valid),
+			status: http.StatusOK},
+		{name: "audience list", status: http.StatusOK,
+			auth: "Bearer " + signJWT(t, rsaKey, "RS256", "rsa", map[string]interface{}{
+				"iss": "https://slack.com", "aud": []string{"B456", "A123"}, "exp": now + 60})},
+		{name: "missing", status: http.StatusUnauthorized},
+		{name: "malformed", auth: "Bearer abc.def", status: http.StatusBadRequest},
+		{name: "wrong key", auth: "Bearer " + signJWT(t, otherKey, "RS256", "rsa", valid),
+			status: http.StatusUnauthorized},
+		{name: "unknown kid", auth: "Bearer " + signJWT(t, otherKey, "RS256", "other", valid),
+			status: http.StatusUnauthorized},
+		{name: "alg mismatch", auth: "Bearer " + signJWT(t, rsaKey, "RS256", "ec", valid),
+			status: http.StatusUnauthorized},
+		{name: "expired", status: http.StatusUnauthorized,
+			auth: "Bearer " + signJWT(t, rsaKey, "RS256", "rsa", map[string]interface{}{
+				"iss": "https://slack.com", "aud": "A123", "exp": now - 60})},
+		{name: "wrong audience", status: http.StatusUnauthorized,
+			auth: "Bearer " + signJWT(t, rsaKey, "RS256", "rsa", map[string]interface{}{
+				"iss": "https://slack.com", "aud": "B456", "exp": now + 60})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/openid", nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+		})
+	}
+
+	// unknown kids only refetch once a minute has passed since the last fetch
+	assert.Equal(t, 1, fetches)
+}
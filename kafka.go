@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagKafkaBrokers = kingpin.
+				Flag("kafka-broker", "bootstrap broker for --sink kafka or --output kafka, like kafka-1:9092, repeatable").
+				Envar("KAFKA_BROKERS").Strings()
+	flagKafkaTopic = kingpin.
+			Flag("kafka-topic", "topic deliveries are produced to").
+			Envar("KAFKA_TOPIC").String()
+	flagKafkaTLS = kingpin.
+			Flag("kafka-tls", "connect to the brokers with tls").
+			Envar("KAFKA_TLS").Bool()
+	flagKafkaTimeout = kingpin.
+				Flag("kafka-timeout", "time the brokers have to acknowledge each delivery").
+				Envar("KAFKA_TIMEOUT").Default("5s").Duration()
+)
+
+var metricKafkaDeliveries = NewCounterVec("kafka_deliveries_total",
+	"deliveries produced to kafka by outcome", "outcome")
+
+// KafkaSink produces each delivery to a kafka topic and waits for all in
+// sync replicas to have it. The record is the json encoded delivery, keyed
+// with --partition-key, and partitioned the way the java client does, so
+// a key lands on the same partition whichever producer sent it.
+type KafkaSink struct {
+	Brokers []string
+	Topic   string
+	Key     *PartitionKey
+	TLS     *tls.Config
+	Timeout time.Duration
+
+	mu          sync.Mutex
+	correlation int32
+	// from the last metadata request, empty until one succeeds
+	leaders []int32
+	addrs   map[int32]string
+	conns   map[int32]*kafkaConn
+}
+
+func openKafkaSink() (Sink, error) {
+	if len(*flagKafkaBrokers) == 0 || *flagKafkaTopic == "" {
+		return nil, errors.New("kafka needs --kafka-broker and --kafka-topic")
+	}
+	s := NewKafkaSink(*flagKafkaBrokers, *flagKafkaTopic, partitionKey)
+	s.Timeout = *flagKafkaTimeout
+	if *flagKafkaTLS {
+		s.TLS = &tls.Config{}
+	}
+	return s, nil
+}
+
+func NewKafkaSink(brokers []string, topic string, key *PartitionKey) *KafkaSink {
+	return &KafkaSink{
+		Brokers: brokers,
+		Topic:   topic,
+		Key:     key,
+		Timeout: 5 * time.Second,
+		conns:   map[int32]*kafkaConn{},
+	}
+}
+
+func (s *KafkaSink) Send(ctx context.Context, d *Delivery) error {
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	key := []byte(s.Key.Key(d))
+	batch := kafkaRecordBatch(key, value, time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// leadership moves and idle connections get dropped, so a failure
+	// on what was already known gets a second try with fresh metadata
+	for attempt := 0; ; attempt++ {
+		fresh := len(s.leaders) == 0
+		err = s.produce(key, batch)
+		if err == nil {
+			metricKafkaDeliveries.Inc("acknowledged")
+			return nil
+		}
+		s.reset()
+		if fresh || attempt > 0 {
+			metricKafkaDeliveries.Inc("failed")
+			return err
+		}
+	}
+}
+
+// Close drops the broker connections
+func (s *KafkaSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	return nil
+}
+
+// reset forgets the metadata and closes every connection
+func (s *KafkaSink) reset() {
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+	s.conns = map[int32]*kafkaConn{}
+	s.leaders = nil
+}
+
+// produce is called with mu held
+func (s *KafkaSink) produce(key, batch []byte) error {
+	if len(s.leaders) == 0 {
+		if err := s.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	partition := int32(kafkaMurmur2(key)&0x7fffffff) % int32(len(s.leaders))
+	c, err := s.conn(s.leaders[partition])
+	if err != nil {
+		return err
+	}
+
+	req := appendKafkaInt16(nil, -1) // no transactional id
+	req = appendKafkaInt16(req, -1)  // acks from all in sync replicas
+	req = appendKafkaInt32(req, int32(s.Timeout/time.Millisecond))
+	req = appendKafkaInt32(req, 1)
+	req = appendKafkaString(req, s.Topic)
+	req = appendKafkaInt32(req, 1)
+	req = appendKafkaInt32(req, partition)
+	req = appendKafkaInt32(req, int32(len(batch)))
+	req = append(req, batch...)
+
+	resp, err := s.roundTrip(c, kafkaProduce, 3, req)
+	if err != nil {
+		return err
+	}
+	// responses [name, partitions [index, error, base offset, append time]]
+	r := &kafkaReader{b: resp}
+	for topics := r.int32(); topics > 0; topics-- {
+		r.string()
+		for partitions := r.int32(); partitions > 0; partitions-- {
+			r.int32()
+			if code := r.int16(); code != 0 && r.err == nil {
+				return kafkaError(code)
+			}
+			r.int64()
+			r.int64()
+		}
+	}
+	return r.err
+}
+
+// refreshMetadata asks the bootstrap brokers, in turn, where the leader of
+// each partition of the topic is. It is called with mu held.
+func (s *KafkaSink) refreshMetadata() error {
+	req := appendKafkaInt32(nil, 1)
+	req = appendKafkaString(req, s.Topic)
+	req = append(req, 0) // do not create the topic
+
+	var last error
+	for _, broker := range s.Brokers {
+		c, err := dialKafka(broker, s.TLS, s.Timeout)
+		if err != nil {
+			last = err
+			continue
+		}
+		resp, err := s.roundTrip(c, kafkaMetadata, 4, req)
+		c.conn.Close()
+		if err != nil {
+			last = err
+			continue
+		}
+		return s.parseMetadata(resp)
+	}
+	return fmt.Errorf("kafka metadata: %v", last)
+}
+
+func (s *KafkaSink) parseMetadata(resp []byte) error {
+	r := &kafkaReader{b: resp}
+	r.int32() // throttle time
+	addrs := map[int32]string{}
+	for brokers := r.int32(); brokers > 0 && r.err == nil; brokers-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster id
+	r.int32()  // controller id
+
+	var leaders []int32
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		code, name := r.int16(), r.string()
+		r.bool()
+		if r.err == nil && name == s.Topic && code != 0 {
+			return fmt.Errorf("topic %s: %v", s.Topic, kafkaError(code))
+		}
+		partitions := r.int32()
+		if name == s.Topic && partitions > 0 {
+			leaders = make([]int32, partitions)
+		}
+		for ; partitions > 0 && r.err == nil; partitions-- {
+			r.int16()
+			index, leader := r.int32(), r.int32()
+			r.int32Array()
+			r.int32Array()
+			if name == s.Topic && index >= 0 && int(index) < len(leaders) {
+				leaders[index] = leader
+			}
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s has no partitions", s.Topic)
+	}
+	s.leaders, s.addrs = leaders, addrs
+	return nil
+}
+
+// conn is the connection to broker node, dialed if need be
+func (s *KafkaSink) conn(node int32) (*kafkaConn, error) {
+	if c, ok := s.conns[node]; ok {
+		return c, nil
+	}
+	addr, ok := s.addrs[node]
+	if !ok {
+		return nil, kafkaError(kafkaLeaderNotAvailable)
+	}
+	c, err := dialKafka(addr, s.TLS, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.conns[node] = c
+	return c, nil
+}
+
+// roundTrip sends one request and reads its response body
+func (s *KafkaSink) roundTrip(c *kafkaConn, api, version int16, body []byte) ([]byte, error) {
+	s.correlation++
+	id := s.correlation
+	c.conn.SetDeadline(time.Now().Add(2 * s.Timeout))
+
+	header := appendKafkaInt16(nil, api)
+	header = appendKafkaInt16(header, version)
+	header = appendKafkaInt32(header, id)
+	header = appendKafkaString(header, "slack_events_proxy")
+	msg := appendKafkaInt32(nil, int32(len(header)+len(body)))
+	msg = append(append(msg, header...), body...)
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != id {
+		return nil, errors.New("kafka response out of order")
+	}
+	return resp[4:], nil
+}
+
+// kafka api keys, and the few error codes worth naming
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+
+	kafkaLeaderNotAvailable = 5
+
+	kafkaMaxResponse = 64 << 20
+)
+
+var kafkaErrors = map[int16]string{
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader or follower",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+}
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if msg, ok := kafkaErrors[int16(e)]; ok {
+		return "kafka: " + msg
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialKafka(addr string, cfg *tls.Config, timeout time.Duration) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if cfg != nil {
+		cfg = cfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// read reads one size prefixed message
+func (c *kafkaConn) read() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > kafkaMaxResponse {
+		return nil, errors.New("kafka response too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(c.r, msg)
+	return msg, err
+}
+
+// kafkaRecordBatch is a v2 record batch holding one record
+func kafkaRecordBatch(key, value []byte, now time.Time) []byte {
+	record := []byte{0}                   // attributes
+	record = appendKafkaVarint(record, 0) // timestamp delta
+	record = appendKafkaVarint(record, 0) // offset delta
+	record = appendKafkaVarint(record, int64(len(key)))
+	record = append(record, key...)
+	record = appendKafkaVarint(record, int64(len(value)))
+	record = append(record, value...)
+	record = appendKafkaVarint(record, 0) // headers
+
+	ts := now.UnixNano() / int64(time.Millisecond)
+	// everything the crc covers, from the attributes on
+	body := appendKafkaInt16(nil, 0)  // attributes, no compression
+	body = appendKafkaInt32(body, 0)  // last offset delta
+	body = appendKafkaInt64(body, ts) // first timestamp
+	body = appendKafkaInt64(body, ts) // max timestamp
+	body = appendKafkaInt64(body, -1) // producer id
+	body = appendKafkaInt16(body, -1) // producer epoch
+	body = appendKafkaInt32(body, -1) // base sequence
+	body = appendKafkaInt32(body, 1)
+	body = appendKafkaVarint(body, int64(len(record)))
+	body = append(body, record...)
+
+	batch := appendKafkaInt64(nil, 0) // base offset
+	// length of what follows: leader epoch, magic, crc and body
+	batch = appendKafkaInt32(batch, int32(4+1+4+len(body)))
+	batch = appendKafkaInt32(batch, -1) // partition leader epoch
+	batch = append(batch, 2)            // magic
+	batch = appendKafkaInt32(batch, int32(crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli))))
+	return append(batch, body...)
+}
+
+// kafkaMurmur2 is the hash the java client's default partitioner uses
+func kafkaMurmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+func appendKafkaInt16(b []byte, v int16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendKafkaInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendKafkaInt64(b []byte, v int64) []byte {
+	return appendKafkaInt32(appendKafkaInt32(b, int32(v>>32)), int32(v))
+}
+
+func appendKafkaString(b []byte, s string) []byte {
+	return append(appendKafkaInt16(b, int16(len(s))), s...)
+}
+
+// appendKafkaVarint appends v zigzag encoded, as records use
+func appendKafkaVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// kafkaReader reads big endian fields, remembering the first short read
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errors.New("short kafka response")
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *kafkaReader) bool() bool {
+	b := r.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, or a nullable one, which comes back empty
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) int32Array() {
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.int32()
+	}
+}
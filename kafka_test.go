@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type kafkaProduced struct {
+	Partition  int32
+	Key, Value []byte
+}
+
+// fakeKafka is a single broker leading every partition of one topic
+type fakeKafka struct {
+	t          *testing.T
+	l          net.Listener
+	topic      string
+	partitions int32
+
+	mu       sync.Mutex
+	produced []kafkaProduced
+	// errors answers the next produce requests with these codes
+	errors []int16
+}
+
+func newFakeKafka(t *testing.T, topic string, partitions int32) *fakeKafka {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	k := &fakeKafka{t: t, l: l, topic: topic, partitions: partitions}
+	go k.serve()
+	return k
+}
+
+func (k *fakeKafka) Close() { k.l.Close() }
+
+func (k *fakeKafka) serve() {
+	for {
+		conn, err := k.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			c := &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+			for {
+				msg, err := c.read()
+				if err != nil {
+					return
+				}
+				r := &kafkaReader{b: msg}
+				api, version, id := r.int16(), r.int16(), r.int32()
+				assert.Equal(k.t, "slack_events_proxy", r.string())
+				var body []byte
+				switch api {
+				case kafkaMetadata:
+					assert.Equal(k.t, int16(4), version)
+					body = k.metadata()
+				case kafkaProduce:
+					assert.Equal(k.t, int16(3), version)
+					body = k.produce(r)
+				default:
+					k.t.Errorf("unexpected api %d", api)
+					return
+				}
+				resp := appendKafkaInt32(nil, int32(4+len(body)))
+				resp = appendKafkaInt32(resp, id)
+				if _, err := conn.Write(append(resp, body...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (k *fakeKafka) metadata() []byte {
+	host, port, _ := net.SplitHostPort(k.l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	b := appendKafkaInt32(nil, 0) // throttle
+	b = appendKafkaInt32(b, 1)
+	b = appendKafkaInt32(b, 7)
+	b = appendKafkaString(b, host)
+	b = appendKafkaInt32(b, int32(portNum))
+	b = appendKafkaInt16(b, -1) // rack
+	b = appendKafkaInt16(b, -1) // cluster id
+	b = appendKafkaInt32(b, 7)
+	b = appendKafkaInt32(b, 1)
+	b = appendKafkaInt16(b, 0)
+	b = appendKafkaString(b, k.topic)
+	b = append(b, 0)
+	b = appendKafkaInt32(b, k.partitions)
+	for i := int32(0); i < k.partitions; i++ {
+		b = appendKafkaInt16(b, 0)
+		b = appendKafkaInt32(b, i)
+		b = appendKafkaInt32(b, 7)
+		b = appendKafkaInt32(b, 1)
+		b = appendKafkaInt32(b, 7)
+		b = appendKafkaInt32(b, 1)
+		b = appendKafkaInt32(b, 7)
+	}
+	return b
+}
+
+func (k *fakeKafka) produce(r *kafkaReader) []byte {
+	assert.Equal(k.t, "", r.string())
+	assert.Equal(k.t, int16(-1), r.int16())
+	r.int32()
+	require.Equal(k.t, int32(1), r.int32())
+	topic := r.string()
+	assert.Equal(k.t, k.topic, topic)
+	require.Equal(k.t, int32(1), r.int32())
+	partition := r.int32()
+	batch := r.next(int(r.int32()))
+	require.NoError(k.t, r.err)
+
+	k.mu.Lock()
+	var code int16
+	if len(k.errors) > 0 {
+		code, k.errors = k.errors[0], k.errors[1:]
+	} else {
+		key, value := decodeKafkaBatch(k.t, batch)
+		k.produced = append(k.produced, kafkaProduced{partition, key, value})
+	}
+	k.mu.Unlock()
+
+	b := appendKafkaInt32(nil, 1)
+	b = appendKafkaString(b, topic)
+	b = appendKafkaInt32(b, 1)
+	b = appendKafkaInt32(b, partition)
+	b = appendKafkaInt16(b, code)
+	b = appendKafkaInt64(b, 0)
+	b = appendKafkaInt64(b, -1)
+	return appendKafkaInt32(b, 0)
+}
+
+// decodeKafkaBatch checks a one record batch and returns its record
+func decodeKafkaBatch(t *testing.T, batch []byte) (key, value []byte) {
+	require.True(t, len(batch) > 21)
+	assert.Equal(t, int32(len(batch)-12), int32(binary.BigEndian.Uint32(batch[8:])))
+	assert.Equal(t, byte(2), batch[16])
+	body := batch[21:]
+	assert.Equal(t, crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)), binary.BigEndian.Uint32(batch[17:]))
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(body[36:]))
+
+	rd := bytes.NewReader(body[40:])
+	varint := func() int64 {
+		v, err := binary.ReadVarint(rd)
+		require.NoError(t, err)
+		return v
+	}
+	bytesOf := func(n int64) []byte {
+		b := make([]byte, n)
+		_, err := rd.Read(b)
+		require.NoError(t, err)
+		return b
+	}
+	length := varint()
+	assert.Equal(t, int64(rd.Len()), length)
+	rd.ReadByte()
+	varint()
+	varint()
+	key = bytesOf(varint())
+	value = bytesOf(varint())
+	assert.Equal(t, int64(0), varint())
+	return key, value
+}
+
+func TestKafkaMurmur2(t *testing.T) {
+	// from the java client's tests
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		assert.Equal(t, want, int32(kafkaMurmur2([]byte(key))), key)
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	broker := newFakeKafka(t, "slack", 4)
+	defer broker.Close()
+
+	key, err := ParsePartitionKey("{team_id}")
+	require.NoError(t, err)
+	s := NewKafkaSink([]string{"127.0.0.1:1", broker.l.Addr().String()}, "slack", key)
+	defer s.Close()
+
+	send := func(team string) {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+		r.Header.Set("Content-Type", "application/json")
+		body := `{"type":"event_callback","team_id":"` + team + `","event":{"type":"message"}}`
+		require.NoError(t, s.Send(context.Background(), NewDelivery(r, []byte(body))))
+	}
+	send("T1")
+	send("T2")
+	send("T1")
+
+	// a moved leader is found again, once
+	broker.mu.Lock()
+	broker.errors = []int16{6}
+	broker.mu.Unlock()
+	send("T3")
+	broker.mu.Lock()
+	broker.errors = []int16{6, 6}
+	broker.mu.Unlock()
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+	err = s.Send(context.Background(), NewDelivery(r, []byte(`{"team_id":"T4"}`)))
+	assert.EqualError(t, err, "kafka: not leader or follower")
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	require.Len(t, broker.produced, 4)
+	for i, team := range []string{"T1", "T2", "T1", "T3"} {
+		p := broker.produced[i]
+		assert.Equal(t, team, string(p.Key))
+		assert.Equal(t, int32(kafkaMurmur2(p.Key)&0x7fffffff)%4, p.Partition)
+		var d Delivery
+		require.NoError(t, json.Unmarshal(p.Value, &d))
+		assert.Contains(t, string(d.Body), team)
+	}
+	assert.Equal(t, broker.produced[0].Partition, broker.produced[2].Partition)
+}
+
+func TestKafkaSinkNoBroker(t *testing.T) {
+	key, err := ParsePartitionKey("{team_id}")
+	require.NoError(t, err)
+	s := NewKafkaSink([]string{"127.0.0.1:1"}, "slack", key)
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+	assert.Error(t, s.Send(context.Background(), NewDelivery(r, []byte("{}"))))
+}
+
+func TestOutputHandler(t *testing.T) {
+	var sent []string
+	fail := false
+	sink := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		if fail {
+			return errors.New("down")
+		}
+		sent = append(sent, string(d.Body))
+		return nil
+	})
+	h := OutputHandler(StatusHandler(http.StatusTeapot, "backend"), PayloadParserFunc(ParseSlackPayload), "test", sink)
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	event := `{"type":"event_callback","event":{"type":"message"}}`
+	w := post("application/json", event)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{event}, sent)
+
+	fail = true
+	w = post("application/json", event)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// anything that needs an answer goes to the backend
+	w = post("application/json", `{"type":"url_verification","challenge":"abc"}`)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	w = post("application/x-www-form-urlencoded", "command=%2Fops")
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Len(t, sent, 1)
+}
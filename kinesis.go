@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagKinesisStream = kingpin.
+				Flag("kinesis-stream", "kinesis stream for --sink kinesis").
+				Envar("KINESIS_STREAM").String()
+	flagKinesisRegion = kingpin.
+				Flag("kinesis-region", "region of the kinesis stream, defaults to AWS_REGION").
+				Envar("KINESIS_REGION").String()
+	flagKinesisEndpoint = kingpin.
+				Flag("kinesis-endpoint", "kinesis api endpoint, for local stacks").
+				Envar("KINESIS_ENDPOINT").URL()
+	flagKinesisInterval = kingpin.
+				Flag("kinesis-interval", "how often records are put to kinesis").
+				Envar("KINESIS_INTERVAL").Default("1s").Duration()
+	flagKinesisBatch = kingpin.
+				Flag("kinesis-batch", "put early once this many deliveries are waiting").
+				Envar("KINESIS_BATCH").Default("500").Int()
+	flagKinesisAggregate = kingpin.
+				Flag("kinesis-aggregate", "pack deliveries sharing a partition key into kpl aggregated records").
+				Envar("KINESIS_AGGREGATE").Default("true").Bool()
+)
+
+var metricKinesisRecords = NewCounterVec("kinesis_deliveries_total",
+	"deliveries handed to kinesis by outcome", "outcome")
+
+// kinesis api limits
+const (
+	kinesisMaxRecords      = 500
+	kinesisMaxRecordBytes  = 1 << 20
+	kinesisMaxRequestBytes = 5 << 20
+	kinesisMaxKeyLength    = 256
+)
+
+// kplMagic starts every aggregated record, so consumers using the kpl
+// deaggregation libraries can tell them apart from plain records
+var kplMagic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+type kinesisEntry struct {
+	key  string
+	data []byte
+}
+
+// KinesisSink batches deliveries and puts them to a kinesis stream. Each
+// record is the json encoded delivery, keyed with --partition-key.
+type KinesisSink struct {
+	Stream    string
+	Region    string
+	Endpoint  string
+	Creds     awsCredentialsProvider
+	Aggregate bool
+	BatchSize int
+	Key       *PartitionKey
+	Client    *http.Client
+
+	mu      sync.Mutex
+	pending []kinesisEntry
+	full    chan struct{}
+}
+
+func openKinesisSink() (Sink, error) {
+	if *flagKinesisStream == "" {
+		return nil, errors.New("--sink kinesis needs --kinesis-stream")
+	}
+	region := *flagKinesisRegion
+	if region == "" {
+		region = awsRegion()
+	}
+	if region == "" {
+		return nil, errors.New("--sink kinesis needs --kinesis-region or AWS_REGION")
+	}
+	s := NewKinesisSink(*flagKinesisStream, region, newAWSCredentialsProvider(), partitionKey)
+	if *flagKinesisEndpoint != nil {
+		s.Endpoint = (*flagKinesisEndpoint).String()
+	}
+	s.Aggregate = *flagKinesisAggregate
+	s.BatchSize = *flagKinesisBatch
+	go s.Run(*flagKinesisInterval)
+	return s, nil
+}
+
+func NewKinesisSink(stream, region string, creds awsCredentialsProvider, key *PartitionKey) *KinesisSink {
+	return &KinesisSink{
+		Stream:    stream,
+		Region:    region,
+		Endpoint:  "https://kinesis." + region + ".amazonaws.com/",
+		Creds:     creds,
+		Aggregate: true,
+		BatchSize: kinesisMaxRecords,
+		Key:       key,
+		Client:    http.DefaultClient,
+		full:      make(chan struct{}, 1),
+	}
+}
+
+func (s *KinesisSink) Send(ctx context.Context, d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	key := s.Key.Key(d)
+	if len(key) > kinesisMaxKeyLength {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, kinesisEntry{key: key, data: data})
+	full := len(s.pending) >= s.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// kinesisRecord is one record of a PutRecords call, along with the
+// deliveries packed into it so they can be put back if it fails.
+type kinesisRecord struct {
+	Data         []byte `json:"Data"`
+	PartitionKey string `json:"PartitionKey"`
+
+	entries []kinesisEntry
+}
+
+// records turns pending deliveries into records. Aggregation packs each
+// partition key's deliveries together in the order they came in.
+func (s *KinesisSink) records(entries []kinesisEntry) []kinesisRecord {
+	if !s.Aggregate {
+		records := make([]kinesisRecord, 0, len(entries))
+		for _, e := range entries {
+			records = append(records, kinesisRecord{
+				Data: e.data, PartitionKey: e.key, entries: []kinesisEntry{e}})
+		}
+		return records
+	}
+
+	var keys []string
+	byKey := map[string][]kinesisEntry{}
+	for _, e := range entries {
+		if _, ok := byKey[e.key]; !ok {
+			keys = append(keys, e.key)
+		}
+		byKey[e.key] = append(byKey[e.key], e)
+	}
+
+	var records []kinesisRecord
+	for _, key := range keys {
+		var group []kinesisEntry
+		size := 0
+		for _, e := range byKey[key] {
+			// leave room for the key, magic, checksum and field overhead
+			if len(group) > 0 && size+len(e.data)+len(key)+64 > kinesisMaxRecordBytes {
+				records = append(records, aggregateRecord(key, group))
+				group, size = nil, 0
+			}
+			group = append(group, e)
+			size += len(e.data) + 16
+		}
+		records = append(records, aggregateRecord(key, group))
+	}
+	return records
+}
+
+// aggregateRecord encodes entries as a kpl AggregatedRecord: the magic, the
+// protobuf message, then the md5 of the message.
+//
+//	message AggregatedRecord {
+//		repeated string partition_key_table = 1;
+//		repeated Record records = 3;
+//	}
+//	message Record {
+//		required uint64 partition_key_index = 1;
+//		required bytes data = 3;
+//	}
+func aggregateRecord(key string, entries []kinesisEntry) kinesisRecord {
+	if len(entries) == 1 {
+		return kinesisRecord{Data: entries[0].data, PartitionKey: key, entries: entries}
+	}
+
+	var msg []byte
+	msg = appendProtoBytes(msg, 1, []byte(key))
+	for _, e := range entries {
+		var record []byte
+		record = appendProtoVarint(record, 1<<3|0)
+		record = appendProtoVarint(record, 0)
+		record = appendProtoBytes(record, 3, e.data)
+		msg = appendProtoBytes(msg, 3, record)
+	}
+	sum := md5.Sum(msg)
+
+	data := make([]byte, 0, len(kplMagic)+len(msg)+len(sum))
+	data = append(data, kplMagic...)
+	data = append(data, msg...)
+	data = append(data, sum[:]...)
+	return kinesisRecord{Data: data, PartitionKey: key, entries: entries}
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendProtoBytes appends a length delimited field
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendProtoVarint(b, uint64(field)<<3|2)
+	b = appendProtoVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// Flush puts everything waiting. Deliveries in records kinesis rejects are
+// kept for the next try, up to ten batches worth.
+func (s *KinesisSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	entries := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(entries) < 1 {
+		return nil
+	}
+
+	var failed []kinesisEntry
+	var firstErr error
+	records := s.records(entries)
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < kinesisMaxRecords {
+			size += len(records[n].Data) + len(records[n].PartitionKey)
+			if n > 0 && size > kinesisMaxRequestBytes {
+				break
+			}
+			n++
+		}
+		batch := records[:n]
+		records = records[n:]
+
+		rejected, err := s.put(ctx, batch)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, r := range rejected {
+			failed = append(failed, r.entries...)
+		}
+	}
+	metricKinesisRecords.Add(float64(len(entries)-len(failed)), "put")
+	if len(failed) < 1 {
+		return firstErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(failed, s.pending...)
+	if limit := s.BatchSize * 10; len(s.pending) > limit {
+		metricKinesisRecords.Add(float64(len(s.pending)-limit), "dropped")
+		s.pending = s.pending[len(s.pending)-limit:]
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("kinesis rejected %d deliveries", len(failed))
+	}
+	return firstErr
+}
+
+// put makes one PutRecords call, returning the records that did not make it
+func (s *KinesisSink) put(ctx context.Context, records []kinesisRecord) ([]kinesisRecord, error) {
+	in := struct {
+		StreamName string          `json:"StreamName"`
+		Records    []kinesisRecord `json:"Records"`
+	}{s.Stream, records}
+	var result struct {
+		FailedRecordCount int
+		Records           []struct {
+			ErrorCode    string
+			ErrorMessage string
+		}
+	}
+	if err := awsCall(ctx, s.Client, s.Creds, s.Endpoint, s.Region, "kinesis",
+		"Kinesis_20131202.PutRecords", in, &result); err != nil {
+		return records, err
+	}
+	if result.FailedRecordCount < 1 {
+		return nil, nil
+	}
+	var rejected []kinesisRecord
+	for i, r := range result.Records {
+		if r.ErrorCode != "" && i < len(records) {
+			rejected = append(rejected, records[i])
+		}
+	}
+	return rejected, nil
+}
+
+func (s *KinesisSink) Run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-s.full:
+		}
+		if err := s.Flush(context.Background()); err != nil {
+			log.Printf("putting to kinesis: %v", err)
+		}
+	}
+}
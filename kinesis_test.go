@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deaggregate undoes aggregateRecord, as a kpl consumer would
+func deaggregate(t *testing.T, data []byte) (keys []string, records [][]byte) {
+	require.True(t, bytes.HasPrefix(data, kplMagic), "missing kpl magic")
+	msg := data[len(kplMagic) : len(data)-md5.Size]
+	sum := md5.Sum(msg)
+	require.Equal(t, sum[:], data[len(data)-md5.Size:], "bad kpl checksum")
+
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		msg = msg[n:]
+		size, n := binary.Uvarint(msg)
+		msg = msg[n:]
+		field := msg[:size]
+		msg = msg[size:]
+		switch tag {
+		case 1<<3 | 2:
+			keys = append(keys, string(field))
+		case 3<<3 | 2:
+			// skip the partition key index, always 0 here
+			require.Equal(t, []byte{1<<3 | 0, 0}, field[:2])
+			field = field[2:]
+			tag, n := binary.Uvarint(field)
+			require.Equal(t, uint64(3<<3|2), tag)
+			field = field[n:]
+			_, n = binary.Uvarint(field)
+			records = append(records, field[n:])
+		default:
+			t.Fatalf("unexpected field tag %d", tag)
+		}
+	}
+	return keys, records
+}
+
+func kinesisDelivery(channel, text string) *Delivery {
+	return &Delivery{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body: []byte(`{"type":"event_callback","team_id":"T1","event":{"type":"message","channel":"` +
+			channel + `","text":"` + text + `"}}`),
+	}
+}
+
+func TestKinesisSink(t *testing.T) {
+	type putRecord struct {
+		Data         []byte
+		PartitionKey string
+	}
+	var puts [][]putRecord
+	reject := true
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Kinesis_20131202.PutRecords", r.Header.Get("X-Amz-Target"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"),
+			"AWS4-HMAC-SHA256 Credential=AKID/"), r.Header.Get("Authorization"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/kinesis/aws4_request")
+
+		var req struct {
+			StreamName string
+			Records    []putRecord
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "slack", req.StreamName)
+		puts = append(puts, req.Records)
+
+		// the first record is throttled the first time around
+		if reject {
+			reject = false
+			w.Write([]byte(`{"FailedRecordCount":1,"Records":[
+				{"ErrorCode":"ProvisionedThroughputExceededException"},
+				{"SequenceNumber":"1","ShardId":"shardId-000000000000"}]}`))
+			return
+		}
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[]}`))
+	}))
+	defer api.Close()
+
+	key, err := ParsePartitionKey("{team_id}/{channel_id}")
+	require.NoError(t, err)
+	sink := NewKinesisSink("slack", "us-east-1", awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, key)
+	sink.Endpoint = api.URL
+	sink.BatchSize = 3
+
+	ctx := context.Background()
+	require.NoError(t, sink.Send(ctx, kinesisDelivery("C1", "one")))
+	require.NoError(t, sink.Send(ctx, kinesisDelivery("C2", "two")))
+	require.NoError(t, sink.Send(ctx, kinesisDelivery("C1", "three")))
+	select {
+	case <-sink.full:
+	default:
+		t.Fatal("sink should be full after a batch")
+	}
+
+	before := metricKinesisRecords.Get("put")
+	assert.EqualError(t, sink.Flush(ctx), "kinesis rejected 2 deliveries")
+	assert.Equal(t, before+1, metricKinesisRecords.Get("put"))
+	require.Len(t, puts, 1)
+	require.Len(t, puts[0], 2, "one record per partition key")
+
+	// C1 is aggregated, in order
+	assert.Equal(t, "T1/C1", puts[0][0].PartitionKey)
+	keys, records := deaggregate(t, puts[0][0].Data)
+	assert.Equal(t, []string{"T1/C1"}, keys)
+	require.Len(t, records, 2)
+	var d Delivery
+	require.NoError(t, json.Unmarshal(records[0], &d))
+	assert.Contains(t, string(d.Body), `"one"`)
+	require.NoError(t, json.Unmarshal(records[1], &d))
+	assert.Contains(t, string(d.Body), `"three"`)
+
+	// C2 is alone, so goes as a plain record
+	assert.Equal(t, "T1/C2", puts[0][1].PartitionKey)
+	require.NoError(t, json.Unmarshal(puts[0][1].Data, &d))
+	assert.Contains(t, string(d.Body), `"two"`)
+
+	// the throttled deliveries are put again
+	require.NoError(t, sink.Flush(ctx))
+	require.Len(t, puts, 2)
+	require.Len(t, puts[1], 1)
+	assert.Equal(t, "T1/C1", puts[1][0].PartitionKey)
+	_, records = deaggregate(t, puts[1][0].Data)
+	assert.Len(t, records, 2)
+
+	// without aggregation every delivery is its own record
+	sink.Aggregate = false
+	require.NoError(t, sink.Send(ctx, kinesisDelivery("C1", "four")))
+	require.NoError(t, sink.Send(ctx, kinesisDelivery("C1", "five")))
+	require.NoError(t, sink.Flush(ctx))
+	require.Len(t, puts, 3)
+	assert.Len(t, puts[2], 2)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	metricLabeledRequests = NewCounterVec("labeled_requests_total",
+		"requests given each label by the config label rules", "label", "value")
+	metricRateLimited = NewCounterVec("rate_limited_total",
+		"requests turned away by a config rate limit", "limit")
+)
+
+// LabelRule gives requests matching every field that is set the label
+// Label with Value. Headers match header values exactly, and Fields match
+// dotted paths into the body, like event.channel_type, or form fields for
+// slash commands. The first matching rule for each label wins.
+type LabelRule struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+
+	Path       string            `json:"path"`
+	Kind       string            `json:"kind"`
+	Type       string            `json:"type"`
+	TeamID     string            `json:"team_id"`
+	AppID      string            `json:"app_id"`
+	ChannelID  string            `json:"channel_id"`
+	CallbackID string            `json:"callback_id"`
+	Headers    map[string]string `json:"headers"`
+	Fields     map[string]string `json:"fields"`
+}
+
+func (rule LabelRule) validate() error {
+	if rule.Label == "" || rule.Value == "" {
+		return fmt.Errorf("label rule needs a label and a value")
+	}
+	switch rule.Kind {
+	case "", PayloadEvent, PayloadCommand, PayloadInteraction:
+	default:
+		return fmt.Errorf("unknown kind %q", rule.Kind)
+	}
+	return nil
+}
+
+func (rule LabelRule) Match(r *http.Request, p *Payload, body []byte) bool {
+	for _, each := range []struct{ want, got string }{
+		{rule.Kind, p.Kind},
+		{rule.Type, p.Type},
+		{rule.TeamID, p.TeamID},
+		{rule.AppID, p.AppID},
+		{rule.ChannelID, p.ChannelID},
+		{rule.CallbackID, p.CallbackID},
+	} {
+		if each.want != "" && each.want != each.got {
+			return false
+		}
+	}
+	if rule.Path != "" && !strings.HasPrefix(r.URL.Path, rule.Path) {
+		return false
+	}
+	for name, want := range rule.Headers {
+		if r.Header.Get(name) != want {
+			return false
+		}
+	}
+	for path, want := range rule.Fields {
+		if got, ok := bodyField(r, body, path); !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyField finds a dotted path in a json body, or in the json payload of an
+// interaction, or else takes path as a form field
+func bodyField(r *http.Request, body []byte, path string) (string, bool) {
+	raw := body
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", false
+		}
+		if form.Get("payload") == "" {
+			_, ok := form[path]
+			return form.Get(path), ok
+		}
+		raw = []byte(form.Get("payload"))
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// Labels are the labels given to one request, by label name
+type Labels map[string]string
+
+// Match is true when every label in want is set to the value wanted
+func (l Labels) Match(want map[string]string) bool {
+	for label, value := range want {
+		if l[label] != value {
+			return false
+		}
+	}
+	return true
+}
+
+type labelsKey struct{}
+
+// RequestLabels are the labels LabelHandler gave r, if any
+func RequestLabels(r *http.Request) Labels {
+	labels, _ := r.Context().Value(labelsKey{}).(Labels)
+	return labels
+}
+
+// LabelHandler labels each request by rules, for routes, rate limits and
+// metrics to go by. Requests already labeled further out keep their labels.
+// Deliveries from a queue are labeled again, but not counted again.
+func LabelHandler(child http.Handler, parser PayloadParser, rules []LabelRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RequestLabels(r) != nil {
+			child.ServeHTTP(w, r)
+			return
+		}
+		// rules on the path and headers still apply to bodies that do not
+		// parse, which matters ahead of verification
+		labels := Labels{}
+		body, _ := readBody(r)
+		p, err := parser.ParsePayload(r, body)
+		if err != nil {
+			p = &Payload{}
+		}
+		for _, rule := range rules {
+			if _, ok := labels[rule.Label]; !ok && rule.Match(r, p, body) {
+				labels[rule.Label] = rule.Value
+			}
+		}
+		if r.Header.Get(HeaderProxyAttempt) == "" {
+			for label, value := range labels {
+				metricLabeledRequests.Inc(label, value)
+			}
+		}
+		child.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), labelsKey{}, labels)))
+	})
+}
+
+// RateLimitConfig limits requests with every one of Labels to Rate a second,
+// with bursts of up to Burst. Requests over the limit are answered 429,
+// which slack retries later.
+type RateLimitConfig struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Rate   float64           `json:"rate"`
+	Burst  int               `json:"burst"`
+}
+
+func (rl RateLimitConfig) validate() error {
+	if rl.Name == "" {
+		return fmt.Errorf("rate limit needs a name")
+	}
+	if len(rl.Labels) == 0 {
+		return fmt.Errorf("rate limit needs labels to match")
+	}
+	if rl.Rate <= 0 || rl.Burst < 0 {
+		return fmt.Errorf("rate limit needs a positive rate")
+	}
+	return nil
+}
+
+type rateLimit struct {
+	RateLimitConfig
+	bucket *tokenBucket
+}
+
+func buildRateLimits(configs []RateLimitConfig) []rateLimit {
+	limits := make([]rateLimit, len(configs))
+	for i, rl := range configs {
+		burst := rl.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		limits[i] = rateLimit{rl, rateLimitBuckets.get(rl, burst)}
+	}
+	return limits
+}
+
+// rateLimitBuckets keeps each limit's bucket across config reloads, for as
+// long as the limit is configured the same
+var rateLimitBuckets = &bucketStore{buckets: map[string]*tokenBucket{}}
+
+type bucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func bucketKey(rl RateLimitConfig) string {
+	raw, _ := json.Marshal(rl)
+	return string(raw)
+}
+
+// get returns the bucket rl had before, or a new one
+func (s *bucketStore) get(rl RateLimitConfig, burst int) *tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := bucketKey(rl)
+	if b, ok := s.buckets[key]; ok {
+		return b
+	}
+	b := newTokenBucket(rl.Rate, burst)
+	s.buckets[key] = b
+	return b
+}
+
+// keep drops the buckets of limits not in configs, once they are applied
+func (s *bucketStore) keep(configs []RateLimitConfig) {
+	keys := map[string]bool{}
+	for _, rl := range configs {
+		keys[bucketKey(rl)] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.buckets {
+		if !keys[key] {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// RateLimitHandler turns away requests over any limit their labels match.
+// It must be inside LabelHandler.
+func RateLimitHandler(child http.Handler, limits ...rateLimit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels := RequestLabels(r)
+		for _, limit := range limits {
+			if labels.Match(limit.Labels) && !limit.bucket.allow() {
+				metricRateLimited.Inc(limit.Name)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "rate limited", http.StatusTooManyRequests)
+				return
+			}
+		}
+		child.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelHandler(t *testing.T) {
+	rules := []LabelRule{
+		{Label: "tier", Value: "vip", TeamID: "T1"},
+		{Label: "tier", Value: "standard", Kind: PayloadEvent},
+		{Label: "tier", Value: "standard", Kind: PayloadCommand},
+		{Label: "dm", Value: "yes", Fields: map[string]string{"event.channel_type": "im"}},
+		{Label: "ops", Value: "deploy", Fields: map[string]string{"text": "deploy now"}},
+		{Label: "modal", Value: "tickets", Fields: map[string]string{"view.callback_id": "new-ticket"}},
+		{Label: "canary", Value: "yes", Headers: map[string]string{"X-Canary": "1"}},
+		{Label: "path", Value: "commands", Path: "/slack/commands"},
+	}
+	for _, rule := range rules {
+		require.NoError(t, rule.validate())
+	}
+	assert.Error(t, LabelRule{Label: "tier"}.validate())
+	assert.Error(t, LabelRule{Label: "tier", Value: "x", Kind: "email"}.validate())
+
+	form := func(v url.Values) string { return v.Encode() }
+	for _, test := range []struct {
+		name        string
+		path        string
+		contentType string
+		header      http.Header
+		body        string
+		exp         Labels
+	}{
+		{"vip event", "/slack/events", "application/json", nil,
+			`{"type":"event_callback","team_id":"T1","event":{"type":"message","channel_type":"im"}}`,
+			Labels{"tier": "vip", "dm": "yes"}},
+		{"channel event", "/slack/events", "application/json", http.Header{"X-Canary": {"1"}},
+			`{"type":"event_callback","team_id":"T2","event":{"type":"message","channel_type":"channel"}}`,
+			Labels{"tier": "standard", "canary": "yes"}},
+		{"command", "/slack/commands", "application/x-www-form-urlencoded", nil,
+			form(url.Values{"command": {"/ops"}, "text": {"deploy now"}, "team_id": {"T2"}, "trigger_id": {"1.2"}}),
+			Labels{"tier": "standard", "ops": "deploy", "path": "commands"}},
+		{"interaction", "/slack/interactions", "application/x-www-form-urlencoded", nil,
+			form(url.Values{"payload": {`{"type":"view_submission","team":{"id":"T2"},"view":{"callback_id":"new-ticket"}}`}}),
+			Labels{"modal": "tickets"}},
+		{"not slack", "/slack/events", "text/plain", nil, "hello", Labels{}},
+	} {
+		var got Labels
+		h := LabelHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = RequestLabels(r)
+		}), PayloadParserFunc(ParseSlackPayload), rules)
+		r := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+		for name, values := range test.header {
+			r.Header[name] = values
+		}
+		r.Header.Set("Content-Type", test.contentType)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equal(t, test.exp, got, test.name)
+	}
+
+	// labels from further out are kept
+	var got Labels
+	inner := LabelHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestLabels(r)
+	}), PayloadParserFunc(ParseSlackPayload), nil)
+	outer := LabelHandler(inner, PayloadParserFunc(ParseSlackPayload), rules)
+	r := httptest.NewRequest(http.MethodPost, "/slack/events",
+		strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"message"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	outer.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, Labels{"tier": "vip"}, got)
+}
+
+func TestRouteConfigLabels(t *testing.T) {
+	rc := RouteConfig{Kind: PayloadEvent, Labels: map[string]string{"tier": "vip"}}
+	p := &Payload{Kind: PayloadEvent, Type: "message"}
+	var matched []bool
+	h := LabelHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched = append(matched, rc.Match(r, p))
+	}), PayloadParserFunc(ParseSlackPayload), []LabelRule{{Label: "tier", Value: "vip", TeamID: "T1"}})
+	for _, team := range []string{"T1", "T2"} {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events",
+			strings.NewReader(`{"type":"event_callback","team_id":"`+team+`","event":{"type":"message"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.Equal(t, []bool{true, false}, matched)
+	// without labels at all nothing labeled matches
+	assert.False(t, rc.Match(httptest.NewRequest(http.MethodPost, "/", nil), p))
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	limit := RateLimitConfig{Name: "bulk", Labels: map[string]string{"tier": "bulk"}, Rate: 0.001, Burst: 2}
+	require.NoError(t, limit.validate())
+	assert.Error(t, RateLimitConfig{Name: "bulk", Rate: 1}.validate())
+	assert.Error(t, RateLimitConfig{Name: "bulk", Labels: limit.Labels}.validate())
+
+	h := RateLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), buildRateLimits([]RateLimitConfig{limit})...)
+	h = LabelHandler(h, PayloadParserFunc(ParseSlackPayload),
+		[]LabelRule{{Label: "tier", Value: "bulk", TeamID: "T1"}})
+
+	send := func(team string) int {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events",
+			strings.NewReader(`{"type":"event_callback","team_id":"`+team+`","event":{"type":"message"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	before := metricRateLimited.Get("bulk")
+	assert.Equal(t, http.StatusOK, send("T1"))
+	assert.Equal(t, http.StatusOK, send("T1"))
+	assert.Equal(t, http.StatusTooManyRequests, send("T1"))
+	// other teams are not limited
+	assert.Equal(t, http.StatusOK, send("T2"))
+	assert.Equal(t, before+1, metricRateLimited.Get("bulk"))
+}
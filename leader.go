@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagLeaderElection = kingpin.
+				Flag("leader-election", "lock that picks the one replica to run singleton jobs, like backfill, such as kubernetes://<namespace>/<lease> or redis://host:6379/0?key=<key>").
+				Envar("LEADER_ELECTION").String()
+	flagLeaderLease = kingpin.
+			Flag("leader-lease", "how long leadership lasts without being renewed").
+			Envar("LEADER_LEASE").Default("15s").Duration()
+	flagLeaderID = kingpin.
+			Flag("leader-id", "name this replica holds the lock under and reports to /admin/cluster as, the hostname if empty").
+			Envar("LEADER_ID").String()
+)
+
+var metricLeader = NewGaugeVec("leader",
+	"1 while this replica runs the singleton jobs")
+
+// LeaderLock is a lock shared by every replica, held for ttl at a time.
+// Acquire takes the lock for id, or extends it if id already holds it, and
+// reports whether id holds it after.
+type LeaderLock interface {
+	Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, id string) error
+}
+
+// LeaderLockDriver opens a lock from what follows scheme:// in its url.
+type LeaderLockDriver func(spec string) (LeaderLock, error)
+
+var (
+	leaderLockDriversMu sync.RWMutex
+	leaderLockDrivers   = map[string]LeaderLockDriver{
+		"kubernetes": openKubernetesLease,
+		"redis":      openRedisLock,
+		"rediss":     openRedissLock,
+	}
+)
+
+// RegisterLeaderLock adds a driver for locks with the given scheme.
+func RegisterLeaderLock(scheme string, driver LeaderLockDriver) {
+	leaderLockDriversMu.Lock()
+	defer leaderLockDriversMu.Unlock()
+	leaderLockDrivers[scheme] = driver
+}
+
+// OpenLeaderLock opens a lock like kubernetes://default/slack-events-proxy
+func OpenLeaderLock(raw string) (LeaderLock, error) {
+	i := strings.Index(raw, "://")
+	if i < 1 {
+		return nil, fmt.Errorf("leader lock %q needs a scheme", raw)
+	}
+	leaderLockDriversMu.RLock()
+	driver, ok := leaderLockDrivers[raw[:i]]
+	leaderLockDriversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no leader lock driver for %q", raw[:i])
+	}
+	return driver(raw[i+3:])
+}
+
+type leaderJob struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// leaderElector keeps trying for the lock, running its jobs while it holds
+// it and cancelling them when it is lost.
+type leaderElector struct {
+	Lock LeaderLock
+	ID   string
+	TTL  time.Duration
+
+	mu      sync.Mutex
+	jobs    []leaderJob
+	leading bool
+	renewed time.Time
+	cancel  context.CancelFunc
+}
+
+// leader is set up in main from --leader-election, nil when every replica
+// runs the singleton jobs
+var leader *leaderElector
+
+func leaderFromFlags() (*leaderElector, error) {
+	if *flagLeaderElection == "" {
+		return nil, nil
+	}
+	lock, err := OpenLeaderLock(*flagLeaderElection)
+	if err != nil {
+		return nil, err
+	}
+	id, err := replicaID()
+	if err != nil {
+		return nil, err
+	}
+	return &leaderElector{Lock: lock, ID: id, TTL: *flagLeaderLease}, nil
+}
+
+// replicaID is what this replica goes by to the others, --leader-id or
+// else the hostname
+func replicaID() (string, error) {
+	if *flagLeaderID != "" {
+		return *flagLeaderID, nil
+	}
+	return os.Hostname()
+}
+
+// runSingleton runs job on one replica only, or right away without
+// --leader-election
+func runSingleton(name string, job func(ctx context.Context)) {
+	if leader == nil {
+		go job(context.Background())
+		return
+	}
+	leader.Go(name, job)
+}
+
+// Go runs job whenever e becomes the leader
+func (e *leaderElector) Go(name string, job func(ctx context.Context)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.jobs = append(e.jobs, leaderJob{name, job})
+}
+
+// Leading is true while e holds the lock
+func (e *leaderElector) Leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading
+}
+
+// Run tries for the lock a few times each TTL, until ctx is done, then
+// lets it go
+func (e *leaderElector) Run(ctx context.Context) {
+	tick := time.NewTicker(e.TTL / 3)
+	defer tick.Stop()
+	for {
+		e.try(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			e.step(false)
+			release, cancel := context.WithTimeout(context.Background(), e.TTL/3)
+			if err := e.Lock.Release(release, e.ID); err != nil {
+				log.Printf("releasing leadership: %v", err)
+			}
+			cancel()
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (e *leaderElector) try(ctx context.Context, now time.Time) {
+	attempt, cancel := context.WithTimeout(ctx, e.TTL/3)
+	held, err := e.Lock.Acquire(attempt, e.ID, e.TTL)
+	cancel()
+	if err != nil {
+		log.Printf("leader election: %v", err)
+		e.mu.Lock()
+		// keep going until the lease may have run out for the others
+		held = e.leading && now.Sub(e.renewed) < e.TTL*2/3
+		e.mu.Unlock()
+	} else if held {
+		e.mu.Lock()
+		e.renewed = now
+		e.mu.Unlock()
+	}
+	e.step(held)
+}
+
+// step starts or stops the jobs as leadership changes
+func (e *leaderElector) step(leading bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if leading == e.leading {
+		return
+	}
+	e.leading = leading
+	if !leading {
+		log.Printf("%s lost leadership, stopping singleton jobs", e.ID)
+		metricLeader.Set(0)
+		e.cancel()
+		return
+	}
+	metricLeader.Set(1)
+	var ctx context.Context
+	ctx, e.cancel = context.WithCancel(context.Background())
+	var names []string
+	for _, job := range e.jobs {
+		names = append(names, job.name)
+		go job.run(ctx)
+	}
+	log.Printf("%s is the leader, starting %s", e.ID, strings.Join(names, ", "))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryLock is a LeaderLock held in memory, shared by electors in a test
+type memoryLock struct {
+	mu      sync.Mutex
+	holder  string
+	expires time.Time
+	err     error
+}
+
+func (l *memoryLock) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	if l.holder != id && l.holder != "" && time.Now().Before(l.expires) {
+		return false, nil
+	}
+	l.holder, l.expires = id, time.Now().Add(ttl)
+	return true, nil
+}
+
+func (l *memoryLock) Release(ctx context.Context, id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder == id {
+		l.holder = ""
+	}
+	return nil
+}
+
+func TestLeaderElector(t *testing.T) {
+	lock := &memoryLock{}
+	var mu sync.Mutex
+	running := map[string]bool{}
+	elector := func(id string) *leaderElector {
+		e := &leaderElector{Lock: lock, ID: id, TTL: time.Minute}
+		e.Go("job", func(ctx context.Context) {
+			mu.Lock()
+			running[id] = true
+			mu.Unlock()
+			<-ctx.Done()
+			mu.Lock()
+			running[id] = false
+			mu.Unlock()
+		})
+		return e
+	}
+	isRunning := func(id string) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return running[id]
+		}
+	}
+
+	a, b := elector("a"), elector("b")
+	now := time.Now()
+	a.try(context.Background(), now)
+	b.try(context.Background(), now)
+	assert.True(t, a.Leading())
+	assert.False(t, b.Leading())
+	assert.Eventually(t, isRunning("a"), time.Second, time.Millisecond)
+	assert.Equal(t, float64(1), metricLeader.Get())
+
+	// a blip keeps the leader going for a while
+	lock.err = errors.New("unreachable")
+	a.try(context.Background(), now.Add(time.Second))
+	assert.True(t, a.Leading())
+	a.try(context.Background(), now.Add(time.Minute))
+	assert.False(t, a.Leading())
+	assert.Eventually(t, func() bool { return !isRunning("a")() }, time.Second, time.Millisecond)
+	lock.err = nil
+
+	// once the lock is let go another replica takes over
+	require.NoError(t, lock.Release(context.Background(), "a"))
+	b.try(context.Background(), now.Add(time.Minute))
+	assert.True(t, b.Leading())
+	assert.Eventually(t, isRunning("b"), time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Run(ctx)
+	assert.False(t, b.Leading())
+	assert.Equal(t, "", lock.holder, "the lock is released on the way out")
+}
+
+// fakeRedis answers the commands RedisLock and RedisSequenceStore send,
+// running their scripts against a map, and the hash commands
+// RedisClusterStore sends
+func fakeRedis(t *testing.T, password string) (addr string, keys map[string]string, done func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var mu sync.Mutex
+	keys = map[string]string{}
+	hashes := map[string]map[string]string{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					reply, err := readRedisReply(r)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range reply.([]interface{}) {
+						args = append(args, arg.(string))
+					}
+					mu.Lock()
+					switch {
+					case args[0] == "AUTH" && args[len(args)-1] == password:
+						authed = true
+						conn.Write([]byte("+OK\r\n"))
+					case !authed:
+						conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+					case args[0] == "SELECT":
+						conn.Write([]byte("+OK\r\n"))
+					case args[0] == "EVAL" && args[1] == redisAcquire:
+						if v, ok := keys[args[3]]; ok && v != args[4] {
+							conn.Write([]byte(":0\r\n"))
+						} else {
+							keys[args[3]] = args[4]
+							conn.Write([]byte(":1\r\n"))
+						}
+					case args[0] == "EVAL" && args[1] == redisRelease:
+						n := 0
+						if keys[args[3]] == args[4] {
+							delete(keys, args[3])
+							n = 1
+						}
+						conn.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+					case args[0] == "EVAL" && args[1] == redisSequenceNext:
+						event := ""
+						if args[2] == "2" {
+							event = args[4]
+						}
+						seq, ok := keys[event]
+						if event == "" || !ok {
+							n, _ := strconv.Atoi(keys[args[3]])
+							seq = strconv.Itoa(n + 1)
+							keys[args[3]] = seq
+							if event != "" {
+								keys[event] = seq
+							}
+						}
+						conn.Write([]byte(":" + seq + "\r\n"))
+					case args[0] == "HSET":
+						if hashes[args[1]] == nil {
+							hashes[args[1]] = map[string]string{}
+						}
+						hashes[args[1]][args[2]] = args[3]
+						conn.Write([]byte(":1\r\n"))
+					case args[0] == "HDEL":
+						delete(hashes[args[1]], args[2])
+						conn.Write([]byte(":1\r\n"))
+					case args[0] == "HGETALL":
+						fmt.Fprintf(conn, "*%d\r\n", 2*len(hashes[args[1]]))
+						for field, value := range hashes[args[1]] {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+						}
+					case args[0] == "PEXPIRE":
+						conn.Write([]byte(":1\r\n"))
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String(), keys, func() { l.Close() }
+}
+
+func TestRedisLock(t *testing.T) {
+	addr, keys, done := fakeRedis(t, "hunter2")
+	defer done()
+	ctx := context.Background()
+
+	lock, err := OpenLeaderLock("redis://:hunter2@" + addr + "/2?key=leader")
+	require.NoError(t, err)
+	held, err := lock.Acquire(ctx, "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, map[string]string{"leader": "a"}, keys)
+	held, err = lock.Acquire(ctx, "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, held)
+	require.NoError(t, lock.Release(ctx, "b"))
+	require.NoError(t, lock.Release(ctx, "a"))
+	assert.Empty(t, keys)
+
+	lock, err = OpenLeaderLock("redis://" + addr)
+	require.NoError(t, err)
+	_, err = lock.Acquire(ctx, "a", time.Minute)
+	assert.EqualError(t, err, "redis: NOAUTH Authentication required.")
+}
+
+func TestKubernetesLease(t *testing.T) {
+	var mu sync.Mutex
+	var stored *kubernetesLease
+	version := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "Bearer sa-token", r.Header.Get("Authorization"))
+		const leases = "/apis/coordination.k8s.io/v1/namespaces/proxy/leases"
+		var in kubernetesLease
+		if r.Body != nil {
+			json.NewDecoder(r.Body).Decode(&in)
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == leases+"/leader":
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(stored)
+		case r.Method == http.MethodPost && r.URL.Path == leases:
+			if stored != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			version++
+			in.Metadata.ResourceVersion = strconv.Itoa(version)
+			stored = &in
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(stored)
+		case r.Method == http.MethodPut && r.URL.Path == leases+"/leader":
+			if in.Metadata.ResourceVersion != stored.Metadata.ResourceVersion {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			version++
+			in.Metadata.ResourceVersion = strconv.Itoa(version)
+			stored = &in
+			json.NewEncoder(w).Encode(stored)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"kind":"Status","message":"forbidden"}`))
+		}
+	}))
+	defer api.Close()
+	dir, err := ioutil.TempDir("", "lease")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	token := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(token, []byte("sa-token\n"), 0600))
+
+	lease := &KubernetesLease{Namespace: "proxy", Name: "leader", API: api.URL, TokenFile: token, Client: http.DefaultClient}
+	ctx := context.Background()
+	held, err := lease.Acquire(ctx, "a", 15*time.Second)
+	require.NoError(t, err)
+	assert.True(t, held, "made the lease")
+	held, err = lease.Acquire(ctx, "a", 15*time.Second)
+	require.NoError(t, err)
+	assert.True(t, held, "renewed the lease")
+	held, err = lease.Acquire(ctx, "b", 15*time.Second)
+	require.NoError(t, err)
+	assert.False(t, held, "a holds it")
+	assert.Equal(t, 15, stored.Spec.LeaseDurationSeconds)
+
+	// an expired lease can be taken over
+	stored.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(kubernetesMicroTime)
+	held, err = lease.Acquire(ctx, "b", 15*time.Second)
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, "b", stored.Spec.HolderIdentity)
+	assert.Equal(t, 1, stored.Spec.LeaseTransitions)
+
+	require.NoError(t, lease.Release(ctx, "a"), "a does not hold it")
+	assert.Equal(t, "b", stored.Spec.HolderIdentity)
+	require.NoError(t, lease.Release(ctx, "b"))
+	assert.Equal(t, "", stored.Spec.HolderIdentity)
+
+	lease.Namespace = "other"
+	_, err = lease.Acquire(ctx, "a", 15*time.Second)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "kubernetes returned 403"), err.Error())
+}
+
+func TestOpenLeaderLock(t *testing.T) {
+	for raw, err := range map[string]string{
+		"kubernetes://proxy":    `kubernetes lease "proxy" is not <namespace>/<name>`,
+		"redis://":              "redis needs a host",
+		"zookeeper://zk:2181/x": `no leader lock driver for "zookeeper"`,
+		"default/slack-events":  `leader lock "default/slack-events" needs a scheme`,
+	} {
+		_, got := OpenLeaderLock(raw)
+		assert.EqualError(t, got, err, raw)
+	}
+	lock, err := OpenLeaderLock("rediss://redis.internal")
+	require.NoError(t, err)
+	assert.Equal(t, "rediss", lock.(*RedisLock).URL.Scheme)
+	assert.Equal(t, "slack_events_proxy:leader", lock.(*RedisLock).Key)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const kubernetesServiceAccountCA = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+// kubernetesMicroTime is how the api writes a lease's times
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// KubernetesLease is a lock on a coordination.k8s.io lease, the same kind
+// client-go's leader election uses. The service account needs get, create
+// and update on leases in Namespace.
+type KubernetesLease struct {
+	Namespace string
+	Name      string
+	API       string
+	TokenFile string
+	Client    *http.Client
+}
+
+// openKubernetesLease takes a namespace and lease name, like
+// kubernetes://default/slack-events-proxy, talking to the api server the
+// pod was given
+func openKubernetesLease(spec string) (LeaderLock, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("kubernetes lease %q is not <namespace>/<name>", spec)
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes lease needs to run in a pod, KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", kubernetesServiceAccountCA)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &KubernetesLease{
+		Namespace: parts[0],
+		Name:      parts[1],
+		API:       "https://" + net.JoinHostPort(host, port),
+		TokenFile: kubernetesServiceAccountToken,
+		Client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+type kubernetesLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+func (l *KubernetesLease) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(l.Namespace) + "/leases"
+}
+
+func (l *KubernetesLease) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC().Format(kubernetesMicroTime)
+	var lease kubernetesLease
+	status, err := l.call(ctx, http.MethodGet, l.path()+"/"+url.PathEscape(l.Name), nil, &lease)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name, lease.Metadata.Namespace = l.Name, l.Namespace
+		lease.Spec.HolderIdentity = id
+		lease.Spec.LeaseDurationSeconds = int((ttl + time.Second - 1) / time.Second)
+		lease.Spec.AcquireTime, lease.Spec.RenewTime = now, now
+		status, err = l.call(ctx, http.MethodPost, l.path(), &lease, nil)
+		// another replica made it first
+		return err == nil && status != http.StatusConflict, err
+	}
+
+	if lease.Spec.HolderIdentity != id {
+		renewed, _ := time.Parse(kubernetesMicroTime, lease.Spec.RenewTime)
+		expires := renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if lease.Spec.HolderIdentity != "" && time.Now().Before(expires) {
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = id
+		lease.Spec.AcquireTime = now
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int((ttl + time.Second - 1) / time.Second)
+	lease.Spec.RenewTime = now
+	// the resource version makes this fail if anyone got there first
+	status, err = l.call(ctx, http.MethodPut, l.path()+"/"+url.PathEscape(l.Name), &lease, nil)
+	return err == nil && status != http.StatusConflict, err
+}
+
+func (l *KubernetesLease) Release(ctx context.Context, id string) error {
+	var lease kubernetesLease
+	status, err := l.call(ctx, http.MethodGet, l.path()+"/"+url.PathEscape(l.Name), nil, &lease)
+	if err != nil || status == http.StatusNotFound || lease.Spec.HolderIdentity != id {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	_, err = l.call(ctx, http.MethodPut, l.path()+"/"+url.PathEscape(l.Name), &lease, nil)
+	return err
+}
+
+// call makes a call to the api server, returning the status for not found
+// and conflict, which are not errors here
+func (l *KubernetesLease) call(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+	token, err := ioutil.ReadFile(l.TokenFile)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(method, l.API+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 300:
+		return 0, fmt.Errorf("kubernetes returned %d: %s", resp.StatusCode, bytes.TrimSpace(raw))
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(raw, out)
+	}
+	return resp.StatusCode, nil
+}
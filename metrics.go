@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a tiny prometheus text exposition, enough for counters, gauges and
+// histograms without pulling in the whole client library. Scrapers asking
+// for openmetrics get it, with exemplars on histograms.
+
+type metric interface {
+	writeMetric(w io.Writer, openMetrics bool)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		}
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		for _, m := range metrics {
+			m.writeMetric(w, openMetrics)
+		}
+		if openMetrics {
+			fmt.Fprintln(w, "# EOF")
+		}
+	})
+}
+
+// metricVec holds one value per unique set of label values
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind, name, help string, labels []string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]float64{},
+	}
+}
+
+func (m *metricVec) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s wants %d labels, got %d", m.name, len(m.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (m *metricVec) add(v float64, values []string) {
+	key := m.key(values)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) set(v float64, values []string) {
+	key := m.key(values)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) get(values []string) float64 {
+	key := m.key(values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+// writeHeader writes the HELP and TYPE lines. Openmetrics names counters
+// without their _total.
+func (m *metricVec) writeHeader(w io.Writer, openMetrics bool) {
+	name := m.name
+	if openMetrics && m.kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+}
+
+func (m *metricVec) writeMetric(w io.Writer, openMetrics bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writeHeader(w, openMetrics)
+
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name,
+			formatLabels(m.labels, k), strconv.FormatFloat(m.values[k], 'g', -1, 64))
+	}
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + quoteLabel(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes what the text format needs escaped in label
+// values. Anything else, utf-8 included, goes through as it is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value for the text format, which has to be
+// valid utf-8, so bad bytes are replaced
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
+
+// withLabel adds one more label to labels from formatLabels
+func withLabel(labels, name, value string) string {
+	pair := name + "=" + quoteLabel(value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+type CounterVec struct{ *metricVec }
+
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	c := CounterVec{newMetricVec("counter", name, help, labels)}
+	registerMetric(c)
+	return c
+}
+
+func (c CounterVec) Inc(values ...string)            { c.add(1, values) }
+func (c CounterVec) Add(v float64, values ...string) { c.add(v, values) }
+func (c CounterVec) Get(values ...string) float64    { return c.get(values) }
+
+type GaugeVec struct{ *metricVec }
+
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	g := GaugeVec{newMetricVec("gauge", name, help, labels)}
+	registerMetric(g)
+	return g
+}
+
+func (g GaugeVec) Set(v float64, values ...string) { g.set(v, values) }
+func (g GaugeVec) Add(v float64, values ...string) { g.add(v, values) }
+func (g GaugeVec) Get(values ...string) float64    { return g.get(values) }
+
+// latencyBuckets are in seconds, around slack's 3 second deadline
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 3, 5, 10}
+
+// HistogramVec counts observations into buckets. Each bucket keeps the
+// latest exemplar observed into it, pointing at a trace.
+type HistogramVec struct{ *histogramVec }
+
+type histogramVec struct {
+	*metricVec
+	buckets []float64
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	// counts are per bucket, with +Inf last, and made cumulative on output
+	counts    []uint64
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	h := HistogramVec{&histogramVec{
+		metricVec: newMetricVec("histogram", name, help, labels),
+		buckets:   buckets,
+		series:    map[string]*histogram{},
+	}}
+	registerMetric(h)
+	return h
+}
+
+func (h HistogramVec) Observe(v float64, values ...string) { h.observe(v, "", values) }
+
+// ObserveExemplar observes v, and keeps it as the exemplar for its bucket
+// when traceID is set
+func (h HistogramVec) ObserveExemplar(v float64, traceID string, values ...string) {
+	h.observe(v, traceID, values)
+}
+
+// Count is how many observations there have been
+func (h HistogramVec) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *histogramVec) observe(v float64, traceID string, values []string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{
+			counts:    make([]uint64, len(h.buckets)+1),
+			exemplars: make([]*exemplar, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+	if traceID != "" {
+		s.exemplars[i] = &exemplar{traceID: traceID, value: v, at: time.Now()}
+	}
+}
+
+func (h *histogramVec) writeMetric(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w, openMetrics)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+		labels := formatLabels(h.labels, k)
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d", h.name, withLabel(labels, "le", le), cumulative)
+			if e := s.exemplars[i]; e != nil && openMetrics {
+				fmt.Fprintf(w, " # {trace_id=%s} %s %.3f", quoteLabel(e.traceID),
+					strconv.FormatFloat(e.value, 'g', -1, 64), float64(e.at.UnixNano())/1e9)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "requests seen by the test", "code", "method")
+	counter.Inc("200", http.MethodGet)
+	counter.Add(2, "500", http.MethodPost)
+	gauge := NewGaugeVec("test_depth", "depth of the test")
+	gauge.Set(7)
+
+	assert.Equal(t, float64(2), counter.Get("500", http.MethodPost))
+	assert.Panics(t, func() { counter.Inc("200") })
+
+	ts := httptest.NewServer(MetricsHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `# TYPE test_requests_total counter
+test_requests_total{code="200",method="GET"} 1
+test_requests_total{code="500",method="POST"} 2
+`)
+	assert.Contains(t, string(body), `# TYPE test_depth gauge
+test_depth 7
+`)
+}
+
+func TestQuoteLabel(t *testing.T) {
+	for value, want := range map[string]string{
+		"plain":         `"plain"`,
+		`C:\tmp`:        `"C:\\tmp"`,
+		`say "hi"`:      `"say \"hi\""`,
+		"two\nlines":    `"two\nlines"`,
+		"tab\tand ünï":  "\"tab\tand ünï\"",
+		"bad \xff byte": "\"bad \uFFFD byte\"",
+	} {
+		assert.Equal(t, want, quoteLabel(value), value)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	hist := NewHistogramVec("test_duration_seconds", "duration of the test", []float64{0.1, 1}, "route")
+	NewCounterVec("test_observations_total", "observations in the test").Inc()
+	hist.Observe(0.05, "a")
+	hist.ObserveExemplar(0.5, "4bf92f3577b34da6a3ce929d0e0e4736", "a")
+	hist.Observe(2, "a")
+	assert.Equal(t, uint64(3), hist.Count("a"))
+	assert.Equal(t, uint64(0), hist.Count("b"))
+
+	scrape := func(accept string) string {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		MetricsHandler().ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	text := scrape("text/plain")
+	assert.Contains(t, text, `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="a",le="0.1"} 1
+test_duration_seconds_bucket{route="a",le="1"} 2
+test_duration_seconds_bucket{route="a",le="+Inf"} 3
+test_duration_seconds_sum{route="a"} 2.55
+test_duration_seconds_count{route="a"} 3
+`)
+	assert.NotContains(t, text, "trace_id")
+	assert.NotContains(t, text, "# EOF")
+
+	om := scrape("application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	assert.Contains(t, om, `test_duration_seconds_bucket{route="a",le="1"} 2 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.5 `)
+	assert.Contains(t, om, "# TYPE test_observations counter\ntest_observations_total 1\n")
+	assert.True(t, strings.HasSuffix(om, "# EOF\n"))
+}
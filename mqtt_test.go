@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mqttPublished struct {
+	Topic   string
+	Payload []byte
+}
+
+// serveFakeMQTT accepts one client, checks its connect, and acks every
+// publish until ack returns false
+func serveFakeMQTT(t *testing.T, l net.Listener, connects chan<- string, published chan<- mqttPublished, ack func() bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+			typ, body, err := c.read()
+			if err != nil {
+				return
+			}
+			assert.Equal(t, byte(mqttConnect<<4), typ)
+			assert.Equal(t, "\x00\x04MQTT\x04", string(body[:7]))
+			assert.Equal(t, byte(mqttCleanSession|mqttUsernameFlag|mqttPasswordFlag), body[7])
+			connects <- string(body[10:])
+			c.write(mqttConnack<<4, []byte{0, 0})
+
+			for {
+				typ, body, err := c.read()
+				if err != nil || typ>>4 == mqttDisconnect {
+					return
+				}
+				assert.Equal(t, byte(mqttPublish<<4|mqttQoS1), typ)
+				size := int(binary.BigEndian.Uint16(body))
+				p := mqttPublished{Topic: string(body[2 : 2+size]), Payload: body[4+size:]}
+				if !ack() {
+					return
+				}
+				published <- p
+				c.write(mqttPuback<<4, body[2+size:4+size])
+			}
+		}()
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	connects := make(chan string, 10)
+	published := make(chan mqttPublished, 10)
+	acking := make(chan bool, 10)
+	go serveFakeMQTT(t, l, connects, published, func() bool { return <-acking })
+
+	topic, err := parseKeyTemplate("topic", "slack/{team_id}/{kind}/{type}")
+	require.NoError(t, err)
+	sink := &MQTTSink{
+		URL:      &url.URL{Scheme: "mqtt", User: url.UserPassword("proxy", "pw"), Host: l.Addr().String()},
+		Topic:    topic,
+		ClientID: "proxy-1",
+		Timeout:  time.Second,
+	}
+
+	d := &Delivery{
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   []byte("command=%2Fdoor&team_id=T1&text=open"),
+	}
+	acking <- true
+	require.NoError(t, sink.Send(context.Background(), d))
+	assert.Equal(t, "\x00\x07proxy-1\x00\x05proxy\x00\x02pw", <-connects)
+	p := <-published
+	assert.Equal(t, "slack/T1/command/door", p.Topic)
+	var got Delivery
+	require.NoError(t, json.Unmarshal(p.Payload, &got))
+	assert.Equal(t, d.Body, got.Body)
+
+	// a dropped connection is redialed once
+	before := metricMQTTDeliveries.Get("failed")
+	acking <- false
+	acking <- true
+	require.NoError(t, sink.Send(context.Background(), d))
+	<-connects
+	<-published
+
+	// but not twice
+	acking <- false
+	acking <- false
+	assert.Error(t, sink.Send(context.Background(), d))
+	assert.Equal(t, before+1, metricMQTTDeliveries.Get("failed"))
+	assert.Nil(t, sink.conn)
+}
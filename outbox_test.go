@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryOutbox struct {
+	seen map[string]bool
+	put  []*Delivery
+	err  error
+}
+
+func (m *memoryOutbox) Put(ctx context.Context, key string, d *Delivery) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	if m.seen[key] {
+		return false, nil
+	}
+	m.seen[key] = true
+	m.put = append(m.put, d)
+	return true, nil
+}
+
+func (m *memoryOutbox) Dispatch(ctx context.Context, n int, deliver func(*Delivery) error) (int, error) {
+	return 0, nil
+}
+
+func (m *memoryOutbox) Prune(ctx context.Context, cutoff time.Time) error { return nil }
+
+func TestOutboxHandler(t *testing.T) {
+	var forwarded []string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := readBody(r)
+		forwarded = append(forwarded, string(d))
+		w.Write([]byte("from backend"))
+	})
+	store := &memoryOutbox{seen: map[string]bool{}}
+	h := OutboxHandler(backend, PayloadParserFunc(ParseSlackPayload), store)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	event := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message"}}`
+
+	// stored and acked, and a retry is acked without storing it again
+	for i := 0; i < 2; i++ {
+		w := post(event)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Body.String())
+	}
+	require.Len(t, store.put, 1)
+	assert.Equal(t, event, string(store.put[0].Body))
+	assert.Empty(t, forwarded)
+
+	// challenges need the backend's answer
+	w := post(`{"type":"url_verification","challenge":"abc"}`)
+	assert.Equal(t, "from backend", w.Body.String())
+
+	// a broken store does not lose the event
+	store.err = errors.New("connection refused")
+	w = post(`{"type":"event_callback","event_id":"Ev2","event":{"type":"message"}}`)
+	assert.Equal(t, "from backend", w.Body.String())
+	assert.Len(t, forwarded, 2)
+}
+
+func TestPostgresOutbox(t *testing.T) {
+	stored := map[string]bool{}
+	var claim string
+	var released []string
+	d := &Delivery{Method: http.MethodPost, RequestURI: "/events", Body: []byte(`{"event_id":"Ev1"}`)}
+	raw, err := json.Marshal(d)
+	require.NoError(t, err)
+
+	db := newFakePostgres(t, "secret", func(sql string, args []*string) ([][]*string, string, string) {
+		switch {
+		case strings.HasPrefix(sql, "INSERT INTO slack_events_dedup"):
+			if stored[*args[0]] {
+				return nil, "INSERT 0 0", ""
+			}
+			stored[*args[0]] = true
+			return nil, "INSERT 0 1", ""
+		case strings.Contains(sql, "RETURNING"):
+			assert.Equal(t, "2", *args[0])
+			claim = *args[1]
+			// out of order, as RETURNING may give them
+			return [][]*string{
+				{pgText("2"), pgText("9"), pgText(string(raw))},
+				{pgText("1"), pgText("0"), pgText(string(raw))},
+			}, "UPDATE 2", ""
+		case strings.HasPrefix(sql, "UPDATE"):
+			// only while this dispatcher still holds the claim
+			assert.Contains(t, sql, "claimed_by = $2")
+			released = append(released, *args[0]+" "+*args[1])
+			return nil, "UPDATE 1", ""
+		}
+		return nil, "OK", ""
+	})
+	defer db.Close()
+
+	o, err := OpenPostgresOutbox(db.URL(), 2, 10)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	added, err := o.Put(ctx, "Ev1", d)
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = o.Put(ctx, "Ev1", d)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	var attempts []int
+	n, err := o.Dispatch(ctx, 2, func(d *Delivery) error {
+		attempts = append(attempts, d.Attempts)
+		return errors.New("backend returned 503")
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int{0, 9}, attempts)
+	assert.NotEmpty(t, claim)
+	assert.Equal(t, []string{"1 " + claim, "2 " + claim}, released)
+
+	statements := db.log()[len(outboxSchema):]
+	for i := range statements {
+		statements[i] = strings.SplitN(statements[i], " (", 2)[0]
+		statements[i] = strings.SplitN(statements[i], " SET", 2)[0]
+		statements[i] = strings.SplitN(statements[i], " FROM", 2)[0]
+	}
+	assert.Equal(t, []string{
+		"BEGIN", "INSERT INTO slack_events_dedup", "INSERT INTO slack_events_outbox", "COMMIT",
+		"BEGIN", "INSERT INTO slack_events_dedup", "COMMIT",
+		// claimed in a transaction of its own, then each outcome on its own
+		"BEGIN", "UPDATE slack_events_outbox", "COMMIT",
+		"UPDATE slack_events_outbox", "UPDATE slack_events_outbox",
+	}, statements)
+	log := db.log()
+	assert.Contains(t, log[len(log)-2], "next_attempt_at = now()", "retried")
+	assert.Contains(t, log[len(log)-1], "failed_at = now()", "out of attempts")
+}
+
+func TestOutboxCounters(t *testing.T) {
+	totals := map[string]int{"events duplicate": 40}
+	db := newFakePostgres(t, "secret", func(sql string, args []*string) ([][]*string, string, string) {
+		switch {
+		case strings.HasPrefix(sql, "INSERT INTO slack_events_counters"):
+			n, err := strconv.Atoi(*args[2])
+			require.NoError(t, err)
+			totals[*args[0]+" "+*args[1]] += n
+			return nil, "INSERT 0 1", ""
+		case strings.HasPrefix(sql, "SELECT name, outcome, value"):
+			var rows [][]*string
+			for key, v := range totals {
+				parts := strings.SplitN(key, " ", 2)
+				rows = append(rows, []*string{pgText(parts[0]), pgText(parts[1]), pgText(strconv.Itoa(v))})
+			}
+			return rows, "SELECT " + strconv.Itoa(len(rows)), ""
+		}
+		return nil, "OK", ""
+	})
+	defer db.Close()
+	o, err := OpenPostgresOutbox(db.URL(), 1, 10)
+	require.NoError(t, err)
+
+	// only what is counted from here on is added
+	synced := map[string]float64{}
+	for _, each := range outboxCounters {
+		for _, outcome := range each.outcomes {
+			synced[each.name+" "+outcome] = each.counter.Get(outcome)
+		}
+	}
+	metricOutboxEvents.Inc("duplicate")
+	metricOutboxEvents.Inc("duplicate")
+	metricOutboxDeliveries.Inc("failed")
+
+	ctx := context.Background()
+	require.NoError(t, o.SyncCounters(ctx, synced))
+	assert.Equal(t, map[string]int{"events duplicate": 42, "deliveries failed": 1}, totals)
+	assert.Equal(t, float64(42), metricOutboxEventsCumulative.Get("duplicate"))
+	assert.Equal(t, float64(1), metricOutboxDeliveriesCumulative.Get("failed"))
+	assert.Equal(t, float64(0), metricOutboxDeliveriesCumulative.Get("delivered"))
+
+	// nothing new is not added again, but another replica's counts show up
+	totals["deliveries delivered"] = 7
+	require.NoError(t, o.SyncCounters(ctx, synced))
+	assert.Equal(t, 42, totals["events duplicate"])
+	assert.Equal(t, float64(7), metricOutboxDeliveriesCumulative.Get("delivered"))
+}
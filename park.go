@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagParkDir = kingpin.
+			Flag("park-dir", "directory to keep events the backend failed in, they are acked and forwarded again once it recovers").
+			Envar("PARK_DIR").String()
+	flagParkInterval = kingpin.
+				Flag("park-interval", "how often parked events are tried again").
+				Envar("PARK_INTERVAL").Default("10s").Duration()
+)
+
+var (
+	metricParkedEvents = NewCounterVec("parked_events_total",
+		"events handled by --park-dir, by outcome: parked, forwarded or failed", "outcome")
+	metricParkQueue = NewGaugeVec("parked_events",
+		"events waiting in --park-dir")
+)
+
+// parked is set up in main when --park-dir is set
+var parked *ParkQueue
+
+// ParkQueue keeps events on disk, a file each, so they outlive restarts.
+// Files are named by when the event came in, and forwarded in that order.
+type ParkQueue struct {
+	dir string
+	// only one drain at a time, so no event is forwarded twice
+	mu sync.Mutex
+}
+
+func OpenParkQueue(dir string) (*ParkQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &ParkQueue{dir: dir}
+	names, err := q.names()
+	if err != nil {
+		return nil, err
+	}
+	metricParkQueue.Set(float64(len(names)))
+	return q, nil
+}
+
+// names lists the parked events, oldest first
+func (q *ParkQueue) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// Put writes d to disk, it is parked once this returns
+func (q *ParkQueue) Put(d *Delivery) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(d.IdempotencyKey()))
+	name := fmt.Sprintf("%020d-%s.json", d.ReceivedAt.UnixNano(), hex.EncodeToString(sum[:8]))
+	if err := writeFileAtomic(filepath.Join(q.dir, name), raw); err != nil {
+		return err
+	}
+	metricParkQueue.Add(1)
+	return nil
+}
+
+// Drain hands parked events to deliver, oldest first, removing each that
+// goes through. It stops at the first failure, the backend is likely still
+// down, but passes over events a backend's schedule held back. It returns
+// how many were delivered.
+func (q *ParkQueue) Drain(deliver func(*Delivery) error) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	names, err := q.names()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		path := filepath.Join(q.dir, name)
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return n, err
+		}
+		var d Delivery
+		if err := json.Unmarshal(raw, &d); err != nil {
+			// kept for a person to look at, but out of the way
+			log.Printf("park: %s: %v, moving it aside", name, err)
+			metricParkQueue.Add(-1)
+			if err := os.Rename(path, path+".bad"); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := deliver(&d); errors.Is(err, errDeliveryDeferred) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+		metricParkedEvents.Inc("forwarded")
+		metricParkQueue.Add(-1)
+		if err := os.Remove(path); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ParkHandler forwards events to child, and parks those the backend fails
+// with a 5xx or 429, acking them with an empty 200 so slack does not retry
+// them, or give up on them after its own retries. If an event can not be
+// parked the backend's answer is passed on. Commands and interactions,
+// and url_verification, need the backend's answer so go straight to child.
+func ParkHandler(child http.Handler, parser PayloadParser, q *ParkQueue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.Type == "url_verification" {
+			child.ServeHTTP(w, r)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		resp := NewResponseBuffer()
+		child.ServeHTTP(resp, r)
+		if status := resp.StatusCode(); status != http.StatusTooManyRequests && status < 500 {
+			resp.CopyTo(w)
+			return
+		}
+		if err := q.Put(NewDelivery(r, body)); err != nil {
+			log.Printf("park: %v", err)
+			metricParkedEvents.Inc("failed")
+			resp.CopyTo(w)
+			return
+		}
+		metricParkedEvents.Inc("parked")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// runParked tries parked events again every interval, until the process
+// exits
+func runParked(q *ParkQueue, forward http.Handler, interval time.Duration) {
+	for {
+		if _, err := q.Drain(func(d *Delivery) error { return forwardDelivery(forward, d) }); err != nil {
+			log.Printf("park: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParkHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "park")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	q, err := OpenParkQueue(filepath.Join(dir, "parked"))
+	require.NoError(t, err)
+
+	down := true
+	var forwarded []string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if down {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		forwarded = append(forwarded, string(body))
+		w.Write([]byte("ok"))
+	})
+	h := ParkHandler(backend, PayloadParserFunc(ParseSlackPayload), q)
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	event := func(id string) string {
+		return `{"type":"event_callback","event_id":"` + id + `","event":{"type":"message"}}`
+	}
+
+	// events the backend fails are acked and parked
+	for _, id := range []string{"Ev1", "Ev2", "Ev3"} {
+		w := post("application/json", event(id))
+		assert.Equal(t, http.StatusOK, w.Code, id)
+		assert.Empty(t, w.Body.String(), id)
+	}
+	// commands still get the backend's failure
+	w := post("application/x-www-form-urlencoded", "command=%2Fops")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	names, err := q.names()
+	require.NoError(t, err)
+	assert.Len(t, names, 3)
+
+	// nothing drains while the backend is down
+	deliver := func(d *Delivery) error { return forwardDelivery(backend, d) }
+	n, err := q.Drain(deliver)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	// a file that can not be read back is moved aside
+	require.NoError(t, ioutil.WriteFile(filepath.Join(q.dir, "00000000000000000000-bad.json"), []byte("{"), 0600))
+
+	down = false
+	n, err = q.Drain(deliver)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{event("Ev1"), event("Ev2"), event("Ev3")}, forwarded)
+	names, err = q.names()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	_, err = os.Stat(filepath.Join(q.dir, "00000000000000000000-bad.json.bad"))
+	assert.NoError(t, err)
+
+	// once up, events are forwarded as usual
+	w = post("application/json", event("Ev4"))
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestParkQueueDrainStops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "park")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	q, err := OpenParkQueue(dir)
+	require.NoError(t, err)
+
+	for _, body := range []string{"one", "two"} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		require.NoError(t, q.Put(NewDelivery(r, []byte(body))))
+	}
+	var tried []string
+	n, err := q.Drain(func(d *Delivery) error {
+		tried = append(tried, string(d.Body))
+		return errors.New("down")
+	})
+	assert.EqualError(t, err, "down")
+	assert.Equal(t, 0, n)
+	assert.Equal(t, []string{"one"}, tried)
+}
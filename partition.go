@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagPartitionKey = kingpin.
+	Flag("partition-key", "partition key template for queue sinks, from {team_id}, {channel_id}, {user_id}, {app_id}, {kind} and {type}").
+	Envar("PARTITION_KEY").Default("{team_id}/{channel_id}").String()
+
+// partitionKey is parsed from --partition-key in main, for queue sinks
+var partitionKey *PartitionKey
+
+// payload fields a partition key can be built from
+var partitionFields = map[string]func(p *Payload) string{
+	"team_id":    func(p *Payload) string { return p.TeamID },
+	"channel_id": func(p *Payload) string { return p.ChannelID },
+	"user_id":    func(p *Payload) string { return p.UserID },
+	"app_id":     func(p *Payload) string { return p.AppID },
+	"kind":       func(p *Payload) string { return p.Kind },
+	"type":       func(p *Payload) string { return p.Type },
+}
+
+// PartitionKey picks the partition or ordering key a queue sink sends a
+// delivery with. Deliveries with the same key stay in order, so keying by
+// channel keeps each conversation in order downstream.
+type PartitionKey struct {
+	literals []string
+	fields   []func(p *Payload) string
+}
+
+// ParsePartitionKey parses templates like "{team_id}/{channel_id}".
+func ParsePartitionKey(template string) (*PartitionKey, error) {
+	k, err := parseKeyTemplate("partition key", template)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.fields) < 1 {
+		return nil, fmt.Errorf("partition key %q uses no fields", template)
+	}
+	return k, nil
+}
+
+// parseKeyTemplate parses any template over partitionFields, what names
+// the template in errors
+func parseKeyTemplate(what, template string) (*PartitionKey, error) {
+	k := &PartitionKey{}
+	rest := template
+	for {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			k.literals = append(k.literals, rest)
+			break
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("%s %q: unclosed {", what, template)
+		}
+		name := rest[open+1 : open+end]
+		field, ok := partitionFields[name]
+		if !ok {
+			return nil, fmt.Errorf("%s %q: unknown field %q", what, template, name)
+		}
+		k.literals = append(k.literals, rest[:open])
+		k.fields = append(k.fields, field)
+		rest = rest[open+end+1:]
+	}
+	return k, nil
+}
+
+// Key renders the key for d. Payloads without any of the fields, or that
+// can not be parsed, get their idempotency key, which spreads them out as
+// there is no order to keep.
+func (k *PartitionKey) Key(d *Delivery) string {
+	p, err := d.Payload(PayloadParserFunc(ParseSlackPayload))
+	if err != nil {
+		return d.IdempotencyKey()
+	}
+	key, found := k.Render(p)
+	if !found {
+		return d.IdempotencyKey()
+	}
+	return key
+}
+
+// Render fills the template in from p, found is false if every field was
+// empty.
+func (k *PartitionKey) Render(p *Payload) (key string, found bool) {
+	var b strings.Builder
+	for i, field := range k.fields {
+		b.WriteString(k.literals[i])
+		value := field(p)
+		found = found || value != ""
+		b.WriteString(value)
+	}
+	b.WriteString(k.literals[len(k.literals)-1])
+	return b.String(), found
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionKey(t *testing.T) {
+	event := `{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message","channel":"C1","user":"U1"}}`
+	noChannel := `{"type":"event_callback","event_id":"Ev2","event":{"type":"team_join"}}`
+
+	for name, tc := range map[string]struct {
+		template string
+		body     string
+		key      string
+		err      string
+	}{
+		"default":      {template: "{team_id}/{channel_id}", body: event, key: "T1/C1"},
+		"literals":     {template: "slack-{user_id}-x", body: event, key: "slack-U1-x"},
+		"no fields":    {template: "{channel_id}", body: noChannel, key: "Ev2"},
+		"unparsable":   {template: "{channel_id}", body: "{", key: "021fb596db81e6d02bf3d2586ee3981fe519f275c0ac9ca76bbcf2ebb4097d96"},
+		"unknown":      {template: "{channel}", err: `partition key "{channel}": unknown field "channel"`},
+		"unclosed":     {template: "{team_id", err: `partition key "{team_id": unclosed {`},
+		"only literal": {template: "all", err: `partition key "all" uses no fields`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			k, err := ParsePartitionKey(tc.template)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			in := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			in.Header.Set("Content-Type", "application/json")
+			assert.Equal(t, tc.key, k.Key(NewDelivery(in, []byte(tc.body))))
+		})
+	}
+}
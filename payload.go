@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+)
+
+// payload kinds shared by every provider
+const (
+	PayloadEvent       = "event"
+	PayloadCommand     = "command"
+	PayloadInteraction = "interaction"
+)
+
+// Payload is the provider neutral view of a request body that the routing
+// and filter layers work with.
+type Payload struct {
+	Kind       string // one of the Payload* kinds
+	Type       string // event type, slash command, or interaction type
+	ID         string // event_id for events, trigger_id otherwise
+	TeamID     string
+	AppID      string
+	ChannelID  string
+	UserID     string
+	Text       string
+	CallbackID string
+}
+
+// PayloadParser turns a verified request body into a Payload. The body may
+// be a spooled file mapped into memory, so it must not be kept past the call.
+type PayloadParser interface {
+	ParsePayload(r *http.Request, body []byte) (*Payload, error)
+}
+
+type PayloadParserFunc func(r *http.Request, body []byte) (*Payload, error)
+
+func (f PayloadParserFunc) ParsePayload(r *http.Request, body []byte) (*Payload, error) {
+	return f(r, body)
+}
+
+var ErrUnknownPayload = errors.New("unknown payload format")
+
+var (
+	payloadParsersMu sync.RWMutex
+	payloadParsers   = map[string]PayloadParser{
+		"slack": PayloadParserFunc(ParseSlackPayload),
+	}
+)
+
+// RegisterPayloadParser makes a parser available by provider name, so
+// providers other than slack can plug in their own formats.
+func RegisterPayloadParser(provider string, p PayloadParser) {
+	payloadParsersMu.Lock()
+	defer payloadParsersMu.Unlock()
+	payloadParsers[provider] = p
+}
+
+func LookupPayloadParser(provider string) (PayloadParser, error) {
+	payloadParsersMu.RLock()
+	defer payloadParsersMu.RUnlock()
+	p, ok := payloadParsers[provider]
+	if !ok {
+		return nil, fmt.Errorf("no payload parser for provider %q", provider)
+	}
+	return p, nil
+}
+
+// ParseSlackPayload picks the slack format based on the content type -
+// events come in as json, commands and interactivity as forms.
+func ParseSlackPayload(r *http.Request, body []byte) (*Payload, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		return ParseSlackEvent(body)
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		if form.Get("payload") != "" {
+			return ParseSlackInteraction(form)
+		}
+		return ParseSlackCommand(form)
+	}
+	return nil, ErrUnknownPayload
+}
+
+type slackEventEnvelope struct {
+	Type     string `json:"type"`
+	TeamID   string `json:"team_id"`
+	APIAppID string `json:"api_app_id"`
+	EventID  string `json:"event_id"`
+	Event    struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		User    string `json:"user"`
+		Text    string `json:"text"`
+	} `json:"event"`
+}
+
+func ParseSlackEvent(body []byte) (*Payload, error) {
+	var env slackEventEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, err
+	}
+	if env.Type == "" {
+		return nil, ErrUnknownPayload
+	}
+
+	p := &Payload{
+		Kind:      PayloadEvent,
+		Type:      env.Event.Type,
+		ID:        env.EventID,
+		TeamID:    env.TeamID,
+		AppID:     env.APIAppID,
+		ChannelID: env.Event.Channel,
+		UserID:    env.Event.User,
+		Text:      env.Event.Text,
+	}
+	if p.Type == "" {
+		// envelopes without an inner event, like url_verification
+		p.Type = env.Type
+	}
+	return p, nil
+}
+
+func ParseSlackCommand(form url.Values) (*Payload, error) {
+	if form.Get("command") == "" {
+		return nil, ErrUnknownPayload
+	}
+	return &Payload{
+		Kind:      PayloadCommand,
+		Type:      form.Get("command"),
+		ID:        form.Get("trigger_id"),
+		TeamID:    form.Get("team_id"),
+		AppID:     form.Get("api_app_id"),
+		ChannelID: form.Get("channel_id"),
+		UserID:    form.Get("user_id"),
+		Text:      form.Get("text"),
+	}, nil
+}
+
+type slackInteraction struct {
+	Type       string `json:"type"`
+	TriggerID  string `json:"trigger_id"`
+	CallbackID string `json:"callback_id"`
+	APIAppID   string `json:"api_app_id"`
+	Team       struct {
+		ID string `json:"id"`
+	} `json:"team"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	View struct {
+		CallbackID string `json:"callback_id"`
+	} `json:"view"`
+}
+
+func ParseSlackInteraction(form url.Values) (*Payload, error) {
+	var in slackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &in); err != nil {
+		return nil, err
+	}
+	if in.Type == "" {
+		return nil, ErrUnknownPayload
+	}
+
+	p := &Payload{
+		Kind:       PayloadInteraction,
+		Type:       in.Type,
+		ID:         in.TriggerID,
+		TeamID:     in.Team.ID,
+		AppID:      in.APIAppID,
+		ChannelID:  in.Channel.ID,
+		UserID:     in.User.ID,
+		CallbackID: in.CallbackID,
+	}
+	if p.CallbackID == "" {
+		// modal payloads carry the callback_id on the view
+		p.CallbackID = in.View.CallbackID
+	}
+	return p, nil
+}
+
+// RequestPayload parses the body of r, leaving the body in place for the
+// next handler to read. Under PayloadCacheHandler the body is only parsed
+// once, and a spooled body is parsed from the file rather than read into
+// memory.
+func RequestPayload(r *http.Request, parser PayloadParser) (*Payload, error) {
+	cache, _ := r.Context().Value(payloadCacheKey{}).(*payloadCache)
+	if cache != nil {
+		if p, err, ok := cache.get(parser); ok {
+			return p, err
+		}
+	}
+
+	var p *Payload
+	if spooled, ok := r.Body.(spooledBody); ok {
+		body, unmap, err := mapBody(spooled.File)
+		if err != nil {
+			return nil, err
+		}
+		p, err = parser.ParsePayload(r, body)
+		if unmapErr := unmap(); err == nil && unmapErr != nil {
+			return nil, unmapErr
+		}
+		if cache != nil {
+			cache.set(parser, p, err)
+		}
+		return p, err
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	p, err = parser.ParsePayload(r, body)
+	if cache != nil {
+		cache.set(parser, p, err)
+	}
+	return p, err
+}
+
+type payloadCacheKey struct{}
+
+// payloadCache holds what RequestPayload made of a request's body
+type payloadCache struct {
+	mu      sync.Mutex
+	parser  PayloadParser
+	payload *Payload
+	err     error
+}
+
+func (c *payloadCache) get(parser PayloadParser) (*Payload, error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.parser == nil || !sameParser(c.parser, parser) {
+		return nil, nil, false
+	}
+	return c.payload, c.err, true
+}
+
+func (c *payloadCache) set(parser PayloadParser, p *Payload, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parser, c.payload, c.err = parser, p, err
+}
+
+// sameParser compares parsers, including PayloadParserFuncs, which == can
+// not. Those are told apart by their code, so closures from one func
+// literal count as the same parser.
+func sameParser(a, b PayloadParser) bool {
+	fa, okA := a.(PayloadParserFunc)
+	fb, okB := b.(PayloadParserFunc)
+	if okA || okB {
+		return okA && okB && reflect.ValueOf(fa).Pointer() == reflect.ValueOf(fb).Pointer()
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// PayloadCacheHandler lets the handlers under it share the payload of each
+// request instead of every one parsing the body.
+func PayloadCacheHandler(child http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		child.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), payloadCacheKey{}, &payloadCache{})))
+	})
+}
+
+// readBody reads the whole body of r and puts a fresh copy back in its place.
+// A body spooled to a temp file stays there, rewound for the next read.
+func readBody(r *http.Request) ([]byte, error) {
+	if spooled, ok := r.Body.(spooledBody); ok {
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(spooled)
+		if err != nil {
+			return nil, err
+		}
+		_, err = spooled.Seek(0, io.SeekStart)
+		return body, err
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSlackPayload(t *testing.T) {
+	parser, err := LookupPayloadParser("slack")
+	require.NoError(t, err)
+
+	for name, tc := range testdataParseSlackPayload {
+		t.Run(name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			r.Header.Set("Content-Type", tc.contentType)
+
+			p, err := parser.ParsePayload(r, []byte(tc.body))
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.exp, p)
+		})
+	}
+}
+
+func TestRegisterPayloadParser(t *testing.T) {
+	_, err := LookupPayloadParser("github")
+	assert.EqualError(t, err, `no payload parser for provider "github"`)
+
+	RegisterPayloadParser("github", PayloadParserFunc(
+		func(r *http.Request, body []byte) (*Payload, error) {
+			return &Payload{Kind: PayloadEvent, Type: r.Header.Get("X-GitHub-Event")}, nil
+		}))
+	defer func() {
+		payloadParsersMu.Lock()
+		delete(payloadParsers, "github")
+		payloadParsersMu.Unlock()
+	}()
+
+	parser, err := LookupPayloadParser("github")
+	require.NoError(t, err)
+	r, err := http.NewRequest(http.MethodPost, "/", nil)
+	require.NoError(t, err)
+	r.Header.Set("X-GitHub-Event", "push")
+	p, err := parser.ParsePayload(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &Payload{Kind: PayloadEvent, Type: "push"}, p)
+}
+
+func TestRequestPayloadCache(t *testing.T) {
+	parses := 0
+	counting := PayloadParserFunc(func(r *http.Request, body []byte) (*Payload, error) {
+		parses++
+		return ParseSlackPayload(r, body)
+	})
+	body := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message"}}`
+
+	var got []*Payload
+	h := PayloadCacheHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, parser := range []PayloadParser{counting, counting, PayloadParserFunc(ParseSlackPayload)} {
+			p, err := RequestPayload(r, parser)
+			require.NoError(t, err)
+			got = append(got, p)
+		}
+		// the body is still there for the next handler
+		rest, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(rest))
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, 1, parses)
+	require.Len(t, got, 3)
+	assert.True(t, got[0] == got[1], "the second call gets the cached payload")
+	assert.Equal(t, got[0], got[2])
+}
+
+func TestRequestPayloadSpooled(t *testing.T) {
+	f, err := ioutil.TempFile("", "slack-body-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	body := `{"type":"event_callback","event_id":"Ev1","event":{"type":"message"}}`
+	_, err = f.WriteString(body)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+	r.Header.Set("Content-Type", "application/json")
+	r.Body = spooledBody{f}
+	p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload))
+	require.NoError(t, err)
+	assert.Equal(t, "Ev1", p.ID)
+
+	// parsing leaves the file where it was
+	rest, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(rest))
+}
@@ -0,0 +1,96 @@
+package main
+
+import "net/url"
+
+var testdataParseSlackPayload = map[string]struct {
+	contentType string
+	body        string
+	exp         *Payload
+	err         string
+}{
+	"event": {
+		contentType: "application/json",
+		body:        `{"type":"event_callback","team_id":"T1","api_app_id":"A1","event_id":"Ev1","event":{"type":"message","channel":"C1","user":"U1","text":"hi"}}`,
+		exp: &Payload{
+			Kind:      PayloadEvent,
+			Type:      "message",
+			ID:        "Ev1",
+			TeamID:    "T1",
+			AppID:     "A1",
+			ChannelID: "C1",
+			UserID:    "U1",
+			Text:      "hi",
+		},
+	},
+	"url verification": {
+		contentType: "application/json; charset=utf-8",
+		body:        `{"type":"url_verification","challenge":"abc","token":"x"}`,
+		exp:         &Payload{Kind: PayloadEvent, Type: "url_verification"},
+	},
+	"command": {
+		contentType: "application/x-www-form-urlencoded",
+		body: url.Values{
+			"command":    {"/ops"},
+			"text":       {"deploy api"},
+			"team_id":    {"T1"},
+			"api_app_id": {"A1"},
+			"channel_id": {"C1"},
+			"user_id":    {"U1"},
+			"trigger_id": {"13345224609.738474920.8088930838d88f008e0"},
+		}.Encode(),
+		exp: &Payload{
+			Kind:      PayloadCommand,
+			Type:      "/ops",
+			ID:        "13345224609.738474920.8088930838d88f008e0",
+			TeamID:    "T1",
+			AppID:     "A1",
+			ChannelID: "C1",
+			UserID:    "U1",
+			Text:      "deploy api",
+		},
+	},
+	"view submission": {
+		contentType: "application/x-www-form-urlencoded",
+		body: url.Values{"payload": {
+			`{"type":"view_submission","trigger_id":"t1","api_app_id":"A1","team":{"id":"T1"},"user":{"id":"U1"},"view":{"callback_id":"new-ticket"}}`,
+		}}.Encode(),
+		exp: &Payload{
+			Kind:       PayloadInteraction,
+			Type:       "view_submission",
+			ID:         "t1",
+			TeamID:     "T1",
+			AppID:      "A1",
+			UserID:     "U1",
+			CallbackID: "new-ticket",
+		},
+	},
+	"block actions": {
+		contentType: "application/x-www-form-urlencoded",
+		body: url.Values{"payload": {
+			`{"type":"block_actions","trigger_id":"t2","team":{"id":"T1"},"channel":{"id":"C1"},"user":{"id":"U1"}}`,
+		}}.Encode(),
+		exp: &Payload{
+			Kind:      PayloadInteraction,
+			Type:      "block_actions",
+			ID:        "t2",
+			TeamID:    "T1",
+			ChannelID: "C1",
+			UserID:    "U1",
+		},
+	},
+	"bad json": {
+		contentType: "application/json",
+		body:        `{"type":`,
+		err:         "unexpected end of JSON input",
+	},
+	"form without command": {
+		contentType: "application/x-www-form-urlencoded",
+		body:        "team_id=T1",
+		err:         ErrUnknownPayload.Error(),
+	},
+	"unknown content type": {
+		contentType: "text/plain",
+		body:        "hello",
+		err:         ErrUnknownPayload.Error(),
+	},
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PipelineStage is one step of the handler chain in the config file.
+// Stages that take Params use them in place of the flags for that stage.
+type PipelineStage struct {
+	Stage  string          `json:"stage"`
+	Params json.RawMessage `json:"params"`
+}
+
+// defaultPipeline is the chain without a pipeline in the config, in the
+// order requests pass through it
+var defaultPipeline = []string{
+	"restrict_uri",
+	"probe",
+	"restrict_method",
+	"restrict_user_agent",
+	"body_read_timeout",
+	"header_limit",
+	"body_limit",
+	"body_spool",
+	"jwt_routes",
+	"verify_signature",
+	"label",
+	"rate_limit",
+	"challenge",
+	"retry_classify",
+	"anomaly",
+	"silence",
+	"ack",
+}
+
+// stageBuilder wraps next in one stage, or returns nil when the flags and
+// config leave the stage off
+type stageBuilder func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error)
+
+var pipelineStages = map[string]stageBuilder{
+	"restrict_uri": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			URIs []string `json:"uris"`
+		}{}
+		if err := stageParams(params, &p); err != nil {
+			return nil, err
+		}
+		if len(p.URIs) > 0 {
+			return RestrictURIHandler(next, p.URIs...), nil
+		}
+		if len(config.AllowedURIs) > 0 {
+			return RestrictURIHandler(next, config.AllowedURIs...), nil
+		}
+		if *flagHttpAllowedURIsSetByUser {
+			return RestrictURIHandler(next, *flagHttpAllowedURIs...), nil
+		}
+		return nil, nil
+	},
+	"probe": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		return ProbeHandler(next, allowedMethods(config)...), stageParams(params, nil)
+	},
+	"restrict_method": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			Methods []string `json:"methods"`
+		}{}
+		if err := stageParams(params, &p); err != nil {
+			return nil, err
+		}
+		if len(p.Methods) > 0 {
+			return RestrictMethodHandler(next, p.Methods...), nil
+		}
+		if len(config.AllowedMethods) > 0 || *flagHttpAllowedMethodsSetByUser {
+			return RestrictMethodHandler(next, allowedMethods(config)...), nil
+		}
+		return nil, nil
+	},
+	"restrict_user_agent": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			Prefixes []string `json:"prefixes"`
+		}{*flagUserAgents}
+		if err := stageParams(params, &p); err != nil || len(p.Prefixes) == 0 {
+			return nil, err
+		}
+		return RestrictUserAgentHandler(next, p.Prefixes...), nil
+	},
+	"body_read_timeout": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			Timeout Duration `json:"timeout"`
+		}{Duration(*flagBodyReadTimeout)}
+		if err := stageParams(params, &p); err != nil || p.Timeout <= 0 {
+			return nil, err
+		}
+		return BodyReadTimeoutHandler(next, time.Duration(p.Timeout)), nil
+	},
+	"header_limit": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			Max int `json:"max"`
+		}{*flagMaxHeaders}
+		if err := stageParams(params, &p); err != nil || p.Max <= 0 {
+			return nil, err
+		}
+		return HeaderLimitHandler(next, p.Max), nil
+	},
+	"body_limit": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			MaxBytes int64 `json:"max_bytes"`
+		}{int64(*flagMaxBodyBytes)}
+		if err := stageParams(params, &p); err != nil || p.MaxBytes <= 0 {
+			return nil, err
+		}
+		return BodyLimitHandler(next, p.MaxBytes), nil
+	},
+	"body_spool": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		p := struct {
+			Threshold int64 `json:"threshold"`
+		}{int64(*flagBodySpoolThreshold)}
+		if err := stageParams(params, &p); err != nil || p.Threshold <= 0 {
+			return nil, err
+		}
+		return SpoolBodyHandler(next, p.Threshold, *flagBodySpoolDir), nil
+	},
+	// routes authenticated by jwt skip everything after this stage
+	"jwt_routes": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		routes := jwtRoutes(config, forward)
+		if err := stageParams(params, nil); err != nil || len(routes) == 0 {
+			return nil, err
+		}
+		return PathRouteHandler(next, routes...), nil
+	},
+	"verify_signature": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		next = SampleHandler(next, tracer)
+		h := (&SlackVerifier{
+			SecretsFunc: slackSecrets.Get,
+			Expire:      *flagSlackExpire,
+			Versions:    *flagSlackSignatureVersions,
+			Replays:     slackReplays,
+		}).Handler(next)
+		if teamSecrets(config) {
+			h = TeamVerifyHandler(h, config.Teams, func(secret string) http.Handler {
+				return (&SlackVerifier{
+					Secrets:  []string{secret},
+					Expire:   *flagSlackExpire,
+					Versions: *flagSlackSignatureVersions,
+					Replays:  slackReplays,
+				}).Handler(next)
+			})
+		}
+		h = AppVerifyHandler(h, config.Apps, func(secret string, expire time.Duration) http.Handler {
+			return (&SlackVerifier{
+				Secrets:  []string{secret},
+				Expire:   expire,
+				Versions: *flagSlackSignatureVersions,
+				Replays:  slackReplays,
+			}).Handler(next)
+		})
+		return h, stageParams(params, nil)
+	},
+	"label": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		if err := stageParams(params, nil); err != nil || (len(config.Labels) == 0 && len(config.RateLimits) == 0) {
+			return nil, err
+		}
+		return LabelHandler(next, PayloadParserFunc(ParseSlackPayload), config.Labels), nil
+	},
+	"rate_limit": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		if err := stageParams(params, nil); err != nil || len(config.RateLimits) == 0 {
+			return nil, err
+		}
+		return RateLimitHandler(next, buildRateLimits(config.RateLimits)...), nil
+	},
+	"challenge": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		if err := stageParams(params, nil); err != nil || !*flagAnswerChallenges {
+			return nil, err
+		}
+		return ChallengeHandler(next, PayloadParserFunc(ParseSlackPayload)), nil
+	},
+	"retry_classify": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		if err := stageParams(params, nil); err != nil || retryHistory == nil {
+			return nil, err
+		}
+		return RetryClassifyHandler(next, PayloadParserFunc(ParseSlackPayload), retryHistory), nil
+	},
+	"anomaly": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		if err := stageParams(params, nil); err != nil || eventVolumes == nil {
+			return nil, err
+		}
+		return AnomalyHandler(next, PayloadParserFunc(ParseSlackPayload), eventVolumes, *flagAnomalyThrottle), nil
+	},
+	"silence": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		return SilenceHandler(next, PayloadParserFunc(ParseSlackPayload), silences), stageParams(params, nil)
+	},
+	"ack": func(next http.Handler, config *Config, forward http.Handler, params json.RawMessage) (http.Handler, error) {
+		if err := stageParams(params, nil); err != nil {
+			return nil, err
+		}
+		if parked != nil {
+			next = ParkHandler(next, PayloadParserFunc(ParseSlackPayload), parked)
+		}
+		switch {
+		case outbox != nil:
+			return OutboxHandler(next, PayloadParserFunc(ParseSlackPayload), outbox), nil
+		case asyncAcks != nil:
+			return AsyncAckHandler(next, PayloadParserFunc(ParseSlackPayload), asyncAcks, *flagAsyncAckInteractive), nil
+		case *flagAckEvents:
+			return AckEventsHandler(next, PayloadParserFunc(ParseSlackPayload), *flagAckBackendTimeout), nil
+		case parked != nil:
+			return next, nil
+		}
+		return nil, nil
+	},
+}
+
+// allowedMethods are the methods from the config, or else --method
+func allowedMethods(config *Config) []string {
+	if len(config.AllowedMethods) > 0 {
+		return config.AllowedMethods
+	}
+	return *flagHttpAllowedMethods
+}
+
+// stageParams decodes params into into, which is nil for stages that take
+// none
+func stageParams(params json.RawMessage, into interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if into == nil {
+		return fmt.Errorf("takes no params")
+	}
+	d := json.NewDecoder(bytes.NewReader(params))
+	d.DisallowUnknownFields()
+	return d.Decode(into)
+}
+
+// buildPipeline wraps forward in stages, so the first stage sees requests
+// first. Each stage in use gets its own trace span. Routes in the config
+// can skip stages, or add their own, for requests on their path.
+func buildPipeline(stages []PipelineStage, config *Config, forward http.Handler) (http.Handler, error) {
+	skips := map[string][]string{}
+	for _, rc := range config.Routes {
+		for _, stage := range rc.Skip {
+			skips[stage] = append(skips[stage], rc.Path)
+		}
+	}
+
+	h, err := wrapStages(forward, stages, config, forward, skips)
+	if err != nil {
+		return nil, err
+	}
+	var routes []PathRoute
+	for _, rc := range config.Routes {
+		if len(rc.Stages) == 0 {
+			continue
+		}
+		routed, err := wrapStages(h, rc.Stages, config, forward, nil)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", rc.Name, err)
+		}
+		routes = append(routes, PathRoute{Prefix: rc.Path, Handler: routed})
+	}
+	if len(routes) > 0 {
+		h = PathRouteHandler(h, routes...)
+	}
+	return h, nil
+}
+
+// wrapStages wraps next in stages. Requests on a path in skips for a stage
+// go straight past it.
+func wrapStages(next http.Handler, stages []PipelineStage, config *Config,
+	forward http.Handler, skips map[string][]string) (http.Handler, error) {
+	h := next
+	for i := len(stages) - 1; i >= 0; i-- {
+		wrapped, err := pipelineStages[stages[i].Stage](h, config, forward, stages[i].Params)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline stage %s: %v", stages[i].Stage, err)
+		}
+		if wrapped == nil {
+			continue
+		}
+		wrapped = TraceHandler(wrapped, tracer, stages[i].Stage, SpanKindInternal)
+		if skipped := skips[stages[i].Stage]; len(skipped) > 0 {
+			past := make([]PathRoute, len(skipped))
+			for j, prefix := range skipped {
+				past[j] = PathRoute{Prefix: prefix, Handler: h}
+			}
+			wrapped = PathRouteHandler(wrapped, past...)
+		}
+		h = wrapped
+	}
+	return h, nil
+}
+
+// validatePipeline checks a pipeline from the config. Requests must always
+// be verified, and stages that depend on another must come after it.
+func validatePipeline(stages []PipelineStage, config *Config) error {
+	seen := map[string]int{}
+	for i, stage := range stages {
+		if _, ok := pipelineStages[stage.Stage]; !ok {
+			return fmt.Errorf("unknown pipeline stage %q", stage.Stage)
+		}
+		if _, ok := seen[stage.Stage]; ok {
+			return fmt.Errorf("pipeline stage %s is listed twice", stage.Stage)
+		}
+		seen[stage.Stage] = i
+	}
+
+	verify, ok := seen["verify_signature"]
+	if !ok {
+		return fmt.Errorf("pipeline has no verify_signature stage")
+	}
+	if jwt, ok := seen["jwt_routes"]; ok && jwt > verify {
+		return fmt.Errorf("pipeline stage jwt_routes must come before verify_signature")
+	}
+	if limit, ok := seen["rate_limit"]; ok {
+		if label, ok := seen["label"]; !ok || label > limit {
+			return fmt.Errorf("pipeline stage rate_limit must come after label")
+		}
+	}
+	for _, need := range []struct {
+		stage string
+		on    bool
+	}{
+		{"jwt_routes", hasJWTRoutes(config)},
+		{"rate_limit", len(config.RateLimits) > 0},
+	} {
+		if _, ok := seen[need.stage]; need.on && !ok {
+			return fmt.Errorf("pipeline has no %s stage, but the config uses it", need.stage)
+		}
+	}
+	return nil
+}
+
+func defaultPipelineStages() []PipelineStage {
+	stages := make([]PipelineStage, len(defaultPipeline))
+	for i, name := range defaultPipeline {
+		stages[i] = PipelineStage{Stage: name}
+	}
+	return stages
+}
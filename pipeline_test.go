@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	stages := func(names ...string) []PipelineStage {
+		out := make([]PipelineStage, len(names))
+		for i, name := range names {
+			out[i] = PipelineStage{Stage: name}
+		}
+		return out
+	}
+	labeled := &Config{
+		Labels:     []LabelRule{{Label: "tier", Value: "bulk"}},
+		RateLimits: []RateLimitConfig{{Name: "bulk", Labels: map[string]string{"tier": "bulk"}, Rate: 1}},
+	}
+
+	for _, test := range []struct {
+		name   string
+		stages []PipelineStage
+		config *Config
+		ok     bool
+	}{
+		{"default", defaultPipelineStages(), labeled, true},
+		{"just verify", stages("verify_signature"), &Config{}, true},
+		{"limit first", stages("label", "rate_limit", "verify_signature", "ack"), labeled, true},
+		{"unverified", stages("probe", "ack"), &Config{}, false},
+		{"unknown", stages("verify_signature", "gzip"), &Config{}, false},
+		{"twice", stages("verify_signature", "silence", "silence"), &Config{}, false},
+		{"jwt after verify", stages("verify_signature", "jwt_routes"), &Config{}, false},
+		{"limit before label", stages("rate_limit", "label", "verify_signature"), labeled, false},
+		{"limit without label", stages("rate_limit", "verify_signature"), labeled, false},
+		{"limits configured but no stage", stages("label", "verify_signature"), labeled, false},
+	} {
+		err := validatePipeline(test.stages, test.config)
+		if test.ok {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+}
+
+func TestBuildPipeline(t *testing.T) {
+	forward := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(h http.Handler, method, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/slack/events", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// params stand in for flags
+	h, err := buildPipeline([]PipelineStage{
+		{Stage: "restrict_method", Params: json.RawMessage(`{"methods":["POST"]}`)},
+		{Stage: "body_limit", Params: json.RawMessage(`{"max_bytes":8}`)},
+		{Stage: "verify_signature"},
+	}, &Config{}, forward)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, send(h, http.MethodGet, ""))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(h, http.MethodPost, "a body over eight bytes"))
+	assert.Equal(t, http.StatusBadRequest, send(h, http.MethodPost, "{}"))
+
+	// rate limiting ahead of verification turns away a flood of unsigned
+	// requests before any signature is checked
+	config := &Config{
+		Labels:     []LabelRule{{Label: "path", Value: "events", Path: "/slack/events"}},
+		RateLimits: []RateLimitConfig{{Name: "events", Labels: map[string]string{"path": "events"}, Rate: 0.001, Burst: 1}},
+	}
+	h, err = buildPipeline([]PipelineStage{
+		{Stage: "label"},
+		{Stage: "rate_limit"},
+		{Stage: "verify_signature"},
+	}, config, forward)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, send(h, http.MethodPost, "{}"))
+	assert.Equal(t, http.StatusTooManyRequests, send(h, http.MethodPost, "{}"))
+
+	for _, stage := range []PipelineStage{
+		{Stage: "verify_signature", Params: json.RawMessage(`{"expire":"5m"}`)},
+		{Stage: "body_limit", Params: json.RawMessage(`{"max":8}`)},
+		{Stage: "header_limit", Params: json.RawMessage(`{"max":"lots"}`)},
+	} {
+		_, err := buildPipeline([]PipelineStage{stage}, &Config{}, forward)
+		assert.Error(t, err, stage.Stage)
+	}
+}
+
+func TestBuildPipelineRouteStages(t *testing.T) {
+	forward := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(h http.Handler, method, path, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	config := &Config{Routes: []RouteConfig{
+		{Path: "/internal", Skip: []string{"body_limit"}},
+		{Path: "/admin", Stages: []PipelineStage{
+			{Stage: "restrict_method", Params: json.RawMessage(`{"methods":["POST"]}`)},
+		}},
+	}}
+	h, err := buildPipeline([]PipelineStage{
+		{Stage: "body_limit", Params: json.RawMessage(`{"max_bytes":8}`)},
+		{Stage: "verify_signature"},
+	}, config, forward)
+	require.NoError(t, err)
+
+	// skipped stages are passed, but the rest of the pipeline still runs
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(h, http.MethodPost, "/slack/events", "a body over eight bytes"))
+	assert.Equal(t, http.StatusBadRequest, send(h, http.MethodPost, "/internal", "a body over eight bytes"))
+	// route stages run ahead of the pipeline, only on their path
+	assert.Equal(t, http.StatusMethodNotAllowed, send(h, http.MethodGet, "/admin", ""))
+	assert.Equal(t, http.StatusBadRequest, send(h, http.MethodGet, "/slack/events", ""))
+
+	config.Routes[1].Stages[0].Params = json.RawMessage(`{"verbs":["POST"]}`)
+	_, err = buildPipeline(defaultPipelineStages(), config, forward)
+	assert.Error(t, err)
+}
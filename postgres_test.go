@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// fakePostgres logs clients in with scram and answers each statement with
+// whatever exec returns. A non empty errMsg is sent as an ErrorResponse.
+type fakePostgres struct {
+	t        *testing.T
+	password string
+	exec     func(sql string, args []*string) (rows [][]*string, tag, errMsg string)
+
+	ln         net.Listener
+	mu         sync.Mutex
+	statements []string
+}
+
+func newFakePostgres(t *testing.T, password string,
+	exec func(sql string, args []*string) ([][]*string, string, string)) *fakePostgres {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakePostgres{t: t, password: password, exec: exec, ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakePostgres) URL() *url.URL {
+	u, _ := url.Parse("postgres://proxy:" + f.password + "@" + f.ln.Addr().String() + "/events")
+	return u
+}
+
+func (f *fakePostgres) Close() { f.ln.Close() }
+
+func (f *fakePostgres) log() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.statements...)
+}
+
+func (f *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn)}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return
+	}
+	startup := make([]byte, binary.BigEndian.Uint32(header)-4)
+	io.ReadFull(c.r, startup)
+	assert.Contains(f.t, string(startup), "user\x00proxy\x00database\x00events\x00")
+
+	if !f.scram(c) {
+		c.write('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed for user \"proxy\"\x00\x00"))
+		return
+	}
+	c.write('R', []byte{0, 0, 0, 0})
+	c.write('Z', []byte("I"))
+
+	var sql string
+	var args []*string
+	failed := false
+	for {
+		typ, msg, err := c.read()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 'P':
+			sql = strings.SplitN(string(msg[1:]), "\x00", 2)[0]
+		case 'B':
+			args = nil
+			msg = msg[4:]
+			n := int(binary.BigEndian.Uint16(msg))
+			msg = msg[2:]
+			for i := 0; i < n; i++ {
+				size := int32(binary.BigEndian.Uint32(msg))
+				msg = msg[4:]
+				if size < 0 {
+					args = append(args, nil)
+					continue
+				}
+				value := string(msg[:size])
+				args = append(args, &value)
+				msg = msg[size:]
+			}
+		case 'E':
+			f.mu.Lock()
+			f.statements = append(f.statements, strings.Join(strings.Fields(sql), " "))
+			f.mu.Unlock()
+			rows, tag, errMsg := f.exec(sql, args)
+			if errMsg != "" {
+				c.write('E', []byte("SERROR\x00C23505\x00M"+errMsg+"\x00\x00"))
+				failed = true
+				continue
+			}
+			for _, row := range rows {
+				out := appendPgUint16(nil, uint16(len(row)))
+				for _, v := range row {
+					if v == nil {
+						out = appendPgUint32(out, 0xffffffff)
+						continue
+					}
+					out = appendPgUint32(out, uint32(len(*v)))
+					out = append(out, *v...)
+				}
+				c.write('D', out)
+			}
+			c.write('C', append([]byte(tag), 0))
+		case 'S':
+			status := "I"
+			if failed {
+				status = "E"
+			}
+			failed = false
+			c.write('Z', []byte(status))
+		case 'X':
+			return
+		}
+	}
+}
+
+// scram runs the server side of SCRAM-SHA-256
+func (f *fakePostgres) scram(c *pgConn) bool {
+	c.write('R', append([]byte{0, 0, 0, 10}, "SCRAM-SHA-256\x00\x00"...))
+	_, msg, err := c.read()
+	if err != nil {
+		return false
+	}
+	msg = msg[len("SCRAM-SHA-256\x00")+4:]
+	clientBare := strings.TrimPrefix(string(msg), "n,,")
+	nonce := strings.TrimPrefix(clientBare, "n=,r=") + "server-nonce"
+	salt := []byte("pepper")
+	serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	c.write('R', append([]byte{0, 0, 0, 11}, serverFirst...))
+
+	_, msg, err = c.read()
+	if err != nil {
+		return false
+	}
+	final := string(msg)
+	i := strings.Index(final, ",p=")
+	proof, _ := base64.StdEncoding.DecodeString(final[i+3:])
+	authMessage := clientBare + "," + serverFirst + "," + final[:i]
+
+	salted := pbkdf2.Key([]byte(f.password), salt, 4096, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	clientKey := scramHMAC(storedKey[:], authMessage)
+	for i := range clientKey {
+		if i < len(proof) {
+			clientKey[i] ^= proof[i]
+		}
+	}
+	if sha256.Sum256(clientKey) != storedKey {
+		return false
+	}
+	serverSig := scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	c.write('R', append([]byte{0, 0, 0, 12}, "v="+base64.StdEncoding.EncodeToString(serverSig)...))
+	return true
+}
+
+func pgText(s string) *string { return &s }
+
+func TestPostgresQuery(t *testing.T) {
+	db := newFakePostgres(t, "hunter2", func(sql string, args []*string) ([][]*string, string, string) {
+		switch {
+		case strings.HasPrefix(sql, "SELECT"):
+			return [][]*string{{args[0], nil}}, "SELECT 1", ""
+		case strings.HasPrefix(sql, "INSERT"):
+			return nil, "", `duplicate key value violates unique constraint "pkey"`
+		}
+		return nil, "UPDATE 3", ""
+	})
+	defer db.Close()
+
+	c, err := dialPostgres(db.URL(), time.Second)
+	require.NoError(t, err)
+	defer c.close()
+
+	res, err := c.query("SELECT $1, NULL", "one")
+	require.NoError(t, err)
+	assert.Equal(t, [][]*string{{pgText("one"), nil}}, res.Rows)
+
+	_, err = c.query("INSERT INTO t VALUES ($1)", nil)
+	assert.EqualError(t, err, `postgres ERROR 23505: duplicate key value violates unique constraint "pkey"`)
+
+	// the connection is still good after an error
+	res, err = c.query("UPDATE t SET n = $1", 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.RowsAffected())
+
+	bad := db.URL()
+	bad.User = url.UserPassword("proxy", "wrong")
+	_, err = dialPostgres(bad, time.Second)
+	assert.Contains(t, err.Error(), "password authentication failed")
+}
+
+func TestPgSCRAM(t *testing.T) {
+	// the example exchange from RFC 7677
+	s := &pgSCRAM{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	s.clientFirst()
+	s.clientBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	require.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,"+
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", final)
+	assert.NoError(t, s.verifyServer("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	assert.Error(t, s.verifyServer("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+
+	_, err = s.clientFinal("r=someone-elses-nonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	assert.Error(t, err)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagUser = kingpin.
+			Flag("user", "user to switch to once listeners are open and keys are loaded, by each worker under --workers").
+			Envar("PROXY_USER").String()
+	flagGroup = kingpin.
+			Flag("group", "group to switch to once listeners are open, defaults to the user's group").
+			Envar("PROXY_GROUP").String()
+)
+
+// lookupIDs resolves names or numeric ids to the uid and gid to run as
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
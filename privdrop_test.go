@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupIDs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		user, group string
+		uid, gid    int
+		err         string
+	}{
+		"by name":       {user: "root", uid: 0, gid: 0},
+		"by id":         {user: "0", group: "0", uid: 0, gid: 0},
+		"unknown user":  {user: "no-such-user-here", err: `unknown user "no-such-user-here"`},
+		"unknown group": {user: "root", group: "no-such-group-here", err: `unknown group "no-such-group-here"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			uid, gid, err := lookupIDs(tc.user, tc.group)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.uid, uid)
+			assert.Equal(t, tc.gid, gid)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagTracePropagation = kingpin.
+	Flag("trace-propagation", "trace headers read from callers and sent to backends, repeatable: tracecontext, b3, b3multi, baggage").
+	Envar("TRACE_PROPAGATION").Default("tracecontext").Enums("tracecontext", "b3", "b3multi", "baggage")
+
+const (
+	HeaderB3        = "B3"
+	HeaderB3TraceID = "X-B3-Traceid"
+	HeaderB3SpanID  = "X-B3-Spanid"
+	HeaderB3Sampled = "X-B3-Sampled"
+	HeaderBaggage   = "Baggage"
+)
+
+// propagation is what t reads and writes, tracecontext unless set
+func (t *Tracer) propagation() []string {
+	if len(t.Propagation) == 0 {
+		return []string{"tracecontext"}
+	}
+	return t.Propagation
+}
+
+// extract finds the caller's trace in header, trying each propagation in
+// order
+func (t *Tracer) extract(header http.Header) (spanContext, bool) {
+	for _, p := range t.propagation() {
+		var sc spanContext
+		ok := false
+		switch p {
+		case "tracecontext":
+			sc, ok = parseTraceparent(header.Get(HeaderTraceparent))
+		case "b3":
+			sc, ok = parseB3(header.Get(HeaderB3))
+		case "b3multi":
+			sc, ok = parseB3Multi(header)
+		}
+		if ok {
+			return sc, true
+		}
+	}
+	return spanContext{}, false
+}
+
+// inject sets the trace headers for sc on r, and adds baggage to any the
+// request already had
+func (t *Tracer) inject(r *http.Request, sc spanContext, baggage string) {
+	sampled := "0"
+	if sc.Sampled {
+		sampled = "1"
+	}
+	traceID, spanID := hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:])
+	for _, p := range t.propagation() {
+		switch p {
+		case "tracecontext":
+			r.Header.Set(HeaderTraceparent, sc.traceparent())
+		case "b3":
+			r.Header.Set(HeaderB3, traceID+"-"+spanID+"-"+sampled)
+		case "b3multi":
+			r.Header.Set(HeaderB3TraceID, traceID)
+			r.Header.Set(HeaderB3SpanID, spanID)
+			r.Header.Set(HeaderB3Sampled, sampled)
+		case "baggage":
+			if baggage != "" {
+				if prior := r.Header.Get(HeaderBaggage); prior != "" {
+					baggage = prior + "," + baggage
+				}
+				r.Header.Set(HeaderBaggage, baggage)
+			}
+		}
+	}
+}
+
+// baggage carries the team, the payload type and the labels of a slack
+// request on to the backend, when t propagates baggage
+func (t *Tracer) baggage(r *http.Request) string {
+	if !containsString(t.propagation(), "baggage") {
+		return ""
+	}
+	var entries []string
+	add := func(key, value string) {
+		if value != "" {
+			entries = append(entries, key+"="+url.PathEscape(value))
+		}
+	}
+	if p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload)); err == nil {
+		add("slack.team_id", p.TeamID)
+		add("slack.kind", p.Kind)
+		add("slack.type", p.Type)
+	}
+	labels := RequestLabels(r)
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add("slack.label."+name, labels[name])
+	}
+	return strings.Join(entries, ",")
+}
+
+// parseB3 reads a single b3 header, {trace}-{span}-{sampled}-{parent}, where
+// only the ids are required. A 64 bit trace id is padded to 128.
+func parseB3(header string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return spanContext{}, false
+	}
+	sampled := ""
+	if len(parts) > 2 {
+		sampled = parts[2]
+	}
+	return b3Context(parts[0], parts[1], sampled)
+}
+
+func parseB3Multi(header http.Header) (spanContext, bool) {
+	return b3Context(header.Get(HeaderB3TraceID), header.Get(HeaderB3SpanID), header.Get(HeaderB3Sampled))
+}
+
+func b3Context(traceID, spanID, sampled string) (spanContext, bool) {
+	var sc spanContext
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if len(traceID) != 32 || len(spanID) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	// d is b3's debug flag, which implies sampled
+	sc.Sampled = sampled == "1" || sampled == "d" || sampled == "true"
+	return sc, true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseB3(t *testing.T) {
+	for header, exp := range map[string]bool{
+		"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1":                  true,
+		"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-d-05e3ac9a4f6e3b90": true,
+		"64fe8b2a57d3eff7-e457b5a2e4d86bd1-0":                                  false,
+		"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1":                    false,
+	} {
+		sc, ok := parseB3(header)
+		require.True(t, ok, header)
+		assert.Equal(t, exp, sc.Sampled, header)
+	}
+	sc, _ := parseB3("64fe8b2a57d3eff7-e457b5a2e4d86bd1-0")
+	assert.Equal(t, "000000000000000064fe8b2a57d3eff7", strings.Split(sc.traceparent(), "-")[1])
+
+	for _, header := range []string{"", "0", "80f198ee56343ba8-e457b5a2e4d86bd1-1-x-y", "zz-e457b5a2e4d86bd1",
+		"00000000000000000000000000000000-e457b5a2e4d86bd1"} {
+		_, ok := parseB3(header)
+		assert.False(t, ok, header)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	tr := &Tracer{Sample: 1, Propagation: []string{"b3multi", "b3", "baggage"}}
+	var sent http.Header
+	var body []byte
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Clone()
+		body, _ = ioutil.ReadAll(r.Body)
+	})
+	h := TraceHandler(backend, tr, "reverse_proxy", SpanKindClient)
+	h = LabelHandler(h, PayloadParserFunc(ParseSlackPayload), []LabelRule{{Label: "tier", Value: "vip", TeamID: "T1"}})
+	h = TraceHandler(h, tr, "slack_request", SpanKindServer)
+
+	r := httptest.NewRequest(http.MethodPost, "/slack/events",
+		strings.NewReader(`{"type":"event_callback","team_id":"T1","event":{"type":"app mention"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(HeaderB3TraceID, "80f198ee56343ba864fe8b2a57d3eff7")
+	r.Header.Set(HeaderB3SpanID, "e457b5a2e4d86bd1")
+	r.Header.Set(HeaderB3Sampled, "1")
+	r.Header.Set(HeaderBaggage, "userId=alice")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	// the caller's b3 trace continues in both b3 formats, and not in w3c
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7", sent.Get(HeaderB3TraceID))
+	assert.NotEqual(t, "e457b5a2e4d86bd1", sent.Get(HeaderB3SpanID))
+	assert.Equal(t, "1", sent.Get(HeaderB3Sampled))
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7-"+sent.Get(HeaderB3SpanID)+"-1", sent.Get(HeaderB3))
+	assert.Empty(t, sent.Get(HeaderTraceparent))
+	assert.Equal(t, "userId=alice,slack.team_id=T1,slack.kind=event,slack.type=app%20mention,slack.label.tier=vip",
+		sent.Get(HeaderBaggage))
+	// reading the body for baggage leaves it for the backend
+	assert.Contains(t, string(body), `"team_id":"T1"`)
+}
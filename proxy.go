@@ -1,67 +1,476 @@
 package main
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/jakdept/slack_events_proxy/slackverify"
+	"github.com/quic-go/quic-go/http3"
 )
 
 var (
 	// required restrictions
+	// checked in serve, so the update command can go without them
 	flagProxyTarget = kingpin.
-			Flag("proxy-host", "proxy host for requests").
-			Required().URL()
+			Flag("proxy-host", "proxy host for requests, repeat to spread them round robin (required)").
+			URLList()
+	flagListen = kingpin.
+			Flag("listen", "address to listen on, repeatable, :http without this or --listen-unix").
+			Envar("LISTEN").TCPList()
+	flagListenUnix = kingpin.
+			Flag("listen-unix", "unix socket to listen on, like /run/slack_proxy.sock").
+			Envar("LISTEN_UNIX").String()
+	flagListenUnixMode = kingpin.
+				Flag("listen-unix-mode", "permissions of the --listen-unix socket, in octal").
+				Envar("LISTEN_UNIX_MODE").Default("0660").String()
 	flagSlackToken = kingpin.
-			Flag("slack-token", "slack verification token").
-			Envar("SLACK_TOKEN").Required().String()
+			Flag("slack-token", "slack verification token, repeat while rotating (required)").
+			Envar("SLACK_TOKEN").Strings()
 	flagSlackExpire = kingpin.
 			Flag("slack-expire", "max age of slack timestamp").
 			Envar("SLACK_EXPIRE").Default("30s").Duration()
+	flagSlackSignatureVersions = kingpin.
+					Flag("slack-signature-version", "slack signature versions to accept").
+					Envar("SLACK_SIGNATURE_VERSION").Default(SlackSignatureVersion).Strings()
+	flagSlackReplayCache = kingpin.
+				Flag("slack-replay-cache", "signatures to remember, turning away exact copies of a request while fresh, 0 to disable. Kept in memory, so it can not be used with --workers").
+				Envar("SLACK_REPLAY_CACHE").Default("0").Int()
+	flagMaxBodyBytes = kingpin.
+				Flag("max-body", "max size of request body, 0 to disable").
+				Envar("MAX_BODY").Default("1MB").Bytes()
+	flagUserAgents = kingpin.
+			Flag("user-agent", "only accept user agents starting with this, repeatable").
+			Envar("USER_AGENT").Strings()
+	flagMaxHeaders = kingpin.
+			Flag("max-headers", "max number of request headers, 0 to disable").
+			Envar("MAX_HEADERS").Default("64").Int()
 
 	// handler restrictions
-	flagHttpAllowedMethodsSetByUser *bool
+	flagHttpAllowedMethodsSetByUser = new(bool)
 	flagHttpAllowedMethods          = kingpin.
 					Flag("method", "methods to accept").
 					Envar("HTTP_METHOD").Default(http.MethodPost).
 					IsSetByUser(flagHttpAllowedMethodsSetByUser).
 					Strings()
-	flagHttpAllowedURIsSetByUser *bool
+	flagHttpAllowedURIsSetByUser = new(bool)
 	flagHttpAllowedURIs          = kingpin.
 					Flag("uri", "uris to accept").
 					IsSetByUser(flagHttpAllowedURIsSetByUser).
 					Envar("HTTP_URI").Strings()
+
+	// forwarding options
+	flagSequence = kingpin.
+			Flag("sequence", "number events per channel in "+HeaderProxySequence+", in memory unless --sequence-store is set, where numbers start over on restart and --workers can not be used").
+			Envar("SEQUENCE").Bool()
 )
 
-func buildHandler() (h http.Handler) {
-	// these get built outside in
-	h = httputil.NewSingleHostReverseProxy(*flagProxyTarget)
-	h = VerifySlackSignatureHandler(h, *flagSlackToken, *flagSlackExpire)
+// slackReplays is set up in main with --slack-replay-cache, and outlives
+// config reloads
+var slackReplays *slackverify.ReplayCache
+
+var cmdServe = kingpin.Command("serve", "verify slack requests and forward them on").Default()
+
+var sequenceStore SequenceStore = NewMemorySequenceStore(10000)
+
+// auditLog records accepted requests when --audit-log is set
+var auditLog *AuditLog
+
+// buildForwardHandler builds the part of the chain verified requests are
+// forwarded through, which is shared with anything delivering events
+// that did not come in over http
+func buildForwardHandler(config *Config) (h http.Handler, err error) {
+	h, err = buildBackendSelect(config, newBalancedProxy(config.backendTargets()))
+	if err != nil {
+		return nil, err
+	}
+	if outputSink != nil {
+		h = OutputHandler(h, PayloadParserFunc(ParseSlackPayload), *flagOutput, outputSink)
+	}
+	uris, err := uriRoutes(*flagURIRoutes)
+	if err != nil {
+		return nil, err
+	}
+	if len(uris) > 0 {
+		h = PathRouteHandler(h, uris...)
+	}
+	if apps := appRoutes(config.Apps); len(apps) > 0 {
+		h = PathRouteHandler(h, apps...)
+	}
+	routes, err := buildRoutes(config, h)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) > 0 {
+		h = RouteHandler(h, PayloadParserFunc(ParseSlackPayload), routes...)
+	}
+	if len(config.Schedules) > 0 {
+		h = BackendScheduleHandler(h, buildBackendSchedules(config))
+	}
+	h = TraceHandler(LatencyHandler(h, metricBackendDuration), tracer, "reverse_proxy", SpanKindClient)
+	if len(config.Labels) > 0 {
+		h = LabelHandler(h, PayloadParserFunc(ParseSlackPayload), config.Labels)
+	}
+	deadlines, err := parseTypeDeadlines(*flagTypeDeadlines)
+	if err != nil {
+		return nil, err
+	}
+	if *flagDeadlineHeader {
+		h = DeadlineHeaderHandler(h)
+	}
+	h = AdaptiveConcurrencyHandler(h, backendLimiter, *flagAdaptiveConcurrencyWait)
+	h = BackendRetryHandler(h, *flagBackendRetries, *flagBackendRetryBackoff)
+	h = ForwardDeadlineHandler(h, PayloadParserFunc(ParseSlackPayload), *flagForwardDeadline, deadlines)
+	h = UsageHandler(h, PayloadParserFunc(ParseSlackPayload), usage)
+	h = BandwidthHandler(h, PayloadParserFunc(ParseSlackPayload))
+	if receipts != nil {
+		h = ReceiptHandler(h, PayloadParserFunc(ParseSlackPayload), receipts)
+	}
+	if auditLog != nil {
+		h = AuditHandler(h, auditLog, PayloadParserFunc(ParseSlackPayload))
+	}
+	if *flagSequence {
+		h = SequenceHandler(h, PayloadParserFunc(ParseSlackPayload), sequenceStore)
+	}
+	for _, each := range sinks {
+		if each.responses {
+			h = ResponseSinkHandler(h, each.name, each.sink, int(*flagArchiveResponseBody))
+		} else {
+			h = SinkHandler(h, each.name, each.sink)
+		}
+	}
+	if *flagBodySHA256 {
+		h = BodyChecksumHandler(h)
+	}
+	// deliveries from queues start their own traces
+	h = TraceHandler(SampleHandler(h, tracer), tracer, "forward", SpanKindInternal)
+	return h, nil
+}
 
-	if *flagHttpAllowedURIsSetByUser {
-		h = RestrictMethodHandler(h, *flagHttpAllowedURIs...)
+// buildHandler builds the whole chain for config. It has no side effects,
+// so a failed build on reload leaves nothing half applied.
+func buildHandler(config *Config) (h http.Handler, err error) {
+	forward, err := buildForwardHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	stages := config.Pipeline
+	if len(stages) == 0 {
+		stages = defaultPipelineStages()
 	}
-	if *flagHttpAllowedMethodsSetByUser {
-		h = RestrictMethodHandler(h, *flagHttpAllowedMethods...)
+	h, err = buildPipeline(stages, config, forward)
+	if err != nil {
+		return nil, err
 	}
-	return
+	h = PayloadCacheHandler(h)
+	h = TraceHandler(LatencyHandler(h, metricRequestDuration), tracer, "slack_request", SpanKindServer)
+	if *flagDeadlineHeader {
+		h = ArrivalHandler(h)
+	}
+	return h, nil
 }
 
 func main() {
-	kingpin.Parse()
+	info := buildInfo()
+	kingpin.Version(info.String())
+	if kingpin.Parse() == cmdUpdate.FullCommand() {
+		kingpin.FatalIfError(runUpdate(), "update")
+		return
+	}
+	metricBuildInfo.Set(1, info.Version, info.Commit, info.BuildDate, info.GoVersion)
+	verifyFailures.max = *flagCaptureFailures
+	if *flagFIPS {
+		kingpin.FatalIfError(checkFIPS(), "")
+	}
+
+	config, err := loadConfig(*flagConfigFile)
+	kingpin.FatalIfError(err, "")
+	if len(*flagSlackToken) < 1 && *flagSlackTokenFile == "" && *flagSlackTokenSource == "" && !configSecrets(config) {
+		kingpin.Fatalf("required flag --slack-token, --slack-token-file or --slack-token-source not provided, and no team or app secrets in the config")
+	}
+	if len(config.backendTargets()) == 0 {
+		kingpin.Fatalf("required flag --proxy-host not provided, and no backend in the config")
+	}
+
+	// workers were started once everything was up
+	if len(*flagWaitFor) > 0 && workerIndex() == 0 {
+		targets, err := waitTargets(*flagWaitFor, config)
+		kingpin.FatalIfError(err, "")
+		ctx, cancel := context.WithTimeout(context.Background(), *flagWaitTimeout)
+		err = waitFor(ctx, targets, time.Second)
+		cancel()
+		kingpin.FatalIfError(err, "")
+	}
+
+	if *flagHTTP3 && *flagWorkers > 0 {
+		kingpin.Fatalf("--http3 can not be used with --workers")
+	}
+	if features := singleProcessFeatures(config); len(features) > 0 && *flagWorkers > 0 {
+		kingpin.Fatalf("%s can not be used with --workers, each worker would keep its own", strings.Join(features, ", "))
+	}
+
+	mode, err := strconv.ParseUint(*flagListenUnixMode, 8, 32)
+	kingpin.FatalIfError(err, "--listen-unix-mode")
+	listeners, err := listen(listenAddrs(), *flagListenUnix, os.FileMode(mode))
+	if err != nil {
+		log.Fatalf("listening: %v", err)
+	}
+	if *flagWorkers > 0 && workerIndex() == 0 {
+		s, err := newSupervisor(listeners)
+		if err != nil {
+			log.Fatalf("starting workers: %v", err)
+		}
+		// the supervisor keeps its privileges, each worker drops them once
+		// it has read its keys, secrets and config
+		s.Run(*flagWorkers)
+		return
+	}
+
+	secrets := *flagSlackToken
+	if *flagSlackTokenFile != "" || *flagSlackTokenSource != "" {
+		name, src, interval, err := slackSecretSource()
+		kingpin.FatalIfError(err, "")
+		loaded, err := src.Secrets(context.Background())
+		kingpin.FatalIfError(err, "loading secrets from %s", name)
+		go watchSecretSource(name, src, interval, slackRefresh, slackSecrets, *flagSlackToken)
+		secrets = append(loaded, secrets...)
+	}
+	slackSecrets.Set(secrets)
 
-	log.Fatal(http.ListenAndServe(":http", buildHandler()))
+	partitionKey, err = ParsePartitionKey(*flagPartitionKey)
+	kingpin.FatalIfError(err, "")
+	if *flagSequenceStore != "" {
+		if sequenceStore, err = OpenSequenceStore(*flagSequenceStore); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	banner, err := newStartupBanner(kingpin.CommandLine, config)
+	if err != nil {
+		log.Fatalf("fingerprinting config: %v", err)
+	}
+	if primaryProcess() {
+		raw, _ := json.Marshal(banner)
+		log.Printf("starting %s", raw)
+	}
+
+	if *flagSecretStatsFile != "" && primaryProcess() {
+		if err := slackSecretStats.load(*flagSecretStatsFile); err != nil {
+			log.Fatalf("loading secret stats: %v", err)
+		}
+		go slackSecretStats.persist(*flagSecretStatsFile, time.Minute)
+	}
+	if *flagUsageExport != "" {
+		go usage.export(*flagUsageExport, *flagUsageFormat, *flagUsageInterval)
+	}
+	if *flagAuditLog != "" {
+		if *flagWorkers > 0 {
+			log.Fatalf("--audit-log can not be shared between --workers")
+		}
+		if auditLog, err = OpenAuditLog(*flagAuditLog); err != nil {
+			log.Fatalf("opening audit log: %v", err)
+		}
+	}
+	if *flagSlackReplayCache > 0 {
+		slackReplays = slackverify.NewReplayCache(*flagSlackReplayCache)
+	}
+	if *flagReceiptURL != nil {
+		receipts = newReceiptPoster(*flagReceiptURL, *flagReceiptTimeout)
+	}
+	if *flagOTLPEndpoint != nil {
+		header, err := parseOTLPHeaders(*flagOTLPHeaders)
+		kingpin.FatalIfError(err, "")
+		exporter := newOTLPExporter(*flagOTLPEndpoint, header, *flagTraceService, 5*time.Second)
+		tracer = &Tracer{Sample: *flagTraceSample, Export: exporter.add, Propagation: *flagTracePropagation}
+	}
+	if *flagWarehouse != nil {
+		w, err := OpenWarehouse(*flagWarehouse)
+		if err != nil {
+			log.Fatalf("opening warehouse: %v", err)
+		}
+		sink := NewWarehouseSink(w, *flagWarehouseBatch)
+		go sink.Run(*flagWarehouseInterval)
+		sinks = append(sinks, namedSink{"warehouse", sink, false})
+	}
+	if *flagShadowArchive != "" {
+		sink, err := shadowSink()
+		if err != nil {
+			log.Fatalf("opening shadow archive: %v", err)
+		}
+		sinks = append(sinks, namedSink{"shadow", sink, *flagArchiveResponses})
+	}
+	for _, name := range *flagSinks {
+		sink, err := OpenSink(name)
+		if err != nil {
+			log.Fatalf("opening sink %s: %v", name, err)
+		}
+		sinks = append(sinks, namedSink{name, sink, false})
+	}
+	for i := range sinks {
+		sinks[i].sink = isolateSink(sinks[i].name, sinks[i].sink)
+	}
+	// not isolated, a failure has to reach slack so it retries
+	if *flagOutput != "http" {
+		if outputSink, err = OpenSink(*flagOutput); err != nil {
+			log.Fatalf("opening --output %s: %v", *flagOutput, err)
+		}
+	}
+	if *flagOutbox != nil {
+		if *flagAsyncAck {
+			log.Fatalf("--outbox and --async-ack can not both be used")
+		}
+		pg, err := OpenPostgresOutbox(*flagOutbox, *flagOutboxConns, *flagOutboxMaxAttempts)
+		if err != nil {
+			log.Fatalf("opening outbox: %v", err)
+		}
+		outbox = pg
+		if *flagOutboxCounters {
+			go syncOutboxCounters(pg, time.Minute)
+		}
+	} else if *flagOutboxCounters {
+		log.Fatalf("--outbox-counters needs --outbox")
+	}
+	if *flagAsyncAck {
+		asyncAcks = newAsyncQueue(*flagAsyncAckQueue, *flagAsyncAckWorkers,
+			*flagAsyncAckRetries, *flagAckBackendTimeout)
+		asyncAcks.aging = *flagAsyncAckAging
+	}
+	if *flagParkDir != "" {
+		if parked, err = OpenParkQueue(*flagParkDir); err != nil {
+			log.Fatalf("opening --park-dir: %v", err)
+		}
+	}
+	if *flagRetryHistory > 0 {
+		retryHistory = newRetryTracker(*flagRetryHistory)
+	}
+	if *flagAnomalyFactor > 0 {
+		eventVolumes = newVolumeTracker(*flagAnomalyFactor, *flagAnomalyFloor)
+	}
+	if *flagAdaptiveConcurrency {
+		backendLimiter = NewAdaptiveLimiter(*flagAdaptiveConcurrencyMin, *flagAdaptiveConcurrencyMax)
+	}
+	if backendTransport, err = newBackendTransport(); err != nil {
+		log.Fatalf("setting up backend tls: %v", err)
+	}
+	reloader = newConfigReloader(*flagConfigFile)
+	kingpin.FatalIfError(reloader.apply(config), "")
+	go reloadOnHangup(reloader, slackRefresh, tlsRefresh, backendTLSRefresh)
+
+	// with workers only the first one runs these
+	if primaryProcess() {
+		if leader, err = leaderFromFlags(); err != nil {
+			log.Fatalf("leader election: %v", err)
+		}
+	}
+	if *flagClusterStore != "" && primaryProcess() {
+		if clusterStore, err = OpenClusterStore(*flagClusterStore); err != nil {
+			log.Fatalf("cluster store: %v", err)
+		}
+		id, err := replicaID()
+		if err != nil {
+			log.Fatalf("cluster store: %v", err)
+		}
+		go runClusterReports(clusterStore, id, *flagClusterInterval)
+	}
+	if *flagAdminListen != "" && primaryProcess() {
+		adminL, err := net.Listen("tcp", *flagAdminListen)
+		if err != nil {
+			log.Fatalf("admin listener: %v", err)
+		}
+		go func() {
+			log.Fatal(http.Serve(adminL, buildAdminHandler(reloader.forward)))
+		}()
+	}
+	// backends only ever reach this one, never the admin listener
+	if *flagRespondListen != "" && primaryProcess() {
+		forwarder, err := NewResponseURLForwarder(*flagRespondHosts, *flagRespondRate, *flagRespondRetries)
+		kingpin.FatalIfError(err, "--respond-rate")
+		respondL, err := net.Listen("tcp", *flagRespondListen)
+		if err != nil {
+			log.Fatalf("respond listener: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/respond", forwarder)
+		go func() {
+			log.Fatal(http.Serve(respondL, mux))
+		}()
+	}
+	if outbox != nil {
+		go runOutbox(outbox, reloader.forward)
+	}
+	// workers share the directory, one of them drains it
+	if parked != nil && primaryProcess() {
+		go runParked(parked, reloader.forward, *flagParkInterval)
+	}
+	if *flagBackfillStateFile != "" && primaryProcess() {
+		runSingleton("backfill", func(ctx context.Context) { runBackfill(ctx, reloader.forward) })
+	}
+	if leader != nil {
+		go leader.Run(context.Background())
+	}
+
+	srv := &http.Server{
+		Handler: reloader.handler,
+	}
+	if srv.TLSConfig, err = listenTLS(); err != nil {
+		log.Fatalf("setting up tls: %v", err)
+	}
+	if *flagTLSClientCA != "" {
+		if srv.TLSConfig == nil {
+			log.Fatalf("--tls-client-ca needs --tls-cert or --acme-domain")
+		}
+		srv.Handler = ClientCertHandler(srv.Handler, *flagTLSClientCAExempt...)
+	}
+	var h3 *http3.Server
+	var h3Conns []net.PacketConn
+	if *flagHTTP3 {
+		if srv.TLSConfig == nil {
+			log.Fatalf("--http3 needs --tls-cert or --acme-domain")
+		}
+		if h3Conns, err = listenHTTP3(listenAddrs()); err != nil {
+			log.Fatalf("listening for http3: %v", err)
+		}
+		h3 = newHTTP3Server(srv.Handler, srv.TLSConfig)
+		srv.Handler = AltSvcHandler(srv.Handler, listenAddrs()[0].Port)
+	}
+	// everything privileged, binding ports and reading config, is done
+	if *flagUser != "" {
+		if err := dropPrivileges(*flagUser, *flagGroup); err != nil {
+			log.Fatalf("dropping privileges: %v", err)
+		}
+	}
+	// the supervisor is left alone, it has to exec workers
+	if *flagHarden {
+		if err := harden(hardenPaths()); err != nil {
+			log.Fatalf("hardening: %v", err)
+		}
+	}
+	errs := make(chan error, len(listeners)+len(h3Conns))
+	for _, c := range h3Conns {
+		go func(c net.PacketConn) { errs <- h3.Serve(c) }(c)
+	}
+	for _, l := range listeners {
+		if *flagProxyProtocol {
+			l = ProxyProtocolListener{l}
+		}
+		go func(l net.Listener) {
+			// the keypair comes from TLSConfig, so no files are named
+			if srv.TLSConfig != nil {
+				errs <- srv.ServeTLS(l, "", "")
+			} else {
+				errs <- srv.Serve(l)
+			}
+		}(l)
+	}
+	log.Fatal(<-errs)
 }
 
 func StatusHandler(statusCode int, status string) http.Handler {
@@ -89,6 +498,57 @@ func RestrictMethodHandler(child http.Handler, methods ...string) http.Handler {
 	})
 }
 
+var metricUserAgentRejections = NewCounterVec("user_agent_rejections_total",
+	"requests rejected for their user agent")
+
+// RestrictUserAgentHandler only passes requests whose User-Agent starts with
+// one of prefixes, like "Slackbot 1.0". Anyone can send that, so it only
+// cheaply turns away scanners before verification.
+func RestrictUserAgentHandler(child http.Handler, prefixes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.UserAgent(), prefix) {
+				child.ServeHTTP(w, r)
+				return
+			}
+		}
+		metricUserAgentRejections.Inc()
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
+
+// ProbeHandler answers HEAD and OPTIONS itself. Neither can carry a signed
+// body, so sending them on to verification only fills the logs with
+// failures from health checks and scanners. HEAD is only allowed where GET
+// is, as it is GET without the body.
+func ProbeHandler(child http.Handler, methods ...string) http.Handler {
+	allowed := append([]string(nil), methods...)
+	head := false
+	for _, method := range methods {
+		head = head || method == http.MethodGet
+	}
+	if head {
+		allowed = append(allowed, http.MethodHead)
+	}
+	allow := strings.Join(append(allowed, http.MethodOptions), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			if !head {
+				w.Header().Set("Allow", allow)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodOptions:
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			child.ServeHTTP(w, r)
+		}
+	})
+}
+
 func RestrictURIHandler(child http.Handler, uri ...string) http.Handler {
 	for i := 0; i < len(uri); {
 		switch {
@@ -166,64 +626,89 @@ func BodyLimitHandler(child http.Handler, maxSize int64) http.Handler {
 	})
 }
 
+var metricHeaderLimitRejections = NewCounterVec("header_limit_rejections_total",
+	"requests rejected for carrying too many headers")
+
+// HeaderLimitHandler rejects requests with more than max header values.
+// MaxHeaderBytes bounds the total size, this bounds the count of tiny ones.
+func HeaderLimitHandler(child http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for _, values := range r.Header {
+			count += len(values)
+		}
+		if count > max {
+			metricHeaderLimitRejections.Inc()
+			http.Error(w, "too many headers", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		child.ServeHTTP(w, r)
+	})
+}
+
 const (
-	SlackSignatureVersion = "v0"
-	SlackHeaderSignature  = "X-Slack-Signature"
-	SlackHeaderTimestamp  = "X-Slack-Request-Timestamp"
+	SlackSignatureVersion = slackverify.Version
+	SlackHeaderSignature  = slackverify.HeaderSignature
+	SlackHeaderTimestamp  = slackverify.HeaderTimestamp
 )
 
+var metricSlackVerifyFailures = NewCounterVec("slack_verify_failures_total",
+	"requests that failed slack signature verification", "reason")
+
+// VerifySlackSignatureHandler checks the slack signature on each request
+// before handing it to child. versions lists the accepted signature versions,
+// and defaults to SlackSignatureVersion.
 func VerifySlackSignatureHandler(
 	child http.Handler,
 	token string,
 	expire time.Duration,
+	versions ...string,
 ) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// grab the timestamp on the request, and verify not stale
-		tsStr := r.Header.Get(SlackHeaderTimestamp)
-		tsInt, err := strconv.Atoi(tsStr)
-		if err != nil {
-			http.Error(w, "bad timestamp in "+SlackHeaderTimestamp, http.StatusBadRequest)
-			return
-		}
-		ts := time.Unix(int64(tsInt), 0)
+	v := &SlackVerifier{
+		Secrets:  []string{token},
+		Expire:   expire,
+		Versions: versions,
+	}
+	return v.Handler(child)
+}
 
-		if ts.Add(expire).Before(time.Now()) {
-			http.Error(w, "timestamp expired", http.StatusUnauthorized)
-			return
-		}
+// SlackVerifier is a slackverify.Verifier that also keeps metrics and per
+// secret stats.
+type SlackVerifier slackverify.Verifier
 
-		// grab the expected signature
-		trimmed := strings.TrimPrefix(
-			r.Header.Get(SlackHeaderSignature),
-			SlackSignatureVersion+"=")
-		expSig, err := hex.DecodeString(trimmed)
-		if err != nil {
-			http.Error(w, "bad signature", http.StatusBadRequest)
-			return
+func (v *SlackVerifier) Handler(child http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, err := (*slackverify.Verifier)(v).Verify(r)
+		if err == nil || err == slackverify.ErrMismatch {
+			// the body is left in place when only the signature is wrong
+			slackPendingSecrets.check(r, v.Expire, v.Versions)
 		}
-
-		// grab the contents of the body for signature generation
-		// have to read the full body and verify checksum before calling child handler
-		newBody, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
+			e := err.(*slackverify.Error)
+			metricSlackVerifyFailures.Inc(e.Reason)
+			if e == slackverify.ErrMismatch {
+				body, _ := readBody(r)
+				verifyFailures.capture(r, body)
+			}
+			http.Error(w, e.Message, e.Status)
 			return
 		}
-		r.Body.Close()
-
-		// calculate the current checksum
-		mac := hmac.New(sha256.New, []byte(token))
-		// by spec mac.Write always returns nil
-		fmt.Fprintf(mac, "%s:%s:%s", SlackSignatureVersion, tsStr, string(newBody))
+		slackSecretStats.record(secret)
+		child.ServeHTTP(w, r)
+	})
+}
 
-		calcSig := mac.Sum(nil)
+// SignSlackRequest signs r the way slack would, for requests the proxy
+// makes up itself.
+func SignSlackRequest(r *http.Request, secret string, ts time.Time, body []byte) {
+	slackverify.Sign(r, secret, ts, body)
+}
 
-		if !hmac.Equal(expSig, calcSig) {
-			http.Error(w, "verification failed", http.StatusUnauthorized)
-			return
+func containsString(list []string, s string) bool {
+	for _, each := range list {
+		if each == s {
+			return true
 		}
-
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(newBody))
-		child.ServeHTTP(w, r)
-	})
+	}
+	return false
 }
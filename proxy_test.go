@@ -5,16 +5,18 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/alecthomas/units"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestBuildHandler(t *testing.T) {
 	// backend target doesn't matter, it never gets there
-	*flagProxyTarget = &url.URL{Scheme: "http", Host: "127.0.0.1:80"}
+	*flagProxyTarget = []*url.URL{{Scheme: "http", Host: "127.0.0.1:80"}}
 	for name, tc := range testdataBuildHandler {
 		t.Run(name, func(t *testing.T) {
 			*flagHttpAllowedURIs = tc.allowedURI
@@ -23,7 +25,10 @@ func TestBuildHandler(t *testing.T) {
 			*flagHttpAllowedMethods = tc.allowedMethod
 			flagHttpAllowedMethodsSetByUser = new(bool)
 			*flagHttpAllowedMethodsSetByUser = len(tc.allowedMethod) > 0
-			tcSrv := httptest.NewServer(buildHandler())
+			*flagMaxBodyBytes = units.Base2Bytes(tc.maxBodyBytes)
+			h, err := buildHandler(&Config{})
+			require.NoError(t, err)
+			tcSrv := httptest.NewServer(h)
 			defer tcSrv.Close()
 			resp, err := http.Post(tcSrv.URL, "", strings.NewReader(tc.Body))
 			require.NoError(t, err)
@@ -73,6 +78,72 @@ func TestResetrictMethodHandler(t *testing.T) {
 	}
 }
 
+func TestRestrictUserAgentHandler(t *testing.T) {
+	h := RestrictUserAgentHandler(StatusHandler(http.StatusNoContent, ""),
+		"Slackbot 1.0", "internal-replay/")
+
+	before := metricUserAgentRejections.Get()
+	for ua, statusCode := range map[string]int{
+		"Slackbot 1.0 (+https://api.slack.com/robots)": http.StatusNoContent,
+		"internal-replay/2":                            http.StatusNoContent,
+		"Mozilla/5.0 zgrab/0.x":                        http.StatusForbidden,
+		"":                                             http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, statusCode, w.Code, ua)
+	}
+	assert.Equal(t, before+2, metricUserAgentRejections.Get())
+}
+
+func TestProbeHandler(t *testing.T) {
+	for _, test := range []struct {
+		methods []string
+		status  map[string]int
+		allow   string
+	}{
+		{
+			methods: []string{http.MethodPost},
+			status: map[string]int{
+				// as GET would be
+				http.MethodHead:    http.StatusMethodNotAllowed,
+				http.MethodOptions: http.StatusNoContent,
+				http.MethodPost:    http.StatusBadRequest,
+			},
+			allow: "POST, OPTIONS",
+		},
+		{
+			methods: []string{http.MethodGet, http.MethodPost},
+			status: map[string]int{
+				http.MethodHead:    http.StatusOK,
+				http.MethodOptions: http.StatusNoContent,
+				http.MethodPost:    http.StatusBadRequest,
+			},
+			allow: "GET, POST, HEAD, OPTIONS",
+		},
+	} {
+		ts := httptest.NewServer(ProbeHandler(
+			StatusHandler(http.StatusBadRequest, "verification failed"),
+			test.methods...,
+		))
+		for method, statusCode := range test.status {
+			t.Run(strings.Join(test.methods, ",")+"-"+method, func(t *testing.T) {
+				req, err := http.NewRequest(method, ts.URL, nil)
+				require.NoError(t, err)
+				resp, err := ts.Client().Do(req)
+				require.NoError(t, err)
+				assert.Equal(t, statusCode, resp.StatusCode)
+				if method == http.MethodOptions || statusCode == http.StatusMethodNotAllowed {
+					assert.Equal(t, test.allow, resp.Header.Get("Allow"))
+				}
+			})
+		}
+		ts.Close()
+	}
+}
+
 func TestRestrictURIHandler(t *testing.T) {
 	ts := httptest.NewServer(RestrictURIHandler(
 		StatusHandler(http.StatusNoContent, ""),
@@ -116,6 +187,25 @@ func TestBodyLimitHandler(t *testing.T) {
 	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
 }
 
+func TestHeaderLimitHandler(t *testing.T) {
+	h := HeaderLimitHandler(StatusHandler(http.StatusNoContent, ""), 4)
+
+	before := metricHeaderLimitRejections.Get()
+	for count, statusCode := range map[int]int{
+		4: http.StatusNoContent,
+		5: http.StatusRequestHeaderFieldsTooLarge,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		for i := 0; i < count; i++ {
+			r.Header.Add("X-Header", strconv.Itoa(i))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, statusCode, w.Code, "%d headers", count)
+	}
+	assert.Equal(t, before+1, metricHeaderLimitRejections.Get())
+}
+
 func TestVerifySlackSignatureHandler(t *testing.T) {
 	for name, tc := range testdataVerifySlackSignature {
 		t.Run(name, func(t *testing.T) {
@@ -125,6 +215,7 @@ func TestVerifySlackSignatureHandler(t *testing.T) {
 				tc.child,
 				tc.key,
 				tc.expire,
+				tc.versions...,
 			))
 			defer ts.Close()
 
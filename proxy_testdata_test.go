@@ -50,7 +50,7 @@ var testdataBuildHandler = map[string]struct {
 	},
 	"denied by URI": {
 		allowedURI:    []string{"/not-like-this"},
-		expStatusCode: http.StatusMethodNotAllowed,
+		expStatusCode: http.StatusNotFound,
 	},
 	"denied by method": {
 		allowedMethod: []string{http.MethodGet},
@@ -116,6 +116,7 @@ type testdataVerifySlackSignatureRequest struct {
 var testdataVerifySlackSignature = map[string]struct {
 	key      string
 	expire   time.Duration
+	versions []string
 	child    http.Handler
 	requests []testdataVerifySlackSignatureRequest
 }{
@@ -162,4 +163,86 @@ var testdataVerifySlackSignature = map[string]struct {
 			},
 		},
 	},
+	"future version": {
+		key:      "8f742231b10e8888abcd99yyyzzz85a5",
+		expire:   time.Hour * 24 * 365 * 50,
+		versions: []string{"v0", "v1"},
+		child:    StatusHandler(http.StatusNoContent, ""),
+		requests: []testdataVerifySlackSignatureRequest{
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v1=b9ec5c22cd97972b175fd813c664a65091d36d72d1d8a553ff0ced70142039a7",
+				StatusCode: http.StatusNoContent,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v0=e8beca64fdd1a137bebe4f274bd47abcbee4e63c101f4bc8461b7e9398109030",
+				StatusCode: http.StatusNoContent,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v2=b9ec5c22cd97972b175fd813c664a65091d36d72d1d8a553ff0ced70142039a7",
+				StatusCode: http.StatusNotImplemented,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "b9ec5c22cd97972b175fd813c664a65091d36d72d1d8a553ff0ced70142039a7",
+				StatusCode: http.StatusBadRequest,
+			},
+		},
+	},
+	"default version only": {
+		key:    "8f742231b10e8888abcd99yyyzzz85a5",
+		expire: time.Hour * 24 * 365 * 50,
+		child:  StatusHandler(http.StatusNoContent, ""),
+		requests: []testdataVerifySlackSignatureRequest{
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v1=b9ec5c22cd97972b175fd813c664a65091d36d72d1d8a553ff0ced70142039a7",
+				StatusCode: http.StatusNotImplemented,
+			},
+		},
+	},
+	"multiple signatures": {
+		key:    "8f742231b10e8888abcd99yyyzzz85a5",
+		expire: time.Hour * 24 * 365 * 50,
+		child:  StatusHandler(http.StatusNoContent, ""),
+		requests: []testdataVerifySlackSignatureRequest{
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v0=baad, v0=e8beca64fdd1a137bebe4f274bd47abcbee4e63c101f4bc8461b7e9398109030",
+				StatusCode: http.StatusNoContent,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v1=b9ec5c22cd97972b175fd813c664a65091d36d72d1d8a553ff0ced70142039a7,v0=e8beca64fdd1a137bebe4f274bd47abcbee4e63c101f4bc8461b7e9398109030",
+				StatusCode: http.StatusNoContent,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v0=baad,v0=beef",
+				StatusCode: http.StatusUnauthorized,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v0=lolno,v0=",
+				StatusCode: http.StatusUnauthorized,
+			},
+			{
+				Body:       "hello",
+				Timestamp:  "1531420618",
+				Signature:  "v0=lolno,nope",
+				StatusCode: http.StatusBadRequest,
+			},
+		},
+	},
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagProxyProtocol = kingpin.
+	Flag("proxy-protocol", "expect a PROXY protocol v1 or v2 header on every connection, from a load balancer in tcp mode").
+	Envar("PROXY_PROTOCOL").Bool()
+
+var metricProxyProtocolHeaders = NewCounterVec("proxy_protocol_headers_total",
+	"PROXY protocol headers read off new connections, by result", "result")
+
+// proxyProtocolTimeout is how long a connection has to send its header
+const proxyProtocolTimeout = 5 * time.Second
+
+// proxyProtocolV2Sig starts every v2 header
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener reads a PROXY protocol header off each connection,
+// so RemoteAddr is the client the load balancer saw. Connections without
+// a valid header are closed. The header is read on first use, in the
+// connection's own goroutine, so a slow client can not hold up Accept.
+type ProxyProtocolListener struct {
+	net.Listener
+}
+
+func (l ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) header() error {
+	c.once.Do(func() {
+		c.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remote, c.local, c.err = readProxyProtocol(c.r)
+		c.SetReadDeadline(time.Time{})
+		switch {
+		case c.err != nil:
+			metricProxyProtocolHeaders.Inc("invalid")
+			c.Conn.Close()
+		case c.remote == nil:
+			// LOCAL, like a health check from the balancer itself
+			metricProxyProtocolHeaders.Inc("local")
+		default:
+			metricProxyProtocolHeaders.Inc("proxied")
+		}
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	if err := c.header(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.header() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.header() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyProtocol reads a v1 or v2 header. The addresses are nil for
+// connections the balancer made itself.
+func readProxyProtocol(r *bufio.Reader) (remote, local net.Addr, err error) {
+	start, err := r.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+	if bytes.Equal(start, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, nil, fmt.Errorf("no PROXY header")
+}
+
+// readProxyProtocolV1 reads a line like
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	// the longest v1 header is 107 bytes
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY v1 header not terminated")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("bad PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	remote, err := proxyProtocolAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := proxyProtocolAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, local, nil
+}
+
+func proxyProtocolAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, fmt.Errorf("bad PROXY address %s port %s", ip, port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unknown PROXY version %d", head[12]>>4)
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+
+	switch head[12] & 0xf {
+	case 0:
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("unknown PROXY command %d", head[12]&0xf)
+	}
+	// tlvs after the addresses are skipped
+	var size int
+	switch head[13] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry no usable address
+		return nil, nil, nil
+	}
+	if len(rest) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY v2 header too short for its addresses")
+	}
+	remote := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, rest[:size]...)),
+		Port: int(binary.BigEndian.Uint16(rest[2*size:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, rest[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(rest[2*size+2:])),
+	}
+	return remote, local, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyProtocolV2(cmd, family byte, addrs []byte) string {
+	head := append([]byte{}, proxyProtocolV2Sig...)
+	head = append(head, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(head[14:], uint16(len(addrs)))
+	return string(append(head, addrs...))
+}
+
+func TestReadProxyProtocol(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	for name, tc := range map[string]struct {
+		header, remote, local, err string
+	}{
+		"v1 tcp4":    {header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", remote: "192.0.2.1:56324", local: "198.51.100.1:443"},
+		"v1 tcp6":    {header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:443"},
+		"v1 unknown": {header: "PROXY UNKNOWN\r\n"},
+		"v1 bad":     {header: "PROXY TCP4 192.0.2.1 56324 443\r\n", err: `bad PROXY v1 header "PROXY TCP4 192.0.2.1 56324 443"`},
+		"v1 bad ip":  {header: "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n", err: "bad PROXY address 192.0.2 port 56324"},
+		"v1 long":    {header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: "PROXY v1 header not terminated"},
+		"v2 tcp4":    {header: proxyProtocolV2(1, 0x11, v4), remote: "192.0.2.1:56324", local: "198.51.100.1:443"},
+		"v2 tcp6":    {header: proxyProtocolV2(1, 0x21, v6), remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:443"},
+		"v2 tlvs":    {header: proxyProtocolV2(1, 0x11, append(v4, 0x04, 0, 1, 'x')), remote: "192.0.2.1:56324", local: "198.51.100.1:443"},
+		"v2 local":   {header: proxyProtocolV2(0, 0, nil)},
+		"v2 short":   {header: proxyProtocolV2(1, 0x11, v4[:8]), err: "PROXY v2 header too short for its addresses"},
+		"v2 command": {header: proxyProtocolV2(2, 0x11, v4), err: "unknown PROXY command 2"},
+		"none":       {header: "POST /slack/events HTTP/1.1\r\n", err: "no PROXY header"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.header + "GET"))
+			remote, local, err := readProxyProtocol(r)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			if tc.remote == "" {
+				assert.Nil(t, remote)
+				assert.Nil(t, local)
+			} else {
+				assert.Equal(t, tc.remote, remote.String())
+				assert.Equal(t, tc.local, local.String())
+			}
+			// the rest of the stream is left alone
+			rest, _ := ioutil.ReadAll(r)
+			assert.Equal(t, "GET", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	remotes := make(chan string, 1)
+	go http.Serve(ProxyProtocolListener{l}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes <- r.RemoteAddr
+	}))
+
+	send := func(header string) string {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+		c.Write([]byte(header + "POST /slack/events HTTP/1.1\r\nHost: proxy\r\nContent-Length: 0\r\n\r\n"))
+		status, _ := bufio.NewReader(c).ReadString('\n')
+		return status
+	}
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	assert.Equal(t, "192.0.2.1:56324", <-remotes)
+	// the balancer's own health checks keep their address
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", send(proxyProtocolV2(0, 0, nil)))
+	assert.Contains(t, <-remotes, "127.0.0.1:")
+
+	before := metricProxyProtocolHeaders.Get("invalid")
+	assert.Empty(t, send(""))
+	assert.Equal(t, before+1, metricProxyProtocolHeaders.Get("invalid"))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(20, 2)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, b.Wait(ctx))
+	}
+	// the burst is free, the next two take 50ms each
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 90*time.Millisecond, "took %s", elapsed)
+	assert.True(t, elapsed < 500*time.Millisecond, "took %s", elapsed)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, b.Wait(ctx))
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	b := newTokenBucket(20, 2)
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.allow())
+}
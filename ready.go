@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagReadyChecks = kingpin.
+			Flag("ready-check", "dependency /readyz on the admin listener waits on, repeatable: dedup, queue, secrets, backend").
+			Envar("READY_CHECK").Enums("dedup", "queue", "secrets", "backend")
+	flagReadyTimeout = kingpin.
+				Flag("ready-timeout", "time each /readyz check has").
+				Envar("READY_TIMEOUT").Default("2s").Duration()
+)
+
+// readyCheck is nil when the dependency is fine, or not in use
+type readyCheck func(ctx context.Context) error
+
+var readyChecks = map[string]readyCheck{
+	// the outbox dedupes in postgres, the replay cache is in memory
+	"dedup": func(ctx context.Context) error {
+		if c, ok := outbox.(interface{ CheckDedup(context.Context) error }); ok {
+			return c.CheckDedup(ctx)
+		}
+		return nil
+	},
+	"queue": func(ctx context.Context) error {
+		if c, ok := outbox.(interface{ CheckQueue(context.Context) error }); ok {
+			return c.CheckQueue(ctx)
+		}
+		if asyncAcks != nil && asyncAcks.full() {
+			return errors.New("async ack queue is full")
+		}
+		return nil
+	},
+	"secrets": func(ctx context.Context) error {
+		if err := slackSecrets.Err(); err != nil {
+			return err
+		}
+		if len(slackSecrets.Get()) == 0 && (reloader == nil || !configSecrets(reloader.currentConfig())) {
+			return errors.New("no signing secrets")
+		}
+		return nil
+	},
+	"backend": func(ctx context.Context) error {
+		if reloader == nil {
+			return errors.New("no config loaded")
+		}
+		return checkBackends(ctx, configBackends(reloader.currentConfig()))
+	},
+}
+
+// configBackends are every backend config can send to
+func configBackends(config *Config) []*url.URL {
+	backends := append([]*url.URL{}, config.backendTargets()...)
+	var raw []string
+	for _, target := range config.Backends {
+		raw = append(raw, target)
+	}
+	sort.Strings(raw)
+	for _, rc := range config.Routes {
+		if rc.Backend != "" {
+			raw = append(raw, rc.Backend)
+		}
+	}
+	for _, each := range raw {
+		// validated on load
+		if target, err := url.Parse(each); err == nil {
+			backends = append(backends, target)
+		}
+	}
+	return backends
+}
+
+// checkBackends is nil once any backend answers, with anything short of a
+// 5xx, as a GET of its root
+func checkBackends(ctx context.Context, backends []*url.URL) error {
+	var last error
+	for _, target := range backends {
+		if target == nil {
+			continue
+		}
+		root := url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/"}
+		req, err := http.NewRequest(http.MethodGet, root.String(), nil)
+		if err != nil {
+			last = err
+			continue
+		}
+		resp, err := backendClient().Do(req.WithContext(ctx))
+		if err != nil {
+			last = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 500 {
+			return nil
+		}
+		last = fmt.Errorf("%s answered %s", redactURLPassword(root.String()), resp.Status)
+	}
+	if last == nil {
+		return errors.New("no backends")
+	}
+	return fmt.Errorf("no backend is healthy: %v", last)
+}
+
+// ReadyHandler answers 200 once every check in names passes, and 503
+// otherwise, listing how each check went. The checks run at once, each
+// with timeout.
+func ReadyHandler(names []string, checks map[string]readyCheck, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := make(map[string]string, len(names))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		ready := true
+		for _, name := range names {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				err := checks[name](ctx)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					ready = false
+					results[name] = err.Error()
+				} else {
+					results[name] = "ok"
+				}
+			}(name)
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Ready  bool              `json:"ready"`
+			Checks map[string]string `json:"checks"`
+		}{ready, results})
+	})
+}
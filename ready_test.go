@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyHandler(t *testing.T) {
+	checks := map[string]readyCheck{
+		"fine":   func(ctx context.Context) error { return nil },
+		"broken": func(ctx context.Context) error { return errors.New("down") },
+		"slow": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	get := func(names ...string) (int, map[string]string) {
+		w := httptest.NewRecorder()
+		ReadyHandler(names, checks, 10*time.Millisecond).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body struct {
+			Ready  bool
+			Checks map[string]string
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, w.Code == http.StatusOK, body.Ready)
+		return w.Code, body.Checks
+	}
+
+	code, results := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, results)
+	code, results = get("fine")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"fine": "ok"}, results)
+	code, results = get("fine", "broken", "slow")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]string{"fine": "ok", "broken": "down", "slow": "context deadline exceeded"}, results)
+}
+
+func TestReadyChecks(t *testing.T) {
+	defer func(old *secretSet) { slackSecrets = old }(slackSecrets)
+	slackSecrets = &secretSet{}
+	assert.EqualError(t, readyChecks["secrets"](context.Background()), "no signing secrets")
+	slackSecrets.Set([]string{"secret"})
+	assert.NoError(t, readyChecks["secrets"](context.Background()))
+	slackSecrets.setErr(errors.New("vault sealed"))
+	assert.EqualError(t, readyChecks["secrets"](context.Background()), "vault sealed")
+
+	defer func(old *asyncQueue) { asyncAcks = old }(asyncAcks)
+	asyncAcks = newAsyncQueue(1, 0, 0, time.Second)
+	assert.NoError(t, readyChecks["queue"](context.Background()))
+	asyncAcks.add(asyncJob{})
+	assert.EqualError(t, readyChecks["queue"](context.Background()), "async ack queue is full")
+	// without an outbox dedup is in memory
+	assert.NoError(t, readyChecks["dedup"](context.Background()))
+}
+
+func TestCheckBackends(t *testing.T) {
+	healthy := httptest.NewServer(http.NotFoundHandler())
+	defer healthy.Close()
+	failing := httptest.NewServer(StatusHandler(http.StatusBadGateway, "down"))
+	defer failing.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	parse := func(raw string) *url.URL {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		return u
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, checkBackends(ctx, []*url.URL{parse(gone.URL), parse(failing.URL), parse(healthy.URL + "/slack")}))
+	assert.EqualError(t, checkBackends(ctx, []*url.URL{parse(healthy.URL), parse(failing.URL)}[1:]),
+		"no backend is healthy: "+failing.URL+"/ answered 502 Bad Gateway")
+	assert.Error(t, checkBackends(ctx, []*url.URL{parse(gone.URL)}))
+	assert.EqualError(t, checkBackends(ctx, nil), "no backends")
+
+	config := &Config{
+		Backend:  healthy.URL,
+		Backends: map[string]string{"b": "http://b", "a": "http://a"},
+		Routes:   []RouteConfig{{Backend: "http://route"}, {}},
+	}
+	var hosts []string
+	for _, u := range configBackends(config) {
+		hosts = append(hosts, u.Host)
+	}
+	assert.Equal(t, []string{parse(healthy.URL).Host, "a", "b", "route"}, hosts)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagReceiptURL = kingpin.
+			Flag("receipt-url", "observer to POST a json receipt to after each attempt at delivering to the backend").
+			Envar("RECEIPT_URL").URL()
+	flagReceiptTimeout = kingpin.
+				Flag("receipt-timeout", "time the observer has to take each receipt").
+				Envar("RECEIPT_TIMEOUT").Default("5s").Duration()
+)
+
+var metricReceipts = NewCounterVec("delivery_receipts_total",
+	"receipts posted to --receipt-url, by outcome", "outcome")
+
+// receipts waiting to be posted before new ones are dropped
+const receiptQueue = 1000
+
+// receipts is set up in main when --receipt-url is set
+var receipts *receiptPoster
+
+// Receipt describes one attempt at delivering a request to the backend.
+type Receipt struct {
+	Time      time.Time `json:"time"`
+	EventID   string    `json:"event_id"`
+	Kind      string    `json:"kind"`
+	Type      string    `json:"type"`
+	TeamID    string    `json:"team_id"`
+	Outcome   string    `json:"outcome"`
+	Status    int       `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LatencyMS int64     `json:"latency_ms"`
+	DelayMS   int64     `json:"delay_ms"`
+}
+
+// receipt outcomes
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRejected  = "rejected"
+	ReceiptFailed    = "failed"
+)
+
+// receiptOutcome sorts a backend status the way the retrying queues do: a
+// 5xx or 429 is worth trying again, any other 4xx never will be.
+func receiptOutcome(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests || status >= 500:
+		return ReceiptFailed
+	case status >= 400:
+		return ReceiptRejected
+	default:
+		return ReceiptDelivered
+	}
+}
+
+// ReceiptHandler sends a receipt for every request child handles. Attempts
+// and delay come from the headers set on deliveries made from a queue, a
+// request forwarded inline is attempt 1 with no delay.
+func ReceiptHandler(child http.Handler, parser PayloadParser, receipts *receiptPoster) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := Receipt{Attempts: 1}
+		if p, err := RequestPayload(r, parser); err == nil {
+			rec.EventID, rec.Kind, rec.Type, rec.TeamID = p.ID, p.Kind, p.Type, p.TeamID
+		}
+		if n, err := strconv.Atoi(r.Header.Get(HeaderProxyAttempt)); err == nil {
+			rec.Attempts = n
+		}
+		if first, err := time.Parse(time.RFC3339Nano, r.Header.Get(HeaderProxyFirstReceivedAt)); err == nil {
+			rec.DelayMS = int64(start.Sub(first) / time.Millisecond)
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		child.ServeHTTP(sw, r)
+		rec.Time = time.Now().UTC()
+		rec.LatencyMS = int64(time.Since(start) / time.Millisecond)
+		rec.Status = sw.Status()
+		rec.Outcome = receiptOutcome(rec.Status)
+		receipts.add(rec)
+	})
+}
+
+// receiptPoster posts receipts from a queue, so a slow observer never
+// holds up a delivery. Receipts are best effort, and are not retried.
+type receiptPoster struct {
+	url     string
+	client  *http.Client
+	pending chan Receipt
+}
+
+func newReceiptPoster(u *url.URL, timeout time.Duration) *receiptPoster {
+	p := &receiptPoster{
+		url:     u.String(),
+		client:  &http.Client{Timeout: timeout},
+		pending: make(chan Receipt, receiptQueue),
+	}
+	go p.run()
+	return p
+}
+
+func (p *receiptPoster) add(rec Receipt) {
+	select {
+	case p.pending <- rec:
+	default:
+		metricReceipts.Inc("dropped")
+	}
+}
+
+func (p *receiptPoster) run() {
+	failing := false
+	for rec := range p.pending {
+		if err := p.post(rec); err != nil {
+			metricReceipts.Inc("failed")
+			if !failing {
+				log.Printf("posting delivery receipt: %v", err)
+			}
+			failing = true
+			continue
+		}
+		metricReceipts.Inc("sent")
+		failing = false
+	}
+}
+
+func (p *receiptPoster) post(rec Receipt) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("observer returned %d", resp.StatusCode)
+	}
+	return nil
+}
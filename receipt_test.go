@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiptHandler(t *testing.T) {
+	got := make(chan Receipt, 10)
+	observer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var rec Receipt
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&rec))
+		got <- rec
+	}))
+	defer observer.Close()
+	u, err := url.Parse(observer.URL)
+	require.NoError(t, err)
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := readBody(r)
+		switch {
+		case strings.Contains(string(body), "Ev503"):
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		case strings.Contains(string(body), "Ev400"):
+			http.Error(w, "bad", http.StatusBadRequest)
+		}
+	})
+	h := ReceiptHandler(backend, PayloadParserFunc(ParseSlackPayload), newReceiptPoster(u, time.Second))
+
+	for _, tc := range []struct {
+		eventID  string
+		attempt  string
+		outcome  string
+		status   int
+		attempts int
+	}{
+		{"Ev200", "", ReceiptDelivered, 200, 1},
+		{"Ev503", "3", ReceiptFailed, 503, 3},
+		{"Ev400", "", ReceiptRejected, 400, 1},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(
+			`{"type":"event_callback","event_id":"`+tc.eventID+`","team_id":"T1","event":{"type":"message"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		if tc.attempt != "" {
+			r.Header.Set(HeaderProxyAttempt, tc.attempt)
+			r.Header.Set(HeaderProxyFirstReceivedAt, time.Now().Add(-time.Minute).Format(time.RFC3339Nano))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, "the backend answer goes back untouched")
+
+		select {
+		case rec := <-got:
+			assert.Equal(t, tc.eventID, rec.EventID)
+			assert.Equal(t, "T1", rec.TeamID)
+			assert.Equal(t, "message", rec.Type)
+			assert.Equal(t, tc.outcome, rec.Outcome)
+			assert.Equal(t, tc.status, rec.Status)
+			assert.Equal(t, tc.attempts, rec.Attempts)
+			if tc.attempt != "" {
+				assert.True(t, rec.DelayMS >= 60000, "delay %d", rec.DelayMS)
+			} else {
+				assert.Zero(t, rec.DelayMS)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no receipt for %s", tc.eventID)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// Redactor blanks out fields of a payload before it is stored anywhere.
+// Fields are dotted paths into json bodies, like event.text, and are applied
+// to every element of an array along the way. Form bodies are redacted by
+// key, and the json in an interactivity payload field by path.
+type Redactor struct {
+	Fields []string
+}
+
+func (rd Redactor) Redact(d *Delivery) *Delivery {
+	out := *d
+	mediaType, _, _ := mime.ParseMediaType(d.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if body, ok := rd.redactJSON(d.Body); ok {
+			out.Body = body
+		}
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(d.Body))
+		if err != nil {
+			return &out
+		}
+		for _, field := range rd.Fields {
+			if _, ok := form[field]; ok {
+				form.Set(field, redacted)
+			}
+		}
+		if payload, ok := rd.redactJSON([]byte(form.Get("payload"))); ok {
+			form.Set("payload", string(payload))
+		}
+		out.Body = []byte(form.Encode())
+	}
+	return &out
+}
+
+func (rd Redactor) redactJSON(body []byte) ([]byte, bool) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, false
+	}
+	for _, field := range rd.Fields {
+		redactPath(doc, strings.Split(field, "."))
+	}
+	out, err := json.Marshal(doc)
+	return out, err == nil
+}
+
+func redactPath(doc interface{}, path []string) {
+	switch node := doc.(type) {
+	case []interface{}:
+		for _, each := range node {
+			redactPath(each, path)
+		}
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			node[path[0]] = redacted
+			return
+		}
+		redactPath(child, path[1:])
+	}
+}
+
+// RedactSink redacts deliveries before passing them on to sink.
+func RedactSink(rd Redactor, sink Sink) Sink {
+	return SinkFunc(func(ctx context.Context, d *Delivery) error {
+		return sink.Send(ctx, rd.Redact(d))
+	})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	for name, tc := range testdataRedactor {
+		t.Run(name, func(t *testing.T) {
+			in := &Delivery{
+				Header: http.Header{"Content-Type": {tc.contentType}},
+				Body:   []byte(tc.body),
+			}
+			out := Redactor{Fields: tc.fields}.Redact(in)
+			assert.Equal(t, tc.exp, string(out.Body))
+			assert.Equal(t, tc.body, string(in.Body), "original must be left alone")
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+var testdataRedactor = map[string]struct {
+	fields      []string
+	contentType string
+	body        string
+	exp         string
+}{
+	"event text": {
+		fields:      []string{"event.text", "event.missing", "token"},
+		contentType: "application/json",
+		body:        `{"token":"abc","event":{"text":"secret plans","type":"message"}}`,
+		exp:         `{"event":{"text":"REDACTED","type":"message"},"token":"REDACTED"}`,
+	},
+	"through arrays": {
+		fields:      []string{"event.blocks.text"},
+		contentType: "application/json",
+		body:        `{"event":{"blocks":[{"text":"one"},{"text":"two"},"bare"]}}`,
+		exp:         `{"event":{"blocks":[{"text":"REDACTED"},{"text":"REDACTED"},"bare"]}}`,
+	},
+	"command form": {
+		fields:      []string{"text"},
+		contentType: "application/x-www-form-urlencoded",
+		body:        "command=%2Fops&text=deploy+secret",
+		exp:         "command=%2Fops&text=REDACTED",
+	},
+	"interaction payload": {
+		fields:      []string{"user.name"},
+		contentType: "application/x-www-form-urlencoded",
+		body:        `payload=%7B%22user%22%3A%7B%22id%22%3A%22U1%22%2C%22name%22%3A%22bob%22%7D%7D`,
+		exp:         `payload=%7B%22user%22%3A%7B%22id%22%3A%22U1%22%2C%22name%22%3A%22REDACTED%22%7D%7D`,
+	},
+	"not json": {
+		fields:      []string{"event.text"},
+		contentType: "application/json",
+		body:        `{"event":`,
+		exp:         `{"event":`,
+	},
+	"other content": {
+		fields:      []string{"text"},
+		contentType: "text/plain",
+		body:        "text=left alone",
+		exp:         "text=left alone",
+	},
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisAcquire sets the key to the id unless someone else holds it
+const redisAcquire = `local v = redis.call('get', KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call('set', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0`
+
+// redisRelease deletes the key only if the id holds it
+const redisRelease = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+
+// RedisLock is a lock on one redis key holding the leader's id, set to
+// expire after the lease. Each call takes a new connection, as they are
+// seconds apart.
+type RedisLock struct {
+	URL *url.URL
+	Key string
+}
+
+// openRedisLock takes a redis url, with an optional key query parameter,
+// like redis://:password@redis:6379/0?key=slack-events-proxy-leader.
+// rediss:// connects with tls.
+func openRedisLock(spec string) (LeaderLock, error) {
+	u, err := url.Parse("redis://" + spec)
+	if err != nil {
+		return nil, fmt.Errorf("redis %q: %v", spec, err)
+	}
+	if u.Host == "" {
+		return nil, errors.New("redis needs a host")
+	}
+	key := u.Query().Get("key")
+	if key == "" {
+		key = "slack_events_proxy:leader"
+	}
+	return &RedisLock{URL: u, Key: key}, nil
+}
+
+func openRedissLock(spec string) (LeaderLock, error) {
+	l, err := openRedisLock(spec)
+	if err != nil {
+		return nil, err
+	}
+	l.(*RedisLock).URL.Scheme = "rediss"
+	return l, nil
+}
+
+// parseRedisURL reads a redis:// or rediss:// url, and the key query
+// parameter, or else defaultKey
+func parseRedisURL(raw, defaultKey string) (*url.URL, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, "", fmt.Errorf("%q must be redis:// or rediss://", raw)
+	}
+	if u.Host == "" {
+		return nil, "", errors.New("redis needs a host")
+	}
+	key := u.Query().Get("key")
+	if key == "" {
+		key = defaultKey
+	}
+	return u, key, nil
+}
+
+func (l *RedisLock) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	reply, err := l.do(ctx, "EVAL", redisAcquire, "1", l.Key, id, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return reply == int64(1), err
+}
+
+func (l *RedisLock) Release(ctx context.Context, id string) error {
+	_, err := l.do(ctx, "EVAL", redisRelease, "1", l.Key, id)
+	return err
+}
+
+func (l *RedisLock) do(ctx context.Context, args ...string) (interface{}, error) {
+	return redisDo(ctx, l.URL, args...)
+}
+
+// redisDo runs one command on a new connection to u, after logging in and
+// picking the database from the url
+func redisDo(ctx context.Context, u *url.URL, args ...string) (interface{}, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(host, "6379")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "rediss" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var cmds [][]string
+	if password, ok := u.User.Password(); ok {
+		if user := u.User.Username(); user != "" {
+			cmds = append(cmds, []string{"AUTH", user, password})
+		} else {
+			cmds = append(cmds, []string{"AUTH", password})
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		cmds = append(cmds, []string{"SELECT", db})
+	}
+	cmds = append(cmds, args)
+
+	var out strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&out, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&out, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(conn, out.String()); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	var reply interface{}
+	for range cmds {
+		if reply, err = readRedisReply(r); err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
+// readRedisReply reads a reply, as a string, an int64, nil or a slice of
+// those. Error replies come back as errors.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply %q", line)
+}
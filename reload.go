@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	metricConfigReloads = NewCounterVec("config_reloads_total",
+		"config reloads applied")
+	metricConfigReloadFailures = NewCounterVec("config_reload_failures_total",
+		"config reloads rejected, leaving the previous config in place")
+)
+
+// swapHandler serves whichever handler was stored last, so the chain can be
+// replaced without touching the listener.
+type swapHandler struct {
+	current atomic.Value
+}
+
+func (s *swapHandler) store(h http.Handler) { s.current.Store(&h) }
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.current.Load().(*http.Handler)).ServeHTTP(w, r)
+}
+
+// configReloader rebuilds the handler chain from the config file. A config
+// that fails to load or build is rejected as a whole, and the previous one
+// keeps serving.
+type configReloader struct {
+	path    string
+	handler *swapHandler
+	// forward is the chain after acking, for deliveries made from queues
+	forward *swapHandler
+
+	mu          sync.Mutex
+	fingerprint string
+	config      *Config
+}
+
+// reloader is set up in main once the handler has been built
+var reloader *configReloader
+
+func newConfigReloader(path string) *configReloader {
+	return &configReloader{path: path, handler: &swapHandler{}, forward: &swapHandler{}}
+}
+
+// apply is called with mu held, or before the reloader is shared
+func (c *configReloader) apply(config *Config) error {
+	if features := singleProcessFeatures(config); len(features) > 0 && *flagWorkers > 0 {
+		return fmt.Errorf("%s can not be used with --workers", strings.Join(features, ", "))
+	}
+	fp, err := fingerprintConfig(effectiveFlags(kingpin.CommandLine), config)
+	if err != nil {
+		return err
+	}
+	h, err := buildHandler(config)
+	if err != nil {
+		return err
+	}
+	forward, err := buildForwardHandler(config)
+	if err != nil {
+		return err
+	}
+	// windows are only swapped once nothing else can fail
+	if err := silences.replaceConfig(config.Silences); err != nil {
+		return err
+	}
+	c.handler.store(h)
+	c.forward.store(forward)
+	rateLimitBuckets.keep(config.RateLimits)
+	c.fingerprint = fp
+	c.config = config
+	return nil
+}
+
+func (c *configReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	config, err := loadConfig(c.path)
+	if err == nil {
+		err = c.apply(config)
+	}
+	if err != nil {
+		metricConfigReloadFailures.Inc()
+		raw, _ := json.Marshal(map[string]string{
+			"msg":     "config reload failed, keeping the previous config",
+			"config":  c.path,
+			"error":   err.Error(),
+			"serving": c.fingerprint,
+		})
+		log.Printf("%s", raw)
+		return err
+	}
+	metricConfigReloads.Inc()
+	log.Printf("reloaded %s, config fingerprint %s", c.path, c.fingerprint)
+	return nil
+}
+
+func (c *configReloader) currentFingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fingerprint
+}
+
+func (c *configReloader) currentConfig() *Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+// reloadOnHangup reloads the config, and has secrets and anything else in
+// refresh read again, each time the process gets a SIGHUP. The listener is
+// untouched, so nothing in flight is lost.
+func reloadOnHangup(c *configReloader, refresh ...chan<- struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.Printf("got SIGHUP, reloading")
+		c.reload()
+		for _, ch := range refresh {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// ReloadHandler reloads the config on POST, answering 422 if it was
+// rejected.
+func ReloadHandler(c *configReloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := c.reload(); err != nil {
+			http.Error(w, "reload failed, previous config kept: "+err.Error(),
+				http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"config_fingerprint": c.currentFingerprint()})
+	})
+}
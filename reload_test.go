@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigReloader(t *testing.T) {
+	*flagProxyTarget = []*url.URL{{Scheme: "http", Host: "127.0.0.1:80"}}
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"routes":[{"name":"a"}]}`), 0600))
+	config, err := loadConfig(path)
+	require.NoError(t, err)
+	c := newConfigReloader(path)
+	require.NoError(t, c.apply(config))
+	first := c.currentFingerprint()
+	served := c.handler.current.Load()
+
+	reload := func() int {
+		w := httptest.NewRecorder()
+		ReloadHandler(c).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+		return w.Code
+	}
+
+	before := metricConfigReloadFailures.Get()
+	for name, tc := range map[string]struct {
+		config    string
+		deadlines []string
+	}{
+		"unparsable rule": {config: `{"routes":[{"name":"a","backend":"deployer"}]}`},
+		// the window would be put in the store if the build were half applied
+		"failed build": {deadlines: []string{"block_actions"}, config: `{
+			"silences":[{"id":"half-applied","schedule":"* * * * *","duration":"1m"}]}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			*flagTypeDeadlines = tc.deadlines
+			defer func() { *flagTypeDeadlines = nil }()
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.config), 0600))
+			assert.Equal(t, http.StatusUnprocessableEntity, reload())
+			assert.Equal(t, first, c.currentFingerprint())
+			assert.True(t, served == c.handler.current.Load(), "the previous handler keeps serving")
+			for _, sw := range silences.list() {
+				assert.NotEqual(t, "half-applied", sw.ID)
+			}
+		})
+	}
+	assert.Equal(t, before+2, metricConfigReloadFailures.Get())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"routes":[{"name":"b"}]}`), 0600))
+	assert.Equal(t, http.StatusOK, reload())
+	assert.NotEqual(t, first, c.currentFingerprint())
+
+	w := httptest.NewRecorder()
+	ReloadHandler(c).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestSwapHandler(t *testing.T) {
+	var s swapHandler
+	s.store(StatusHandler(http.StatusOK, "one"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("")))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	s.store(StatusHandler(http.StatusAccepted, "two"))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("")))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestReloadBackend(t *testing.T) {
+	*flagProxyTarget = []*url.URL{{Scheme: "http", Host: "127.0.0.1:1"}}
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{}`), 0600))
+	config, err := loadConfig(path)
+	require.NoError(t, err)
+	c := newConfigReloader(path)
+	require.NoError(t, c.apply(config))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"backend":"`+backend.URL+`",
+		"allowed_uris":["/slack/events"],"allowed_methods":["POST"]}`), 0600))
+	require.NoError(t, c.reload())
+
+	w := httptest.NewRecorder()
+	c.forward.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader("{}")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	w = httptest.NewRecorder()
+	c.handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/slack/other", strings.NewReader("{}")))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	c.handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/slack/events", strings.NewReader("{}")))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"backend":"no-host"}`), 0600))
+	assert.Error(t, c.reload())
+}
+
+func TestReloadKeepsRateLimits(t *testing.T) {
+	*flagProxyTarget = []*url.URL{{Scheme: "http", Host: "127.0.0.1:80"}}
+	limit := RateLimitConfig{Name: "bulk", Labels: map[string]string{"tier": "bulk"}, Rate: 0.001, Burst: 1}
+	config := func(name string, limit RateLimitConfig) *Config {
+		return &Config{
+			Routes:     []RouteConfig{{Name: name}},
+			Labels:     []LabelRule{{Label: "tier", Value: "bulk"}},
+			RateLimits: []RateLimitConfig{limit},
+		}
+	}
+	bucket := func() *tokenBucket { return buildRateLimits([]RateLimitConfig{limit})[0].bucket }
+
+	c := newConfigReloader("")
+	require.NoError(t, c.apply(config("a", limit)))
+	require.True(t, bucket().allow())
+
+	// the limit is unchanged, so what it let through still counts
+	require.NoError(t, c.apply(config("b", limit)))
+	assert.False(t, bucket().allow())
+
+	// a changed limit starts over, and the old bucket is dropped
+	limit.Burst = 2
+	require.NoError(t, c.apply(config("b", limit)))
+	assert.True(t, bucket().allow())
+	assert.Len(t, rateLimitBuckets.buckets, 1)
+}
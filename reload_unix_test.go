@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadOnHangup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{}`), 0600))
+	c := newConfigReloader(path)
+
+	secrets := make(chan struct{}, 1)
+	go reloadOnHangup(c, secrets)
+	// give signal.Notify a moment to be in place
+	time.Sleep(50 * time.Millisecond)
+	before := metricConfigReloads.Get()
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-secrets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("secrets were never refreshed")
+	}
+	assert.Equal(t, before+1, metricConfigReloads.Get())
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagReplayArchives = kingpin.
+	Flag("replay-archive", "archive file /admin/replay may read events from, as well as --shadow-archive").
+	Envar("REPLAY_ARCHIVE").Strings()
+
+var metricReplayed = NewCounterVec("admin_replayed_total",
+	"archived events replayed from /admin/replay, by outcome", "outcome")
+
+// HeaderProxyReplay marks a delivery replayed from an archive, so a later
+// replay does not pick up the copy as well as the original
+const HeaderProxyReplay = "X-Proxy-Replay"
+
+// the most events one replay call handles, unless asked for fewer
+const replayMaxEvents = 1000
+
+// ReplayFilter picks archived events. Zero fields match everything.
+// Outcome and Status match the backend answer recorded with
+// --archive-responses, so events archived without one never match them.
+type ReplayFilter struct {
+	Since   time.Time
+	Until   time.Time
+	Types   []string
+	Teams   []string
+	Outcome string
+	Status  int
+	Limit   int
+}
+
+func parseReplayFilter(q url.Values) (ReplayFilter, error) {
+	f := ReplayFilter{Types: q["type"], Teams: q["team"], Outcome: q.Get("outcome"), Limit: replayMaxEvents}
+	for name, into := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if raw := q.Get(name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return f, fmt.Errorf("%s: %v", name, err)
+			}
+			*into = t
+		}
+	}
+	switch f.Outcome {
+	case "", ReceiptDelivered, ReceiptRejected, ReceiptFailed:
+	default:
+		return f, fmt.Errorf("outcome must be %s, %s or %s", ReceiptDelivered, ReceiptRejected, ReceiptFailed)
+	}
+	for name, into := range map[string]*int{"status": &f.Status, "limit": &f.Limit} {
+		if raw := q.Get(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 {
+				return f, fmt.Errorf("%s must be a positive number", name)
+			}
+			*into = n
+		}
+	}
+	if f.Limit > replayMaxEvents {
+		f.Limit = replayMaxEvents
+	}
+	return f, nil
+}
+
+func (f ReplayFilter) match(d *Delivery) bool {
+	if d.Header.Get(HeaderProxyReplay) != "" {
+		return false
+	}
+	if (!f.Since.IsZero() && d.ReceivedAt.Before(f.Since)) || (!f.Until.IsZero() && !d.ReceivedAt.Before(f.Until)) {
+		return false
+	}
+	if f.Outcome != "" || f.Status != 0 {
+		if d.Response == nil ||
+			(f.Outcome != "" && receiptOutcome(d.Response.Status) != f.Outcome) ||
+			(f.Status != 0 && d.Response.Status != f.Status) {
+			return false
+		}
+	}
+	if len(f.Types) == 0 && len(f.Teams) == 0 {
+		return true
+	}
+	p, err := d.Payload(PayloadParserFunc(ParseSlackPayload))
+	if err != nil {
+		return false
+	}
+	return (len(f.Types) == 0 || containsString(f.Types, p.Type)) &&
+		(len(f.Teams) == 0 || containsString(f.Teams, p.TeamID))
+}
+
+// ReplayedEvent is one event a replay picked, and how the backend answered
+// it this time. Status is left out on a dry run.
+type ReplayedEvent struct {
+	EventID    string    `json:"event_id"`
+	Type       string    `json:"type"`
+	TeamID     string    `json:"team_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Status     int       `json:"status,omitempty"`
+}
+
+type replayResult struct {
+	DryRun   bool            `json:"dry_run"`
+	Matched  int             `json:"matched"`
+	Replayed int             `json:"replayed"`
+	Failed   int             `json:"failed"`
+	Events   []ReplayedEvent `json:"events"`
+
+	Contract *ContractReport `json:"contract,omitempty"`
+}
+
+// ReplayPace spaces out replayed events, so a day of traffic does not land
+// on the backend in seconds. The zero value sends them as fast as the
+// backend takes them.
+type ReplayPace struct {
+	// Original keeps the gaps between events as slack sent them, divided
+	// by Speed
+	Original bool
+	Speed    float64
+	// Rate is events per second, when not keeping the original gaps
+	Rate float64
+}
+
+func parseReplayPace(q url.Values) (ReplayPace, error) {
+	var p ReplayPace
+	for name, into := range map[string]*float64{"speed": &p.Speed, "rate": &p.Rate} {
+		if raw := q.Get(name); raw != "" {
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil || n <= 0 {
+				return p, fmt.Errorf("%s must be a positive number", name)
+			}
+			*into = n
+		}
+	}
+	switch q.Get("pace") {
+	case "", "fast":
+		p.Rate = 0
+	case "original":
+		p.Original, p.Rate = true, 0
+		if p.Speed == 0 {
+			p.Speed = 1
+		}
+	case "rate":
+		if p.Rate == 0 {
+			return p, fmt.Errorf("pace=rate needs rate, in events per second")
+		}
+	default:
+		return p, fmt.Errorf("pace must be fast, original or rate")
+	}
+	return p, nil
+}
+
+// offset is how long after the replay starts the ith event goes out
+func (p ReplayPace) offset(i int, first, d *Delivery) time.Duration {
+	switch {
+	case p.Original:
+		if gap := d.ReceivedAt.Sub(first.ReceivedAt); gap > 0 {
+			return time.Duration(float64(gap) / p.Speed)
+		}
+	case p.Rate > 0:
+		return time.Duration(float64(i) / p.Rate * float64(time.Second))
+	}
+	return 0
+}
+
+// ReplayHandler replays archived events picked by the query string through
+// forward on POST, like
+// /admin/replay?since=2020-09-01T00:00:00Z&type=message&outcome=failed.
+// With dry_run=true it only lists what would be replayed. Events go one at
+// a time, oldest first, paced by pace=fast, pace=original with an optional
+// speed multiplier, or pace=rate with rate events per second. A slow
+// replay can run after answering with background=true. With compare=true
+// each event also goes to candidate, and the answers are compared, bodies
+// too with compare_bodies=true.
+func ReplayHandler(archives []string, forward, candidate http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filter, err := parseReplayFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pace, err := parseReplayPace(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		background, _ := strconv.ParseBool(r.URL.Query().Get("background"))
+		compare, _ := strconv.ParseBool(r.URL.Query().Get("compare"))
+		compareBodies, _ := strconv.ParseBool(r.URL.Query().Get("compare_bodies"))
+		if compare && candidate == nil {
+			http.Error(w, "compare needs --replay-candidate", http.StatusBadRequest)
+			return
+		}
+
+		var picked []*Delivery
+		for _, path := range archives {
+			f, err := os.Open(path)
+			if err != nil {
+				http.Error(w, "opening archive: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			err = ReadArchive(f, func(d *Delivery) error {
+				if len(picked) < filter.Limit && filter.match(d) {
+					picked = append(picked, d)
+				}
+				return nil
+			})
+			f.Close()
+			if err != nil {
+				http.Error(w, "reading archive: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		sort.SliceStable(picked, func(i, j int) bool {
+			return picked[i].ReceivedAt.Before(picked[j].ReceivedAt)
+		})
+
+		result := &replayResult{DryRun: dryRun, Matched: len(picked), Events: []ReplayedEvent{}}
+		for _, d := range picked {
+			event := ReplayedEvent{ReceivedAt: d.ReceivedAt}
+			if p, err := d.Payload(PayloadParserFunc(ParseSlackPayload)); err == nil {
+				event.EventID, event.Type, event.TeamID = p.ID, p.Type, p.TeamID
+			}
+			result.Events = append(result.Events, event)
+		}
+		var check *contractCheck
+		if compare && !dryRun {
+			check = newContractCheck(candidate, compareBodies, timeout)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case dryRun:
+		case background:
+			events := append([]ReplayedEvent(nil), result.Events...)
+			go replayEvents(context.Background(), picked, forward, timeout, pace, check, &replayResult{Events: events})
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			replayEvents(r.Context(), picked, forward, timeout, pace, check, result)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// replayEvents sends picked through forward as paced, filling in result,
+// and stops early if ctx is done. Each event is compared against the
+// candidate when check is set.
+func replayEvents(ctx context.Context, picked []*Delivery, forward http.Handler,
+	timeout time.Duration, pace ReplayPace, check *contractCheck, result *replayResult) {
+	start := time.Now()
+	for i, d := range picked {
+		if wait := time.Until(start.Add(pace.offset(i, picked[0], d))); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			log.Printf("replay stopped after %d of %d archived events: %v", i, len(picked), ctx.Err())
+			break
+		}
+		result.Events[i].Status = replayOne(ctx, d, forward, timeout, check, result.Events[i])
+		if receiptOutcome(result.Events[i].Status) == ReceiptDelivered {
+			result.Replayed++
+			metricReplayed.Inc("replayed")
+		} else {
+			result.Failed++
+			metricReplayed.Inc("failed")
+		}
+	}
+	log.Printf("replayed %d archived events, %d failed", result.Replayed, result.Failed)
+	if check != nil {
+		result.Contract = &check.Report
+		log.Printf("contract check: %d of %d events answered the same by the candidate",
+			check.Report.Matched, check.Report.Compared)
+	}
+}
+
+// replayOne sends d through forward, returning the backend's status
+func replayOne(ctx context.Context, d *Delivery, forward http.Handler, timeout time.Duration,
+	check *contractCheck, event ReplayedEvent) int {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	d.Response = nil
+	r, err := d.Request(ctx)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	r.Header.Set(HeaderProxyReplay, "true")
+	// the same attempt goes to the candidate, headers and all
+	var candidate *http.Request
+	if check != nil {
+		candidate = r.Clone(ctx)
+		candidate.Body = ioutil.NopCloser(bytes.NewReader(d.Body))
+	}
+	resp := NewResponseBuffer()
+	forward.ServeHTTP(resp, r)
+	if check != nil {
+		check.compare(candidate, event, resp)
+	}
+	return resp.StatusCode()
+}
+
+// replayArchives are the archives /admin/replay reads
+func replayArchives() []string {
+	archives := append([]string(nil), *flagReplayArchives...)
+	if *flagShadowArchive != "" {
+		archives = append(archives, *flagShadowArchive)
+	}
+	return archives
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReplayFilter(t *testing.T) {
+	for query, exp := range map[string]ReplayFilter{
+		"": {Limit: replayMaxEvents},
+		"since=2020-09-01T00:00:00Z&type=message&type=app_mention&team=T1&outcome=failed&status=503&limit=5": {
+			Since:   time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC),
+			Types:   []string{"message", "app_mention"},
+			Teams:   []string{"T1"},
+			Outcome: ReceiptFailed,
+			Status:  503,
+			Limit:   5,
+		},
+		"limit=100000": {Limit: replayMaxEvents},
+	} {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		got, err := parseReplayFilter(q)
+		require.NoError(t, err, query)
+		assert.Equal(t, exp, got, query)
+	}
+
+	for _, query := range []string{"since=yesterday", "outcome=lost", "status=abc", "limit=0"} {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		_, err = parseReplayFilter(q)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestReplayHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.ndjson")
+
+	event := func(id, eventType, team string, at time.Time, status int, replayed bool) *Delivery {
+		d := &Delivery{
+			Method:     http.MethodPost,
+			RequestURI: "/slack/events",
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body: []byte(`{"type":"event_callback","event_id":"` + id + `","team_id":"` + team +
+				`","event":{"type":"` + eventType + `"}}`),
+			ReceivedAt: at,
+		}
+		if status != 0 {
+			d.Response = &DeliveryResponse{Status: status}
+		}
+		if replayed {
+			d.Header.Set(HeaderProxyReplay, "true")
+		}
+		return d
+	}
+	day := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	archive, err := OpenArchiveSink(path)
+	require.NoError(t, err)
+	for _, d := range []*Delivery{
+		event("Ev1", "message", "T1", day, 200, false),
+		event("Ev2", "message", "T1", day.Add(time.Hour), 503, false),
+		event("Ev3", "app_mention", "T2", day.Add(2*time.Hour), 500, false),
+		event("Ev4", "message", "T2", day.Add(3*time.Hour), 0, false),
+		event("Ev2", "message", "T1", day.Add(4*time.Hour), 503, true),
+	} {
+		require.NoError(t, archive.Send(context.Background(), d))
+	}
+	require.NoError(t, archive.Close())
+
+	var forwarded []*http.Request
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r)
+		if p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload)); err == nil && p.TeamID == "T2" {
+			http.Error(w, "still down", http.StatusServiceUnavailable)
+		}
+	})
+	h := ReplayHandler([]string{path}, backend, nil, time.Second)
+
+	for _, test := range []struct {
+		query    string
+		ids      []string
+		replayed int
+		failed   int
+	}{
+		{"dry_run=true", []string{"Ev1", "Ev2", "Ev3", "Ev4"}, 0, 0},
+		{"dry_run=true&outcome=failed", []string{"Ev2", "Ev3"}, 0, 0},
+		{"dry_run=true&type=message&team=T2", []string{"Ev4"}, 0, 0},
+		{"dry_run=true&since=2020-09-01T01:00:00Z&until=2020-09-01T03:00:00Z", []string{"Ev2", "Ev3"}, 0, 0},
+		{"dry_run=true&status=200", []string{"Ev1"}, 0, 0},
+		{"dry_run=true&limit=1", []string{"Ev1"}, 0, 0},
+		{"outcome=failed", []string{"Ev2", "Ev3"}, 1, 1},
+	} {
+		forwarded = nil
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/replay?"+test.query, nil))
+		require.Equal(t, http.StatusOK, w.Code, test.query)
+
+		var got replayResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+		var ids []string
+		for _, each := range got.Events {
+			ids = append(ids, each.EventID)
+		}
+		assert.Equal(t, test.ids, ids, test.query)
+		assert.Equal(t, len(test.ids), got.Matched, test.query)
+		assert.Equal(t, test.replayed, got.Replayed, test.query)
+		assert.Equal(t, test.failed, got.Failed, test.query)
+		if got.DryRun {
+			assert.Empty(t, forwarded, test.query)
+			continue
+		}
+		require.Len(t, forwarded, len(test.ids), test.query)
+		for _, r := range forwarded {
+			assert.Equal(t, "true", r.Header.Get(HeaderProxyReplay))
+			assert.Equal(t, "1", r.Header.Get(HeaderProxyAttempt))
+		}
+		assert.Equal(t, http.StatusOK, got.Events[0].Status)
+		assert.Equal(t, http.StatusServiceUnavailable, got.Events[1].Status)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/replay", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/replay?outcome=lost", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestReplayPace(t *testing.T) {
+	for query, exp := range map[string]ReplayPace{
+		"":                      {},
+		"pace=fast&rate=5":      {},
+		"pace=original":         {Original: true, Speed: 1},
+		"pace=original&speed=4": {Original: true, Speed: 4},
+		"pace=rate&rate=20":     {Rate: 20},
+	} {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		got, err := parseReplayPace(q)
+		require.NoError(t, err, query)
+		assert.Equal(t, exp, got, query)
+	}
+	for _, query := range []string{"pace=slow", "pace=rate", "pace=rate&rate=-1", "pace=original&speed=0"} {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		_, err = parseReplayPace(q)
+		assert.Error(t, err, query)
+	}
+
+	day := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	first := &Delivery{ReceivedAt: day}
+	later := &Delivery{ReceivedAt: day.Add(time.Minute)}
+	earlier := &Delivery{ReceivedAt: day.Add(-time.Minute)}
+	assert.Equal(t, time.Duration(0), ReplayPace{}.offset(3, first, later))
+	assert.Equal(t, time.Minute, ReplayPace{Original: true, Speed: 1}.offset(3, first, later))
+	assert.Equal(t, 15*time.Second, ReplayPace{Original: true, Speed: 4}.offset(3, first, later))
+	assert.Equal(t, time.Duration(0), ReplayPace{Original: true, Speed: 1}.offset(3, first, earlier))
+	assert.Equal(t, 1500*time.Millisecond, ReplayPace{Rate: 2}.offset(3, first, later))
+}
+
+func TestReplayHandlerPaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.ndjson")
+
+	day := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	archive, err := OpenArchiveSink(path)
+	require.NoError(t, err)
+	// archived out of order, replayed oldest first
+	for _, at := range []time.Duration{0, 2 * time.Second, time.Second} {
+		require.NoError(t, archive.Send(context.Background(), &Delivery{
+			Method:     http.MethodPost,
+			RequestURI: "/slack/events",
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       []byte(`{"type":"event_callback","event_id":"Ev` + at.String() + `"}`),
+			ReceivedAt: day.Add(at),
+		}))
+	}
+	require.NoError(t, archive.Close())
+
+	sent := make(chan time.Time, 10)
+	var order []string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload))
+		require.NoError(t, err)
+		order = append(order, p.ID)
+		sent <- time.Now()
+	})
+	h := ReplayHandler([]string{path}, backend, nil, time.Second)
+
+	// a second of traffic at 20x is 50ms between events
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/replay?pace=original&speed=20", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.Equal(t, []string{"Ev0s", "Ev1s", "Ev2s"}, order)
+
+	// in the background the answer comes first
+	order = nil
+	for len(sent) > 0 {
+		<-sent
+	}
+	start = time.Now()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/replay?pace=rate&rate=20&background=true", nil))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var got replayResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, 3, got.Matched)
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case last = <-sent:
+		case <-time.After(5 * time.Second):
+			t.Fatal("background replay did not finish")
+		}
+	}
+	assert.True(t, last.Sub(start) >= 100*time.Millisecond)
+}
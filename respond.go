@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagRespondListen = kingpin.
+				Flag("respond-listen", "address for the listener backends send response_url messages to at /respond, disabled if empty. Keep it apart from --admin-listen, backends must not reach the admin endpoints").
+				Envar("RESPOND_LISTEN").String()
+	flagRespondHosts = kingpin.
+				Flag("respond-host", "hosts backends may send response_url messages to").
+				Envar("RESPOND_HOST").Default("hooks.slack.com").Strings()
+	flagRespondRate = kingpin.
+			Flag("respond-rate", "messages sent per second to each response_url").
+			Envar("RESPOND_RATE").Default("1").Float64()
+	flagRespondRetries = kingpin.
+				Flag("respond-retries", "times a failed response_url message is retried").
+				Envar("RESPOND_RETRIES").Default("3").Int()
+)
+
+var metricResponseURL = NewCounterVec("slack_response_url_messages_total",
+	"messages sent to slack response_urls for backends by outcome", "outcome")
+
+// ResponseURLRequest is what backends post to have a message sent on to a
+// slack response_url.
+type ResponseURLRequest struct {
+	ResponseURL string          `json:"response_url"`
+	Message     json.RawMessage `json:"message"`
+}
+
+// response_urls stop taking messages after half an hour
+const responseURLLifetime = 30 * time.Minute
+
+// ResponseURLForwarder sends messages to slack response_urls for backends,
+// with retries and a rate limit on each response_url, so delayed responses
+// are visible at the proxy too.
+type ResponseURLForwarder struct {
+	Hosts   []string
+	Retries int
+	Backoff time.Duration
+	Rate    float64
+	Client  *http.Client
+
+	// a token bucket per response_url
+	limits *Cache
+}
+
+func NewResponseURLForwarder(hosts []string, rate float64, retries int) (*ResponseURLForwarder, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("response_url rate must be above 0, not %v", rate)
+	}
+	return &ResponseURLForwarder{
+		Hosts:   hosts,
+		Retries: retries,
+		Backoff: time.Second,
+		Rate:    rate,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		limits:  NewCache("response_url_limits", 10000, responseURLLifetime),
+	}, nil
+}
+
+// limit is the token bucket for target
+func (f *ResponseURLForwarder) limit(target string) *tokenBucket {
+	b, _ := f.limits.Load(target, func() (interface{}, error) {
+		return newTokenBucket(f.Rate, 1), nil
+	})
+	return b.(*tokenBucket)
+}
+
+func (f *ResponseURLForwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in ResponseURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		metricResponseURL.Inc("rejected")
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(in.ResponseURL)
+	if err != nil || target.Scheme != "https" || !containsString(f.Hosts, target.Hostname()) {
+		// only ever talk to slack, this must not become an open relay
+		metricResponseURL.Inc("rejected")
+		http.Error(w, "response_url not allowed", http.StatusBadRequest)
+		return
+	}
+	if len(in.Message) < 1 {
+		metricResponseURL.Inc("rejected")
+		http.Error(w, "message required", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := f.send(r, target.String(), in.Message)
+	if err != nil {
+		metricResponseURL.Inc("failed")
+		log.Printf("response_url %s: %v", target.Path, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	metricResponseURL.Inc("sent")
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (f *ResponseURLForwarder) send(r *http.Request, target string, msg []byte) (*http.Response, error) {
+	backoff := f.Backoff
+	limit := f.limit(target)
+	for attempt := 0; ; attempt++ {
+		if err := limit.Wait(r.Context()); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(msg))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(r.Context())
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := f.Client.Do(req)
+		retry := err != nil ||
+			resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= 500
+		if !retry || attempt >= f.Retries {
+			return resp, err
+		}
+
+		wait := backoff
+		if err == nil {
+			if after, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+				wait = time.Duration(after) * time.Second
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("slack returned %d", resp.StatusCode)
+		}
+		log.Printf("response_url attempt %d: %v, retrying in %s", attempt+1, err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseURLForwarder(t *testing.T) {
+	var got []string
+	fail := 1
+	slack := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		if fail > 0 {
+			fail--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		got = append(got, r.URL.Path+" "+string(body))
+		w.Write([]byte("ok"))
+	}))
+	defer slack.Close()
+	slackURL, err := url.Parse(slack.URL)
+	require.NoError(t, err)
+
+	f, err := NewResponseURLForwarder([]string{slackURL.Hostname()}, 100, 1)
+	require.NoError(t, err)
+	f.Backoff = time.Millisecond
+	f.Client = slack.Client()
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	post := func(responseURL, message string) *http.Response {
+		in, err := json.Marshal(ResponseURLRequest{
+			ResponseURL: responseURL,
+			Message:     json.RawMessage(message),
+		})
+		require.NoError(t, err)
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(string(in)))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// retried past the first failure
+	resp := post(slack.URL+"/commands/T1/1/abc", `{"text":"done"}`)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, []string{`/commands/T1/1/abc {"text":"done"}`}, got)
+
+	// out of retries
+	fail = 2
+	resp = post(slack.URL+"/commands/T1/1/abc", `{"text":"done"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	for name, responseURL := range map[string]string{
+		"plain http":  strings.Replace(slack.URL, "https", "http", 1) + "/commands",
+		"other host":  "https://example.com/commands",
+		"not a url":   "%zz",
+		"no url":      "",
+		"userinfo":    "https://" + slackURL.Hostname() + "@example.com/",
+		"looks alike": "https://" + slackURL.Hostname() + ".example.com/",
+	} {
+		resp := post(responseURL, `{"text":"done"}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+	assert.Len(t, got, 1)
+
+	resp, err = http.Get(ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestResponseURLForwarderLimits(t *testing.T) {
+	_, err := NewResponseURLForwarder(nil, 0, 1)
+	assert.EqualError(t, err, "response_url rate must be above 0, not 0")
+
+	f, err := NewResponseURLForwarder(nil, 0.001, 1)
+	require.NoError(t, err)
+	first := f.limit("https://hooks.slack.com/commands/T1/1/abc")
+	assert.True(t, first.allow())
+	assert.False(t, first.allow())
+	assert.Same(t, first, f.limit("https://hooks.slack.com/commands/T1/1/abc"))
+
+	// another response_url has its own bucket
+	assert.True(t, f.limit("https://hooks.slack.com/commands/T1/2/def").allow())
+}
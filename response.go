@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ResponseBuffer collects a response in memory so it can be inspected,
+// changed, or dropped before anything reaches the client.
+type ResponseBuffer struct {
+	header http.Header
+	Status int
+	Body   bytes.Buffer
+}
+
+func NewResponseBuffer() *ResponseBuffer {
+	return &ResponseBuffer{header: http.Header{}}
+}
+
+func (b *ResponseBuffer) Header() http.Header { return b.header }
+
+func (b *ResponseBuffer) WriteHeader(status int) {
+	if b.Status == 0 {
+		b.Status = status
+	}
+}
+
+func (b *ResponseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.Body.Write(p)
+}
+
+// StatusCode is the status written, or 200 if the handler never wrote one.
+func (b *ResponseBuffer) StatusCode() int {
+	if b.Status == 0 {
+		return http.StatusOK
+	}
+	return b.Status
+}
+
+// CopyTo sends the buffered response on to w.
+func (b *ResponseBuffer) CopyTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.StatusCode())
+	w.Write(b.Body.Bytes())
+}
+
+// how the backend response is passed back to slack
+const (
+	ResponseVerbatim = "verbatim"
+	ResponseMapped   = "mapped"
+	ResponseReplaced = "replaced"
+)
+
+// ResponseConfig sets what slack sees of a backend response. Verbatim passes
+// it through, mapped turns backend 5xx errors into an empty 200, and
+// replaced always answers with Status and Body.
+type ResponseConfig struct {
+	Mode        string `json:"mode"`
+	Status      int    `json:"status"`
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+
+	Headers []HeaderRule `json:"headers"`
+}
+
+// when a HeaderRule applies, going by the status slack is sent
+const (
+	HeaderAlways  = "always"
+	HeaderSuccess = "success"
+	HeaderFailure = "failure"
+)
+
+// HeaderRule adds a header to responses sent back to slack, such as
+// X-Slack-No-Retry. The value is Value, or the request header named by
+// FromRequest when that is set, which is handy for passing tracing ids back.
+type HeaderRule struct {
+	Name        string `json:"name"`
+	Value       string `json:"value"`
+	FromRequest string `json:"from_request"`
+	When        string `json:"when"`
+}
+
+func (hr HeaderRule) validate() error {
+	if hr.Name == "" || strings.ContainsAny(hr.Name, " :\r\n") ||
+		strings.ContainsAny(hr.Value, "\r\n") {
+		return fmt.Errorf("bad response header %q", hr.Name)
+	}
+	switch hr.When {
+	case "", HeaderAlways, HeaderSuccess, HeaderFailure:
+	default:
+		return fmt.Errorf("unknown response header condition %q", hr.When)
+	}
+	return nil
+}
+
+func (hr HeaderRule) applies(status int) bool {
+	switch hr.When {
+	case HeaderSuccess:
+		return status < 300
+	case HeaderFailure:
+		return status >= 300
+	}
+	return true
+}
+
+func (rc ResponseConfig) validate() error {
+	switch rc.Mode {
+	case "", ResponseVerbatim, ResponseMapped:
+	case ResponseReplaced:
+		if rc.Status != 0 && (rc.Status < 100 || rc.Status > 599) {
+			return fmt.Errorf("bad replacement status %d", rc.Status)
+		}
+	default:
+		return fmt.Errorf("unknown response mode %q", rc.Mode)
+	}
+	for _, hr := range rc.Headers {
+		if err := hr.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResponseHeaderHandler adds the headers in rules that apply to the status
+// child answers with.
+func ResponseHeaderHandler(child http.Handler, rules []HeaderRule) http.Handler {
+	if len(rules) < 1 {
+		return child
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		child.ServeHTTP(&headerWriter{ResponseWriter: w, r: r, rules: rules}, r)
+	})
+}
+
+// headerWriter adds headers just before the status goes out
+type headerWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	rules   []HeaderRule
+	written bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		for _, hr := range w.rules {
+			if !hr.applies(status) {
+				continue
+			}
+			value := hr.Value
+			if hr.FromRequest != "" {
+				value = w.r.Header.Get(hr.FromRequest)
+			}
+			if value != "" {
+				w.Header().Set(hr.Name, value)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *headerWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// ResponseModeHandler changes the response of child per rc.
+func ResponseModeHandler(child http.Handler, route string, rc ResponseConfig) http.Handler {
+	if rc.Mode == "" || rc.Mode == ResponseVerbatim {
+		return child
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := NewResponseBuffer()
+		child.ServeHTTP(resp, r)
+
+		switch rc.Mode {
+		case ResponseMapped:
+			if resp.StatusCode() >= 500 {
+				log.Printf("route %s: backend returned %d, answering 200: %s",
+					route, resp.StatusCode(), bytes.TrimSpace(resp.Body.Bytes()))
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			resp.CopyTo(w)
+
+		case ResponseReplaced:
+			if resp.StatusCode() >= 300 {
+				log.Printf("route %s: backend returned %d, replaced", route, resp.StatusCode())
+			}
+			if rc.ContentType != "" {
+				w.Header().Set("Content-Type", rc.ContentType)
+			}
+			status := rc.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(rc.Body))
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseBuffer(t *testing.T) {
+	buf := NewResponseBuffer()
+	assert.Equal(t, http.StatusOK, buf.StatusCode())
+
+	StatusHandler(http.StatusTeapot, "short and stout").
+		ServeHTTP(buf, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTeapot, buf.StatusCode())
+	assert.Equal(t, "short and stout\n", buf.Body.String())
+
+	rec := httptest.NewRecorder()
+	buf.CopyTo(rec)
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, "short and stout\n", rec.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+}
+
+func TestResponseModeHandler(t *testing.T) {
+	for name, tc := range map[string]struct {
+		rc         ResponseConfig
+		backend    int
+		expStatus  int
+		expBody    string
+		expHeaders map[string]string
+	}{
+		"verbatim ok":    {backend: http.StatusOK, expStatus: http.StatusOK, expBody: "backend\n"},
+		"verbatim error": {rc: ResponseConfig{Mode: ResponseVerbatim}, backend: http.StatusBadGateway, expStatus: http.StatusBadGateway, expBody: "backend\n"},
+		"mapped ok":      {rc: ResponseConfig{Mode: ResponseMapped}, backend: http.StatusOK, expStatus: http.StatusOK, expBody: "backend\n"},
+		"mapped 4xx":     {rc: ResponseConfig{Mode: ResponseMapped}, backend: http.StatusNotFound, expStatus: http.StatusNotFound, expBody: "backend\n"},
+		"mapped 5xx":     {rc: ResponseConfig{Mode: ResponseMapped}, backend: http.StatusInternalServerError, expStatus: http.StatusOK},
+		"replaced": {
+			rc:         ResponseConfig{Mode: ResponseReplaced, Status: http.StatusAccepted, Body: `{"text":"on it"}`, ContentType: "application/json"},
+			backend:    http.StatusInternalServerError,
+			expStatus:  http.StatusAccepted,
+			expBody:    `{"text":"on it"}`,
+			expHeaders: map[string]string{"Content-Type": "application/json"},
+		},
+		"replaced default status": {rc: ResponseConfig{Mode: ResponseReplaced}, backend: http.StatusOK, expStatus: http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ResponseModeHandler(StatusHandler(tc.backend, "backend"), name, tc.rc).
+				ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+			assert.Equal(t, tc.expStatus, rec.Code)
+			assert.Equal(t, tc.expBody, rec.Body.String())
+			for k, v := range tc.expHeaders {
+				assert.Equal(t, v, rec.Header().Get(k))
+			}
+		})
+	}
+}
+
+func TestResponseHeaderHandler(t *testing.T) {
+	rules := []HeaderRule{
+		{Name: "X-Slack-No-Retry", Value: "1", When: HeaderFailure},
+		{Name: "X-Handled", Value: "yes", When: HeaderSuccess},
+		{Name: "X-Trace-Id", FromRequest: "X-Request-Id"},
+	}
+	for name, tc := range map[string]struct {
+		backend    int
+		requestID  string
+		expHeaders map[string]string
+	}{
+		"success": {backend: http.StatusOK, requestID: "abc",
+			expHeaders: map[string]string{"X-Handled": "yes", "X-Trace-Id": "abc", "X-Slack-No-Retry": ""}},
+		"failure": {backend: http.StatusBadGateway,
+			expHeaders: map[string]string{"X-Handled": "", "X-Trace-Id": "", "X-Slack-No-Retry": "1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tc.requestID != "" {
+				r.Header.Set("X-Request-Id", tc.requestID)
+			}
+			rec := httptest.NewRecorder()
+			ResponseHeaderHandler(StatusHandler(tc.backend, "backend"), rules).ServeHTTP(rec, r)
+			assert.Equal(t, tc.backend, rec.Code)
+			for k, v := range tc.expHeaders {
+				assert.Equal(t, v, rec.Header().Get(k), k)
+			}
+		})
+	}
+
+	// headers follow the status after the response mode has changed it
+	rec := httptest.NewRecorder()
+	ResponseHeaderHandler(ResponseModeHandler(StatusHandler(http.StatusBadGateway, "backend"),
+		"mapped", ResponseConfig{Mode: ResponseMapped}), rules).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "yes", rec.Header().Get("X-Handled"))
+}
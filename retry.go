@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagRetryHistory = kingpin.
+	Flag("retry-history", "how many event ids to remember answers for, to explain slack retries").
+	Envar("RETRY_HISTORY").Default("10000").Int()
+
+var metricSlackRetries = NewCounterVec("slack_retries_total",
+	"retried events by likely cause, and the reason slack gave", "cause", "reason")
+
+// headers slack sets on a retried event
+const (
+	HeaderSlackRetryNum    = "X-Slack-Retry-Num"
+	HeaderSlackRetryReason = "X-Slack-Retry-Reason"
+)
+
+// slack gives up on an event that is not answered within this
+const slackResponseWindow = 3 * time.Second
+
+// retry causes an operator can act on
+const (
+	RetryBackendTimeout = "backend_timeout"
+	RetryServerError    = "server_error"
+	RetryClientError    = "client_error"
+	RetryNetwork        = "network"
+	RetryUnknown        = "unknown"
+)
+
+// answer is what the proxy did with an earlier attempt at an event. Status
+// stays 0 until the answer has gone out.
+type answer struct {
+	Status  int
+	Elapsed time.Duration
+}
+
+// retryHistory is set up in main with --retry-history. It is kept across
+// config reloads, so retries of events answered before one are still
+// explained.
+var retryHistory *retryTracker
+
+// retryTracker remembers how the last maxEvents events were answered.
+type retryTracker struct {
+	mu      sync.Mutex
+	answers *Cache
+}
+
+func newRetryTracker(maxEvents int) *retryTracker {
+	return &retryTracker{answers: NewCache("retry_classify", maxEvents, 0)}
+}
+
+// start records an attempt at eventID, returning the previous answer if
+// there was one
+func (t *retryTracker) start(eventID string) (prev *answer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.answers.Get(eventID); ok {
+		copied := *a.(*answer)
+		prev = &copied
+	}
+	t.answers.Set(eventID, &answer{})
+	return prev
+}
+
+func (t *retryTracker) finish(eventID string, status int, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.answers.Get(eventID); ok {
+		a.(*answer).Status, a.(*answer).Elapsed = status, elapsed
+	}
+}
+
+// classifyRetry combines the reason slack gives for a retry with how the
+// proxy answered the attempt before it.
+func classifyRetry(reason string, prev *answer) string {
+	if prev == nil {
+		// the earlier attempt never got here, or has been forgotten
+		switch reason {
+		case "http_timeout", "connection_failed", "ssl_error":
+			return RetryNetwork
+		}
+		return RetryUnknown
+	}
+	switch {
+	case prev.Status == 0 || prev.Elapsed >= slackResponseWindow:
+		return RetryBackendTimeout
+	case prev.Status >= 500:
+		return RetryServerError
+	case prev.Status >= 300:
+		return RetryClientError
+	case reason == "http_timeout":
+		// answered in time, so the answer was lost on the way back
+		return RetryNetwork
+	}
+	return RetryUnknown
+}
+
+// RetryClassifyHandler counts slack retries of events by their likely
+// cause. It has to see the final answer slack gets, so it goes outside of
+// anything that changes the response.
+func RetryClassifyHandler(child http.Handler, parser PayloadParser, t *retryTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.ID == "" {
+			child.ServeHTTP(w, r)
+			return
+		}
+
+		prev := t.start(p.ID)
+		if r.Header.Get(HeaderSlackRetryNum) != "" {
+			reason := r.Header.Get(HeaderSlackRetryReason)
+			cause := classifyRetry(reason, prev)
+			metricSlackRetries.Inc(cause, reason)
+			log.Printf("slack retry %s of event %s, slack says %q, likely %s",
+				r.Header.Get(HeaderSlackRetryNum), p.ID, reason, cause)
+		}
+
+		// time to the answer, as an acked event keeps child busy after it
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		child.ServeHTTP(sw, r)
+		if sw.written.IsZero() {
+			sw.written = time.Now()
+		}
+		t.finish(p.ID, sw.Status(), sw.written.Sub(start))
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyRetry(t *testing.T) {
+	for name, tc := range map[string]struct {
+		reason string
+		prev   *answer
+		cause  string
+	}{
+		"never got here":   {reason: "connection_failed", cause: RetryNetwork},
+		"forgotten":        {reason: "http_error", cause: RetryUnknown},
+		"still working":    {reason: "http_timeout", prev: &answer{}, cause: RetryBackendTimeout},
+		"answered late":    {reason: "http_timeout", prev: &answer{Status: 200, Elapsed: 4 * time.Second}, cause: RetryBackendTimeout},
+		"our 5xx":          {reason: "http_error", prev: &answer{Status: 502}, cause: RetryServerError},
+		"our 4xx":          {reason: "http_error", prev: &answer{Status: 404}, cause: RetryClientError},
+		"answer lost":      {reason: "http_timeout", prev: &answer{Status: 200, Elapsed: time.Second}, cause: RetryNetwork},
+		"answered just ok": {reason: "unknown_error", prev: &answer{Status: 200}, cause: RetryUnknown},
+	} {
+		assert.Equal(t, tc.cause, classifyRetry(tc.reason, tc.prev), name)
+	}
+}
+
+func TestRetryTracker(t *testing.T) {
+	tracker := newRetryTracker(2)
+	assert.Nil(t, tracker.start("Ev1"))
+	tracker.finish("Ev1", http.StatusBadGateway, time.Second)
+	assert.Equal(t, &answer{Status: http.StatusBadGateway, Elapsed: time.Second}, tracker.start("Ev1"))
+
+	tracker.start("Ev2")
+	tracker.start("Ev3")
+	assert.Nil(t, tracker.start("Ev1"), "only the last two events are kept")
+}
+
+func TestRetryClassifyHandler(t *testing.T) {
+	status := http.StatusInternalServerError
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	h := RetryClassifyHandler(backend, PayloadParserFunc(ParseSlackPayload), newRetryTracker(10))
+
+	before := metricSlackRetries.Get(RetryServerError, "http_error")
+	beforeUnknown := metricSlackRetries.Get(RetryUnknown, "http_error")
+	send := func(retry string) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(
+			`{"type":"event_callback","event_id":"Ev42","event":{"type":"message"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		if retry != "" {
+			r.Header.Set(HeaderSlackRetryNum, retry)
+			r.Header.Set(HeaderSlackRetryReason, "http_error")
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	send("")
+	status = http.StatusOK
+	send("1")
+	assert.Equal(t, before+1, metricSlackRetries.Get(RetryServerError, "http_error"))
+
+	// the second retry follows an answer that went fine
+	send("2")
+	assert.Equal(t, before+1, metricSlackRetries.Get(RetryServerError, "http_error"))
+	assert.Equal(t, beforeUnknown+1, metricSlackRetries.Get(RetryUnknown, "http_error"))
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var metricDroppedEvents = NewCounterVec("dropped_events_total",
+	"events acked without being forwarded by --event-route, by event type", "type")
+
+var (
+	flagCommandRoutes = kingpin.
+				Flag("command-route", "send a slash command, optionally by its first word, to another backend, like '/ops deploy=http://deployer'").
+				Envar("COMMAND_ROUTE").Strings()
+	flagViewRoutes = kingpin.
+			Flag("view-route", "send modal submissions and closes by view callback_id to another backend, like 'new-ticket=http://tickets'").
+			Envar("VIEW_ROUTE").Strings()
+	flagEventRoutes = kingpin.
+			Flag("event-route", "send events api events by event type to another backend, or drop them, like 'reaction_added=http://reactions' or 'message=drop'").
+			Envar("EVENT_ROUTE").Strings()
+	flagURIRoutes = kingpin.
+			Flag("uri-route", "send requests under a uri prefix to another backend, like '/slack/commands=http://commands'").
+			Envar("URI_ROUTE").Strings()
+	flagViewDeadline = kingpin.
+				Flag("view-deadline", "time a view backend has to answer, inside slack's 3s window").
+				Envar("VIEW_DEADLINE").Default("2500ms").Duration()
+)
+
+// buildRoutes collects every configured route, in the order they are tried.
+// Routes from the config file come first, then those from flags, then the
+// backends of teams.
+func buildRoutes(config *Config, fallback http.Handler) ([]Route, error) {
+	var routes []Route
+	for _, rc := range config.Routes {
+		routes = append(routes, rc.Route(fallback))
+	}
+
+	commands, err := commandRoutes(*flagCommandRoutes)
+	if err != nil {
+		return nil, err
+	}
+	views, err := viewRoutes(*flagViewRoutes, *flagViewDeadline)
+	if err != nil {
+		return nil, err
+	}
+	events, err := eventRoutes(*flagEventRoutes)
+	if err != nil {
+		return nil, err
+	}
+	routes = append(routes, commands...)
+	routes = append(routes, views...)
+	routes = append(routes, events...)
+	return append(routes, teamRoutes(config.Teams)...), nil
+}
+
+// Route sends requests whose payload matches to Handler instead of the
+// default backend.
+type Route struct {
+	Name    string
+	Match   func(r *http.Request, p *Payload) bool
+	Handler http.Handler
+}
+
+// RouteHandler hands each request to the first route matching its payload.
+// Anything unmatched, or that does not parse, goes to fallback.
+func RouteHandler(fallback http.Handler, parser PayloadParser, routes ...Route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		for _, route := range routes {
+			if route.Match(r, p) {
+				noteRoute(r, route.Name)
+				route.Handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// CommandRule matches a slash command, and if Arg is set only when it is the
+// first word of the command text.
+type CommandRule struct {
+	Command string
+	Arg     string
+	Target  *url.URL
+}
+
+// ParseCommandRule parses rules like "/ops deploy=http://deployer:8080".
+func ParseCommandRule(raw string) (CommandRule, error) {
+	i := strings.Index(raw, "=")
+	if i < 0 {
+		return CommandRule{}, fmt.Errorf("command route %q is missing =backend", raw)
+	}
+	target, err := url.Parse(strings.TrimSpace(raw[i+1:]))
+	if err != nil || target.Host == "" {
+		return CommandRule{}, fmt.Errorf("command route %q has a bad backend", raw)
+	}
+
+	fields := strings.Fields(raw[:i])
+	if len(fields) < 1 || len(fields) > 2 || !strings.HasPrefix(fields[0], "/") {
+		return CommandRule{}, fmt.Errorf("command route %q should look like '/command [arg]=backend'", raw)
+	}
+	rule := CommandRule{Command: fields[0], Target: target}
+	if len(fields) > 1 {
+		rule.Arg = fields[1]
+	}
+	return rule, nil
+}
+
+func (rule CommandRule) Match(r *http.Request, p *Payload) bool {
+	if p.Kind != PayloadCommand || p.Type != rule.Command {
+		return false
+	}
+	if rule.Arg == "" {
+		return true
+	}
+	words := strings.Fields(p.Text)
+	return len(words) > 0 && strings.EqualFold(words[0], rule.Arg)
+}
+
+// commandRoutes turns rules into routes, with rules on an argument checked
+// before rules on just the command.
+func commandRoutes(raw []string) ([]Route, error) {
+	rules := make([]CommandRule, 0, len(raw))
+	for _, each := range raw {
+		rule, err := ParseCommandRule(each)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Arg != "" && rules[j].Arg == ""
+	})
+
+	routes := make([]Route, len(rules))
+	for i, rule := range rules {
+		routes[i] = Route{
+			Name:    strings.TrimSpace(rule.Command + " " + rule.Arg),
+			Match:   rule.Match,
+			Handler: newBackendProxy(rule.Target),
+		}
+	}
+	return routes, nil
+}
+
+// ViewRule matches modal view_submission and view_closed payloads by the
+// callback_id of the view.
+type ViewRule struct {
+	CallbackID string
+	Target     *url.URL
+}
+
+// ParseViewRule parses rules like "new-ticket=http://tickets:8080".
+func ParseViewRule(raw string) (ViewRule, error) {
+	i := strings.Index(raw, "=")
+	if i < 0 {
+		return ViewRule{}, fmt.Errorf("view route %q is missing =backend", raw)
+	}
+	target, err := url.Parse(strings.TrimSpace(raw[i+1:]))
+	if err != nil || target.Host == "" {
+		return ViewRule{}, fmt.Errorf("view route %q has a bad backend", raw)
+	}
+	callbackID := strings.TrimSpace(raw[:i])
+	if callbackID == "" {
+		return ViewRule{}, fmt.Errorf("view route %q is missing a callback_id", raw)
+	}
+	return ViewRule{CallbackID: callbackID, Target: target}, nil
+}
+
+func (rule ViewRule) Match(r *http.Request, p *Payload) bool {
+	return p.Kind == PayloadInteraction &&
+		(p.Type == "view_submission" || p.Type == "view_closed") &&
+		p.CallbackID == rule.CallbackID
+}
+
+// viewRoutes turns rules into routes. The backend answer, which may carry a
+// response_action, is passed back to slack as long as it comes within
+// deadline.
+func viewRoutes(raw []string, deadline time.Duration) ([]Route, error) {
+	routes := make([]Route, 0, len(raw))
+	for _, each := range raw {
+		rule, err := ParseViewRule(each)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, Route{
+			Name:  "view " + rule.CallbackID,
+			Match: rule.Match,
+			Handler: http.TimeoutHandler(newBackendProxy(rule.Target),
+				deadline, "backend missed the view deadline"),
+		})
+	}
+	return routes, nil
+}
+
+// PathRoute sends requests with a path under Prefix to Handler.
+type PathRoute struct {
+	Prefix  string
+	Handler http.Handler
+}
+
+// PathRouteHandler hands requests to the first route their path falls
+// under, or fallback. Unlike RouteHandler it never looks at the body, so it
+// is safe to use before a request is verified.
+func PathRouteHandler(fallback http.Handler, routes ...PathRoute) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, route := range routes {
+			if pathUnder(r.URL.Path, route.Prefix) {
+				noteRoute(r, route.Prefix)
+				route.Handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// pathUnder reports whether the cleaned p is prefix or below it, so /hook
+// covers /hook/a but not /hooks, and /hook/../admin is not under /hook
+func pathUnder(p, prefix string) bool {
+	p, prefix = path.Clean("/"+p), path.Clean("/"+prefix)
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// EventRule matches events api events by their event type. Drop has them
+// acked without going anywhere, in place of Target.
+type EventRule struct {
+	Type   string
+	Target *url.URL
+	Drop   bool
+}
+
+// ParseEventRule parses rules like "app_mention=http://mentions:8080" or
+// "message=drop".
+func ParseEventRule(raw string) (EventRule, error) {
+	i := strings.Index(raw, "=")
+	if i < 0 {
+		return EventRule{}, fmt.Errorf("event route %q is missing =backend", raw)
+	}
+	rule := EventRule{Type: strings.TrimSpace(raw[:i])}
+	if rule.Type == "" {
+		return EventRule{}, fmt.Errorf("event route %q is missing an event type", raw)
+	}
+	if backend := strings.TrimSpace(raw[i+1:]); backend == "drop" {
+		rule.Drop = true
+		return rule, nil
+	}
+	target, err := url.Parse(strings.TrimSpace(raw[i+1:]))
+	if err != nil || target.Host == "" {
+		return EventRule{}, fmt.Errorf("event route %q has a bad backend", raw)
+	}
+	rule.Target = target
+	return rule, nil
+}
+
+func (rule EventRule) Match(r *http.Request, p *Payload) bool {
+	return p.Kind == PayloadEvent && p.Type == rule.Type
+}
+
+// eventRoutes turns rules into routes. Dropped events get an empty 200 so
+// slack does not retry them.
+func eventRoutes(raw []string) ([]Route, error) {
+	routes := make([]Route, 0, len(raw))
+	for _, each := range raw {
+		rule, err := ParseEventRule(each)
+		if err != nil {
+			return nil, err
+		}
+		var h http.Handler
+		if rule.Drop {
+			eventType := rule.Type
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				metricDroppedEvents.Inc(eventType)
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(http.StatusOK)
+			})
+		} else {
+			h = newBackendProxy(rule.Target)
+		}
+		routes = append(routes, Route{Name: "event " + rule.Type, Match: rule.Match, Handler: h})
+	}
+	return routes, nil
+}
+
+// URIRule matches requests whose path is under Prefix.
+type URIRule struct {
+	Prefix string
+	Target *url.URL
+}
+
+// ParseURIRule parses rules like "/slack/commands=http://commands:8080".
+func ParseURIRule(raw string) (URIRule, error) {
+	i := strings.Index(raw, "=")
+	if i < 0 {
+		return URIRule{}, fmt.Errorf("uri route %q is missing =backend", raw)
+	}
+	target, err := url.Parse(strings.TrimSpace(raw[i+1:]))
+	if err != nil || target.Host == "" {
+		return URIRule{}, fmt.Errorf("uri route %q has a bad backend", raw)
+	}
+	prefix := strings.TrimSpace(raw[:i])
+	if !strings.HasPrefix(prefix, "/") {
+		return URIRule{}, fmt.Errorf("uri route %q should look like '/prefix=backend'", raw)
+	}
+	return URIRule{Prefix: prefix, Target: target}, nil
+}
+
+// uriRoutes turns rules into path routes, longest prefix first so the most
+// specific rule wins.
+func uriRoutes(raw []string) ([]PathRoute, error) {
+	rules := make([]URIRule, 0, len(raw))
+	for _, each := range raw {
+		rule, err := ParseURIRule(each)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+
+	routes := make([]PathRoute, len(rules))
+	for i, rule := range rules {
+		routes[i] = PathRoute{Prefix: rule.Prefix, Handler: newBackendProxy(rule.Target)}
+	}
+	return routes, nil
+}
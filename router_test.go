@@ -0,0 +1,257 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommandRule(t *testing.T) {
+	for raw, tc := range testdataParseCommandRule {
+		t.Run(raw, func(t *testing.T) {
+			rule, err := ParseCommandRule(raw)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.command, rule.Command)
+			assert.Equal(t, tc.arg, rule.Arg)
+			assert.Equal(t, tc.target, rule.Target.String())
+		})
+	}
+}
+
+// namedBackend answers with its name, after checking the body made it
+func namedBackend(t *testing.T, name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.NotEmpty(t, body, "backend %s got an empty body", name)
+		w.Write([]byte(name))
+	}))
+}
+
+func TestCommandRoutes(t *testing.T) {
+	backends := map[string]*httptest.Server{}
+	for _, name := range []string{"default", "ops", "deployer", "status"} {
+		backends[name] = namedBackend(t, name)
+		defer backends[name].Close()
+	}
+
+	// the general rule comes first, but specific rules still win
+	routes, err := commandRoutes([]string{
+		"/ops=" + backends["ops"].URL,
+		"/ops deploy=" + backends["deployer"].URL,
+		"/ops status=" + backends["status"].URL,
+	})
+	require.NoError(t, err)
+	ts := httptest.NewServer(RouteHandler(backends["default"].Config.Handler,
+		PayloadParserFunc(ParseSlackPayload), routes...))
+	defer ts.Close()
+
+	for name, tc := range testdataCommandRoutes {
+		t.Run(name, func(t *testing.T) {
+			form := url.Values{"command": {tc.command}, "text": {tc.text}}
+			resp, err := http.Post(ts.URL, "application/x-www-form-urlencoded",
+				strings.NewReader(form.Encode()))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.backend, string(body))
+		})
+	}
+
+	_, err = commandRoutes([]string{"/ops"})
+	assert.Error(t, err)
+}
+
+func TestParseViewRule(t *testing.T) {
+	for raw, tc := range testdataParseViewRule {
+		t.Run(raw, func(t *testing.T) {
+			rule, err := ParseViewRule(raw)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.callbackID, rule.CallbackID)
+			assert.Equal(t, tc.target, rule.Target.String())
+		})
+	}
+}
+
+func TestViewRoutes(t *testing.T) {
+	tickets := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response_action":"errors","errors":{"title":"too short"}}`))
+	}))
+	defer tickets.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	fallback := namedBackend(t, "default")
+	defer fallback.Close()
+
+	routes, err := viewRoutes([]string{
+		"new-ticket=" + tickets.URL,
+		"survey=" + slow.URL,
+	}, 50*time.Millisecond)
+	require.NoError(t, err)
+	ts := httptest.NewServer(RouteHandler(fallback.Config.Handler,
+		PayloadParserFunc(ParseSlackPayload), routes...))
+	defer ts.Close()
+
+	post := func(payload string) (*http.Response, string) {
+		form := url.Values{"payload": {payload}}
+		resp, err := http.Post(ts.URL, "application/x-www-form-urlencoded",
+			strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := post(`{"type":"view_submission","view":{"callback_id":"new-ticket"}}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"response_action":"errors","errors":{"title":"too short"}}`, body)
+
+	resp, _ = post(`{"type":"view_closed","view":{"callback_id":"new-ticket"}}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body = post(`{"type":"block_actions","view":{"callback_id":"new-ticket"}}`)
+	assert.Equal(t, "default", body)
+
+	start := time.Now()
+	resp, _ = post(`{"type":"view_submission","view":{"callback_id":"survey"}}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestParseURIRule(t *testing.T) {
+	for raw, tc := range testdataParseURIRule {
+		t.Run(raw, func(t *testing.T) {
+			rule, err := ParseURIRule(raw)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.prefix, rule.Prefix)
+			assert.Equal(t, tc.target, rule.Target.String())
+		})
+	}
+}
+
+func TestURIRoutes(t *testing.T) {
+	backends := map[string]*httptest.Server{}
+	for _, name := range []string{"default", "slack", "events", "commands"} {
+		backends[name] = namedBackend(t, name)
+		defer backends[name].Close()
+	}
+	routes, err := uriRoutes([]string{
+		"/slack=" + backends["slack"].URL,
+		"/slack/events=" + backends["events"].URL,
+		"/slack/commands=" + backends["commands"].URL,
+	})
+	require.NoError(t, err)
+	target, err := url.Parse(backends["default"].URL)
+	require.NoError(t, err)
+	h := PathRouteHandler(newBackendProxy(target), routes...)
+
+	for path, want := range map[string]string{
+		"/slack/events":      "events",
+		"/slack/events/app":  "events",
+		"/slack/commands":    "commands",
+		"/slack/interactive": "slack",
+		"/github/webhook":    "default",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("token=x")))
+		assert.Equal(t, want, w.Body.String(), path)
+	}
+
+	_, err = uriRoutes([]string{"/slack"})
+	assert.EqualError(t, err, `uri route "/slack" is missing =backend`)
+}
+
+func TestPathUnder(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix string
+		under        bool
+	}{
+		{"/hook", "/hook", true},
+		{"/hook/a", "/hook", true},
+		{"/hook/a", "/hook/", true},
+		{"/hooks-other", "/hook", false},
+		{"/hook/../admin", "/hook", false},
+		{"//hook//a", "/hook", true},
+		{"/anything", "/", true},
+	} {
+		assert.Equal(t, tc.under, pathUnder(tc.path, tc.prefix), "%s under %s", tc.path, tc.prefix)
+	}
+}
+
+func TestParseEventRule(t *testing.T) {
+	for raw, tc := range testdataParseEventRule {
+		t.Run(raw, func(t *testing.T) {
+			rule, err := ParseEventRule(raw)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.eventType, rule.Type)
+			assert.Equal(t, tc.drop, rule.Drop)
+			if !tc.drop {
+				assert.Equal(t, tc.target, rule.Target.String())
+			}
+		})
+	}
+}
+
+func TestEventRoutes(t *testing.T) {
+	mentions := namedBackend(t, "mentions")
+	defer mentions.Close()
+	fallback := namedBackend(t, "default")
+	defer fallback.Close()
+	target, err := url.Parse(fallback.URL)
+	require.NoError(t, err)
+
+	routes, err := eventRoutes([]string{"app_mention=" + mentions.URL, "message=drop"})
+	require.NoError(t, err)
+	h := RouteHandler(newBackendProxy(target), PayloadParserFunc(ParseSlackPayload), routes...)
+
+	before := metricDroppedEvents.Get("message")
+	for eventType, want := range map[string]string{
+		"app_mention":    "mentions",
+		"message":        "",
+		"reaction_added": "default",
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events",
+			strings.NewReader(`{"type":"event_callback","event":{"type":"`+eventType+`"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, eventType)
+		assert.Equal(t, want, w.Body.String(), eventType)
+	}
+	assert.Equal(t, before+1, metricDroppedEvents.Get("message"))
+
+	_, err = eventRoutes([]string{"message"})
+	assert.EqualError(t, err, `event route "message" is missing =backend`)
+}
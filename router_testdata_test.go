@@ -0,0 +1,69 @@
+package main
+
+var testdataParseCommandRule = map[string]struct {
+	command string
+	arg     string
+	target  string
+	err     string
+}{
+	"/ops=http://ops":                {command: "/ops", target: "http://ops"},
+	"/ops deploy=http://deployer:80": {command: "/ops", arg: "deploy", target: "http://deployer:80"},
+	" /ops  status = http://status ": {command: "/ops", arg: "status", target: "http://status"},
+	"/ops":                           {err: `command route "/ops" is missing =backend`},
+	"/ops=deployer":                  {err: `command route "/ops=deployer" has a bad backend`},
+	"ops=http://ops":                 {err: `command route "ops=http://ops" should look like '/command [arg]=backend'`},
+	"/ops a b=http://ops":            {err: `command route "/ops a b=http://ops" should look like '/command [arg]=backend'`},
+	"=http://ops":                    {err: `command route "=http://ops" should look like '/command [arg]=backend'`},
+}
+
+var testdataCommandRoutes = map[string]struct {
+	command string
+	text    string
+	backend string
+}{
+	"deploy":           {command: "/ops", text: "deploy api now", backend: "deployer"},
+	"deploy any case":  {command: "/ops", text: "  DEPLOY api", backend: "deployer"},
+	"status":           {command: "/ops", text: "status", backend: "status"},
+	"other arg":        {command: "/ops", text: "restart api", backend: "ops"},
+	"no text":          {command: "/ops", backend: "ops"},
+	"prefix is a word": {command: "/ops", text: "deployment", backend: "ops"},
+	"other command":    {command: "/weather", text: "deploy", backend: "default"},
+}
+
+var testdataParseViewRule = map[string]struct {
+	callbackID string
+	target     string
+	err        string
+}{
+	"new-ticket=http://tickets":    {callbackID: "new-ticket", target: "http://tickets"},
+	" survey = http://survey:8080": {callbackID: "survey", target: "http://survey:8080"},
+	"new-ticket":                   {err: `view route "new-ticket" is missing =backend`},
+	"=http://tickets":              {err: `view route "=http://tickets" is missing a callback_id`},
+	"new-ticket=tickets":           {err: `view route "new-ticket=tickets" has a bad backend`},
+}
+
+var testdataParseURIRule = map[string]struct {
+	prefix string
+	target string
+	err    string
+}{
+	"/slack/events=http://events":         {prefix: "/slack/events", target: "http://events"},
+	" /slack/commands = http://cmds:8080": {prefix: "/slack/commands", target: "http://cmds:8080"},
+	"/slack/events":                       {err: `uri route "/slack/events" is missing =backend`},
+	"slack=http://events":                 {err: `uri route "slack=http://events" should look like '/prefix=backend'`},
+	"/slack/events=events":                {err: `uri route "/slack/events=events" has a bad backend`},
+}
+
+var testdataParseEventRule = map[string]struct {
+	eventType string
+	target    string
+	drop      bool
+	err       string
+}{
+	"app_mention=http://mentions":      {eventType: "app_mention", target: "http://mentions"},
+	" reaction_added = http://re:8080": {eventType: "reaction_added", target: "http://re:8080"},
+	"message=drop":                     {eventType: "message", drop: true},
+	"message":                          {err: `event route "message" is missing =backend`},
+	"=drop":                            {err: `event route "=drop" is missing an event type`},
+	"message=mentions":                 {err: `event route "message=mentions" has a bad backend`},
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+	"sync"
+)
+
+// sampleKey is what every sampling decision about a delivery is made on.
+// It hashes the idempotency key, the event_id for events, so tracing and
+// the shadow archive pick the same events, and slack's retries of them.
+func sampleKey(d *Delivery) uint64 {
+	sum := sha256.Sum256([]byte(d.IdempotencyKey()))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// sampled is true for a rate fraction of keys. A key sampled at one rate is
+// sampled at every higher rate, so an event traced at 1% is always in a 10%
+// shadow archive.
+func sampled(key uint64, rate float64) bool {
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	}
+	return float64(key>>11)/(1<<53) < rate
+}
+
+// traceDecision holds the spans of a trace started here until the event is
+// known, so the trace is sampled on its sampleKey. A trace whose event is
+// never found falls back to its trace id.
+type traceDecision struct {
+	mu      sync.Mutex
+	root    *Span
+	decided bool
+	sampled bool
+	held    []*Span
+}
+
+type traceDecisionKey struct{}
+
+// SampleHandler decides the trace of each request on its event, for
+// tracing to agree with everything else sampling events. It must be past
+// verification, as it reads the body.
+func SampleHandler(child http.Handler, t *Tracer) http.Handler {
+	if t == nil {
+		return child
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, ok := r.Context().Value(traceDecisionKey{}).(*traceDecision); ok {
+			if body, err := readBody(r); err == nil {
+				t.decide(d, sampled(sampleKey(NewDelivery(r, body)), t.Sample))
+			}
+		}
+		child.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampled(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		key := sampleKey(&Delivery{Body: []byte(fmt.Sprint(i))})
+		assert.False(t, sampled(key, 0))
+		assert.True(t, sampled(key, 1))
+		// lower rates sample a subset of higher ones
+		if sampled(key, 0.1) {
+			assert.True(t, sampled(key, 0.5), "key %d", key)
+		}
+	}
+}
+
+func TestSampleHandler(t *testing.T) {
+	var mu sync.Mutex
+	var spans []*Span
+	tr := &Tracer{Sample: 0.5, Export: func(s *Span) {
+		mu.Lock()
+		spans = append(spans, s)
+		mu.Unlock()
+	}}
+
+	var sent string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get(HeaderTraceparent)
+	})
+	h := TraceHandler(backend, tr, "reverse_proxy", SpanKindClient)
+	h = SampleHandler(h, tr)
+	h = TraceHandler(h, tr, "verify_signature", SpanKindInternal)
+	h = TraceHandler(h, tr, "slack_request", SpanKindServer)
+
+	var archived []string
+	shadow := SampleSink(tr.Sample, SinkFunc(func(ctx context.Context, d *Delivery) error {
+		p, err := d.Payload(PayloadParserFunc(ParseSlackPayload))
+		require.NoError(t, err)
+		archived = append(archived, p.ID)
+		return nil
+	}))
+
+	// every event is traced and archived alike, whatever its trace id
+	var traced []string
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("Ev%d", i)
+		body := `{"type":"event_callback","event_id":"` + id + `","event":{"type":"message"}}`
+		spans = nil
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		sc, ok := parseTraceparent(sent)
+		require.True(t, ok)
+		if len(spans) > 0 {
+			require.Len(t, spans, 3)
+			assert.True(t, sc.Sampled)
+			traced = append(traced, id)
+		} else {
+			assert.False(t, sc.Sampled)
+		}
+
+		r = httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		require.NoError(t, shadow.Send(context.Background(), NewDelivery(r, []byte(body))))
+	}
+	assert.NotEmpty(t, traced)
+	assert.Equal(t, archived, traced)
+
+	// a trace that never reaches SampleHandler falls back to its trace id
+	spans = nil
+	tr.Sample = 1
+	TraceHandler(StatusHandler(http.StatusBadRequest, "bad signature"), tr, "slack_request", SpanKindServer).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slack/events", nil))
+	assert.Len(t, spans, 1)
+}
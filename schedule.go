@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HeaderProxyDeferred is set, to rate or window, on the 429 answering an
+// event a backend's schedule held back
+const HeaderProxyDeferred = "X-Proxy-Deferred"
+
+var metricDeferredEvents = NewCounterVec("backend_deferred_total",
+	"events held back from a backend by its schedule, by reason: rate or window", "backend", "reason")
+
+// errDeliveryDeferred is returned by forwardDelivery for events a
+// backend's schedule held back, which is not the backend failing
+var errDeliveryDeferred = errors.New("held back by the backend's schedule")
+
+// BackendSchedule caps how fast and when events are delivered to Backend,
+// a url or the name of one of the config's backends. Rate is events a
+// second with bursts of up to Burst, uncapped when 0, and with a Window
+// events are only delivered while it is open.
+//
+// Events held back are answered with a 429, which --park-dir and the
+// outbox keep and try again later, so slack is still acked straight away.
+// Events coming back from those queues wait for the rate instead. Commands
+// and interactions are held back the same way, which slack shows as a
+// failure, so schedules suit backends that only take events.
+type BackendSchedule struct {
+	Backend string      `json:"backend"`
+	Rate    float64     `json:"rate"`
+	Burst   int         `json:"burst"`
+	Window  *CronWindow `json:"window"`
+}
+
+func (bs *BackendSchedule) validate(backends map[string]string) error {
+	if _, err := bs.target(backends); err != nil {
+		return err
+	}
+	if bs.Rate < 0 || bs.Burst < 0 {
+		return fmt.Errorf("rate and burst cannot be negative")
+	}
+	if bs.Rate == 0 && bs.Window == nil {
+		return fmt.Errorf("schedule needs a rate or a window")
+	}
+	if bs.Window != nil {
+		return bs.Window.init()
+	}
+	return nil
+}
+
+// target is the url of Backend, looked up in backends if it is a name
+func (bs *BackendSchedule) target(backends map[string]string) (string, error) {
+	raw := bs.Backend
+	if named, ok := backends[raw]; ok {
+		raw = named
+	}
+	target, err := url.Parse(raw)
+	if err != nil || target.Host == "" {
+		return "", fmt.Errorf("bad backend %q", bs.Backend)
+	}
+	return target.String(), nil
+}
+
+type backendSchedule struct {
+	BackendSchedule
+	bucket *tokenBucket
+}
+
+// hold returns why r may not be delivered at now, or "" if it may
+func (s *backendSchedule) hold(r *http.Request, now time.Time) string {
+	if s.Window != nil && !s.Window.open(now) {
+		return "window"
+	}
+	if s.bucket == nil {
+		return ""
+	}
+	// events from a queue are already acked, so they can wait their turn
+	if r.Header.Get(HeaderProxyAttempt) != "" {
+		if s.bucket.Wait(r.Context()) != nil {
+			return "rate"
+		}
+		return ""
+	}
+	if !s.bucket.allow() {
+		return "rate"
+	}
+	return ""
+}
+
+// buildBackendSchedules keys the config's schedules by backend url
+func buildBackendSchedules(config *Config) map[string]*backendSchedule {
+	schedules := map[string]*backendSchedule{}
+	for _, bs := range config.Schedules {
+		// validated on load
+		target, _ := bs.target(config.Backends)
+		s := &backendSchedule{BackendSchedule: bs}
+		if bs.Rate > 0 {
+			burst := bs.Burst
+			if burst < 1 {
+				burst = 1
+			}
+			s.bucket = newTokenBucket(bs.Rate, burst)
+		}
+		schedules[target] = s
+	}
+	return schedules
+}
+
+type schedulesKey struct{}
+
+// BackendScheduleHandler has every backend child forwards to keep to its
+// schedule
+func BackendScheduleHandler(child http.Handler, schedules map[string]*backendSchedule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		child.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), schedulesKey{}, schedules)))
+	})
+}
+
+// holdBack answers r with a 429 and returns true when the schedule for
+// target, if it has one, does not let r through yet
+func holdBack(w http.ResponseWriter, r *http.Request, target *url.URL) bool {
+	schedules, _ := r.Context().Value(schedulesKey{}).(map[string]*backendSchedule)
+	s, ok := schedules[target.String()]
+	if !ok {
+		return false
+	}
+	reason := s.hold(r, time.Now())
+	if reason == "" {
+		return false
+	}
+	metricDeferredEvents.Inc(redactURLPassword(target.String()), reason)
+	w.Header().Set(HeaderProxyDeferred, reason)
+	if reason == "rate" {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, "held back by the backend's schedule", http.StatusTooManyRequests)
+	return true
+}
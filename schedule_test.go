@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendSchedule(t *testing.T) {
+	var got []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Host)
+	}))
+	defer backend.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	target, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	otherTarget, err := url.Parse(other.URL)
+	require.NoError(t, err)
+
+	config := &Config{
+		Backends:  map[string]string{"analytics": backend.URL},
+		Schedules: []BackendSchedule{{Backend: "analytics", Rate: 0.001, Burst: 2}},
+	}
+	schedules := buildBackendSchedules(config)
+	post := func(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		BackendScheduleHandler(h, schedules).ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := post(newBackendProxy(target), httptest.NewRequest(http.MethodPost, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w := post(newBackendProxy(target), httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "rate", w.Header().Get(HeaderProxyDeferred))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Len(t, got, 2)
+
+	// queued events wait for the rate, as long as they have time to
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+	r.Header.Set(HeaderProxyAttempt, "2")
+	w = post(newBackendProxy(target), r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// other backends are left alone
+	for i := 0; i < 3; i++ {
+		w := post(newBackendProxy(otherTarget), httptest.NewRequest(http.MethodPost, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+func TestBackendScheduleWindow(t *testing.T) {
+	window := &CronWindow{Schedule: "0 22 * * *", Duration: Duration(8 * time.Hour), Timezone: "America/Chicago"}
+	require.NoError(t, window.init())
+	s := &backendSchedule{BackendSchedule: BackendSchedule{Window: window}}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+
+	chicago, err := time.LoadLocation("America/Chicago")
+	require.NoError(t, err)
+	for at, want := range map[string]string{
+		"2026-03-02 21:59": "window",
+		"2026-03-02 22:00": "",
+		"2026-03-03 05:59": "",
+		"2026-03-03 06:00": "window",
+		"2026-03-03 12:00": "window",
+	} {
+		now, err := time.ParseInLocation("2006-01-02 15:04", at, chicago)
+		require.NoError(t, err)
+		assert.Equal(t, want, s.hold(r, now), at)
+	}
+}
+
+func TestBackendScheduleValidate(t *testing.T) {
+	backends := map[string]string{"analytics": "http://analytics:8080"}
+	for name, tc := range map[string]struct {
+		schedule BackendSchedule
+		err      string
+	}{
+		"rate":       {BackendSchedule{Backend: "analytics", Rate: 50}, ""},
+		"url":        {BackendSchedule{Backend: "http://other:8080", Rate: 50}, ""},
+		"window":     {BackendSchedule{Backend: "analytics", Window: &CronWindow{Schedule: "0 22 * * *", Duration: Duration(time.Hour)}}, ""},
+		"no backend": {BackendSchedule{Backend: "nope", Rate: 50}, `bad backend "nope"`},
+		"nothing":    {BackendSchedule{Backend: "analytics"}, "schedule needs a rate or a window"},
+		"negative":   {BackendSchedule{Backend: "analytics", Rate: -1}, "rate and burst cannot be negative"},
+		"bad window": {BackendSchedule{Backend: "analytics", Window: &CronWindow{Schedule: "0 22 * * *"}}, "duration must be between 0 and 24h0m0s"},
+	} {
+		err := tc.schedule.validate(backends)
+		if tc.err == "" {
+			assert.NoError(t, err, name)
+		} else {
+			assert.EqualError(t, err, tc.err, name)
+		}
+	}
+}
+
+func TestParkDrainDeferred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "park")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	q, err := OpenParkQueue(filepath.Join(dir, "parked"))
+	require.NoError(t, err)
+
+	for _, id := range []string{"Ev1", "Ev2"} {
+		r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+		r.Header.Set("Content-Type", "application/json")
+		require.NoError(t, q.Put(NewDelivery(r, []byte(`{"type":"event_callback","event_id":"`+id+`"}`))))
+		time.Sleep(time.Millisecond)
+	}
+
+	// a held back event does not keep the ones after it parked
+	var forwarded []string
+	n, err := q.Drain(func(d *Delivery) error {
+		if strings.Contains(string(d.Body), "Ev1") {
+			return errDeliveryDeferred
+		}
+		forwarded = append(forwarded, string(d.Body))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, forwarded, 1)
+	names, err := q.names()
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+}
+
+func TestForwardDeliveryDeferred(t *testing.T) {
+	defer func(old time.Duration) { *flagAckBackendTimeout = old }(*flagAckBackendTimeout)
+	*flagAckBackendTimeout = time.Second
+
+	forward := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderProxyDeferred, "window")
+		http.Error(w, "held back", http.StatusTooManyRequests)
+	})
+	r := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+	err := forwardDelivery(forward, NewDelivery(r, []byte("{}")))
+	assert.Equal(t, errDeliveryDeferred, err)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/jakdept/slack_events_proxy/slackverify"
+)
+
+var flagSecretStatsFile = kingpin.
+	Flag("secret-stats-file", "file to persist per secret verification counts to").
+	Envar("SECRET_STATS_FILE").String()
+
+var metricSlackSecretMatches = NewCounterVec("slack_verify_secret_matches_total",
+	"requests verified by each signing secret", "secret")
+
+var metricPendingSecretChecks = NewCounterVec("slack_pending_secret_checks_total",
+	"live requests checked against a pending signing secret", "secret", "result")
+
+// SecretFingerprint identifies a secret in logs, metrics and the admin api
+// without giving it away.
+func SecretFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:4])
+}
+
+type SecretStat struct {
+	Secret     string    `json:"secret"`
+	Configured bool      `json:"configured"`
+	Matches    uint64    `json:"matches"`
+	LastMatch  time.Time `json:"last_match"`
+}
+
+// secretStats counts which secret each request verified against, so an old
+// secret can be retired once it stops matching after a rotation.
+type secretStats struct {
+	mu    sync.Mutex
+	stats map[string]*SecretStat
+}
+
+var slackSecretStats = newSecretStats()
+
+func newSecretStats() *secretStats {
+	return &secretStats{stats: map[string]*SecretStat{}}
+}
+
+func (s *secretStats) record(secret string) {
+	fp := SecretFingerprint(secret)
+	metricSlackSecretMatches.Inc(fp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, ok := s.stats[fp]
+	if !ok {
+		stat = &SecretStat{Secret: fp}
+		s.stats[fp] = stat
+	}
+	stat.Matches++
+	stat.LastMatch = time.Now().UTC()
+}
+
+// snapshot lists stats for every configured secret, and any secret seen
+// before that is no longer configured.
+func (s *secretStats) snapshot(configured []string) []SecretStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := map[string]SecretStat{}
+	for _, stat := range s.stats {
+		all[stat.Secret] = *stat
+	}
+	for _, secret := range configured {
+		fp := SecretFingerprint(secret)
+		stat := all[fp]
+		stat.Secret = fp
+		stat.Configured = true
+		all[fp] = stat
+	}
+
+	out := make([]SecretStat, 0, len(all))
+	for _, stat := range all {
+		out = append(out, stat)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Secret < out[j].Secret })
+	return out
+}
+
+func (s *secretStats) load(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var stats []SecretStat
+	if err := json.Unmarshal(raw, &stats); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range stats {
+		stats[i].Configured = false
+		s.stats[stats[i].Secret] = &stats[i]
+	}
+	return nil
+}
+
+func (s *secretStats) save(path string) error {
+	raw, err := json.MarshalIndent(s.snapshot(nil), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, raw)
+}
+
+func (s *secretStats) persist(path string, every time.Duration) {
+	for range time.Tick(every) {
+		if err := s.save(path); err != nil {
+			log.Printf("saving secret stats: %v", err)
+		}
+	}
+}
+
+func SecretStatsHandler(stats *secretStats, configured func() []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.snapshot(configured()))
+	})
+}
+
+// PendingSecret is a secret that is not trusted yet. Live traffic is checked
+// against it only to report whether slack has started signing with it.
+type PendingSecret struct {
+	Secret     string    `json:"secret"`
+	Added      time.Time `json:"added"`
+	Checked    uint64    `json:"checked"`
+	Matches    uint64    `json:"matches"`
+	FirstMatch time.Time `json:"first_match"`
+	LastMatch  time.Time `json:"last_match"`
+
+	secret string
+}
+
+// pendingSecrets lets an operator confirm a rotation on slack's side worked
+// before removing the old secret. It only sees the traffic of the process
+// serving the admin listener.
+type pendingSecrets struct {
+	mu      sync.Mutex
+	pending map[string]*PendingSecret
+}
+
+var slackPendingSecrets = newPendingSecrets()
+
+func newPendingSecrets() *pendingSecrets {
+	return &pendingSecrets{pending: map[string]*PendingSecret{}}
+}
+
+func (p *pendingSecrets) add(secret string) string {
+	fp := SecretFingerprint(secret)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pending[fp]; !ok {
+		p.pending[fp] = &PendingSecret{Secret: fp, Added: time.Now().UTC(), secret: secret}
+	}
+	return fp
+}
+
+func (p *pendingSecrets) remove(fp string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.pending[fp]
+	delete(p.pending, fp)
+	return ok
+}
+
+func (p *pendingSecrets) list() []PendingSecret {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := []PendingSecret{}
+	for _, each := range p.pending {
+		out = append(out, *each)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Secret < out[j].Secret })
+	return out
+}
+
+// check verifies r against each pending secret, and must only be called
+// when the body is still in place
+func (p *pendingSecrets) check(r *http.Request, expire time.Duration, versions []string) {
+	p.mu.Lock()
+	var secrets []string
+	for _, each := range p.pending {
+		secrets = append(secrets, each.secret)
+	}
+	p.mu.Unlock()
+
+	for _, secret := range secrets {
+		v := &slackverify.Verifier{Secrets: []string{secret}, Expire: expire, Versions: versions}
+		_, err := v.Verify(r)
+		p.record(secret, err == nil)
+	}
+}
+
+func (p *pendingSecrets) record(secret string, matched bool) {
+	fp := SecretFingerprint(secret)
+	if matched {
+		metricPendingSecretChecks.Inc(fp, "match")
+	} else {
+		metricPendingSecretChecks.Inc(fp, "mismatch")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	each, ok := p.pending[fp]
+	if !ok {
+		return
+	}
+	each.Checked++
+	if !matched {
+		return
+	}
+	now := time.Now().UTC()
+	if each.Matches == 0 {
+		each.FirstMatch = now
+		log.Printf("pending secret %s verified live traffic", fp)
+	}
+	each.Matches++
+	each.LastMatch = now
+}
+
+// PendingSecretsHandler lists pending secrets on GET, adds the secret in a
+// json body like {"secret":"..."} on POST, and removes the one with the
+// fingerprint in ?secret on DELETE. Secrets are never echoed back.
+func PendingSecretsHandler(p *pendingSecrets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Secret string `json:"secret"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Secret == "" {
+				http.Error(w, "body must be json with a secret", http.StatusBadRequest)
+				return
+			}
+			log.Printf("pending secret %s added", p.add(req.Secret))
+		case http.MethodDelete:
+			fp := r.URL.Query().Get("secret")
+			if !p.remove(fp) {
+				http.Error(w, fmt.Sprintf("no pending secret %q", fp), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.list())
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlackVerifierSecrets(t *testing.T) {
+	oldSecret := "8f742231b10e8888abcd99yyyzzz85a5"
+	newSecret := "this is the new secret"
+	v := &SlackVerifier{
+		Secrets: []string{newSecret, oldSecret},
+		Expire:  time.Hour * 24 * 365 * 50,
+	}
+	ts := httptest.NewServer(v.Handler(StatusHandler(http.StatusNoContent, "")))
+	defer ts.Close()
+
+	before := metricSlackSecretMatches.Get(SecretFingerprint(oldSecret))
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Header.Set(SlackHeaderTimestamp, "1531420618")
+	req.Header.Set(SlackHeaderSignature,
+		"v0=e8beca64fdd1a137bebe4f274bd47abcbee4e63c101f4bc8461b7e9398109030")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Equal(t, before+1, metricSlackSecretMatches.Get(SecretFingerprint(oldSecret)))
+	assert.Equal(t, float64(0), metricSlackSecretMatches.Get(SecretFingerprint(newSecret)))
+}
+
+func TestSecretStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretstats")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	stats := newSecretStats()
+	stats.record("old")
+	stats.record("old")
+	require.NoError(t, stats.save(path))
+
+	loaded := newSecretStats()
+	require.NoError(t, loaded.load(path))
+	require.NoError(t, loaded.load(filepath.Join(dir, "missing.json")))
+	loaded.record("new")
+
+	ts := httptest.NewServer(SecretStatsHandler(loaded, func() []string { return []string{"new", "newer"} }))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var got []SecretStat
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	require.Len(t, got, 3)
+
+	byFingerprint := map[string]SecretStat{}
+	for _, stat := range got {
+		byFingerprint[stat.Secret] = stat
+	}
+
+	old := byFingerprint[SecretFingerprint("old")]
+	assert.False(t, old.Configured)
+	assert.Equal(t, uint64(2), old.Matches)
+	assert.False(t, old.LastMatch.IsZero())
+
+	assert.True(t, byFingerprint[SecretFingerprint("new")].Configured)
+	assert.Equal(t, uint64(1), byFingerprint[SecretFingerprint("new")].Matches)
+
+	newer := byFingerprint[SecretFingerprint("newer")]
+	assert.True(t, newer.Configured)
+	assert.Equal(t, uint64(0), newer.Matches)
+	assert.True(t, newer.LastMatch.IsZero())
+}
+
+func TestPendingSecrets(t *testing.T) {
+	oldSecret := "8f742231b10e8888abcd99yyyzzz85a5"
+	v := &SlackVerifier{
+		Secrets: []string{"the current secret"},
+		Expire:  time.Hour * 24 * 365 * 50,
+	}
+	ts := httptest.NewServer(v.Handler(StatusHandler(http.StatusNoContent, "")))
+	defer ts.Close()
+	admin := httptest.NewServer(PendingSecretsHandler(slackPendingSecrets))
+	defer admin.Close()
+
+	resp, err := http.Post(admin.URL, "application/json",
+		strings.NewReader(`{"secret":"`+oldSecret+`"}`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	fp := SecretFingerprint(oldSecret)
+	defer slackPendingSecrets.remove(fp)
+
+	send := func(sig string) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.Header.Set(SlackHeaderTimestamp, "1531420618")
+		req.Header.Set(SlackHeaderSignature, sig)
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	// slack has switched to the pending secret, but it is not trusted yet
+	assert.Equal(t, http.StatusUnauthorized,
+		send("v0=e8beca64fdd1a137bebe4f274bd47abcbee4e63c101f4bc8461b7e9398109030"))
+	assert.Equal(t, http.StatusUnauthorized,
+		send("v0=0000000000000000000000000000000000000000000000000000000000000000"))
+
+	resp, err = http.Get(admin.URL)
+	require.NoError(t, err)
+	var pending []PendingSecret
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pending))
+	require.Len(t, pending, 1)
+	assert.Equal(t, fp, pending[0].Secret)
+	assert.Equal(t, uint64(2), pending[0].Checked)
+	assert.Equal(t, uint64(1), pending[0].Matches)
+	assert.False(t, pending[0].FirstMatch.IsZero())
+
+	req, err := http.NewRequest(http.MethodDelete, admin.URL+"?secret="+fp, nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, slackPendingSecrets.list())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagSlackTokenFile = kingpin.
+				Flag("slack-token-file", "file holding slack verification tokens, one per line, reread as it changes").
+				Envar("SLACK_TOKEN_FILE").String()
+	flagSlackTokenFileInterval = kingpin.
+					Flag("slack-token-file-interval", "how often --slack-token-file is checked for changes").
+					Envar("SLACK_TOKEN_FILE_INTERVAL").Default("10s").Duration()
+	flagSlackTokenSource = kingpin.
+				Flag("slack-token-source", "where to load slack verification tokens from, like awssm://<arn> or vault://secret/data/slack?field=signing_secret").
+				Envar("SLACK_TOKEN_SOURCE").String()
+	flagSlackTokenSourceInterval = kingpin.
+					Flag("slack-token-source-interval", "how often --slack-token-source is refreshed").
+					Envar("SLACK_TOKEN_SOURCE_INTERVAL").Default("5m").Duration()
+)
+
+var metricSecretReloads = NewCounterVec("slack_secret_reloads_total",
+	"times the slack signing secrets changed at runtime, by result", "result")
+
+// secretSet holds the signing secrets in use, which may change while
+// running
+type secretSet struct {
+	mu      sync.RWMutex
+	secrets []string
+	// err is why the source last failed to load, if it did
+	err error
+}
+
+func (s *secretSet) Get() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secrets
+}
+
+func (s *secretSet) Set(secrets []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets = secrets
+}
+
+func (s *secretSet) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+func (s *secretSet) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// slackSecrets are set up in main from --slack-token and friends
+var slackSecrets = &secretSet{}
+
+// slackRefresh has the slack secret source read again right away
+var slackRefresh = make(chan struct{}, 1)
+
+// SecretSource loads signing secrets from outside the proxy. More than one
+// may be returned while rotating, the newest first.
+type SecretSource interface {
+	Secrets(ctx context.Context) ([]string, error)
+}
+
+// SecretSourceDriver opens a source from what follows scheme:// in its url.
+type SecretSourceDriver func(spec string) (SecretSource, error)
+
+var (
+	secretSourceDriversMu sync.RWMutex
+	secretSourceDrivers   = map[string]SecretSourceDriver{
+		"awssm": openAWSSecretsManagerSource,
+		"file":  openFileSecretSource,
+		"vault": openVaultSecretSource,
+	}
+)
+
+// RegisterSecretSource adds a driver for sources with the given scheme.
+func RegisterSecretSource(scheme string, driver SecretSourceDriver) {
+	secretSourceDriversMu.Lock()
+	defer secretSourceDriversMu.Unlock()
+	secretSourceDrivers[scheme] = driver
+}
+
+// OpenSecretSource opens a source like file:///run/secrets/slack. Sources
+// are not always urls, secrets manager arns do not parse as one, so only
+// the scheme is split off.
+func OpenSecretSource(raw string) (SecretSource, error) {
+	i := strings.Index(raw, "://")
+	if i < 1 {
+		return nil, fmt.Errorf("secret source %q needs a scheme", raw)
+	}
+	secretSourceDriversMu.RLock()
+	driver, ok := secretSourceDrivers[raw[:i]]
+	secretSourceDriversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no secret source driver for %q", raw[:i])
+	}
+	return driver(raw[i+3:])
+}
+
+// slackSecretSource is the source from --slack-token-file or
+// --slack-token-source, with how often to refresh it
+func slackSecretSource() (name string, src SecretSource, interval time.Duration, err error) {
+	switch {
+	case *flagSlackTokenFile != "" && *flagSlackTokenSource != "":
+		return "", nil, 0, errors.New("--slack-token-file and --slack-token-source can not both be used")
+	case *flagSlackTokenFile != "":
+		return *flagSlackTokenFile, fileSecretSource(*flagSlackTokenFile), *flagSlackTokenFileInterval, nil
+	default:
+		src, err := OpenSecretSource(*flagSlackTokenSource)
+		return *flagSlackTokenSource, src, *flagSlackTokenSourceInterval, err
+	}
+}
+
+// parseSecrets reads one secret per line. Blank lines are skipped, and
+// nothing at all is an error, as it would fail every request.
+func parseSecrets(raw string) ([]string, error) {
+	var secrets []string
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+	if len(secrets) < 1 {
+		return nil, errors.New("no secrets found")
+	}
+	return secrets, nil
+}
+
+// fileSecretSource reads one secret per line from a file
+type fileSecretSource string
+
+func openFileSecretSource(spec string) (SecretSource, error) {
+	return fileSecretSource(spec), nil
+}
+
+func (f fileSecretSource) Secrets(ctx context.Context) ([]string, error) {
+	raw, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := parseSecrets(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	return secrets, nil
+}
+
+// leasedSecretSource is a source whose secrets expire, and so may need
+// reading again sooner than its refresh interval. 0 means no sooner.
+type leasedSecretSource interface {
+	refreshIn() time.Duration
+}
+
+// watchSecretSource reloads src every interval, and swaps the secrets in set
+// for what it holds followed by static. The secrets themselves are
+// compared, rather than a file's mtime, as kubernetes swaps secret volumes
+// in with a symlink. A source that fails keeps the secrets already in use.
+func watchSecretSource(name string, src SecretSource, interval time.Duration,
+	refresh <-chan struct{}, set *secretSet, static []string) {
+	failing := false
+	for {
+		wait := interval
+		if leased, ok := src.(leasedSecretSource); ok {
+			if d := leased.refreshIn(); d > 0 && d < wait {
+				wait = d
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-refresh:
+			timer.Stop()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		secrets, err := src.Secrets(ctx)
+		cancel()
+		set.setErr(err)
+		if err != nil {
+			metricSecretReloads.Inc("failed")
+			if !failing {
+				log.Printf("loading secrets from %s: %v, keeping current secrets", name, err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		secrets = append(secrets, static...)
+		if strings.Join(secrets, "\n") == strings.Join(set.Get(), "\n") {
+			continue
+		}
+		set.Set(secrets)
+		metricSecretReloads.Inc("changed")
+		log.Printf("reloaded %d secrets from %s", len(secrets)-len(static), name)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSecretSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, tc := range map[string]struct {
+		content string
+		exp     []string
+		err     bool
+	}{
+		"one":      {content: "shh\n", exp: []string{"shh"}},
+		"rotating": {content: "new\n\n  old  \n", exp: []string{"new", "old"}},
+		"no line":  {content: "shh", exp: []string{"shh"}},
+		"empty":    {content: "\n \n", err: true},
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(tc.content), 0600))
+		secrets, err := fileSecretSource(path).Secrets(context.Background())
+		if tc.err {
+			assert.Error(t, err, name)
+			continue
+		}
+		assert.NoError(t, err, name)
+		assert.Equal(t, tc.exp, secrets, name)
+	}
+
+	_, err = fileSecretSource(filepath.Join(dir, "missing")).Secrets(context.Background())
+	assert.Error(t, err)
+}
+
+func TestWatchSecretSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0600))
+
+	set := &secretSet{secrets: []string{"old", "static"}}
+	go watchSecretSource(path, fileSecretSource(path), 10*time.Millisecond, nil, set, []string{"static"})
+
+	waitFor := func(exp []string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !assert.ObjectsAreEqual(exp, set.Get()) {
+			require.True(t, time.Now().Before(deadline), "secrets never became %v, are %v", exp, set.Get())
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// rotated in place like a kubernetes secret
+	require.NoError(t, writeFileAtomic(path, []byte("new\nold\n")))
+	waitFor([]string{"new", "old", "static"})
+
+	// a broken file keeps what is already in use
+	before := metricSecretReloads.Get("failed")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	deadline := time.Now().Add(5 * time.Second)
+	for metricSecretReloads.Get("failed") == before {
+		require.True(t, time.Now().Before(deadline), "empty file never noticed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"new", "old", "static"}, set.Get())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("new\n"), 0600))
+	waitFor([]string{"new", "static"})
+}
+
+func TestWatchSecretSourceRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("new\n"), 0600))
+
+	// the interval is too long to matter, only the refresh reloads
+	set := &secretSet{secrets: []string{"old"}}
+	refresh := make(chan struct{})
+	go watchSecretSource(path, fileSecretSource(path), time.Hour, refresh, set, nil)
+	refresh <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for !assert.ObjectsAreEqual([]string{"new"}, set.Get()) {
+		require.True(t, time.Now().Before(deadline), "secrets were never refreshed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOpenSecretSource(t *testing.T) {
+	for raw, expErr := range map[string]string{
+		"file:///run/secrets/slack":                                        "",
+		"awssm://arn:aws:secretsmanager:us-east-1:1:secret:slack?key=sign": "",
+		"awssm://?region=us-east-1":                                        "awssm needs a secret name or arn",
+		"/run/secrets/slack":                                               `secret source "/run/secrets/slack" needs a scheme`,
+		"gcpsm://projects/p/secrets/s":                                     `no secret source driver for "gcpsm"`,
+	} {
+		_, err := OpenSecretSource(raw)
+		if expErr == "" {
+			assert.NoError(t, err, raw)
+		} else {
+			assert.EqualError(t, err, expErr, raw)
+		}
+	}
+}
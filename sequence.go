@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagSequenceStore = kingpin.
+	Flag("sequence-store", "redis to keep --sequence numbers in, so they survive restarts and are shared by replicas and --workers, like redis://redis:6379/0?key=slack_events_proxy:sequence").
+	Envar("SEQUENCE_STORE").String()
+
+const HeaderProxySequence = "X-Proxy-Sequence"
+
+// SequenceStore hands out monotonic sequence numbers per channel. A retried
+// event gets the number it was first given, so backends can spot both gaps
+// and reordering.
+type SequenceStore interface {
+	Next(channel, eventID string) (uint64, error)
+}
+
+// MemorySequenceStore keeps sequences in memory, remembering the last
+// maxEvents event ids for retries.
+type MemorySequenceStore struct {
+	mu        sync.Mutex
+	channels  map[string]uint64
+	events    map[string]uint64
+	order     []string
+	maxEvents int
+}
+
+func NewMemorySequenceStore(maxEvents int) *MemorySequenceStore {
+	return &MemorySequenceStore{
+		channels:  map[string]uint64{},
+		events:    map[string]uint64{},
+		maxEvents: maxEvents,
+	}
+}
+
+func (s *MemorySequenceStore) Next(channel, eventID string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq, ok := s.events[eventID]; ok && eventID != "" {
+		return seq, nil
+	}
+
+	s.channels[channel]++
+	seq := s.channels[channel]
+	if eventID == "" || s.maxEvents < 1 {
+		return seq, nil
+	}
+
+	s.events[eventID] = seq
+	s.order = append(s.order, eventID)
+	if len(s.order) > s.maxEvents {
+		delete(s.events, s.order[0])
+		s.order = s.order[1:]
+	}
+	return seq, nil
+}
+
+// redisSequenceNext returns the number KEYS[2], the event, was given, or
+// else the channel's next number, remembering it for the event
+const redisSequenceNext = `if #KEYS == 2 then
+	local seq = redis.call('get', KEYS[2])
+	if seq then
+		return tonumber(seq)
+	end
+end
+local seq = redis.call('incr', KEYS[1])
+if #KEYS == 2 then
+	redis.call('set', KEYS[2], seq, 'EX', ARGV[1])
+end
+return seq`
+
+// how long an event keeps its number for slack's retries, which stop well
+// within an hour
+const redisSequenceEventTTL = time.Hour
+
+// RedisSequenceStore keeps a counter per channel in redis, so numbers
+// carry on across restarts and every process shares them. Each number
+// takes a round trip on a new connection.
+type RedisSequenceStore struct {
+	URL     *url.URL
+	Key     string
+	Timeout time.Duration
+}
+
+// OpenSequenceStore takes a redis url like the redis leader lock does,
+// redis://:password@redis:6379/0?key=slack_events_proxy:sequence
+func OpenSequenceStore(raw string) (*RedisSequenceStore, error) {
+	u, key, err := parseRedisURL(raw, "slack_events_proxy:sequence")
+	if err != nil {
+		return nil, fmt.Errorf("sequence store: %v", err)
+	}
+	return &RedisSequenceStore{URL: u, Key: key, Timeout: time.Second}, nil
+}
+
+func (s *RedisSequenceStore) Next(channel, eventID string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	args := []string{"EVAL", redisSequenceNext, "1", s.Key + ":channel:" + channel}
+	if eventID != "" {
+		args[2] = "2"
+		args = append(args, s.Key+":event:"+eventID)
+	}
+	args = append(args, strconv.Itoa(int(redisSequenceEventTTL/time.Second)))
+	reply, err := redisDo(ctx, s.URL, args...)
+	if err != nil {
+		return 0, err
+	}
+	seq, ok := reply.(int64)
+	if !ok || seq < 1 {
+		return 0, fmt.Errorf("sequence store: unexpected reply %v", reply)
+	}
+	return uint64(seq), nil
+}
+
+// SequenceHandler sets X-Proxy-Sequence on requests for a channel. Requests
+// without a channel pass through untouched.
+func SequenceHandler(child http.Handler, parser PayloadParser, store SequenceStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.ChannelID == "" {
+			child.ServeHTTP(w, r)
+			return
+		}
+
+		seq, err := store.Next(p.TeamID+"/"+p.ChannelID, p.ID)
+		if err != nil {
+			log.Printf("assigning sequence for %s: %v", p.ChannelID, err)
+			child.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Set(HeaderProxySequence, strconv.FormatUint(seq, 10))
+		child.ServeHTTP(w, r)
+	})
+}
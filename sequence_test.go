@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySequenceStore(t *testing.T) {
+	s := NewMemorySequenceStore(2)
+	next := func(channel, eventID string) uint64 {
+		seq, err := s.Next(channel, eventID)
+		require.NoError(t, err)
+		return seq
+	}
+
+	assert.Equal(t, uint64(1), next("C1", "Ev1"))
+	assert.Equal(t, uint64(2), next("C1", "Ev2"))
+	assert.Equal(t, uint64(1), next("C2", "Ev3"))
+	// retries keep their first number
+	assert.Equal(t, uint64(2), next("C1", "Ev2"))
+	// Ev1 has been forgotten by now
+	assert.Equal(t, uint64(3), next("C1", "Ev1"))
+	assert.Equal(t, uint64(4), next("C1", ""))
+	assert.Equal(t, uint64(5), next("C1", ""))
+}
+
+func TestRedisSequenceStore(t *testing.T) {
+	addr, keys, done := fakeRedis(t, "")
+	defer done()
+	s, err := OpenSequenceStore("redis://" + addr + "?key=seq")
+	require.NoError(t, err)
+	next := func(channel, eventID string) uint64 {
+		seq, err := s.Next(channel, eventID)
+		require.NoError(t, err)
+		return seq
+	}
+
+	assert.Equal(t, uint64(1), next("T1/C1", "Ev1"))
+	assert.Equal(t, uint64(2), next("T1/C1", "Ev2"))
+	assert.Equal(t, uint64(1), next("T1/C2", "Ev3"))
+	assert.Equal(t, uint64(2), next("T1/C1", "Ev2"), "retries keep their first number")
+	assert.Equal(t, uint64(3), next("T1/C1", ""))
+	assert.Equal(t, "3", keys["seq:channel:T1/C1"])
+	assert.Equal(t, "2", keys["seq:event:Ev2"])
+
+	_, err = OpenSequenceStore("memory://")
+	assert.EqualError(t, err, `sequence store: "memory://" must be redis:// or rediss://`)
+}
+
+func TestSequenceHandler(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Header().Set(HeaderProxySequence, r.Header.Get(HeaderProxySequence))
+		w.Write(body)
+	})
+	ts := httptest.NewServer(SequenceHandler(echo,
+		PayloadParserFunc(ParseSlackPayload), NewMemorySequenceStore(10)))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		body string
+		seq  string
+	}{
+		{`{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message","channel":"C1"}}`, "1"},
+		{`{"type":"event_callback","team_id":"T1","event_id":"Ev2","event":{"type":"message","channel":"C1"}}`, "2"},
+		{`{"type":"event_callback","team_id":"T2","event_id":"Ev3","event":{"type":"message","channel":"C1"}}`, "1"},
+		{`{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message","channel":"C1"}}`, "1"},
+		{`{"type":"event_callback","team_id":"T1","event_id":"Ev4","event":{"type":"team_join"}}`, ""},
+		{`not json`, ""},
+	} {
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(tc.body))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, tc.body, string(body), "body must reach the backend")
+		assert.Equal(t, tc.seq, resp.Header.Get(HeaderProxySequence), tc.body)
+	}
+}
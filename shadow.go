@@ -0,0 +1,26 @@
+package main
+
+import "github.com/alecthomas/kingpin"
+
+var (
+	flagShadowArchive = kingpin.
+				Flag("shadow-archive", "archive file a sample of verified events is copied to").
+				Envar("SHADOW_ARCHIVE").String()
+	flagShadowSampleRate = kingpin.
+				Flag("shadow-sample-rate", "fraction of verified events copied to the shadow archive").
+				Envar("SHADOW_SAMPLE_RATE").Default("0.01").Float64()
+	flagShadowRedact = kingpin.
+				Flag("shadow-redact", "payload field to redact before archiving, like event.text").
+				Envar("SHADOW_REDACT").Strings()
+)
+
+// shadowSink copies a redacted sample of verified events to an archive, for
+// analytics that want a representative sample without archiving everything
+func shadowSink() (Sink, error) {
+	archive, err := OpenArchiveSink(*flagShadowArchive)
+	if err != nil {
+		return nil, err
+	}
+	return SampleSink(*flagShadowSampleRate,
+		RedactSink(Redactor{Fields: *flagShadowRedact}, archive)), nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricSilencedEvents = NewCounterVec("silenced_events_total",
+	"events acked without forwarding during a silence window", "window")
+
+// SilenceWindow drops matching events for Duration after each time
+// Schedule, a cron expression, comes around. Team and Type narrow down
+// which events, an empty one matches everything.
+type SilenceWindow struct {
+	ID       string   `json:"id"`
+	Schedule string   `json:"schedule"`
+	Duration Duration `json:"duration"`
+	Timezone string   `json:"timezone"`
+	Team     string   `json:"team"`
+	Type     string   `json:"type"`
+
+	window CronWindow
+}
+
+// Duration reads durations in json the way flags take them, like "90m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// longest window that is checked
+const maxSilence = 24 * time.Hour
+
+// CronWindow is open for Duration after each time Schedule, a cron
+// expression, comes around in Timezone, or utc when it is empty
+type CronWindow struct {
+	Schedule string   `json:"schedule"`
+	Duration Duration `json:"duration"`
+	Timezone string   `json:"timezone"`
+
+	cron *cronSchedule
+	loc  *time.Location
+}
+
+func (cw *CronWindow) init() error {
+	cron, err := parseCron(cw.Schedule)
+	if err != nil {
+		return err
+	}
+	if cw.Duration <= 0 || time.Duration(cw.Duration) > maxSilence {
+		return fmt.Errorf("duration must be between 0 and %s", maxSilence)
+	}
+	loc := time.UTC
+	if cw.Timezone != "" {
+		if loc, err = time.LoadLocation(cw.Timezone); err != nil {
+			return err
+		}
+	}
+	cw.cron, cw.loc = cron, loc
+	return nil
+}
+
+// open reports whether the schedule came around within Duration of t
+func (cw *CronWindow) open(t time.Time) bool {
+	t = t.In(cw.loc).Truncate(time.Minute)
+	last, ok := cw.cron.last(t, t.Add(-time.Duration(cw.Duration)))
+	return ok && t.Sub(last) < time.Duration(cw.Duration)
+}
+
+func (sw *SilenceWindow) init() error {
+	if sw.ID == "" {
+		return fmt.Errorf("silence window needs an id")
+	}
+	sw.window = CronWindow{Schedule: sw.Schedule, Duration: sw.Duration, Timezone: sw.Timezone}
+	return sw.window.init()
+}
+
+func (sw *SilenceWindow) active(t time.Time) bool {
+	return sw.window.open(t)
+}
+
+func (sw *SilenceWindow) silences(p *Payload, t time.Time) bool {
+	if sw.Team != "" && sw.Team != p.TeamID {
+		return false
+	}
+	if sw.Type != "" && sw.Type != p.Type {
+		return false
+	}
+	return sw.active(t)
+}
+
+// cronSchedule is a five field cron expression. Like classic cron, when
+// day of month and day of week are both set either one matching will do.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// set when day of month or day of week starts with *
+	anyDOM, anyDOW bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule %q needs five fields", expr)
+	}
+	c := &cronSchedule{}
+	for i, each := range []struct {
+		set      *map[int]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 6},
+	} {
+		set, err := parseCronField(fields[i], each.min, each.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron schedule %q: %v", expr, err)
+		}
+		*each.set = set
+	}
+	c.anyDOM = strings.HasPrefix(fields[2], "*")
+	c.anyDOW = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseCronField handles lists of *, single values, and ranges, each with
+// an optional /step
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute[t.Minute()] && c.hour[t.Hour()] && c.matchesDay(t)
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	if !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.anyDOM || c.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// last finds the latest minute at or before t that matches, skipping days
+// and hours that do not, and gives up once it is before since
+func (c *cronSchedule) last(t, since time.Time) (time.Time, bool) {
+	for !t.Before(since) {
+		year, month, day := t.Date()
+		var next time.Time
+		switch {
+		case !c.matchesDay(t):
+			next = time.Date(year, month, day, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !c.hour[t.Hour()]:
+			next = time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.minute[t.Minute()]:
+			return t, true
+		default:
+			next = t.Add(-time.Minute)
+		}
+		// time.Date can land later than t around daylight saving changes
+		if !next.Before(t) {
+			next = t.Add(-time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}, false
+}
+
+// silenceStore holds the windows, which can change at runtime through the
+// admin api
+type silenceStore struct {
+	mu      sync.RWMutex
+	windows map[string]*SilenceWindow
+	// ids of the windows that came from the config, which a reload replaces
+	fromConfig map[string]bool
+}
+
+var silences = newSilenceStore()
+
+func newSilenceStore() *silenceStore {
+	return &silenceStore{windows: map[string]*SilenceWindow{}, fromConfig: map[string]bool{}}
+}
+
+// put adds or replaces a window, which from then on is left alone by reloads
+func (s *silenceStore) put(sw SilenceWindow) error {
+	if err := sw.init(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windows[sw.ID] = &sw
+	delete(s.fromConfig, sw.ID)
+	return nil
+}
+
+// replaceConfig swaps the windows from the previous config for windows,
+// all of them or none if one is bad. Windows set through the admin api stay.
+func (s *silenceStore) replaceConfig(windows []SilenceWindow) error {
+	next := map[string]*SilenceWindow{}
+	for _, sw := range windows {
+		sw := sw
+		if err := sw.init(); err != nil {
+			return fmt.Errorf("silence %s: %v", sw.ID, err)
+		}
+		next[sw.ID] = &sw
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.fromConfig {
+		delete(s.windows, id)
+	}
+	s.fromConfig = map[string]bool{}
+	for id, sw := range next {
+		// one set through the admin api wins over the config
+		if _, ok := s.windows[id]; ok {
+			continue
+		}
+		s.windows[id] = sw
+		s.fromConfig[id] = true
+	}
+	return nil
+}
+
+func (s *silenceStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.windows[id]
+	delete(s.windows, id)
+	delete(s.fromConfig, id)
+	return ok
+}
+
+func (s *silenceStore) list() []SilenceWindow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []SilenceWindow{}
+	for _, sw := range s.windows {
+		out = append(out, *sw)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// silencing returns the window silencing p, if any
+func (s *silenceStore) silencing(p *Payload, t time.Time) *SilenceWindow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sw := range s.windows {
+		if sw.silences(p, t) {
+			return sw
+		}
+	}
+	return nil
+}
+
+// SilenceHandler acks events that fall in a silence window with an empty 200
+// rather than handing them to child.
+func SilenceHandler(child http.Handler, parser PayloadParser, s *silenceStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.Type == "url_verification" {
+			child.ServeHTTP(w, r)
+			return
+		}
+		if sw := s.silencing(p, time.Now()); sw != nil {
+			metricSilencedEvents.Inc(sw.ID)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		child.ServeHTTP(w, r)
+	})
+}
+
+// SilenceAdminHandler lists windows on GET, adds or replaces one from a json
+// body on POST, and removes the one named by ?id on DELETE. Changes only
+// last until restart, the config file is not written. Under --workers only
+// the first worker serves the admin api, so changes are refused there and
+// windows must go in the config.
+func SilenceAdminHandler(s *silenceStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && *flagWorkers > 0 {
+			http.Error(w, "silence windows can only be changed in the config with --workers", http.StatusConflict)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var sw SilenceWindow
+			if err := json.NewDecoder(r.Body).Decode(&sw); err != nil {
+				http.Error(w, "bad silence window: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.put(sw); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("silence window %s set to %s for %s", sw.ID, sw.Schedule, time.Duration(sw.Duration))
+		case http.MethodDelete:
+			if !s.remove(r.URL.Query().Get("id")) {
+				http.Error(w, "no such silence window", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.list())
+	})
+}
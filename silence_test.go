@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		matches []string
+		misses  []string
+		err     bool
+	}{
+		{expr: "0 2 * * *",
+			matches: []string{"2020-09-13T02:00:00Z"},
+			misses:  []string{"2020-09-13T02:01:00Z", "2020-09-13T03:00:00Z"}},
+		{expr: "*/15 9-17 * * 1-5",
+			matches: []string{"2020-09-14T09:45:00Z", "2020-09-18T17:00:00Z"},
+			misses:  []string{"2020-09-14T09:50:00Z", "2020-09-13T10:00:00Z"}},
+		{expr: "30 4 1,15 * *",
+			matches: []string{"2020-09-15T04:30:00Z"},
+			misses:  []string{"2020-09-14T04:30:00Z"}},
+		{expr: "0 0 1 * 1", // either day field will do, like cron
+			matches: []string{"2020-09-01T00:00:00Z", "2020-09-07T00:00:00Z"},
+			misses:  []string{"2020-09-08T00:00:00Z"}},
+		{expr: "0 0 */2 * 1", // but both must match when one starts with *
+			matches: []string{"2020-09-07T00:00:00Z"},
+			misses:  []string{"2020-09-03T00:00:00Z", "2020-09-14T00:00:00Z"}},
+		{expr: "* * *", err: true},
+		{expr: "60 * * * *", err: true},
+		{expr: "5-1 * * * *", err: true},
+		{expr: "*/0 * * * *", err: true},
+		{expr: "a * * * *", err: true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			c, err := parseCron(tc.expr)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, each := range tc.matches {
+				at, _ := time.Parse(time.RFC3339, each)
+				assert.True(t, c.matches(at), each)
+			}
+			for _, each := range tc.misses {
+				at, _ := time.Parse(time.RFC3339, each)
+				assert.False(t, c.matches(at), each)
+			}
+		})
+	}
+}
+
+func TestCronWindowOpen(t *testing.T) {
+	// open has to agree with checking every minute of the window
+	start, _ := time.Parse(time.RFC3339, "2020-03-07T00:00:00Z")
+	for _, cw := range []CronWindow{
+		{Schedule: "0 2 * * 0", Duration: Duration(90 * time.Minute), Timezone: "America/Chicago"},
+		{Schedule: "*/20 9-17 * * 1-5", Duration: Duration(7 * time.Minute)},
+		{Schedule: "45 23 1,15 * 6", Duration: Duration(24 * time.Hour), Timezone: "Asia/Kolkata"},
+	} {
+		require.NoError(t, cw.init())
+		for at := start; at.Before(start.Add(4 * 24 * time.Hour)); at = at.Add(17 * time.Minute) {
+			want := false
+			local := at.In(cw.loc).Truncate(time.Minute)
+			for back := time.Duration(0); back < time.Duration(cw.Duration); back += time.Minute {
+				want = want || cw.cron.matches(local.Add(-back))
+			}
+			require.Equal(t, want, cw.open(at), "%s at %s", cw.Schedule, at)
+		}
+	}
+}
+
+func TestSilenceWindow(t *testing.T) {
+	sw := SilenceWindow{
+		ID:       "maintenance",
+		Schedule: "0 2 * * 0",
+		Duration: Duration(90 * time.Minute),
+		Timezone: "America/Chicago",
+		Type:     "message",
+	}
+	require.NoError(t, sw.init())
+
+	message := &Payload{Kind: PayloadEvent, TeamID: "T1", Type: "message"}
+	reaction := &Payload{Kind: PayloadEvent, TeamID: "T1", Type: "reaction_added"}
+	for at, want := range map[string]bool{
+		"2020-09-13T07:00:00Z": true, // 2am central
+		"2020-09-13T08:29:59Z": true,
+		"2020-09-13T08:30:00Z": false,
+		"2020-09-13T06:59:00Z": false,
+		"2020-09-14T07:00:00Z": false, // monday
+	} {
+		now, _ := time.Parse(time.RFC3339, at)
+		assert.Equal(t, want, sw.silences(message, now), at)
+		assert.False(t, sw.silences(reaction, now), at)
+	}
+
+	for _, bad := range []SilenceWindow{
+		{Schedule: "* * * * *", Duration: Duration(time.Minute)},
+		{ID: "a", Schedule: "* * * * *"},
+		{ID: "a", Schedule: "* * * * *", Duration: Duration(25 * time.Hour)},
+		{ID: "a", Schedule: "* * * * *", Duration: Duration(time.Minute), Timezone: "Nowhere/Special"},
+	} {
+		assert.Error(t, bad.init())
+	}
+}
+
+func TestSilenceHandler(t *testing.T) {
+	store := newSilenceStore()
+	require.NoError(t, store.put(SilenceWindow{
+		ID: "noisy", Schedule: "* * * * *", Duration: Duration(time.Minute), Team: "T1"}))
+
+	forwarded := 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := SilenceHandler(backend, PayloadParserFunc(ParseSlackPayload), store)
+
+	before := metricSilencedEvents.Get("noisy")
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"type":"event_callback","team_id":"T1","event":{"type":"message"}}`, http.StatusOK},
+		{`{"type":"event_callback","team_id":"T2","event":{"type":"message"}}`, http.StatusAccepted},
+		{`{"type":"url_verification","challenge":"abc"}`, http.StatusAccepted},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, tc.body)
+	}
+	assert.Equal(t, 2, forwarded)
+	assert.Equal(t, before+1, metricSilencedEvents.Get("noisy"))
+}
+
+func TestSilenceAdminHandler(t *testing.T) {
+	store := newSilenceStore()
+	h := SilenceAdminHandler(store)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/admin/silences",
+		`{"id":"nightly","schedule":"0 3 * * *","duration":"30m","type":"message"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `[{"id":"nightly","schedule":"0 3 * * *","duration":"30m0s",
+		"timezone":"","team":"","type":"message"}]`, w.Body.String())
+
+	w = do(http.MethodPost, "/admin/silences", `{"id":"bad","schedule":"0 3 * *","duration":"30m"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(http.MethodGet, "/admin/silences", "")
+	assert.Contains(t, w.Body.String(), `"id":"nightly"`)
+
+	w = do(http.MethodDelete, "/admin/silences?id=nightly", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	w = do(http.MethodDelete, "/admin/silences?id=nightly", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// only the first worker would see changes
+	defer func(old int) { *flagWorkers = old }(*flagWorkers)
+	*flagWorkers = 2
+	w = do(http.MethodPost, "/admin/silences", `{"id":"nightly","schedule":"0 3 * * *","duration":"30m"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = do(http.MethodGet, "/admin/silences", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestSilenceStoreReplaceConfig(t *testing.T) {
+	store := newSilenceStore()
+	window := func(id string) SilenceWindow {
+		return SilenceWindow{ID: id, Schedule: "0 3 * * *", Duration: Duration(time.Hour)}
+	}
+	ids := func() (out []string) {
+		for _, sw := range store.list() {
+			out = append(out, sw.ID)
+		}
+		return out
+	}
+
+	require.NoError(t, store.replaceConfig([]SilenceWindow{window("nightly"), window("weekly")}))
+	require.NoError(t, store.put(window("manual")))
+	require.NoError(t, store.put(window("weekly")))
+	assert.Equal(t, []string{"manual", "nightly", "weekly"}, ids())
+
+	// windows dropped from the config go, the admin api's stay
+	require.NoError(t, store.replaceConfig([]SilenceWindow{window("monthly")}))
+	assert.Equal(t, []string{"manual", "monthly", "weekly"}, ids())
+
+	// one bad window keeps all of the previous ones
+	bad := window("broken")
+	bad.Schedule = "0 3 * *"
+	assert.Error(t, store.replaceConfig([]SilenceWindow{window("yearly"), bad}))
+	assert.Equal(t, []string{"manual", "monthly", "weekly"}, ids())
+}
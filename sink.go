@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagSinks = kingpin.
+			Flag("sink", "extra sink to copy verified requests to, may be repeated").
+			Envar("SINK").Strings()
+	flagOutput = kingpin.
+			Flag("output", "where verified events go, http to forward them to the backend, or a sink like kafka to hand them to it instead").
+			Envar("OUTPUT").Default("http").String()
+)
+
+// Sink receives a copy of every verified request, alongside the normal
+// forward to the backend.
+type Sink interface {
+	Send(ctx context.Context, d *Delivery) error
+}
+
+type SinkFunc func(ctx context.Context, d *Delivery) error
+
+func (f SinkFunc) Send(ctx context.Context, d *Delivery) error { return f(ctx, d) }
+
+type namedSink struct {
+	name string
+	sink Sink
+	// responses has the sink wait for the backend, and get its answer too
+	responses bool
+}
+
+// sinks are set up in main, and each gets every verified request
+var sinks []namedSink
+
+// SinkDriver opens a sink from its own flags.
+type SinkDriver func() (Sink, error)
+
+var (
+	sinkDriversMu sync.RWMutex
+	sinkDrivers   = map[string]SinkDriver{
+		"amqp":    openAMQPSink,
+		"exec":    openExecSink,
+		"kafka":   openKafkaSink,
+		"kinesis": openKinesisSink,
+		"mqtt":    openMQTTSink,
+		"sns":     openSNSSink,
+		"spool":   openSpoolSink,
+		"sqs":     openSQSSink,
+	}
+)
+
+// RegisterSink adds a driver for --sink name.
+func RegisterSink(name string, driver SinkDriver) {
+	sinkDriversMu.Lock()
+	defer sinkDriversMu.Unlock()
+	sinkDrivers[name] = driver
+}
+
+func OpenSink(name string) (Sink, error) {
+	sinkDriversMu.RLock()
+	driver, ok := sinkDrivers[name]
+	sinkDriversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no sink named %q, have %s", name, strings.Join(sinkNames(), ", "))
+	}
+	return driver()
+}
+
+func sinkNames() []string {
+	sinkDriversMu.RLock()
+	defer sinkDriversMu.RUnlock()
+	var names []string
+	for name := range sinkDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// outputSink is set up in main when --output names a sink
+var outputSink Sink
+
+// OutputHandler hands events api posts to sink in place of child, and acks
+// them with an empty 200 once the sink has them. If the sink fails slack is
+// answered with a 503, so it retries. Commands, interactions and
+// url_verification need an answer so still go to child.
+func OutputHandler(child http.Handler, parser PayloadParser, name string, sink Sink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := RequestPayload(r, parser)
+		if err != nil || p.Kind != PayloadEvent || p.Type == "url_verification" {
+			child.ServeHTTP(w, r)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		if err := sink.Send(r.Context(), NewDelivery(r, body)); err != nil {
+			log.Printf("output %s: %v", name, err)
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// SinkHandler copies each request to sink before passing it to child. A
+// failing sink is logged and never fails the request.
+func SinkHandler(child http.Handler, name string, sink Sink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		if err := sink.Send(r.Context(), NewDelivery(r, body)); err != nil {
+			log.Printf("sink %s: %v", name, err)
+		}
+		child.ServeHTTP(w, r)
+	})
+}
+
+// ResponseSinkHandler passes each request to child, then copies it to sink
+// along with how child answered it, keeping up to bodyLimit bytes of the
+// response body. A failing sink is logged and never fails the request.
+func ResponseSinkHandler(child http.Handler, name string, sink Sink, bodyLimit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		d := NewDelivery(r, body)
+
+		start := time.Now()
+		rw := &responseCapture{statusWriter: statusWriter{ResponseWriter: w}, limit: bodyLimit}
+		child.ServeHTTP(rw, r)
+		d.Response = &DeliveryResponse{
+			Status:    rw.Status(),
+			LatencyMS: int64(time.Since(start) / time.Millisecond),
+			Body:      rw.body.String(),
+			Truncated: rw.truncated,
+		}
+
+		// the request is done with, so its context may already be canceled
+		if err := sink.Send(context.Background(), d); err != nil {
+			log.Printf("sink %s: %v", name, err)
+		}
+	})
+}
+
+// responseCapture keeps the first limit bytes written through it
+type responseCapture struct {
+	statusWriter
+	limit     int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *responseCapture) Write(p []byte) (int, error) {
+	if room := w.limit - w.body.Len(); room < len(p) {
+		if room > 0 {
+			w.body.Write(p[:room])
+		}
+		w.truncated = true
+	} else {
+		w.body.Write(p)
+	}
+	return w.statusWriter.Write(p)
+}
+
+// SampleSink only passes a rate fraction of deliveries on to sink, picked
+// by sampleKey so they are the same events tracing samples.
+func SampleSink(rate float64, sink Sink) Sink {
+	return SinkFunc(func(ctx context.Context, d *Delivery) error {
+		if !sampled(sampleKey(d), rate) {
+			return nil
+		}
+		return sink.Send(ctx, d)
+	})
+}
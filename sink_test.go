@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkHandler(t *testing.T) {
+	var got []*Delivery
+	sink := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		got = append(got, d)
+		if len(got) > 1 {
+			return errors.New("sink is broken")
+		}
+		return nil
+	})
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	})
+	ts := httptest.NewServer(SinkHandler(echo, "test", sink))
+	defer ts.Close()
+
+	for _, body := range []string{"first", "second"} {
+		resp, err := http.Post(ts.URL+"/events", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		echoed, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		// a broken sink never gets in the way of the backend
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, body, string(echoed))
+	}
+
+	require.Len(t, got, 2)
+	assert.Equal(t, "first", string(got[0].Body))
+	assert.Equal(t, "/events", got[0].RequestURI)
+	assert.Equal(t, "text/plain", got[0].Header.Get("Content-Type"))
+}
+
+func TestSampleSink(t *testing.T) {
+	count := 0
+	counter := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		count++
+		return nil
+	})
+
+	for rate, exp := range map[float64][2]int{
+		0:   {0, 0},
+		1:   {1000, 1000},
+		0.5: {350, 650},
+	} {
+		count = 0
+		sink := SampleSink(rate, counter)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, sink.Send(context.Background(), &Delivery{Body: []byte(strconv.Itoa(i))}))
+		}
+		assert.True(t, count >= exp[0] && count <= exp[1], "rate %v sent %d", rate, count)
+	}
+}
+
+func TestResponseSinkHandler(t *testing.T) {
+	var got []*Delivery
+	sink := SinkFunc(func(ctx context.Context, d *Delivery) error {
+		require.NoError(t, ctx.Err())
+		got = append(got, d)
+		return nil
+	})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if string(body) == "fail" {
+			http.Error(w, "backend is down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	h := ResponseSinkHandler(backend, "archive", sink, 16)
+
+	for _, body := range []string{"fine", "fail"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body)))
+		if body == "fail" {
+			// the whole answer still goes back to slack
+			assert.Equal(t, "backend is down for maintenance\n", w.Body.String())
+		}
+	}
+
+	require.Len(t, got, 2)
+	assert.Equal(t, "fine", string(got[0].Body))
+	assert.Equal(t, &DeliveryResponse{Status: http.StatusOK, Body: "ok"}, got[0].Response)
+	assert.Equal(t, "fail", string(got[1].Body))
+	assert.Equal(t, &DeliveryResponse{
+		Status:    http.StatusServiceUnavailable,
+		Body:      "backend is down ",
+		Truncated: true,
+	}, got[1].Response)
+}
@@ -0,0 +1,112 @@
+// Package slackproxytest helps backend authors test against the same
+// verification the proxy runs in production. A Server verifies requests
+// like the proxy does before handing them to a backend, and the New*Request
+// helpers build requests signed the way slack signs them.
+//
+//	srv := slackproxytest.NewServer("secret", myBackend)
+//	defer srv.Close()
+//
+//	req := srv.NewEventRequest("/", "T123", map[string]string{"type": "app_mention"})
+//	resp, err := srv.Client().Do(req)
+package slackproxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakdept/slack_events_proxy/slackverify"
+)
+
+// Server is an in memory stand in for the proxy, verifying requests with
+// Secret before passing them to its backend.
+type Server struct {
+	*httptest.Server
+	Secret string
+}
+
+// NewServer verifies requests signed with secret and hands them to backend.
+// Requests that fail verification get the same status the proxy answers
+// with.
+func NewServer(secret string, backend http.Handler) *Server {
+	v := &slackverify.Verifier{Secrets: []string{secret}, Expire: 30 * time.Second}
+	return &Server{Server: httptest.NewServer(v.Middleware(backend)), Secret: secret}
+}
+
+// NewProxy is NewServer forwarding to a backend already listening on
+// target, as the proxy would.
+func NewProxy(secret string, target *url.URL) *Server {
+	return NewServer(secret, httputil.NewSingleHostReverseProxy(target))
+}
+
+// NewRequest builds a request for path on the server, signed with its
+// secret.
+func (s *Server) NewRequest(path, contentType string, body []byte) *http.Request {
+	return NewRequest(s.Secret, s.URL+path, contentType, body)
+}
+
+// NewEventRequest wraps event in an events api envelope for team.
+func (s *Server) NewEventRequest(path, team string, event interface{}) *http.Request {
+	return NewEventRequest(s.Secret, s.URL+path, team, event)
+}
+
+// NewInteractionRequest builds an interactivity post carrying payload.
+func (s *Server) NewInteractionRequest(path string, payload interface{}) *http.Request {
+	return NewInteractionRequest(s.Secret, s.URL+path, payload)
+}
+
+// NewCommandRequest builds a slash command post from form.
+func (s *Server) NewCommandRequest(path string, form url.Values) *http.Request {
+	return NewCommandRequest(s.Secret, s.URL+path, form)
+}
+
+// NewRequest builds a post to target signed with secret as of now.
+func NewRequest(secret, target, contentType string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	// httptest leaves RequestURI set, which clients refuse to send
+	r.RequestURI = ""
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("User-Agent", "Slackbot 1.0 (+https://api.slack.com/robots)")
+	slackverify.Sign(r, secret, time.Now(), body)
+	return r
+}
+
+// NewEventRequest builds a signed event_callback for team carrying event,
+// which is marshaled to json.
+func NewEventRequest(secret, target, team string, event interface{}) *http.Request {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		panic("slackproxytest: marshaling event: " + err.Error())
+	}
+	body, _ := json.Marshal(slackverify.Envelope{
+		Type:      "event_callback",
+		TeamID:    team,
+		APIAppID:  "A0TEST",
+		EventID:   "Ev" + strings.ToUpper(strconv.FormatInt(time.Now().UnixNano(), 36)),
+		EventTime: time.Now().Unix(),
+		Event:     raw,
+	})
+	return NewRequest(secret, target, "application/json", body)
+}
+
+// NewCommandRequest builds a signed slash command post from form.
+func NewCommandRequest(secret, target string, form url.Values) *http.Request {
+	return NewRequest(secret, target, "application/x-www-form-urlencoded",
+		[]byte(form.Encode()))
+}
+
+// NewInteractionRequest builds a signed interactivity post, which slack
+// sends as a form with the json payload in a single field.
+func NewInteractionRequest(secret, target string, payload interface{}) *http.Request {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		panic("slackproxytest: marshaling payload: " + err.Error())
+	}
+	return NewCommandRequest(secret, target, url.Values{"payload": {string(raw)}})
+}
@@ -0,0 +1,70 @@
+package slackproxytest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jakdept/slack_events_proxy/slackverify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	var gotTeam, gotType string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTeam = slackverify.TeamID(r.Context())
+		gotType = slackverify.EventType(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := NewServer("secret", backend)
+	defer srv.Close()
+
+	for name, tc := range map[string]struct {
+		req    *http.Request
+		status int
+		team   string
+		typ    string
+	}{
+		"event": {req: srv.NewEventRequest("/", "T123", map[string]string{"type": "app_mention"}),
+			status: http.StatusNoContent, team: "T123", typ: "app_mention"},
+		"command": {req: srv.NewCommandRequest("/", url.Values{"command": {"/ops"}, "team_id": {"T9"}}),
+			status: http.StatusNoContent, team: "T9", typ: "/ops"},
+		"interaction": {req: srv.NewInteractionRequest("/", map[string]interface{}{
+			"type": "block_actions", "team": map[string]string{"id": "T7"}}),
+			status: http.StatusNoContent, team: "T7", typ: "block_actions"},
+		"wrong secret": {req: NewRequest("other", srv.URL, "application/json", []byte(`{}`)),
+			status: http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			gotTeam, gotType = "", ""
+			resp, err := srv.Client().Do(tc.req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			assert.Equal(t, tc.team, gotTeam)
+			assert.Equal(t, tc.typ, gotType)
+		})
+	}
+}
+
+func TestNewProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	target, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	srv := NewProxy("secret", target)
+	defer srv.Close()
+	resp, err := srv.Client().Do(srv.NewRequest("/events", "application/json", []byte(`{"ok":true}`)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"ok":true}`, string(body))
+}
@@ -0,0 +1,103 @@
+package slackverify
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type contextKey struct{}
+
+// verified is what Middleware learned about a request while verifying it
+type verified struct {
+	timestamp time.Time
+	body      []byte
+	envelope  *Envelope
+	teamID    string
+	eventType string
+}
+
+// Envelope is the outer layer of an events api request.
+type Envelope struct {
+	Type      string          `json:"type"`
+	Token     string          `json:"token"`
+	TeamID    string          `json:"team_id"`
+	APIAppID  string          `json:"api_app_id"`
+	EventID   string          `json:"event_id"`
+	EventTime int64           `json:"event_time"`
+	Event     json.RawMessage `json:"event"`
+}
+
+func newContext(ctx context.Context, r *http.Request, ts time.Time, body []byte) context.Context {
+	v := &verified{timestamp: ts, body: body}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var env Envelope
+		if json.Unmarshal(body, &env) == nil {
+			v.envelope = &env
+			v.teamID = env.TeamID
+			v.eventType = env.Type
+			var event struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(env.Event, &event) == nil && event.Type != "" {
+				v.eventType = event.Type
+			}
+		}
+	case "application/x-www-form-urlencoded":
+		form, _ := url.ParseQuery(string(body))
+		v.teamID = form.Get("team_id")
+		v.eventType = form.Get("command")
+		if raw := form.Get("payload"); raw != "" {
+			// interactivity sends its json in a form field
+			var in struct {
+				Type string `json:"type"`
+				Team struct {
+					ID string `json:"id"`
+				} `json:"team"`
+			}
+			if json.Unmarshal([]byte(raw), &in) == nil {
+				v.teamID = in.Team.ID
+				v.eventType = in.Type
+			}
+		}
+	}
+	return context.WithValue(ctx, contextKey{}, v)
+}
+
+func fromContext(ctx context.Context) *verified {
+	v, _ := ctx.Value(contextKey{}).(*verified)
+	if v == nil {
+		return &verified{}
+	}
+	return v
+}
+
+// Verified reports whether ctx came from a request Middleware verified.
+func Verified(ctx context.Context) bool {
+	_, ok := ctx.Value(contextKey{}).(*verified)
+	return ok
+}
+
+// Timestamp is the verified X-Slack-Request-Timestamp of the request.
+func Timestamp(ctx context.Context) time.Time { return fromContext(ctx).timestamp }
+
+// Body is the raw body the signature was checked against. It must not be
+// modified.
+func Body(ctx context.Context) []byte { return fromContext(ctx).body }
+
+// EventEnvelope is the parsed events api envelope, or nil for commands and
+// interactivity.
+func EventEnvelope(ctx context.Context) *Envelope { return fromContext(ctx).envelope }
+
+// TeamID is the workspace the request came from.
+func TeamID(ctx context.Context) string { return fromContext(ctx).teamID }
+
+// EventType is the inner event type for events, the command for slash
+// commands, and the payload type for interactivity.
+func EventType(ctx context.Context) string { return fromContext(ctx).eventType }
@@ -0,0 +1,73 @@
+package slackverify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext(t *testing.T) {
+	v := &Verifier{Secrets: []string{"shh"}, Expire: time.Minute}
+	interaction := url.Values{"payload": {`{"type":"block_actions","team":{"id":"T3"}}`}}.Encode()
+
+	for name, tc := range map[string]struct {
+		contentType string
+		body        string
+		teamID      string
+		eventType   string
+		eventID     string
+	}{
+		"event": {
+			contentType: "application/json",
+			body:        `{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message"}}`,
+			teamID:      "T1", eventType: "message", eventID: "Ev1",
+		},
+		"url verification": {
+			contentType: "application/json",
+			body:        `{"type":"url_verification","challenge":"abc"}`,
+			eventType:   "url_verification",
+		},
+		"command": {
+			contentType: "application/x-www-form-urlencoded",
+			body:        "command=%2Fops&team_id=T2",
+			teamID:      "T2", eventType: "/ops",
+		},
+		"interaction": {
+			contentType: "application/x-www-form-urlencoded",
+			body:        interaction,
+			teamID:      "T3", eventType: "block_actions",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := time.Now().Add(-time.Second).Truncate(time.Second)
+			called := false
+			h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				ctx := r.Context()
+				assert.True(t, Verified(ctx))
+				assert.True(t, ts.Equal(Timestamp(ctx)))
+				assert.Equal(t, tc.body, string(Body(ctx)))
+				assert.Equal(t, tc.teamID, TeamID(ctx))
+				assert.Equal(t, tc.eventType, EventType(ctx))
+				if tc.eventID != "" {
+					require.NotNil(t, EventEnvelope(ctx))
+					assert.Equal(t, tc.eventID, EventEnvelope(ctx).EventID)
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			Sign(r, "shh", ts, []byte(tc.body))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			assert.True(t, called)
+		})
+	}
+
+	assert.False(t, Verified(httptest.NewRequest(http.MethodGet, "/", nil).Context()))
+}
@@ -0,0 +1,105 @@
+package slackverify
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testdata/corpus holds raw requests signed with the secret from slack's
+// docs, in a directory named for the reason they fail, or ok. It doubles
+// as the seed corpus for FuzzVerify.
+const corpusSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// corpusVerifier accepts the 2018 timestamps the corpus was signed with
+func corpusVerifier() *Verifier {
+	return &Verifier{
+		Secrets: []string{corpusSecret},
+		Expire:  time.Since(time.Unix(1531420618, 0)) + time.Hour,
+	}
+}
+
+func TestCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*", "*.http"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, path := range files {
+		reason := filepath.Base(filepath.Dir(path))
+		t.Run(reason+"/"+strings.TrimSuffix(filepath.Base(path), ".http"), func(t *testing.T) {
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			defer f.Close()
+			r, err := http.ReadRequest(bufio.NewReader(f))
+			require.NoError(t, err)
+
+			called := false
+			w := httptest.NewRecorder()
+			corpusVerifier().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				// the body is still there after verification
+				body, err := ioutil.ReadAll(r.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, Body(r.Context()), body)
+				EventEnvelope(r.Context())
+			})).ServeHTTP(w, r)
+
+			if reason == "ok" {
+				assert.True(t, called)
+				return
+			}
+			assert.False(t, called)
+			for _, e := range []*Error{ErrBadTimestamp, ErrExpired, ErrBadSignature,
+				ErrHeaderTooLarge, ErrUnsupportedVersion, ErrMismatch} {
+				if e.Reason == reason {
+					assert.Equal(t, e.Status, w.Code)
+					assert.Equal(t, e.Message+"\n", w.Body.String())
+					return
+				}
+			}
+			t.Fatalf("unknown reason %q", reason)
+		})
+	}
+}
+
+// FuzzVerify feeds raw http requests through Middleware, seeded with the
+// corpus:
+//
+//	go test ./slackverify -fuzz FuzzVerify
+func FuzzVerify(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*", "*.http"))
+	require.NoError(f, err)
+	for _, path := range files {
+		raw, err := ioutil.ReadFile(path)
+		require.NoError(f, err)
+		f.Add(raw)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		v := corpusVerifier()
+		v.Versions = []string{Version, "v1"}
+		v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err == nil {
+				assert.Equal(t, Body(r.Context()), body)
+			}
+			EventEnvelope(r.Context())
+			TeamID(r.Context())
+			EventType(r.Context())
+		})).ServeHTTP(httptest.NewRecorder(), r)
+	})
+}
@@ -0,0 +1,49 @@
+package slackverify
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers signatures already accepted, so an exact copy of a
+// request is turned away for as long as its timestamp would otherwise pass.
+// At most max signatures are kept, the oldest are forgotten first.
+type ReplayCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+	max   int
+}
+
+func NewReplayCache(max int) *ReplayCache {
+	return &ReplayCache{seen: map[string]time.Time{}, max: max}
+}
+
+// add records key until expires, returning false if it is already there
+func (c *ReplayCache) add(key string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until, ok := c.seen[key]; ok && now.Before(until) {
+		return false
+	}
+
+	// forget from the front while it has expired or the cache is full
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if now.Before(c.seen[oldest]) && len(c.order) < c.max {
+			break
+		}
+		delete(c.seen, oldest)
+		c.order = c.order[1:]
+	}
+	c.seen[key] = expires
+	c.order = append(c.order, key)
+	return true
+}
+
+// Len is how many signatures are remembered.
+func (c *ReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
@@ -0,0 +1,61 @@
+package slackverify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplays(t *testing.T) {
+	v := &Verifier{Secrets: []string{"shh"}, Expire: time.Minute, Replays: NewReplayCache(100)}
+	ts := time.Now()
+	request := func(body string, extra ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		Sign(r, "shh", ts, []byte(body))
+		for _, sig := range extra {
+			r.Header.Add(HeaderSignature, sig)
+		}
+		return r
+	}
+
+	_, err := v.Verify(request("hello"))
+	assert.NoError(t, err)
+	_, err = v.Verify(request("hello"))
+	assert.Equal(t, ErrReplayed, err)
+
+	// padding the header with junk does not make a copy new
+	_, err = v.Verify(request("hello", "v0=00", "v0=beef"))
+	assert.Equal(t, ErrReplayed, err)
+
+	// nor does a request that fails verification take up a slot
+	r := request("other")
+	r.Header.Set(HeaderSignature, "v0=00")
+	_, err = v.Verify(r)
+	assert.Equal(t, ErrMismatch, err)
+	_, err = v.Verify(request("other"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Replays.Len())
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	c := NewReplayCache(2)
+	assert.True(t, c.add("a", now.Add(time.Minute), now))
+	assert.False(t, c.add("a", now.Add(time.Minute), now))
+	assert.True(t, c.add("b", now.Add(time.Minute), now))
+
+	// full, so the oldest is forgotten
+	assert.True(t, c.add("c", now.Add(time.Minute), now))
+	assert.Equal(t, 2, c.Len())
+	assert.True(t, c.add("a", now.Add(time.Minute), now))
+
+	// expired entries are dropped as new ones come in
+	later := now.Add(2 * time.Minute)
+	assert.True(t, c.add("d", later.Add(time.Minute), later))
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, c.add("c", later.Add(time.Minute), later))
+}
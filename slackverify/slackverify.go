@@ -0,0 +1,357 @@
+// Package slackverify checks the signature slack puts on every request it
+// sends, as described at
+// https://api.slack.com/authentication/verifying-requests-from-slack
+//
+// Verifier.Middleware has the func(http.Handler) http.Handler shape most
+// routers take middleware in:
+//
+//	// net/http
+//	http.Handle("/slack", v.Middleware(handler))
+//
+//	// chi
+//	r.Use(v.Middleware)
+//
+//	// gorilla/mux
+//	r.Use(v.Middleware)
+//
+//	// echo
+//	e.Use(echo.WrapMiddleware(v.Middleware))
+//
+// Handlers behind the middleware can get at the verified body, timestamp,
+// and parsed event with Body, Timestamp, EventEnvelope, TeamID and
+// EventType rather than reading the body again.
+package slackverify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Version         = "v0"
+	HeaderSignature = "X-Slack-Signature"
+	HeaderTimestamp = "X-Slack-Request-Timestamp"
+)
+
+// limits on the slack headers, well beyond anything slack sends. A
+// signature is a version and 64 hex characters, a timestamp is unix seconds.
+const (
+	maxSignatures      = 8
+	maxSignatureLength = 128
+	maxTimestampLength = 20
+)
+
+// Error is a reason a request failed verification, along with the status
+// to answer it with.
+type Error struct {
+	Reason  string // short name, suitable as a metric label
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+var (
+	ErrBadTimestamp = &Error{"bad_timestamp", http.StatusBadRequest,
+		"bad timestamp in " + HeaderTimestamp}
+	ErrExpired        = &Error{"expired", http.StatusUnauthorized, "timestamp expired"}
+	ErrBadSignature   = &Error{"bad_signature", http.StatusBadRequest, "bad signature"}
+	ErrHeaderTooLarge = &Error{"header_too_large", http.StatusRequestHeaderFieldsTooLarge,
+		"slack headers too large"}
+	ErrUnsupportedVersion = &Error{"unsupported_version", http.StatusNotImplemented,
+		"unsupported signature version"}
+	ErrBadBody     = &Error{"bad_body", http.StatusBadRequest, "bad request"}
+	ErrBodyTimeout = &Error{"body_timeout", http.StatusRequestTimeout,
+		"timed out reading body"}
+	ErrMismatch = &Error{"mismatch", http.StatusUnauthorized, "verification failed"}
+	ErrReplayed = &Error{"replayed", http.StatusConflict, "request already seen"}
+)
+
+// Verifier holds everything needed to verify a slack signature. More than
+// one secret may be configured while rotating, each is tried in order.
+type Verifier struct {
+	Secrets  []string
+	Expire   time.Duration
+	Versions []string // accepted signature versions, defaults to Version
+
+	// SecretsFunc is used instead of Secrets when set, and called for every
+	// request, for secrets that change while running
+	SecretsFunc func() []string
+
+	// Replays, when set, turns away a request whose timestamp and signature
+	// were already accepted
+	Replays *ReplayCache
+}
+
+// Verify checks the signature on r. The body is read to do so, and put back
+// in place for the next handler. A body that is an io.ReadSeeker, like a
+// temp file, is checked as it is read and rewound rather than copied into
+// memory. The secret that matched is returned.
+func (v *Verifier) Verify(r *http.Request) (secret string, err error) {
+	secret, _, _, err = v.verify(r, true)
+	return secret, err
+}
+
+func (v *Verifier) verify(r *http.Request, stream bool) (secret string, ts time.Time, body []byte, err error) {
+	versions := v.Versions
+	if len(versions) < 1 {
+		versions = []string{Version}
+	}
+
+	if err := checkHeaders(r.Header); err != nil {
+		return "", ts, nil, err
+	}
+
+	// grab the timestamp on the request, and verify not stale
+	tsStr := r.Header.Get(HeaderTimestamp)
+	tsInt, err := strconv.Atoi(tsStr)
+	if err != nil {
+		return "", ts, nil, ErrBadTimestamp
+	}
+	ts = time.Unix(int64(tsInt), 0)
+	// a timestamp far in the future would never expire, so a captured
+	// request could be replayed forever
+	if now := time.Now(); ts.Add(v.Expire).Before(now) || ts.After(now.Add(v.Expire)) {
+		return "", ts, nil, ErrExpired
+	}
+
+	// collect every candidate signature the request carries
+	candidates, err := parseSignatures(
+		strings.Join(r.Header[HeaderSignature], ","), versions)
+	if err != nil {
+		return "", ts, nil, err
+	}
+
+	secrets := v.Secrets
+	if v.SecretsFunc != nil {
+		secrets = v.SecretsFunc()
+	}
+	var matched signature
+	var ok bool
+	if rs, seekable := r.Body.(io.ReadSeeker); stream && seekable {
+		secret, matched, ok, err = streamSignatures(candidates, secrets, tsStr, rs)
+		if err != nil {
+			return "", ts, nil, ErrBadBody
+		}
+	} else {
+		// have to read the full body and verify checksum before calling child handler
+		body, err = ioutil.ReadAll(r.Body)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return "", ts, nil, ErrBodyTimeout
+		} else if err != nil {
+			return "", ts, nil, ErrBadBody
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		secret, matched, ok = matchSignatures(candidates, secrets, tsStr, body)
+	}
+	if !ok {
+		return "", ts, nil, ErrMismatch
+	}
+	// keyed on the signature that matched, as extra candidates in the
+	// header would otherwise make a copy look new
+	if v.Replays != nil &&
+		!v.Replays.add(tsStr+":"+matched.version+"="+hex.EncodeToString(matched.sig), ts.Add(v.Expire), time.Now()) {
+		return "", ts, nil, ErrReplayed
+	}
+	return secret, ts, body, nil
+}
+
+// Middleware only hands verified requests on to next, with what was learned
+// verifying them available from the request context.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ts, body, err := v.verify(r, false)
+		if err != nil {
+			e := err.(*Error)
+			http.Error(w, e.Message, e.Status)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(newContext(r.Context(), r, ts, body)))
+	})
+}
+
+// Sign signs r the way slack would, for requests made up outside of slack.
+func Sign(r *http.Request, secret string, ts time.Time, body []byte) {
+	tsStr := strconv.FormatInt(ts.Unix(), 10)
+	r.Header.Set(HeaderTimestamp, tsStr)
+	r.Header.Set(HeaderSignature, Signature(secret, Version, tsStr, body))
+}
+
+// Signature is the header value slack would send for body.
+func Signature(secret, version, ts string, body []byte) string {
+	return version + "=" + hex.EncodeToString(mac(secret, version, ts, body))
+}
+
+// checkHeaders rejects pathological slack headers before any work is done
+// on them
+func checkHeaders(h http.Header) error {
+	if len(h[HeaderTimestamp]) > 1 {
+		return ErrHeaderTooLarge
+	}
+	if len(h.Get(HeaderTimestamp)) > maxTimestampLength {
+		return ErrHeaderTooLarge
+	}
+	count := 0
+	for _, each := range h[HeaderSignature] {
+		for _, sig := range strings.Split(each, ",") {
+			count++
+			if count > maxSignatures || len(strings.TrimSpace(sig)) > maxSignatureLength {
+				return ErrHeaderTooLarge
+			}
+		}
+	}
+	return nil
+}
+
+// splitSignature splits a signature header like v0=abcd into its version and
+// hex encoded signature
+func splitSignature(header string) (version, sig string, ok bool) {
+	i := strings.Index(header, "=")
+	if i < 1 {
+		return "", "", false
+	}
+	return header[:i], header[i+1:], true
+}
+
+type signature struct {
+	version string
+	sig     []byte
+}
+
+// parseSignatures pulls every comma separated signature out of the header.
+// Candidates with a version that is not accepted are skipped, and the request
+// is only rejected if no usable candidate is left.
+func parseSignatures(header string, versions []string) ([]signature, error) {
+	var candidates []signature
+	unsupported := false
+	for _, each := range strings.Split(header, ",") {
+		version, sigHex, ok := splitSignature(strings.TrimSpace(each))
+		if !ok {
+			continue
+		}
+		if !containsString(versions, version) {
+			unsupported = true
+			continue
+		}
+		sig, err := hex.DecodeString(sigHex)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, signature{version: version, sig: sig})
+	}
+
+	switch {
+	case len(candidates) > 0:
+		return candidates, nil
+	case unsupported:
+		return nil, ErrUnsupportedVersion
+	default:
+		return nil, ErrBadSignature
+	}
+}
+
+// matchSignatures returns the first secret any candidate matches, and the
+// candidate that matched it. Every candidate is compared in constant time.
+func matchSignatures(
+	candidates []signature,
+	secrets []string,
+	ts string,
+	body []byte,
+) (string, signature, bool) {
+	for _, secret := range secrets {
+		calculated := map[string][]byte{}
+		for _, each := range candidates {
+			calcSig, ok := calculated[each.version]
+			if !ok {
+				calcSig = mac(secret, each.version, ts, body)
+				calculated[each.version] = calcSig
+			}
+
+			if hmac.Equal(each.sig, calcSig) {
+				return secret, each, true
+			}
+		}
+	}
+	return "", signature{}, false
+}
+
+// streamSignatures is matchSignatures for a body read once from body, which
+// is rewound after
+func streamSignatures(
+	candidates []signature,
+	secrets []string,
+	ts string,
+	body io.ReadSeeker,
+) (string, signature, bool, error) {
+	macs := map[string]hash.Hash{}
+	var writers []io.Writer
+	for _, secret := range secrets {
+		for _, each := range candidates {
+			key := secret + "\xff" + each.version
+			if _, ok := macs[key]; ok {
+				continue
+			}
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(each.version + ":" + ts + ":"))
+			macs[key] = mac
+			writers = append(writers, mac)
+		}
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", signature{}, false, err
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), body); err != nil {
+		return "", signature{}, false, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", signature{}, false, err
+	}
+
+	for _, secret := range secrets {
+		for _, each := range candidates {
+			if hmac.Equal(each.sig, macs[secret+"\xff"+each.version].Sum(nil)) {
+				return secret, each, true, nil
+			}
+		}
+	}
+	return "", signature{}, false, nil
+}
+
+// Basestring is what slack signs: the version, timestamp and body joined by
+// colons. The body is used exactly as received, transfer encodings are
+// already undone by net/http, but a Content-Encoding is never decoded.
+func Basestring(version, ts string, body []byte) []byte {
+	base := make([]byte, 0, len(version)+len(ts)+len(body)+2)
+	base = append(base, version...)
+	base = append(base, ':')
+	base = append(base, ts...)
+	base = append(base, ':')
+	return append(base, body...)
+}
+
+func mac(secret, version, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	// by spec mac.Write always returns nil
+	mac.Write(Basestring(version, ts, body))
+	return mac.Sum(nil)
+}
+
+func containsString(list []string, s string) bool {
+	for _, each := range list {
+		if each == s {
+			return true
+		}
+	}
+	return false
+}
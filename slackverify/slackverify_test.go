@@ -0,0 +1,195 @@
+package slackverify
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	v := &Verifier{Secrets: []string{"shh"}, Expire: time.Minute}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	})
+	ts := httptest.NewServer(v.Middleware(next))
+	defer ts.Close()
+
+	for name, tc := range map[string]struct {
+		secret string
+		age    time.Duration
+		status int
+	}{
+		"signed":     {secret: "shh", status: http.StatusOK},
+		"wrong key":  {secret: "loud", status: http.StatusUnauthorized},
+		"expired":    {secret: "shh", age: time.Hour, status: http.StatusUnauthorized},
+		"not signed": {status: http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("hello"))
+			require.NoError(t, err)
+			if tc.secret != "" {
+				Sign(req, tc.secret, time.Now().Add(-tc.age), []byte("hello"))
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			if tc.status == http.StatusOK {
+				body, err := ioutil.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(body), "body should be readable after verification")
+			}
+		})
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	v := &Verifier{Secrets: []string{"shh"}, Expire: time.Minute}
+	sig := "v0=" + strings.Repeat("0", 64)
+
+	for name, tc := range map[string]struct {
+		header http.Header
+		err    error
+	}{
+		"ok": {header: http.Header{
+			HeaderTimestamp: {"1531420618"},
+			HeaderSignature: {sig + "," + sig},
+		}, err: ErrExpired},
+		"long timestamp": {header: http.Header{
+			HeaderTimestamp: {strings.Repeat("1", 21)},
+			HeaderSignature: {sig},
+		}, err: ErrHeaderTooLarge},
+		"repeated timestamp": {header: http.Header{
+			HeaderTimestamp: {"1531420618", "1531420619"},
+			HeaderSignature: {sig},
+		}, err: ErrHeaderTooLarge},
+		"long signature": {header: http.Header{
+			HeaderTimestamp: {"1531420618"},
+			HeaderSignature: {"v0=" + strings.Repeat("0", 200)},
+		}, err: ErrHeaderTooLarge},
+		"too many signatures": {header: http.Header{
+			HeaderTimestamp: {"1531420618"},
+			HeaderSignature: {strings.Repeat(sig+",", 4), strings.Repeat(sig+",", 4) + sig},
+		}, err: ErrHeaderTooLarge},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+			r.Header = tc.header
+			_, err := v.Verify(r)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	v := &Verifier{Secrets: []string{"shh"}, Expire: time.Minute}
+	ts := httptest.NewServer(v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	})))
+	defer ts.Close()
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(`{"type":"event_callback"}`))
+	zw.Close()
+
+	for name, tc := range map[string]struct {
+		body     []byte
+		encoding string
+		chunked  bool
+	}{
+		"plain":   {body: []byte(`{"type":"event_callback"}`)},
+		"chunked": {body: []byte(strings.Repeat("chunk ", 1<<12)), chunked: true},
+		// the signature covers the compressed bytes, which are passed on as is
+		"gzip": {body: gzipped.Bytes(), encoding: "gzip"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var in io.Reader = bytes.NewReader(tc.body)
+			if tc.chunked {
+				// hide the length so the client has to chunk
+				in = ioutil.NopCloser(in)
+			}
+			req, err := http.NewRequest(http.MethodPost, ts.URL, in)
+			require.NoError(t, err)
+			if tc.chunked {
+				assert.Equal(t, int64(0), req.ContentLength)
+				req.ContentLength = -1
+			}
+			if tc.encoding != "" {
+				req.Header.Set("Content-Encoding", tc.encoding)
+			}
+			Sign(req, "shh", time.Now(), tc.body)
+
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			got, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.body, got)
+		})
+	}
+}
+
+func TestBasestring(t *testing.T) {
+	assert.Equal(t, "v0:1531420618:a=b&c=%20",
+		string(Basestring("v0", "1531420618", []byte("a=b&c=%20"))))
+}
+
+func TestSecretsFunc(t *testing.T) {
+	secrets := []string{"old"}
+	v := &Verifier{
+		Secrets:     []string{"ignored"},
+		SecretsFunc: func() []string { return secrets },
+		Expire:      time.Minute,
+	}
+	verify := func(secret string) error {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+		Sign(r, secret, time.Now(), []byte("hello"))
+		_, err := v.Verify(r)
+		return err
+	}
+
+	assert.NoError(t, verify("old"))
+	assert.Equal(t, ErrMismatch, verify("ignored"))
+	secrets = []string{"new"}
+	assert.NoError(t, verify("new"))
+	assert.Equal(t, ErrMismatch, verify("old"))
+}
+
+// seekableBody is a body Verify can check without copying it
+type seekableBody struct{ *strings.Reader }
+
+func (seekableBody) Close() error { return nil }
+
+func TestVerifySeekable(t *testing.T) {
+	v := &Verifier{Secrets: []string{"old", "new"}, Expire: time.Minute, Versions: []string{"v0", "v1"}}
+	for secret, want := range map[string]error{"new": nil, "other": ErrMismatch} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		body := seekableBody{strings.NewReader("hello")}
+		r.Body = body
+		Sign(r, secret, time.Now(), []byte("hello"))
+		got, err := v.Verify(r)
+		assert.Equal(t, want, err, secret)
+		if want == nil {
+			assert.Equal(t, secret, got)
+		}
+		assert.Equal(t, body, r.Body, "the body is left in place")
+		rest, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(rest), "and rewound")
+	}
+}
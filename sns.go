@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagSNSTopicARN = kingpin.
+			Flag("sns-topic-arn", "topic for --sink sns or --output sns, like arn:aws:sns:us-east-1:123456789012:slack").
+			Envar("SNS_TOPIC_ARN").String()
+	flagSNSEndpoint = kingpin.
+			Flag("sns-endpoint", "sns api endpoint, for local stacks").
+			Envar("SNS_ENDPOINT").URL()
+)
+
+var metricSNSDeliveries = NewCounterVec("sns_deliveries_total",
+	"deliveries published to sns by outcome", "outcome")
+
+// SNSSink publishes each delivery to an sns topic, the same way SQSSink
+// sends it to a queue
+type SNSSink struct {
+	TopicARN   string
+	Region     string
+	Endpoint   string
+	Creds      awsCredentialsProvider
+	Key        *PartitionKey
+	Attributes []string
+	Client     *http.Client
+}
+
+func openSNSSink() (Sink, error) {
+	if *flagSNSTopicARN == "" {
+		return nil, errors.New("sns needs --sns-topic-arn")
+	}
+	if err := checkMessageAttributes(*flagMessageAttributes); err != nil {
+		return nil, err
+	}
+	s, err := NewSNSSink(*flagSNSTopicARN, newAWSCredentialsProvider(), partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	if *flagSNSEndpoint != nil {
+		s.Endpoint = (*flagSNSEndpoint).String()
+	}
+	s.Attributes = *flagMessageAttributes
+	return s, nil
+}
+
+// NewSNSSink publishes to the topic, in the region of its arn
+func NewSNSSink(topicARN string, creds awsCredentialsProvider, key *PartitionKey) (*SNSSink, error) {
+	// arn:aws:sns:<region>:<account>:<name>
+	parts := strings.Split(topicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return nil, fmt.Errorf("bad sns topic arn %q", topicARN)
+	}
+	return &SNSSink{
+		TopicARN: topicARN,
+		Region:   parts[3],
+		Endpoint: "https://sns." + parts[3] + ".amazonaws.com/",
+		Creds:    creds,
+		Key:      key,
+		Client:   http.DefaultClient,
+	}, nil
+}
+
+// Send calls Publish, which sns only offers over its query api
+func (s *SNSSink) Send(ctx context.Context, d *Delivery) error {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {s.TopicARN},
+		"Message":  {string(body)},
+	}
+	attrs := messageAttributes(d, s.Attributes)
+	for i, name := range sortedAttributes(attrs) {
+		prefix := "MessageAttributes.entry." + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"Name", name)
+		form.Set(prefix+"Value.DataType", "String")
+		form.Set(prefix+"Value.StringValue", attrs[name])
+	}
+	if strings.HasSuffix(s.TopicARN, ".fifo") {
+		form.Set("MessageGroupId", s.Key.Key(d))
+		form.Set("MessageDeduplicationId", messageDedupID(d))
+	}
+
+	if _, err := awsPost(ctx, s.Client, s.Creds, s.Endpoint, s.Region, "sns",
+		"application/x-www-form-urlencoded; charset=utf-8", "", []byte(form.Encode())); err != nil {
+		metricSNSDeliveries.Inc("failed")
+		return err
+	}
+	metricSNSDeliveries.Inc("published")
+	return nil
+}
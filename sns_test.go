@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNSSink(t *testing.T) {
+	var published []url.Values
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/sns/aws4_request")
+		raw, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		form, err := url.ParseQuery(string(raw))
+		require.NoError(t, err)
+		if form.Get("TopicArn") == "arn:aws:sns:us-east-1:123456789012:missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<ErrorResponse><Error><Code>NotFound</Code></Error></ErrorResponse>"))
+			return
+		}
+		published = append(published, form)
+		w.Write([]byte("<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>"))
+	}))
+	defer api.Close()
+
+	key, err := ParsePartitionKey("{team_id}")
+	require.NoError(t, err)
+	creds := awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	s, err := NewSNSSink("arn:aws:sns:us-east-1:123456789012:slack", creds, key)
+	require.NoError(t, err)
+	assert.Equal(t, "https://sns.us-east-1.amazonaws.com/", s.Endpoint)
+	s.Endpoint = api.URL
+	s.Attributes = []string{"type", "team_id"}
+
+	d := kinesisDelivery("C1", "one")
+	require.NoError(t, s.Send(context.Background(), d))
+	require.Len(t, published, 1)
+	form := published[0]
+	assert.Equal(t, "Publish", form.Get("Action"))
+	assert.Equal(t, "team_id", form.Get("MessageAttributes.entry.1.Name"))
+	assert.Equal(t, "T1", form.Get("MessageAttributes.entry.1.Value.StringValue"))
+	assert.Equal(t, "type", form.Get("MessageAttributes.entry.2.Name"))
+	assert.Equal(t, "message", form.Get("MessageAttributes.entry.2.Value.StringValue"))
+	assert.Equal(t, "String", form.Get("MessageAttributes.entry.2.Value.DataType"))
+	assert.Empty(t, form.Get("MessageGroupId"))
+	var got Delivery
+	require.NoError(t, json.Unmarshal([]byte(form.Get("Message")), &got))
+	assert.Equal(t, d.Body, got.Body)
+
+	// fifo topics are grouped and deduplicated
+	s.TopicARN = "arn:aws:sns:us-east-1:123456789012:slack.fifo"
+	require.NoError(t, s.Send(context.Background(), d))
+	require.Len(t, published, 2)
+	assert.Equal(t, "T1", published[1].Get("MessageGroupId"))
+	assert.Equal(t, d.IdempotencyKey(), published[1].Get("MessageDeduplicationId"))
+
+	s.TopicARN = "arn:aws:sns:us-east-1:123456789012:missing"
+	assert.EqualError(t, s.Send(context.Background(), d),
+		"sns returned 404: <ErrorResponse><Error><Code>NotFound</Code></Error></ErrorResponse>")
+
+	_, err = NewSNSSink("slack", creds, key)
+	assert.EqualError(t, err, `bad sns topic arn "slack"`)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagSpoolDir = kingpin.
+	Flag("spool-dir", "directory --sink spool writes a json file per delivery into").
+	Envar("SPOOL_DIR").String()
+
+var metricSpooled = NewCounterVec("spool_deliveries_total",
+	"deliveries written to the spool directory by outcome", "outcome")
+
+// spoolUnsafe is anything that should not end up in a file name
+var spoolUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// SpoolSink writes each delivery as a json file into Dir, for another
+// process to pick up. Files are written into Dir/tmp then renamed into
+// place, so anything matching Dir/*.json is complete. Names sort in the
+// order deliveries were received.
+type SpoolSink struct {
+	Dir string
+}
+
+func openSpoolSink() (Sink, error) {
+	if *flagSpoolDir == "" {
+		return nil, errors.New("--sink spool needs --spool-dir")
+	}
+	return OpenSpoolSink(*flagSpoolDir)
+}
+
+func OpenSpoolSink(dir string) (*SpoolSink, error) {
+	// tmp has to be on the same filesystem for the rename to be atomic
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0700); err != nil {
+		return nil, err
+	}
+	return &SpoolSink{Dir: dir}, nil
+}
+
+func (s *SpoolSink) Send(ctx context.Context, d *Delivery) error {
+	err := s.write(d)
+	if err != nil {
+		metricSpooled.Inc("failed")
+		return err
+	}
+	metricSpooled.Inc("written")
+	return nil
+}
+
+func (s *SpoolSink) write(d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	name := d.ReceivedAt.UTC().Format("20060102T150405.000000000Z") + "-" +
+		spoolUnsafe.ReplaceAllString(d.IdempotencyKey(), "_") + ".json"
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.Dir, "tmp"), name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// the picker may be on the far side of a crash, so only rename in what
+	// is on disk
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name))
+}
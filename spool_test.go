@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := OpenSpoolSink(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+
+	received := time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+	event := &Delivery{
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       []byte(`{"type":"event_callback","event_id":"Ev1","event":{"type":"message"}}`),
+		ReceivedAt: received,
+	}
+	command := &Delivery{
+		Header:     http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:       []byte("command=%2Fops&trigger_id=1.2/3"),
+		ReceivedAt: received.Add(time.Millisecond),
+	}
+	require.NoError(t, sink.Send(context.Background(), event))
+	require.NoError(t, sink.Send(context.Background(), command))
+
+	files, err := filepath.Glob(filepath.Join(dir, "out", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "20200901T120000.000000000Z-Ev1.json", filepath.Base(files[0]))
+	assert.Equal(t, "20200901T120000.001000000Z-1.2_3.json", filepath.Base(files[1]))
+
+	raw, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	var got Delivery
+	require.NoError(t, json.Unmarshal(raw, &got))
+	assert.Equal(t, event.Body, got.Body)
+
+	// nothing is left behind half written
+	tmp, err := ioutil.ReadDir(filepath.Join(dir, "out", "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+}
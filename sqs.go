@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagSQSQueueURL = kingpin.
+			Flag("sqs-queue-url", "queue for --sink sqs or --output sqs, like https://sqs.us-east-1.amazonaws.com/123456789012/slack").
+			Envar("SQS_QUEUE_URL").URL()
+	flagMessageAttributes = kingpin.
+				Flag("message-attribute", "payload field sent as a message attribute by the sqs and sns sinks, from the same fields as --partition-key, repeatable").
+				Envar("MESSAGE_ATTRIBUTES").Default("type", "team_id").Strings()
+)
+
+var metricSQSDeliveries = NewCounterVec("sqs_deliveries_total",
+	"deliveries sent to sqs by outcome", "outcome")
+
+// messageAttributes are the payload fields picked by --message-attribute,
+// leaving out empty ones, which sqs and sns refuse
+func messageAttributes(d *Delivery, fields []string) map[string]string {
+	p, err := d.Payload(PayloadParserFunc(ParseSlackPayload))
+	if err != nil {
+		return nil
+	}
+	attrs := map[string]string{}
+	for _, field := range fields {
+		if value := partitionFields[field](p); value != "" {
+			attrs[field] = value
+		}
+	}
+	return attrs
+}
+
+func checkMessageAttributes(fields []string) error {
+	for _, field := range fields {
+		if _, ok := partitionFields[field]; !ok {
+			return fmt.Errorf("unknown message attribute %q", field)
+		}
+	}
+	return nil
+}
+
+// messageDedupID is the idempotency key of d, hashed if it is longer than
+// fifo queues and topics take
+func messageDedupID(d *Delivery) string {
+	id := d.IdempotencyKey()
+	if len(id) > 128 {
+		sum := sha256.Sum256([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+	return id
+}
+
+// SQSSink sends each delivery to an sqs queue as the json encoded
+// delivery, with the payload fields from --message-attribute as string
+// attributes. Fifo queues get --partition-key as the message group, so
+// each group stays in order, and are deduplicated by idempotency key.
+type SQSSink struct {
+	QueueURL   string
+	Region     string
+	Endpoint   string
+	Creds      awsCredentialsProvider
+	Key        *PartitionKey
+	Attributes []string
+	Client     *http.Client
+}
+
+func openSQSSink() (Sink, error) {
+	if *flagSQSQueueURL == nil {
+		return nil, errors.New("sqs needs --sqs-queue-url")
+	}
+	if err := checkMessageAttributes(*flagMessageAttributes); err != nil {
+		return nil, err
+	}
+	s, err := NewSQSSink(*flagSQSQueueURL, newAWSCredentialsProvider(), partitionKey)
+	if err != nil {
+		return nil, err
+	}
+	s.Attributes = *flagMessageAttributes
+	return s, nil
+}
+
+// NewSQSSink sends to queue, at the endpoint and region the queue url
+// is on
+func NewSQSSink(queue *url.URL, creds awsCredentialsProvider, key *PartitionKey) (*SQSSink, error) {
+	region := awsRegion()
+	// sqs.<region>.amazonaws.com, other hosts are local stacks
+	if parts := strings.Split(queue.Hostname(), "."); len(parts) == 4 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no region in %s, set AWS_REGION", queue.Host)
+	}
+	return &SQSSink{
+		QueueURL: queue.String(),
+		Region:   region,
+		Endpoint: (&url.URL{Scheme: queue.Scheme, Host: queue.Host, Path: "/"}).String(),
+		Creds:    creds,
+		Key:      key,
+		Client:   http.DefaultClient,
+	}, nil
+}
+
+type sqsAttribute struct {
+	DataType    string `json:"DataType"`
+	StringValue string `json:"StringValue"`
+}
+
+func (s *SQSSink) Send(ctx context.Context, d *Delivery) error {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	in := struct {
+		QueueURL               string                  `json:"QueueUrl"`
+		MessageBody            string                  `json:"MessageBody"`
+		MessageAttributes      map[string]sqsAttribute `json:"MessageAttributes,omitempty"`
+		MessageGroupID         string                  `json:"MessageGroupId,omitempty"`
+		MessageDeduplicationID string                  `json:"MessageDeduplicationId,omitempty"`
+	}{QueueURL: s.QueueURL, MessageBody: string(body)}
+	attrs := messageAttributes(d, s.Attributes)
+	if len(attrs) > 0 {
+		in.MessageAttributes = map[string]sqsAttribute{}
+		for name, value := range attrs {
+			in.MessageAttributes[name] = sqsAttribute{"String", value}
+		}
+	}
+	if strings.HasSuffix(s.QueueURL, ".fifo") {
+		in.MessageGroupID = s.Key.Key(d)
+		in.MessageDeduplicationID = messageDedupID(d)
+	}
+
+	var out struct {
+		MessageID string `json:"MessageId"`
+	}
+	if err := awsJSONCall(ctx, s.Client, s.Creds, s.Endpoint, s.Region, "sqs",
+		"application/x-amz-json-1.0", "AmazonSQS.SendMessage", in, &out); err != nil {
+		metricSQSDeliveries.Inc("failed")
+		return err
+	}
+	metricSQSDeliveries.Inc("sent")
+	return nil
+}
+
+// sortedAttributes are the names in attrs, so requests are the same each
+// time
+func sortedAttributes(attrs map[string]string) []string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
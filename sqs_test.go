@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQSSink(t *testing.T) {
+	type sendMessage struct {
+		QueueURL               string `json:"QueueUrl"`
+		MessageBody            string
+		MessageAttributes      map[string]sqsAttribute
+		MessageGroupID         string `json:"MessageGroupId"`
+		MessageDeduplicationID string `json:"MessageDeduplicationId"`
+	}
+	var sent []sendMessage
+	fail := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "AmazonSQS.SendMessage", r.Header.Get("X-Amz-Target"))
+		assert.Equal(t, "application/x-amz-json-1.0", r.Header.Get("Content-Type"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/sqs/aws4_request")
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"no queue"}`))
+			return
+		}
+		var m sendMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&m))
+		sent = append(sent, m)
+		w.Write([]byte(`{"MessageId":"1"}`))
+	}))
+	defer api.Close()
+
+	key, err := ParsePartitionKey("{team_id}/{channel_id}")
+	require.NoError(t, err)
+	creds := awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	queue, err := url.Parse("https://sqs.eu-west-1.amazonaws.com/123456789012/slack.fifo")
+	require.NoError(t, err)
+	s, err := NewSQSSink(queue, creds, key)
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", s.Region)
+	assert.Equal(t, "https://sqs.eu-west-1.amazonaws.com/", s.Endpoint)
+	s.Endpoint = api.URL
+	s.Attributes = []string{"type", "team_id", "user_id"}
+
+	d := kinesisDelivery("C1", "one")
+	require.NoError(t, s.Send(context.Background(), d))
+	require.Len(t, sent, 1)
+	assert.Equal(t, queue.String(), sent[0].QueueURL)
+	assert.Equal(t, map[string]sqsAttribute{
+		"type":    {"String", "message"},
+		"team_id": {"String", "T1"},
+	}, sent[0].MessageAttributes)
+	assert.Equal(t, "T1/C1", sent[0].MessageGroupID)
+	assert.Equal(t, d.IdempotencyKey(), sent[0].MessageDeduplicationID)
+	var got Delivery
+	require.NoError(t, json.Unmarshal([]byte(sent[0].MessageBody), &got))
+	assert.Equal(t, d.Body, got.Body)
+
+	fail = true
+	err = s.Send(context.Background(), d)
+	assert.EqualError(t, err, "sqs returned 400: com.amazonaws.sqs#QueueDoesNotExist: no queue")
+}
+
+func TestNewSQSSinkRegion(t *testing.T) {
+	defer os.Setenv("AWS_REGION", os.Getenv("AWS_REGION"))
+	defer os.Setenv("AWS_DEFAULT_REGION", os.Getenv("AWS_DEFAULT_REGION"))
+	os.Setenv("AWS_REGION", "")
+	os.Setenv("AWS_DEFAULT_REGION", "")
+	local, err := url.Parse("http://localhost:4566/000000000000/slack")
+	require.NoError(t, err)
+	_, err = NewSQSSink(local, awsCredentials{}, nil)
+	assert.EqualError(t, err, "no region in localhost:4566, set AWS_REGION")
+
+	os.Setenv("AWS_REGION", "us-west-2")
+	s, err := NewSQSSink(local, awsCredentials{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", s.Region)
+	assert.Equal(t, "http://localhost:4566/", s.Endpoint)
+}
+
+func TestCheckMessageAttributes(t *testing.T) {
+	assert.NoError(t, checkMessageAttributes([]string{"type", "team_id", "channel_id"}))
+	assert.EqualError(t, checkMessageAttributes([]string{"team"}), `unknown message attribute "team"`)
+}
+
+func TestMessageDedupID(t *testing.T) {
+	d := &Delivery{Header: http.Header{HeaderBodySHA256: {strings.Repeat("x", 200)}}}
+	assert.Len(t, messageDedupID(d), 64)
+	d = kinesisDelivery("C1", "one")
+	assert.Equal(t, d.IdempotencyKey(), messageDedupID(d))
+}
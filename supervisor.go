@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var flagWorkers = kingpin.
+	Flag("workers", "run this many worker processes sharing the listener, 0 to serve in process. "+
+		"Workers keep their own --retry-history, --capture-failures, usage stats and async ack queue, "+
+		"and only the first serves --admin-listen and --respond-listen. "+
+		"Features that would be split between workers, like rate limits, are refused").
+	Envar("WORKERS").Default("0").Int()
+
+// envWorker is set on worker processes to their index, counting from 1.
+// Workers find the shared listeners as their extra files, from fd 3, in
+// the order of --listen, then --listen-unix.
+const envWorker = "SLACK_PROXY_WORKER"
+
+// workerIndex is 0 outside of worker processes
+func workerIndex() int {
+	i, _ := strconv.Atoi(os.Getenv(envWorker))
+	return i
+}
+
+// primaryProcess is true for the one process that runs the things that
+// must not be duplicated, like backfill and the admin listener
+func primaryProcess() bool {
+	return workerIndex() <= 1
+}
+
+// singleProcessFeatures are the features in use that keep their state in
+// memory, which --workers would split between the workers
+func singleProcessFeatures(config *Config) []string {
+	var features []string
+	if *flagSequence && *flagSequenceStore == "" {
+		features = append(features, "--sequence without --sequence-store")
+	}
+	if *flagSlackReplayCache > 0 {
+		features = append(features, "--slack-replay-cache")
+	}
+	if *flagAnomalyFactor > 0 {
+		features = append(features, "--anomaly-factor")
+	}
+	if len(config.RateLimits) > 0 {
+		features = append(features, "rate_limits")
+	}
+	for _, bs := range config.Schedules {
+		if bs.Rate > 0 {
+			features = append(features, "schedules with a rate")
+			break
+		}
+	}
+	return features
+}
+
+// listenAddrs are the --listen addresses, or :http when neither --listen
+// nor --listen-unix is set
+func listenAddrs() []*net.TCPAddr {
+	if len(*flagListen) > 0 || *flagListenUnix != "" {
+		return *flagListen
+	}
+	return []*net.TCPAddr{{Port: 80}}
+}
+
+// listen opens addrs and the unix socket at unixPath, if set, or picks up
+// the listeners a supervisor passed down
+func listen(addrs []*net.TCPAddr, unixPath string, mode os.FileMode) ([]net.Listener, error) {
+	if workerIndex() == 0 {
+		listeners, err := openListeners(addrs)
+		if err != nil || unixPath == "" {
+			return listeners, err
+		}
+		l, err := openUnixListener(unixPath, mode)
+		if err != nil {
+			for _, each := range listeners {
+				each.Close()
+			}
+			return nil, err
+		}
+		return append(listeners, l), nil
+	}
+
+	n := 0
+	for _, addr := range addrs {
+		if addr != nil {
+			n++
+		}
+	}
+	if unixPath != "" {
+		n++
+	}
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.FileListener(os.NewFile(uintptr(3+i), "listener"))
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// openListeners listens on every addr, closing them all again if any fails
+func openListeners(addrs []*net.TCPAddr) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		l, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			for _, each := range listeners {
+				each.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// openUnixListener listens on a socket at path, replacing one left behind
+// by an earlier run, and gives it mode
+func openUnixListener(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// supervisor keeps worker processes running, restarting any that exit
+type supervisor struct {
+	listeners []*os.File
+	command   func(i int) *exec.Cmd
+	backoff   time.Duration
+
+	mu       sync.Mutex
+	stopping bool
+	workers  map[int]*exec.Cmd
+}
+
+func newSupervisor(listeners []net.Listener) (*supervisor, error) {
+	var files []*os.File
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("can not share a %T with workers", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &supervisor{
+		listeners: files,
+		command: func(i int) *exec.Cmd {
+			cmd := exec.Command(exe, os.Args[1:]...)
+			cmd.Env = append(os.Environ(), envWorker+"="+strconv.Itoa(i))
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			return cmd
+		},
+		backoff: time.Second,
+		workers: map[int]*exec.Cmd{},
+	}, nil
+}
+
+// Run starts n workers and keeps them up until the supervisor is told to
+// stop, which it passes on to the workers.
+func (s *supervisor) Run(n int) {
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.keep(i)
+		}(i)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case sig := <-sigs:
+			// each worker reloads itself
+			if sig == syscall.SIGHUP {
+				s.signal(sig)
+				continue
+			}
+			s.stop(sig)
+			<-done
+		case <-done:
+		}
+		return
+	}
+}
+
+func (s *supervisor) keep(i int) {
+	backoff := s.backoff
+	for {
+		cmd := s.command(i)
+		cmd.ExtraFiles = s.listeners
+
+		s.mu.Lock()
+		if s.stopping {
+			s.mu.Unlock()
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			s.workers[i] = cmd
+		}
+		s.mu.Unlock()
+
+		started := time.Now()
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		s.mu.Lock()
+		delete(s.workers, i)
+		stopping := s.stopping
+		s.mu.Unlock()
+		if stopping {
+			return
+		}
+
+		// a worker that ran for a while gets restarted right away, one that
+		// keeps crashing is backed off
+		if time.Since(started) > time.Minute {
+			backoff = s.backoff
+			log.Printf("worker %d exited: %v, restarting", i, err)
+			continue
+		}
+		log.Printf("worker %d exited: %v, restarting in %s", i, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (s *supervisor) stop(sig os.Signal) {
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+	s.signal(sig)
+}
+
+// signal passes sig on to every running worker
+func (s *supervisor) signal(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cmd := range s.workers {
+		cmd.Process.Signal(sig)
+	}
+}
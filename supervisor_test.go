@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWorkerProcess is not a real test, it is the worker the supervisor
+// test starts
+func TestWorkerProcess(t *testing.T) {
+	if os.Getenv("GO_TEST_WORKER") == "" {
+		t.Skip("only run as a worker")
+	}
+	// the addresses only count the listeners passed down
+	listeners, err := listen([]*net.TCPAddr{{}}, "unix", 0)
+	require.NoError(t, err)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crash" {
+			os.Exit(1)
+		}
+		w.Write([]byte(strconv.Itoa(workerIndex())))
+	})
+	go http.Serve(listeners[1], h)
+	http.Serve(listeners[0], h)
+}
+
+func TestSupervisor(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	dir, err := ioutil.TempDir("", "supervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "proxy.sock")
+	second, err := openUnixListener(sock, 0600)
+	require.NoError(t, err)
+	defer second.Close()
+
+	s, err := newSupervisor([]net.Listener{l, second})
+	require.NoError(t, err)
+	s.backoff = 10 * time.Millisecond
+	s.command = func(i int) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWorkerProcess$")
+		cmd.Env = append(os.Environ(), "GO_TEST_WORKER=1", envWorker+"="+strconv.Itoa(i))
+		return cmd
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run(2)
+		close(done)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   time.Second,
+	}
+	url := "http://" + l.Addr().String()
+	// waitForWorkers polls until every worker has answered
+	waitForWorkers := func() {
+		seen := map[string]bool{}
+		deadline := time.Now().Add(10 * time.Second)
+		for len(seen) < 2 && time.Now().Before(deadline) {
+			resp, err := client.Get(url)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			seen[string(body)] = true
+		}
+		assert.Equal(t, map[string]bool{"1": true, "2": true}, seen)
+	}
+
+	waitForWorkers()
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}, Timeout: time.Second}
+	resp, err := unixClient.Get("http://unix/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	client.Get(url + "/crash")
+	time.Sleep(50 * time.Millisecond)
+	waitForWorkers()
+
+	s.stop(os.Interrupt)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	for name, tc := range testdataOpenListeners {
+		t.Run(name, func(t *testing.T) {
+			listeners, err := openListeners(tc.in)
+			var got []string
+			for _, l := range listeners {
+				got = append(got, l.Addr().String())
+				l.Close()
+			}
+			if tc.err != "" {
+				if name == "restricted port" && os.Geteuid() == 0 {
+					t.Skip("root can bind low ports")
+				}
+				// the wording after bind differs by platform
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), strings.Split(tc.err, " bind:")[0])
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.out, got)
+		})
+	}
+}
+
+func TestOpenUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	l, err := openUnixListener(path, 0660)
+	require.NoError(t, err)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	// a socket left behind by a crash is replaced
+	l, err = openUnixListener(path, 0600)
+	require.NoError(t, err)
+	l.Close()
+
+	// anything else in the way is not
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	_, err = openUnixListener(path, 0600)
+	assert.Error(t, err)
+}
+
+func TestSingleProcessFeatures(t *testing.T) {
+	defer func(sequence bool, replay int, factor float64) {
+		*flagSequence, *flagSlackReplayCache, *flagAnomalyFactor = sequence, replay, factor
+	}(*flagSequence, *flagSlackReplayCache, *flagAnomalyFactor)
+	*flagSequence, *flagSlackReplayCache, *flagAnomalyFactor = false, 0, 0
+
+	assert.Empty(t, singleProcessFeatures(&Config{
+		Schedules: []BackendSchedule{{Backend: "analytics", Window: &CronWindow{}}},
+	}))
+
+	*flagSequence, *flagSlackReplayCache, *flagAnomalyFactor = true, 100, 3
+	assert.Equal(t, []string{
+		"--sequence without --sequence-store", "--slack-replay-cache", "--anomaly-factor",
+		"rate_limits", "schedules with a rate",
+	}, singleProcessFeatures(&Config{
+		RateLimits: []RateLimitConfig{{Rate: 1}},
+		Schedules:  []BackendSchedule{{Backend: "analytics", Rate: 5}},
+	}))
+
+	// a reload can not bring them in under --workers either
+	defer func(old int) { *flagWorkers = old }(*flagWorkers)
+	*flagWorkers = 2
+	err := newConfigReloader("").apply(&Config{})
+	assert.EqualError(t, err, "--sequence without --sequence-store, --slack-replay-cache, --anomaly-factor can not be used with --workers")
+}
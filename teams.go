@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var metricTeamMismatches = NewCounterVec("team_mismatches_total",
+	"requests turned away for a team_id other than the team their path belongs to")
+
+// TeamConfig is one slack workspace's own signing secret and backend, for
+// running an app per workspace behind one proxy.
+type TeamConfig struct {
+	// Secret checks the team's requests in place of --slack-token
+	Secret string `json:"secret"`
+	// Backend gets the team's requests, unless a route sends them elsewhere
+	Backend string `json:"backend"`
+	// Path picks the team by request path rather than by the team_id in
+	// the payload, for apps each given their own request url
+	Path string `json:"path"`
+}
+
+func (tc TeamConfig) validate() error {
+	if tc.Secret == "" && tc.Backend == "" {
+		return fmt.Errorf("needs a secret or a backend")
+	}
+	if tc.Backend != "" {
+		target, err := url.Parse(tc.Backend)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("bad backend %q", tc.Backend)
+		}
+	}
+	if tc.Path != "" && !strings.HasPrefix(tc.Path, "/") {
+		return fmt.Errorf("path %q does not start with /", tc.Path)
+	}
+	return nil
+}
+
+// teamSecrets is true when some team has its own secret
+func teamSecrets(config *Config) bool {
+	for _, tc := range config.Teams {
+		if tc.Secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// TeamVerifyHandler checks each request against the secret of the team it
+// claims to be from, going by its path or else the team_id in the payload,
+// before it is verified. The signature has to match that team's secret, so
+// the claim can not be forged. Requests from teams without a secret go to
+// fallback, which checks them against the usual secrets.
+func TeamVerifyHandler(fallback http.Handler, teams map[string]TeamConfig, verify func(secret string) http.Handler) http.Handler {
+	verifiers := map[string]http.Handler{}
+	var paths []PathRoute
+	for team, tc := range teams {
+		if tc.Secret == "" {
+			continue
+		}
+		verifiers[team] = verify(tc.Secret)
+		if tc.Path != "" {
+			paths = append(paths, PathRoute{Prefix: tc.Path, Handler: teamPathHandler(team, verifiers[team])})
+		}
+	}
+	// the longest path wins, like --uri-route
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i].Prefix) > len(paths[j].Prefix) })
+
+	byPayload := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload)); err == nil {
+			if h, ok := verifiers[p.TeamID]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
+	if len(paths) == 0 {
+		return byPayload
+	}
+	return PathRouteHandler(byPayload, paths...)
+}
+
+// teamPathHandler turns away requests on a team's path that carry another
+// team's id, which could otherwise route them to that team's backend
+func teamPathHandler(team string, child http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, err := RequestPayload(r, PayloadParserFunc(ParseSlackPayload)); err == nil && p.TeamID != "" && p.TeamID != team {
+			metricTeamMismatches.Inc()
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		child.ServeHTTP(w, r)
+	})
+}
+
+// teamRoutes send each team with a backend to it, by the team_id of the
+// verified payload
+func teamRoutes(teams map[string]TeamConfig) []Route {
+	names := make([]string, 0, len(teams))
+	for team, tc := range teams {
+		if tc.Backend != "" {
+			names = append(names, team)
+		}
+	}
+	sort.Strings(names)
+
+	routes := make([]Route, len(names))
+	for i, team := range names {
+		team := team
+		// validated on load
+		target, _ := url.Parse(teams[team].Backend)
+		routes[i] = Route{
+			Name:    "team " + team,
+			Match:   func(r *http.Request, p *Payload) bool { return p.TeamID == team },
+			Handler: newBackendProxy(target),
+		}
+	}
+	return routes
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeamVerifyHandler(t *testing.T) {
+	teams := map[string]TeamConfig{
+		"T1": {Secret: "one"},
+		"T2": {Secret: "two", Path: "/slack/two"},
+		"T3": {Backend: "http://three"},
+	}
+	verify := func(secrets ...string) http.Handler {
+		return (&SlackVerifier{Secrets: secrets, Expire: time.Minute}).Handler(StatusHandler(http.StatusOK, "ok"))
+	}
+	h := TeamVerifyHandler(verify("shared"), teams, func(secret string) http.Handler { return verify(secret) })
+
+	for name, tc := range map[string]struct {
+		path, team, secret string
+		code               int
+	}{
+		"own secret":            {"/slack/events", "T1", "one", http.StatusOK},
+		"shared secret":         {"/slack/events", "T1", "shared", http.StatusUnauthorized},
+		"another team's secret": {"/slack/events", "T1", "two", http.StatusUnauthorized},
+		"by path":               {"/slack/two", "", "two", http.StatusOK},
+		"by path, same team":    {"/slack/two/events", "T2", "two", http.StatusOK},
+		"by path, other team":   {"/slack/two", "T1", "two", http.StatusForbidden},
+		"team without secret":   {"/slack/events", "T3", "shared", http.StatusOK},
+		"unknown team":          {"/slack/events", "T9", "shared", http.StatusOK},
+		"unknown team forged":   {"/slack/events", "T9", "one", http.StatusUnauthorized},
+	} {
+		body := `{"type":"event_callback","team_id":"` + tc.team + `","event":{"type":"message"}}`
+		r := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		SignSlackRequest(r, tc.secret, time.Now(), []byte(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tc.code, w.Code, name)
+	}
+}
+
+func TestTeamRoutes(t *testing.T) {
+	one := namedBackend(t, "one")
+	defer one.Close()
+	fallback := namedBackend(t, "default")
+	defer fallback.Close()
+	target, err := url.Parse(fallback.URL)
+	require.NoError(t, err)
+
+	routes := teamRoutes(map[string]TeamConfig{
+		"T1": {Secret: "one", Backend: one.URL},
+		"T2": {Secret: "two"},
+	})
+	require.Len(t, routes, 1)
+	assert.Equal(t, "team T1", routes[0].Name)
+	h := RouteHandler(newBackendProxy(target), PayloadParserFunc(ParseSlackPayload), routes...)
+
+	for team, want := range map[string]string{"T1": "one", "T2": "default"} {
+		r := httptest.NewRequest(http.MethodPost, "/slack/commands",
+			strings.NewReader("command=%2Fops&team_id="+team))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, want, w.Body.String(), team)
+	}
+}
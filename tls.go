@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagTLSCert = kingpin.
+			Flag("tls-cert", "pem certificate chain to serve https with, reread as it changes").
+			Envar("TLS_CERT").String()
+	flagTLSKey = kingpin.
+			Flag("tls-key", "pem private key for --tls-cert").
+			Envar("TLS_KEY").String()
+	flagTLSInterval = kingpin.
+			Flag("tls-interval", "how often --tls-cert and --tls-key are checked for changes, must be above 0").
+			Envar("TLS_INTERVAL").Default("1m").Duration()
+	flagTLSClientCA = kingpin.
+			Flag("tls-client-ca", "pem bundle of CAs client certificates must be signed by, requiring one on every https request").
+			Envar("TLS_CLIENT_CA").String()
+	flagTLSClientCAExempt = kingpin.
+				Flag("tls-client-ca-exempt", "path prefix that needs no client certificate, like the one slack posts to, repeatable").
+				Envar("TLS_CLIENT_CA_EXEMPT").Strings()
+)
+
+var metricClientCertRejections = NewCounterVec("tls_client_cert_rejections_total",
+	"https requests turned away for having no verified client certificate")
+
+var metricTLSReloads = NewCounterVec("tls_cert_reloads_total",
+	"times the tls keypair was read again at runtime, by result", "result")
+
+// tlsRefresh has the keypair read again right away
+var tlsRefresh = make(chan struct{}, 1)
+
+// certReloader serves a keypair from disk, swapping in a new one when the
+// files change
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	raw  []byte
+}
+
+// newCertReloader loads the keypair, failing if it can not be used
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the keypair again, and reports if it changed. A pair that does
+// not load leaves the current one in place.
+func (c *certReloader) load() (bool, error) {
+	certPEM, err := ioutil.ReadFile(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	raw := append(append([]byte{}, certPEM...), keyPEM...)
+	c.mu.RLock()
+	same := bytes.Equal(raw, c.raw)
+	c.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.raw = &cert, raw
+	return true, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.GetCertificate(nil)
+}
+
+// watch reloads the keypair every interval, or when refresh fires. Like the
+// secret files the contents are compared rather than the mtime, as
+// kubernetes swaps secret volumes in with a symlink, and cert-manager
+// writes the cert and key separately.
+func (c *certReloader) watch(interval time.Duration, refresh <-chan struct{}) {
+	failing := false
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-refresh:
+			timer.Stop()
+		}
+
+		changed, err := c.load()
+		if err != nil {
+			metricTLSReloads.Inc("failed")
+			if !failing {
+				log.Printf("loading tls keypair %s: %v, keeping current keypair", c.certFile, err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		if changed {
+			metricTLSReloads.Inc("changed")
+			log.Printf("reloaded tls keypair %s", c.certFile)
+		}
+	}
+}
+
+// tlsConfig serves the keypair from certs, over TLS 1.2 or later. With
+// clientCAs, client certificates are verified against them. They are
+// only required in the handshake without exempt paths, otherwise
+// ClientCertHandler checks them per request.
+func tlsConfig(certs *certReloader, clientCAs *x509.CertPool, exempt bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if exempt {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if *flagFIPS {
+		if err := checkFIPSTLS(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// listenTLS sets up --tls-cert and --tls-key, or a certificate from
+// --acme-domain, or returns nil when neither is set
+func listenTLS() (*tls.Config, error) {
+	issuer, err := acmeFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	certFile, keyFile := *flagTLSCert, *flagTLSKey
+	if issuer != nil {
+		certFile, keyFile = issuer.certFile(), issuer.keyFile()
+		go issuer.renew(12*time.Hour, tlsRefresh)
+	}
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("--tls-cert and --tls-key have to be used together")
+	}
+	if *flagTLSInterval <= 0 {
+		return nil, errors.New("--tls-interval must be above 0 to watch --tls-cert")
+	}
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go certs.watch(*flagTLSInterval, tlsRefresh)
+
+	var clientCAs *x509.CertPool
+	if *flagTLSClientCA != "" {
+		raw, err := ioutil.ReadFile(*flagTLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("%s holds no pem certificates", *flagTLSClientCA)
+		}
+	}
+	return tlsConfig(certs, clientCAs, len(*flagTLSClientCAExempt) > 0)
+}
+
+// ClientCertHandler turns away requests without a verified client
+// certificate, other than those on a path under one of exempt
+func ClientCertHandler(child http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range exempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				child.ServeHTTP(w, r)
+				return
+			}
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			metricClientCertRejections.Inc()
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		child.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyPair writes a self signed keypair for 127.0.0.1 named cn, good
+// for servers and clients
+func writeKeyPair(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err = newCertReloader(certFile, keyFile)
+	assert.Error(t, err)
+	writeKeyPair(t, certFile, keyFile, "first")
+	certs, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	cfg, err := tlsConfig(certs, nil, false)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: StatusHandler(http.StatusOK, "ok"), TLSConfig: cfg}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	served := func() string {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	changed, err := certs.load()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// a key that does not match keeps the pair in use
+	writeKeyPair(t, certFile, filepath.Join(dir, "other.key"), "mismatched")
+	_, err = certs.load()
+	assert.Error(t, err)
+	assert.Equal(t, "first", served())
+
+	writeKeyPair(t, certFile, keyFile, "second")
+	refresh := make(chan struct{}, 1)
+	go certs.watch(time.Hour, refresh)
+	refresh <- struct{}{}
+	assert.Eventually(t, func() bool { return served() == "second" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestListenTLSInterval(t *testing.T) {
+	defer func(cert, key string, interval time.Duration) {
+		*flagTLSCert, *flagTLSKey, *flagTLSInterval = cert, key, interval
+	}(*flagTLSCert, *flagTLSKey, *flagTLSInterval)
+	*flagTLSCert, *flagTLSKey, *flagTLSInterval = "tls.crt", "tls.key", 0
+
+	// the watch would spin without a wait between checks
+	_, err := listenTLS()
+	assert.EqualError(t, err, "--tls-interval must be above 0 to watch --tls-cert")
+}
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeKeyPair(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "server")
+	writeKeyPair(t, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), "client")
+	writeKeyPair(t, filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"), "other")
+	certs, err := newCertReloader(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+	clientPEM, err := ioutil.ReadFile(filepath.Join(dir, "client.crt"))
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(clientPEM))
+
+	serve := func(exempt ...string) string {
+		cfg, err := tlsConfig(certs, clientCAs, len(exempt) > 0)
+		require.NoError(t, err)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv := &http.Server{Handler: ClientCertHandler(StatusHandler(http.StatusOK, "ok"), exempt...), TLSConfig: cfg}
+		go srv.ServeTLS(l, "", "")
+		t.Cleanup(func() { srv.Close() })
+		return "https://" + l.Addr().String()
+	}
+	get := func(url, client string) (int, error) {
+		cfg := &tls.Config{InsecureSkipVerify: true}
+		if client != "" {
+			pair, err := tls.LoadX509KeyPair(filepath.Join(dir, client+".crt"), filepath.Join(dir, client+".key"))
+			require.NoError(t, err)
+			// sent even when the server does not list its issuer
+			cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &pair, nil }
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(url)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	base := serve("/slack")
+	for _, tc := range []struct {
+		path, client string
+		code         int
+	}{
+		{"/admin", "client", http.StatusOK},
+		{"/admin", "", http.StatusForbidden},
+		{"/slack/events", "", http.StatusOK},
+	} {
+		code, err := get(base+tc.path, tc.client)
+		require.NoError(t, err, tc.path)
+		assert.Equal(t, tc.code, code, "%s with %q", tc.path, tc.client)
+	}
+	// a certificate from elsewhere fails the handshake
+	_, err = get(base+"/admin", "other")
+	assert.Error(t, err)
+
+	// without exemptions the handshake needs a certificate
+	base = serve()
+	_, err = get(base+"/slack/events", "")
+	assert.Error(t, err)
+	code, err := get(base+"/slack/events", "client")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagOTLPEndpoint = kingpin.
+				Flag("otlp-endpoint", "otlp/http collector to export trace spans to, like http://localhost:4318").
+				Envar("OTEL_EXPORTER_OTLP_ENDPOINT").URL()
+	flagOTLPHeaders = kingpin.
+			Flag("otlp-header", "header sent with every export to --otlp-endpoint, like authorization=Bearer abc").
+			Envar("OTLP_HEADER").Strings()
+	flagTraceSample = kingpin.
+			Flag("trace-sample", "fraction of requests traced, unless the caller already decided").
+			Envar("TRACE_SAMPLE").Default("1").Float64()
+	flagTraceService = kingpin.
+				Flag("trace-service-name", "service.name spans are exported under").
+				Envar("OTEL_SERVICE_NAME").Default("slack_events_proxy").String()
+)
+
+var metricTraceSpans = NewCounterVec("trace_spans_total",
+	"spans exported to --otlp-endpoint, by outcome", "outcome")
+
+// tracer is set up in main when --otlp-endpoint is set
+var tracer *Tracer
+
+// HeaderTraceparent carries the w3c trace context
+const HeaderTraceparent = "Traceparent"
+
+// SpanKind is the otlp span kind
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// spans waiting to be exported before new ones are dropped, and how many go
+// in one export
+const (
+	traceQueue = 4096
+	traceBatch = 512
+)
+
+// spanContext is what is passed on to child spans, and to the backend
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// parseTraceparent reads a header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Span is one timed step in handling a request
+type Span struct {
+	Context spanContext
+	Parent  [8]byte
+	Name    string
+	Kind    SpanKind
+	Start   time.Time
+	End     time.Time
+	Attrs   map[string]interface{}
+	Failed  bool
+
+	decision *traceDecision
+}
+
+type spanContextKey struct{}
+
+// Tracer starts spans, handing sampled ones to Export once they end.
+type Tracer struct {
+	Sample float64
+	Export func(*Span)
+	// Propagation lists the header formats traces travel in
+	Propagation []string
+}
+
+// start begins a span under the one in ctx. Without one, a server span
+// continues the caller's trace from remote, and anything else starts a new
+// trace.
+func (t *Tracer) start(ctx context.Context, name string, kind SpanKind, remote http.Header) (context.Context, *Span) {
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), Attrs: map[string]interface{}{}}
+	parent, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if !ok && kind == SpanKindServer {
+		parent, ok = t.extract(remote)
+	}
+	if ok {
+		s.Context.TraceID, s.Context.Sampled, s.Parent = parent.TraceID, parent.Sampled, parent.SpanID
+		if d, ok := ctx.Value(traceDecisionKey{}).(*traceDecision); ok {
+			d.mu.Lock()
+			s.decision = d
+			if d.decided {
+				s.Context.Sampled = d.sampled
+			}
+			d.mu.Unlock()
+		}
+	} else {
+		// traces started here wait for SampleHandler to decide on the event
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = t.sample(s.Context.TraceID)
+		s.decision = &traceDecision{root: s, sampled: s.Context.Sampled}
+		ctx = context.WithValue(ctx, traceDecisionKey{}, s.decision)
+	}
+	rand.Read(s.Context.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s.Context), s
+}
+
+// sample decides on the trace id, so every process agrees on a trace
+func (t *Tracer) sample(id [16]byte) bool {
+	return sampled(binary.BigEndian.Uint64(id[8:]), t.Sample)
+}
+
+// decide settles a trace started here, exporting the spans it held if it is
+// sampled. Only the first decision counts.
+func (t *Tracer) decide(d *traceDecision, sampled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t.settle(d, sampled)
+}
+
+// settle is called with d.mu held
+func (t *Tracer) settle(d *traceDecision, sampled bool) {
+	if d.decided {
+		return
+	}
+	d.decided, d.sampled = true, sampled
+	for _, s := range d.held {
+		t.export(s, sampled)
+	}
+	d.held = nil
+}
+
+func (t *Tracer) end(s *Span) {
+	s.End = time.Now()
+	d := s.decision
+	if d == nil {
+		t.export(s, s.Context.Sampled)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.decided:
+	case d.root == s:
+		// the event was never found, so the trace id decides
+		t.settle(d, d.sampled)
+	default:
+		d.held = append(d.held, s)
+		return
+	}
+	t.export(s, d.sampled)
+}
+
+func (t *Tracer) export(s *Span, sampled bool) {
+	if sampled && t.Export != nil {
+		s.Context.Sampled = true
+		t.Export(s)
+	}
+}
+
+// TraceHandler times child as a span named name, when t is set. A server
+// span picks up the caller's traceparent, and a client span sends its own
+// on so the backend's trace continues from it.
+func TraceHandler(child http.Handler, t *Tracer, name string, kind SpanKind) http.Handler {
+	if t == nil {
+		return child
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := t.start(r.Context(), name, kind, r.Header)
+		r = r.WithContext(ctx)
+		if kind == SpanKindServer {
+			span.Attrs["http.method"] = r.Method
+			span.Attrs["http.target"] = r.RequestURI
+		}
+		if kind == SpanKindClient {
+			// cloned so sinks and queues never keep this span's headers,
+			// once the body has been read for baggage
+			baggage := t.baggage(r)
+			r = r.Clone(ctx)
+			t.inject(r, span.Context, baggage)
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		child.ServeHTTP(sw, r)
+		status := sw.Status()
+		span.Attrs["http.status_code"] = status
+		span.Failed = status >= 500
+		t.end(span)
+	})
+}
+
+var (
+	metricRequestDuration = NewHistogramVec("request_duration_seconds",
+		"time to answer slack requests", latencyBuckets)
+	metricBackendDuration = NewHistogramVec("backend_duration_seconds",
+		"time for the backend to answer forwarded requests", latencyBuckets)
+)
+
+// LatencyHandler observes how long child takes into hist. Inside a sampled
+// trace the observation is kept as an exemplar, linking the dashboard to
+// the trace.
+func LatencyHandler(child http.Handler, hist HistogramVec) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		child.ServeHTTP(w, r)
+		traceID, _ := sampledTraceID(r.Context())
+		hist.ObserveExemplar(time.Since(start).Seconds(), traceID)
+	})
+}
+
+// sampledTraceID is the trace ctx is part of, if that trace is sampled
+func sampledTraceID(ctx context.Context) (string, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if !ok {
+		return "", false
+	}
+	sampled := sc.Sampled
+	if d, ok := ctx.Value(traceDecisionKey{}).(*traceDecision); ok {
+		// undecided traces settle on this once they end
+		d.mu.Lock()
+		sampled = d.sampled
+		d.mu.Unlock()
+	}
+	if !sampled {
+		return "", false
+	}
+	return hex.EncodeToString(sc.TraceID[:]), true
+}
+
+// otlpExporter posts spans to an otlp/http collector in batches, as json.
+// Spans are best effort, and are not retried.
+type otlpExporter struct {
+	url      string
+	header   http.Header
+	service  string
+	interval time.Duration
+	client   *http.Client
+	pending  chan *Span
+}
+
+func newOTLPExporter(u *url.URL, header http.Header, service string, interval time.Duration) *otlpExporter {
+	target := *u
+	if target.Path == "" || target.Path == "/" {
+		target.Path = "/v1/traces"
+	}
+	e := &otlpExporter{
+		url:      target.String(),
+		header:   header,
+		service:  service,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		pending:  make(chan *Span, traceQueue),
+	}
+	go e.run()
+	return e
+}
+
+// parseOTLPHeaders reads --otlp-header values like name=value
+func parseOTLPHeaders(raw []string) (http.Header, error) {
+	header := http.Header{}
+	for _, each := range raw {
+		i := strings.Index(each, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("otlp header %q is not name=value", each)
+		}
+		header.Add(strings.TrimSpace(each[:i]), strings.TrimSpace(each[i+1:]))
+	}
+	return header, nil
+}
+
+func (e *otlpExporter) add(s *Span) {
+	select {
+	case e.pending <- s:
+	default:
+		metricTraceSpans.Inc("dropped")
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	failing := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			metricTraceSpans.Add(float64(len(batch)), "failed")
+			if !failing {
+				log.Printf("exporting spans: %v", err)
+			}
+			failing = true
+		} else {
+			metricTraceSpans.Add(float64(len(batch)), "exported")
+			failing = false
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-e.pending:
+			batch = append(batch, s)
+			if len(batch) >= traceBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (e *otlpExporter) post(batch []*Span) error {
+	body, err := json.Marshal(otlpRequest(e.service, batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// the otlp json encoding, just what is needed to send spans
+
+type otlpAttr struct {
+	Key   string        `json:"key"`
+	Value otlpAttrValue `json:"value"`
+}
+
+type otlpAttrValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttrs(attrs map[string]interface{}) []otlpAttr {
+	var out []otlpAttr
+	for key, value := range attrs {
+		var v otlpAttrValue
+		switch value := value.(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttr{Key: key, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func otlpRequest(service string, batch []*Span) interface{} {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.Attrs),
+		}
+		if s.Parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		if s.Failed {
+			span.Status.Code = 2
+		}
+		spans = append(spans, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{{Key: "service.name", Value: otlpAttrValue{StringValue: &service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "slack_events_proxy", "version": version},
+				"spans": spans,
+			}},
+		}},
+	}
+}
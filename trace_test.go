@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for header, exp := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00":       true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01":       false,
+		"": false,
+	} {
+		sc, ok := parseTraceparent(header)
+		assert.Equal(t, exp, ok, header)
+		if ok && header[:2] == "00" {
+			assert.Equal(t, header, sc.traceparent())
+		}
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	var mu sync.Mutex
+	var spans []*Span
+	tr := &Tracer{Sample: 1, Export: func(s *Span) {
+		mu.Lock()
+		spans = append(spans, s)
+		mu.Unlock()
+	}}
+
+	var sent string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get(HeaderTraceparent)
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+	var h http.Handler = TraceHandler(backend, tr, "reverse_proxy", SpanKindClient)
+	inner := h
+	var seen string
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner.ServeHTTP(w, r)
+		// the client span's header is not left on the request
+		seen = r.Header.Get(HeaderTraceparent)
+	})
+	h = TraceHandler(h, tr, "verify_signature", SpanKindInternal)
+	h = TraceHandler(h, tr, "slack_request", SpanKindServer)
+
+	req := httptest.NewRequest(http.MethodPost, "/slack/events", nil)
+	req.Header.Set(HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", seen)
+
+	// spans end inside out
+	require.Len(t, spans, 3)
+	client, internal, server := spans[0], spans[1], spans[2]
+	assert.Equal(t, "reverse_proxy", client.Name)
+	assert.Equal(t, "verify_signature", internal.Name)
+	assert.Equal(t, "slack_request", server.Name)
+	caller, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	for _, s := range spans {
+		assert.Equal(t, caller.TraceID, s.Context.TraceID)
+		assert.True(t, s.Failed)
+		assert.Equal(t, http.StatusBadGateway, s.Attrs["http.status_code"])
+		assert.False(t, s.End.Before(s.Start))
+	}
+	assert.Equal(t, caller.SpanID, server.Parent)
+	assert.Equal(t, server.Context.SpanID, internal.Parent)
+	assert.Equal(t, internal.Context.SpanID, client.Parent)
+	assert.Equal(t, client.Context.traceparent(), sent)
+	assert.Equal(t, "/slack/events", server.Attrs["http.target"])
+
+	// an unsampled trace is still passed on, but nothing is exported
+	spans = nil
+	tr.Sample = 0
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slack/events", nil))
+	assert.Empty(t, spans)
+	sc, ok := parseTraceparent(sent)
+	require.True(t, ok)
+	assert.False(t, sc.Sampled)
+
+	// without a tracer there is nothing in the way
+	TraceHandler(backend, nil, "reverse_proxy", SpanKindClient).ServeHTTP(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slack/events", nil))
+	assert.Empty(t, sent)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	got := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var req map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &req))
+		got <- req
+	}))
+	defer collector.Close()
+
+	u, err := url.Parse(collector.URL)
+	require.NoError(t, err)
+	header, err := parseOTLPHeaders([]string{"Authorization = Bearer abc"})
+	require.NoError(t, err)
+	_, err = parseOTLPHeaders([]string{"Authorization"})
+	assert.Error(t, err)
+
+	e := newOTLPExporter(u, header, "proxy-test", 10*time.Millisecond)
+	sc, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.add(&Span{
+		Context: sc,
+		Parent:  [8]byte{1},
+		Name:    "reverse_proxy",
+		Kind:    SpanKindClient,
+		Start:   time.Unix(1, 0),
+		End:     time.Unix(2, 0),
+		Attrs:   map[string]interface{}{"http.status_code": 502, "http.method": "POST"},
+		Failed:  true,
+	})
+
+	var req map[string]interface{}
+	select {
+	case req = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export")
+	}
+	raw, err := json.Marshal(req)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resourceSpans":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"proxy-test"}}]},
+		"scopeSpans":[{
+			"scope":{"name":"slack_events_proxy","version":"`+version+`"},
+			"spans":[{
+				"traceId":"4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId":"00f067aa0ba902b7",
+				"parentSpanId":"0100000000000000",
+				"name":"reverse_proxy",
+				"kind":3,
+				"startTimeUnixNano":"1000000000",
+				"endTimeUnixNano":"2000000000",
+				"attributes":[
+					{"key":"http.method","value":{"stringValue":"POST"}},
+					{"key":"http.status_code","value":{"intValue":"502"}}
+				],
+				"status":{"code":2}
+			}]
+		}]
+	}]}`, string(raw))
+}
+
+func TestLatencyHandler(t *testing.T) {
+	hist := NewHistogramVec("test_latency_seconds", "latency of the test", latencyBuckets)
+	tr := &Tracer{Sample: 1}
+	h := TraceHandler(LatencyHandler(StatusHandler(http.StatusOK, "ok"), hist), tr, "slack_request", SpanKindServer)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slack/events", nil))
+	tr.Sample = 0
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/slack/events", nil))
+	assert.Equal(t, uint64(2), hist.Count())
+
+	// only the sampled trace is an exemplar
+	exemplars := 0
+	for _, e := range hist.series[""].exemplars {
+		if e != nil {
+			exemplars++
+			assert.Len(t, e.traceID, 32)
+		}
+	}
+	assert.Equal(t, 1, exemplars)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+// updateKey is the base64 ed25519 public key releases are signed with, set
+// at build time with -ldflags "-X main.updateKey=..."
+var updateKey = ""
+
+var (
+	cmdUpdate = kingpin.Command("update",
+		"replace this binary with a signed github release, for installs without a package manager")
+	flagUpdateRepo = cmdUpdate.Flag("repo", "github repository releases come from").
+			Default("jakdept/slack_events_proxy").String()
+	flagUpdateRelease = cmdUpdate.Flag("release", "release tag to install, the latest if empty").String()
+	flagUpdateKey     = cmdUpdate.Flag("key", "base64 ed25519 key the checksums must be signed with").
+				Default(updateKey).String()
+	flagUpdateSkipSignature = cmdUpdate.Flag("skip-signature", "only check checksums, when no signing key is known").Bool()
+	flagUpdateForce         = cmdUpdate.Flag("force", "install even if already running the release").Bool()
+)
+
+// release assets are named like slack_events_proxy_linux_amd64, next to a
+// checksums.txt in sha256sum format and its base64 detached signature
+const (
+	updateChecksums = "checksums.txt"
+	updateSignature = "checksums.txt.sig"
+	maxUpdateSize   = 256 << 20
+)
+
+// updater installs a github release over Path.
+type updater struct {
+	API     string
+	Repo    string
+	Release string
+	Key     ed25519.PublicKey // nil skips the signature check
+	Path    string
+	Client  *http.Client
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func updateAssetName() string {
+	name := "slack_events_proxy_" + runtime.GOOS + "_" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// update installs the release unless it is current, returning the tag it
+// ended up on.
+func (u *updater) update(current string, force bool) (string, error) {
+	rel, err := u.release()
+	if err != nil {
+		return "", err
+	}
+	if rel.TagName == current && !force {
+		return rel.TagName, nil
+	}
+
+	assets := map[string]string{}
+	for _, a := range rel.Assets {
+		assets[a.Name] = a.URL
+	}
+	name := updateAssetName()
+	for _, want := range []string{name, updateChecksums, updateSignature} {
+		if _, ok := assets[want]; !ok && (want != updateSignature || u.Key != nil) {
+			return "", fmt.Errorf("release %s has no %s", rel.TagName, want)
+		}
+	}
+
+	sums, err := u.download(assets[updateChecksums])
+	if err != nil {
+		return "", err
+	}
+	if u.Key != nil {
+		sig, err := u.download(assets[updateSignature])
+		if err != nil {
+			return "", err
+		}
+		sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil || !ed25519.Verify(u.Key, sums, sig) {
+			return "", fmt.Errorf("release %s: bad signature on %s", rel.TagName, updateChecksums)
+		}
+	}
+	want, err := findChecksum(sums, name)
+	if err != nil {
+		return "", err
+	}
+
+	bin, err := u.download(assets[name])
+	if err != nil {
+		return "", err
+	}
+	got := sha256.Sum256(bin)
+	if hex.EncodeToString(got[:]) != want {
+		return "", fmt.Errorf("release %s: checksum mismatch on %s", rel.TagName, name)
+	}
+	return rel.TagName, replaceBinary(u.Path, bin)
+}
+
+func (u *updater) release() (*githubRelease, error) {
+	target := u.API + "/repos/" + u.Repo + "/releases/latest"
+	if u.Release != "" {
+		target = u.API + "/repos/" + u.Repo + "/releases/tags/" + u.Release
+	}
+	raw, err := u.download(target)
+	if err != nil {
+		return nil, err
+	}
+	var rel githubRelease
+	if err := json.Unmarshal(raw, &rel); err != nil {
+		return nil, fmt.Errorf("parsing release: %v", err)
+	}
+	return &rel, nil
+}
+
+func (u *updater) download(target string) ([]byte, error) {
+	resp, err := u.Client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %d", target, resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxUpdateSize {
+		return nil, fmt.Errorf("fetching %s: too large", target)
+	}
+	return raw, nil
+}
+
+// findChecksum picks the sum for name out of sha256sum output
+func findChecksum(sums []byte, name string) (string, error) {
+	s := bufio.NewScanner(bytes.NewReader(sums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// replaceBinary swaps bin in for path with a rename, so there is never a
+// half written binary in place
+func replaceBinary(path string, bin []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".update")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func runUpdate() error {
+	u := &updater{
+		API:     "https://api.github.com",
+		Repo:    *flagUpdateRepo,
+		Release: *flagUpdateRelease,
+		Client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+	switch {
+	case *flagUpdateKey != "":
+		key, err := base64.StdEncoding.DecodeString(*flagUpdateKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("--key must be a base64 ed25519 public key")
+		}
+		u.Key = ed25519.PublicKey(key)
+	case !*flagUpdateSkipSignature:
+		return errors.New("no signing key, set --key or pass --skip-signature")
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if u.Path, err = filepath.EvalSymlinks(path); err != nil {
+		return err
+	}
+
+	tag, err := u.update(version, *flagUpdateForce)
+	if err != nil {
+		return err
+	}
+	if tag == version && !*flagUpdateForce {
+		log.Printf("already running %s", tag)
+		return nil
+	}
+	log.Printf("updated %s from %s to %s, restart to use it", u.Path, version, tag)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdater(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	bin := []byte("#!/bin/sh\necho new\n")
+	sum := sha256.Sum256(bin)
+	sums := []byte(hex.EncodeToString(sum[:]) + "  " + updateAssetName() + "\n" +
+		"0000  slack_events_proxy_plan9_mips\n")
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/jakdept/slack_events_proxy/releases/latest":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"tag_name": "v1.1.0",
+				"assets": []map[string]string{
+					{"name": updateAssetName(), "browser_download_url": ts.URL + "/bin"},
+					{"name": updateChecksums, "browser_download_url": ts.URL + "/sums"},
+					{"name": updateSignature, "browser_download_url": ts.URL + "/sig"},
+				},
+			})
+		case "/bin":
+			w.Write(bin)
+		case "/sums":
+			w.Write(sums)
+		case "/sig":
+			w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, sums)) + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "update")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "slack_events_proxy")
+
+	for name, tc := range map[string]struct {
+		key     ed25519.PublicKey
+		release string
+		current string
+		err     string
+		updated bool
+	}{
+		"signed":       {key: pub, current: "v1.0.0", updated: true},
+		"no signature": {current: "v1.0.0", updated: true},
+		"current":      {key: pub, current: "v1.1.0"},
+		"wrong key":    {key: otherPub, current: "v1.0.0", err: "release v1.1.0: bad signature on checksums.txt"},
+		"missing":      {key: pub, release: "v9", current: "v1.0.0", err: "returned 404"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(path, []byte("old"), 0755))
+			u := &updater{API: ts.URL, Repo: "jakdept/slack_events_proxy", Release: tc.release,
+				Key: tc.key, Path: path, Client: ts.Client()}
+			_, err := u.update(tc.current, false)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			raw, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			if tc.updated {
+				assert.Equal(t, bin, raw)
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+			} else {
+				assert.Equal(t, "old", string(raw))
+			}
+		})
+	}
+
+	// nothing is left behind in the directory
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestFindChecksum(t *testing.T) {
+	sums := []byte("ABCD  slack_events_proxy_linux_amd64\nef01 *slack_events_proxy_darwin_arm64\n")
+	sum, err := findChecksum(sums, "slack_events_proxy_linux_amd64")
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", sum)
+	sum, err = findChecksum(sums, "slack_events_proxy_darwin_arm64")
+	require.NoError(t, err)
+	assert.Equal(t, "ef01", sum)
+	_, err = findChecksum(sums, "slack_events_proxy_windows_amd64.exe")
+	assert.Error(t, err)
+}
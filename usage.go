@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagUsageExport = kingpin.
+			Flag("usage-export", "file to append per app and team usage summaries to").
+			Envar("USAGE_EXPORT").String()
+	flagUsageFormat = kingpin.
+			Flag("usage-format", "format of the usage export").
+			Envar("USAGE_FORMAT").Default("json").Enum("json", "csv")
+	flagUsageInterval = kingpin.
+				Flag("usage-interval", "how much time each usage summary covers").
+				Envar("USAGE_INTERVAL").Default("1h").Duration()
+)
+
+var (
+	metricUsageEvents = NewCounterVec("usage_events_total",
+		"requests forwarded, by slack app and team", "app", "team")
+	metricUsageBytes = NewCounterVec("usage_bytes_total",
+		"request body bytes forwarded, by slack app and team", "app", "team")
+	metricUsageBackendSeconds = NewCounterVec("usage_backend_seconds_total",
+		"time spent waiting on backends, by slack app and team", "app", "team")
+)
+
+// Usage is what one app in one team cost over a period, for charging a
+// shared proxy back to the teams running each app.
+type Usage struct {
+	App            string  `json:"app"`
+	Team           string  `json:"team"`
+	Events         uint64  `json:"events"`
+	Bytes          uint64  `json:"bytes"`
+	BackendSeconds float64 `json:"backend_seconds"`
+}
+
+type UsagePeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Usage []Usage   `json:"usage"`
+}
+
+type usageTracker struct {
+	mu    sync.Mutex
+	start time.Time
+	usage map[[2]string]*Usage
+}
+
+var usage = newUsageTracker(time.Now())
+
+func newUsageTracker(start time.Time) *usageTracker {
+	return &usageTracker{start: start.UTC(), usage: map[[2]string]*Usage{}}
+}
+
+func (u *usageTracker) record(app, team string, bytes int, backend time.Duration) {
+	metricUsageEvents.Inc(app, team)
+	metricUsageBytes.Add(float64(bytes), app, team)
+	metricUsageBackendSeconds.Add(backend.Seconds(), app, team)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	each, ok := u.usage[[2]string{app, team}]
+	if !ok {
+		each = &Usage{App: app, Team: team}
+		u.usage[[2]string{app, team}] = each
+	}
+	each.Events++
+	each.Bytes += uint64(bytes)
+	each.BackendSeconds += backend.Seconds()
+}
+
+// snapshot is the period so far, which rotate also ends
+func (u *usageTracker) snapshot(now time.Time) UsagePeriod {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.period(now)
+}
+
+func (u *usageTracker) rotate(now time.Time) UsagePeriod {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p := u.period(now)
+	u.start = p.End
+	u.usage = map[[2]string]*Usage{}
+	return p
+}
+
+// period is called with mu held
+func (u *usageTracker) period(now time.Time) UsagePeriod {
+	p := UsagePeriod{Start: u.start, End: now.UTC(), Usage: []Usage{}}
+	for _, each := range u.usage {
+		p.Usage = append(p.Usage, *each)
+	}
+	sort.Slice(p.Usage, func(i, j int) bool {
+		if p.Usage[i].App != p.Usage[j].App {
+			return p.Usage[i].App < p.Usage[j].App
+		}
+		return p.Usage[i].Team < p.Usage[j].Team
+	})
+	return p
+}
+
+// export appends a summary to path every interval
+func (u *usageTracker) export(path, format string, every time.Duration) {
+	for now := range time.Tick(every) {
+		if err := appendUsage(path, format, u.rotate(now)); err != nil {
+			log.Printf("exporting usage: %v", err)
+		}
+	}
+}
+
+func appendUsage(path, format string, p UsagePeriod) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := writeUsage(f, format, p, info.Size() == 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeUsage writes a period as a line of json, or as csv rows with an
+// optional header row
+func writeUsage(w io.Writer, format string, p UsagePeriod, header bool) error {
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(p)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if header {
+			cw.Write([]string{"start", "end", "app", "team", "events", "bytes", "backend_seconds"})
+		}
+		for _, each := range p.Usage {
+			cw.Write([]string{
+				p.Start.Format(time.RFC3339),
+				p.End.Format(time.RFC3339),
+				each.App,
+				each.Team,
+				strconv.FormatUint(each.Events, 10),
+				strconv.FormatUint(each.Bytes, 10),
+				strconv.FormatFloat(each.BackendSeconds, 'f', 3, 64),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown usage format %q", format)
+}
+
+// UsageHandler charges each request to its app and team, along with the
+// time child took to answer it.
+func UsageHandler(child http.Handler, parser PayloadParser, u *usageTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var app, team string
+		if p, err := parser.ParsePayload(r, body); err == nil {
+			app, team = p.AppID, p.TeamID
+		}
+
+		size := len(body)
+		start := time.Now()
+		child.ServeHTTP(w, r)
+		u.record(app, team, size, time.Since(start))
+	})
+}
+
+func UsageStatsHandler(u *usageTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(u.snapshot(time.Now()))
+	})
+}
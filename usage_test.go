@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageHandler(t *testing.T) {
+	start := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	u := newUsageTracker(start)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	})
+	h := UsageHandler(backend, PayloadParserFunc(ParseSlackPayload), u)
+
+	bodies := []string{
+		`{"type":"event_callback","api_app_id":"A1","team_id":"T1","event":{"type":"message"}}`,
+		`{"type":"event_callback","api_app_id":"A1","team_id":"T1","event":{"type":"app_mention"}}`,
+		`{"type":"event_callback","api_app_id":"A2","team_id":"T1","event":{"type":"message"}}`,
+	}
+	a1Bytes := len(bodies[0]) + len(bodies[1])
+	before := metricUsageBytes.Get("A1", "T1")
+	for _, body := range bodies {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	p := u.rotate(start.Add(time.Hour))
+	assert.Equal(t, start, p.Start)
+	assert.Equal(t, start.Add(time.Hour), p.End)
+	require.Len(t, p.Usage, 2)
+	assert.Equal(t, "A1", p.Usage[0].App)
+	assert.Equal(t, uint64(2), p.Usage[0].Events)
+	assert.Equal(t, uint64(a1Bytes), p.Usage[0].Bytes)
+	assert.True(t, p.Usage[0].BackendSeconds >= 0.02)
+	assert.Equal(t, "A2", p.Usage[1].App)
+	assert.Equal(t, before+float64(a1Bytes), metricUsageBytes.Get("A1", "T1"))
+
+	// the next period starts empty
+	assert.Empty(t, u.snapshot(start.Add(2*time.Hour)).Usage)
+}
+
+func TestWriteUsage(t *testing.T) {
+	p := UsagePeriod{
+		Start: time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC),
+		End:   time.Date(2020, 9, 13, 13, 0, 0, 0, time.UTC),
+		Usage: []Usage{{App: "A1", Team: "T1", Events: 2, Bytes: 173, BackendSeconds: 0.0216}},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, writeUsage(&out, "csv", p, true))
+	assert.Equal(t, "start,end,app,team,events,bytes,backend_seconds\n"+
+		"2020-09-13T12:00:00Z,2020-09-13T13:00:00Z,A1,T1,2,173,0.022\n", out.String())
+
+	out.Reset()
+	require.NoError(t, writeUsage(&out, "json", p, true))
+	assert.Equal(t, `{"start":"2020-09-13T12:00:00Z","end":"2020-09-13T13:00:00Z",`+
+		`"usage":[{"app":"A1","team":"T1","events":2,"bytes":173,"backend_seconds":0.0216}]}`+"\n", out.String())
+
+	// csv only gets a header at the top of the file
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.csv")
+	require.NoError(t, appendUsage(path, "csv", p))
+	require.NoError(t, appendUsage(path, "csv", p))
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(raw), "\n"))
+}
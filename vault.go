@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagVaultAddr = kingpin.
+			Flag("vault-addr", "vault server vault:// secret sources are read from").
+			Envar("VAULT_ADDR").String()
+	flagVaultToken = kingpin.
+			Flag("vault-token", "vault token, prefer --vault-token-file or --vault-kubernetes-role").
+			Envar("VAULT_TOKEN").String()
+	flagVaultTokenFile = kingpin.
+				Flag("vault-token-file", "file holding a vault token, like a vault agent sink, reread when it expires").
+				Envar("VAULT_TOKEN_FILE").String()
+	flagVaultKubernetesRole = kingpin.
+				Flag("vault-kubernetes-role", "log in to vault with the pod's service account as this role").
+				Envar("VAULT_KUBERNETES_ROLE").String()
+	flagVaultKubernetesMount = kingpin.
+					Flag("vault-kubernetes-mount", "where vault's kubernetes auth method is mounted").
+					Envar("VAULT_KUBERNETES_MOUNT").Default("kubernetes").String()
+	flagVaultNamespace = kingpin.
+				Flag("vault-namespace", "vault enterprise namespace").
+				Envar("VAULT_NAMESPACE").String()
+	flagVaultCACert = kingpin.
+			Flag("vault-ca-cert", "pem file of CAs to trust for --vault-addr").
+			Envar("VAULT_CACERT").String()
+)
+
+const kubernetesServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultAuth is the auth block vault answers a login or renewal with
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// VaultLogin gets a token for a VaultClient. A zero LeaseDuration has the
+// client look the token up to find out when it expires.
+type VaultLogin func(ctx context.Context, c *VaultClient) (*vaultAuth, error)
+
+// VaultClient reads secrets from vault. Its token is renewed once half of
+// its ttl has passed, and it logs in again once the token can not be renewed.
+type VaultClient struct {
+	Addr      string
+	Namespace string
+	Login     VaultLogin
+	Client    *http.Client
+
+	mu        sync.Mutex
+	token     string
+	renewable bool
+	renewAt   time.Time // zero for tokens that never expire
+}
+
+// VaultSecret is a secret read from vault, with its lease
+type VaultSecret struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+// Fields are the secret's values, unwrapped from the extra layer kv version
+// 2 puts them in.
+func (s *VaultSecret) Fields() map[string]interface{} {
+	data, ok := s.Data["data"].(map[string]interface{})
+	if _, versioned := s.Data["metadata"].(map[string]interface{}); ok && versioned {
+		return data
+	}
+	return s.Data
+}
+
+// Read fetches the secret at path, like secret/data/slack. A token vault
+// no longer accepts is replaced and the read tried once more.
+func (c *VaultClient) Read(ctx context.Context, path string) (*VaultSecret, error) {
+	var secret VaultSecret
+	err := c.call(ctx, http.MethodGet, strings.TrimPrefix(path, "/"), nil, &secret)
+	if ve, ok := err.(*vaultError); ok && ve.Status == http.StatusForbidden {
+		c.mu.Lock()
+		c.token = ""
+		c.mu.Unlock()
+		err = c.call(ctx, http.MethodGet, strings.TrimPrefix(path, "/"), nil, &secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// renewIn is how long until the token is due for renewal, or 0 if it never
+// expires
+func (c *VaultClient) renewIn() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.renewAt.IsZero() {
+		return 0
+	}
+	if d := time.Until(c.renewAt); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+func (c *VaultClient) call(ctx context.Context, method, path string, in, out interface{}) error {
+	token, err := c.currentToken(ctx)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, token, method, path, in, out)
+}
+
+// currentToken logs in or renews the token as needed
+func (c *VaultClient) currentToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.renewAt.IsZero() || time.Now().Before(c.renewAt)) {
+		return c.token, nil
+	}
+
+	if c.token != "" && c.renewable {
+		var resp struct{ Auth vaultAuth }
+		err := c.do(ctx, c.token, http.MethodPost, "auth/token/renew-self", struct{}{}, &resp)
+		// past its max ttl a token can not be renewed, so log in again
+		if err == nil && resp.Auth.LeaseDuration > 0 {
+			c.use(resp.Auth.ClientToken, resp.Auth.Renewable, resp.Auth.LeaseDuration)
+			return c.token, nil
+		}
+	}
+
+	auth, err := c.Login(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("vault login: %v", err)
+	}
+	if auth.LeaseDuration == 0 {
+		var resp struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			}
+		}
+		if err := c.do(ctx, auth.ClientToken, http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+			return "", fmt.Errorf("vault token lookup: %v", err)
+		}
+		auth.LeaseDuration, auth.Renewable = resp.Data.TTL, resp.Data.Renewable
+	}
+	c.use(auth.ClientToken, auth.Renewable, auth.LeaseDuration)
+	return c.token, nil
+}
+
+func (c *VaultClient) use(token string, renewable bool, ttl int) {
+	c.token, c.renewable, c.renewAt = token, renewable, time.Time{}
+	if ttl > 0 {
+		c.renewAt = time.Now().Add(time.Duration(ttl) * time.Second / 2)
+	}
+}
+
+type vaultError struct {
+	Status int
+	Errors []string
+}
+
+func (e *vaultError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault returned %d", e.Status)
+	}
+	return fmt.Sprintf("vault returned %d: %s", e.Status, strings.Join(e.Errors, ", "))
+}
+
+func (c *VaultClient) do(ctx context.Context, token, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Addr, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		ve := &vaultError{Status: resp.StatusCode}
+		json.Unmarshal(raw, ve)
+		return ve
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// VaultTokenLogin uses a fixed token
+func VaultTokenLogin(token string) VaultLogin {
+	return func(ctx context.Context, c *VaultClient) (*vaultAuth, error) {
+		return &vaultAuth{ClientToken: token}, nil
+	}
+}
+
+// VaultTokenFileLogin reads the token from path each time, so whatever
+// keeps the file up to date, like vault agent, is picked up
+func VaultTokenFileLogin(path string) VaultLogin {
+	return func(ctx context.Context, c *VaultClient) (*vaultAuth, error) {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		token := strings.TrimSpace(string(raw))
+		if token == "" {
+			return nil, fmt.Errorf("%s is empty", path)
+		}
+		return &vaultAuth{ClientToken: token}, nil
+	}
+}
+
+// VaultKubernetesLogin logs in with the service account token at jwtPath
+func VaultKubernetesLogin(mount, role, jwtPath string) VaultLogin {
+	return func(ctx context.Context, c *VaultClient) (*vaultAuth, error) {
+		jwt, err := ioutil.ReadFile(jwtPath)
+		if err != nil {
+			return nil, err
+		}
+		in := map[string]string{"role": role, "jwt": strings.TrimSpace(string(jwt))}
+		var resp struct{ Auth *vaultAuth }
+		if err := c.do(ctx, "", http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", in, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Auth == nil || resp.Auth.ClientToken == "" {
+			return nil, errors.New("no token in login response")
+		}
+		return resp.Auth, nil
+	}
+}
+
+var (
+	vaultClientOnce sync.Once
+	vaultClient     *VaultClient
+	vaultClientErr  error
+)
+
+// vaultClientFromFlags is shared by everything read from vault, so there
+// is one token to keep renewed
+func vaultClientFromFlags() (*VaultClient, error) {
+	vaultClientOnce.Do(func() {
+		vaultClient, vaultClientErr = newVaultClientFromFlags()
+	})
+	return vaultClient, vaultClientErr
+}
+
+func newVaultClientFromFlags() (*VaultClient, error) {
+	if *flagVaultAddr == "" {
+		return nil, errors.New("reading from vault needs --vault-addr")
+	}
+	var login VaultLogin
+	switch {
+	case *flagVaultKubernetesRole != "":
+		login = VaultKubernetesLogin(*flagVaultKubernetesMount, *flagVaultKubernetesRole, kubernetesServiceAccountToken)
+	case *flagVaultTokenFile != "":
+		login = VaultTokenFileLogin(*flagVaultTokenFile)
+	case *flagVaultToken != "":
+		login = VaultTokenLogin(*flagVaultToken)
+	default:
+		return nil, errors.New("reading from vault needs --vault-kubernetes-role, --vault-token-file or --vault-token")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *flagVaultCACert != "" {
+		pem, err := ioutil.ReadFile(*flagVaultCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *flagVaultCACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		if *flagFIPS {
+			if err := checkFIPSTLS(transport.TLSClientConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &VaultClient{
+		Addr:      *flagVaultAddr,
+		Namespace: *flagVaultNamespace,
+		Login:     login,
+		Client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// VaultSecretSource reads signing secrets from one field of a vault
+// secret, one per line. Secrets with a lease are read again before it runs
+// out.
+type VaultSecretSource struct {
+	Vault *VaultClient
+	Path  string
+	Field string
+
+	mu           sync.Mutex
+	leaseExpires time.Time
+}
+
+// openVaultSecretSource takes a path with an optional field, like
+// vault://secret/data/slack?field=signing_secret
+func openVaultSecretSource(spec string) (SecretSource, error) {
+	path, query := spec, url.Values{}
+	if i := strings.Index(spec, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(spec[i+1:]); err != nil {
+			return nil, fmt.Errorf("vault %q: %v", spec, err)
+		}
+		path = spec[:i]
+	}
+	if path = strings.Trim(path, "/"); path == "" {
+		return nil, errors.New("vault needs a secret path")
+	}
+	client, err := vaultClientFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	return &VaultSecretSource{Vault: client, Path: path, Field: query.Get("field")}, nil
+}
+
+func (s *VaultSecretSource) Secrets(ctx context.Context) ([]string, error) {
+	secret, err := s.Vault.Read(ctx, s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	s.mu.Lock()
+	s.leaseExpires = time.Time{}
+	if secret.LeaseDuration > 0 {
+		s.leaseExpires = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+	}
+	s.mu.Unlock()
+
+	fields := secret.Fields()
+	field := s.Field
+	if field == "" {
+		if len(fields) != 1 {
+			var names []string
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("%s has fields %s, pick one with field=", s.Path, strings.Join(names, ", "))
+		}
+		for name := range fields {
+			field = name
+		}
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s has no string %q", s.Path, field)
+	}
+	secrets, err := parseSecrets(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return secrets, nil
+}
+
+// refreshIn is when the secret should be read again, a little before its
+// lease runs out or the token is due for renewal
+func (s *VaultSecretSource) refreshIn() time.Duration {
+	s.mu.Lock()
+	lease := time.Duration(0)
+	if !s.leaseExpires.IsZero() {
+		if lease = time.Until(s.leaseExpires) * 9 / 10; lease <= 0 {
+			lease = time.Nanosecond
+		}
+	}
+	s.mu.Unlock()
+	if renew := s.Vault.renewIn(); renew > 0 && (lease == 0 || renew < lease) {
+		return renew
+	}
+	return lease
+}
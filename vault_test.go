@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault answers a kubernetes login, token renewal and kv reads
+type fakeVault struct {
+	mu       sync.Mutex
+	calls    []string
+	tokens   map[string]bool
+	issued   int
+	tokenTTL int
+	secret   map[string]interface{}
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.calls = append(v.calls, r.Method+" "+r.URL.Path)
+
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		var in map[string]string
+		json.NewDecoder(r.Body).Decode(&in)
+		if in["role"] != "slack-proxy" || in["jwt"] != "service-account-jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["invalid role or jwt"]}`))
+			return
+		}
+		v.issued++
+		token := "token-" + strconv.Itoa(v.issued)
+		v.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": token, "lease_duration": v.tokenTTL, "renewable": true,
+		}})
+		return
+	}
+
+	token := r.Header.Get("X-Vault-Token")
+	if !v.tokens[token] {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/auth/token/renew-self":
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": token, "lease_duration": v.tokenTTL, "renewable": true,
+		}})
+	case "/v1/secret/data/slack":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_duration": 0,
+			"data":           map[string]interface{}{"data": v.secret, "metadata": map[string]interface{}{"version": 3}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestVaultSecretSource(t *testing.T) {
+	jwt := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(jwt, []byte("service-account-jwt\n"), 0600))
+
+	fake := &fakeVault{
+		tokens:   map[string]bool{},
+		tokenTTL: 3600,
+		secret:   map[string]interface{}{"signing_secret": "new\nold", "other": "x"},
+	}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	client := &VaultClient{
+		Addr:   ts.URL,
+		Login:  VaultKubernetesLogin("kubernetes", "slack-proxy", jwt),
+		Client: ts.Client(),
+	}
+	src := &VaultSecretSource{Vault: client, Path: "secret/data/slack", Field: "signing_secret"}
+
+	secrets, err := src.Secrets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "old"}, secrets)
+	renew := src.refreshIn()
+	assert.True(t, renew > 29*time.Minute && renew <= 30*time.Minute, "renews at half the ttl, got %s", renew)
+
+	// a token due for renewal is renewed rather than replaced
+	client.renewAt = time.Now().Add(-time.Second)
+	_, err = src.Secrets(context.Background())
+	require.NoError(t, err)
+
+	// a revoked token is replaced by logging in again
+	fake.tokens = map[string]bool{}
+	_, err = src.Secrets(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"POST /v1/auth/kubernetes/login",
+		"GET /v1/secret/data/slack",
+		"POST /v1/auth/token/renew-self",
+		"GET /v1/secret/data/slack",
+		"GET /v1/secret/data/slack",
+		"POST /v1/auth/kubernetes/login",
+		"GET /v1/secret/data/slack",
+	}, fake.calls)
+
+	src.Field = ""
+	_, err = src.Secrets(context.Background())
+	assert.EqualError(t, err, "secret/data/slack has fields other, signing_secret, pick one with field=")
+}
+
+func TestVaultTokenLookup(t *testing.T) {
+	lookups := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "s.static", r.Header.Get("X-Vault-Token"))
+		assert.Equal(t, "team-a", r.Header.Get("X-Vault-Namespace"))
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			lookups++
+			w.Write([]byte(`{"data":{"ttl":0,"renewable":false}}`))
+		case "/v1/kv/slack":
+			w.Write([]byte(`{"lease_duration":600,"data":{"signing_secret":"abc"}}`))
+		}
+	}))
+	defer ts.Close()
+
+	src := &VaultSecretSource{
+		Vault: &VaultClient{
+			Addr:      ts.URL,
+			Namespace: "team-a",
+			Login:     VaultTokenLogin("s.static"),
+			Client:    ts.Client(),
+		},
+		Path: "kv/slack",
+	}
+	for i := 0; i < 2; i++ {
+		secrets, err := src.Secrets(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"abc"}, secrets)
+	}
+	assert.Equal(t, 1, lookups, "a token that never expires is looked up once")
+
+	// kv version 1 secrets are read again before their lease runs out
+	refresh := src.refreshIn()
+	assert.True(t, refresh > 8*time.Minute && refresh <= 9*time.Minute, "got %s", refresh)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/jakdept/slack_events_proxy/slackverify"
+)
+
+var flagCaptureFailures = kingpin.
+	Flag("capture-failures", "keep this many requests that failed verification for the admin api").
+	Envar("CAPTURE_FAILURES").Default("0").Int()
+
+var flagVerifyDebugToken = kingpin.
+	Flag("verify-debug-token", "bearer token for /admin/verify/debug on the admin listener, which is not served without one").
+	Envar("VERIFY_DEBUG_TOKEN").String()
+
+// CapturedFailure is a request whose signature did not match, with the
+// basestring the proxy computed for it. Comparing it to what the sender
+// signed shows where the bytes differ.
+type CapturedFailure struct {
+	ReceivedAt       time.Time   `json:"received_at"`
+	RequestURI       string      `json:"request_uri"`
+	Header           http.Header `json:"header"`
+	Basestring       string      `json:"basestring"`
+	BasestringSHA256 string      `json:"basestring_sha256"`
+}
+
+// failureLog holds the most recent failures
+type failureLog struct {
+	mu       sync.Mutex
+	max      int
+	failures []CapturedFailure
+}
+
+var verifyFailures = &failureLog{}
+
+func (l *failureLog) capture(r *http.Request, body []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 {
+		return
+	}
+
+	version := slackverify.Version
+	if sig := r.Header.Get(SlackHeaderSignature); strings.Contains(sig, "=") {
+		version = sig[:strings.Index(sig, "=")]
+	}
+	base := slackverify.Basestring(version, r.Header.Get(SlackHeaderTimestamp), body)
+	sum := sha256.Sum256(base)
+
+	l.failures = append(l.failures, CapturedFailure{
+		ReceivedAt:       time.Now().UTC(),
+		RequestURI:       r.RequestURI,
+		Header:           r.Header.Clone(),
+		Basestring:       string(base),
+		BasestringSHA256: hex.EncodeToString(sum[:]),
+	})
+	if len(l.failures) > l.max {
+		l.failures = l.failures[len(l.failures)-l.max:]
+	}
+}
+
+func (l *failureLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	out := l.failures
+	if out == nil {
+		out = []CapturedFailure{}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// SignatureCheck explains how a request would be verified.
+type SignatureCheck struct {
+	Timestamp  string            `json:"timestamp"`
+	Basestring string            `json:"basestring"`
+	Received   []string          `json:"received"`
+	Expected   map[string]string `json:"expected"` // by secret fingerprint
+	Matched    string            `json:"matched,omitempty"`
+}
+
+// SignatureDebugHandler takes a captured http request, headers and body as
+// they came over the wire, and shows what the proxy makes of its signature.
+// The expected signatures make it a signing oracle, so it belongs on the
+// admin listener only, and only answers requests bearing token.
+func SignatureDebugHandler(secrets func() []string, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		captured, err := http.ReadRequest(bufio.NewReader(r.Body))
+		if err != nil {
+			http.Error(w, "bad captured request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(captured.Body)
+		if err != nil {
+			http.Error(w, "bad captured body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		check := SignatureCheck{
+			Timestamp: captured.Header.Get(SlackHeaderTimestamp),
+			Expected:  map[string]string{},
+		}
+		version := slackverify.Version
+		for _, header := range captured.Header[SlackHeaderSignature] {
+			for _, sig := range strings.Split(header, ",") {
+				sig = strings.TrimSpace(sig)
+				check.Received = append(check.Received, sig)
+				if i := strings.Index(sig, "="); i > 0 {
+					version = sig[:i]
+				}
+			}
+		}
+		check.Basestring = string(slackverify.Basestring(version, check.Timestamp, body))
+
+		for _, secret := range secrets() {
+			expected := slackverify.Signature(secret, version, check.Timestamp, body)
+			check.Expected[SecretFingerprint(secret)] = expected
+			if check.Matched == "" && containsString(check.Received, expected) {
+				check.Matched = SecretFingerprint(secret)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(check)
+	})
+}
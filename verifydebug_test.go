@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureFailures(t *testing.T) {
+	defer func(old *failureLog) { verifyFailures = old }(verifyFailures)
+	verifyFailures = &failureLog{max: 2}
+
+	h := (&SlackVerifier{Secrets: []string{"shh"}, Expire: time.Minute}).
+		Handler(StatusHandler(http.StatusNoContent, ""))
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader("body "+strconv.Itoa(i)))
+		r.Header.Set(SlackHeaderTimestamp, ts)
+		r.Header.Set(SlackHeaderSignature, "v0="+strings.Repeat("0", 64))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	// failures before the signature is checked have no basestring to show
+	r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader("stale"))
+	r.Header.Set(SlackHeaderTimestamp, "1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	verifyFailures.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/verify/failures", nil))
+	var failures []CapturedFailure
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&failures))
+	require.Len(t, failures, 2)
+	assert.Equal(t, "v0:"+ts+":body 1", failures[0].Basestring)
+	assert.Equal(t, "v0:"+ts+":body 2", failures[1].Basestring)
+	assert.Equal(t, "/events", failures[1].RequestURI)
+	assert.Len(t, failures[1].BasestringSHA256, 64)
+}
+
+func TestSignatureDebugHandler(t *testing.T) {
+	// the example from slack's documentation
+	secret := "8f742231b10e8888abcd99yyyzzz85a5"
+	body := "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+	sig := "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"
+	captured := "POST /slack/commands HTTP/1.1\r\n" +
+		"Host: proxy\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\n" +
+		"X-Slack-Request-Timestamp: 1531420618\r\n" +
+		"X-Slack-Signature: " + sig + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+
+	h := SignatureDebugHandler(func() []string { return []string{"other", secret} }, "debug-token")
+	for name, tc := range map[string]struct {
+		method  string
+		auth    string
+		in      string
+		status  int
+		matched string
+	}{
+		"match":      {method: http.MethodPost, in: captured, status: http.StatusOK, matched: SecretFingerprint(secret)},
+		"no match":   {method: http.MethodPost, in: strings.Replace(captured, "a2114d", "b2114d", 1), status: http.StatusOK},
+		"not http":   {method: http.MethodPost, in: "hello", status: http.StatusBadRequest},
+		"wrong verb": {method: http.MethodGet, status: http.StatusMethodNotAllowed},
+		"no token":   {method: http.MethodPost, auth: "-", in: captured, status: http.StatusUnauthorized},
+		"bad token":  {method: http.MethodPost, auth: "Bearer other", in: captured, status: http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/admin/verify/debug", strings.NewReader(tc.in))
+			switch tc.auth {
+			case "":
+				r.Header.Set("Authorization", "Bearer debug-token")
+			case "-":
+			default:
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, tc.status, w.Code, w.Body.String())
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var check SignatureCheck
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&check))
+			assert.Equal(t, "1531420618", check.Timestamp)
+			assert.Equal(t, "v0:1531420618:"+body, check.Basestring)
+			assert.Equal(t, sig, check.Expected[SecretFingerprint(secret)])
+			assert.Len(t, check.Expected, 2)
+			assert.Equal(t, tc.matched, check.Matched)
+		})
+	}
+
+	// without a token it answers nothing
+	w := httptest.NewRecorder()
+	SignatureDebugHandler(func() []string { return []string{secret} }, "").ServeHTTP(w,
+		httptest.NewRequest(http.MethodPost, "/admin/verify/debug", strings.NewReader(captured)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	VersionHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var info BuildInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(t, BuildInfo{Version: "dev", Commit: "unknown", BuildDate: "unknown",
+		GoVersion: runtime.Version()}, info)
+	assert.Equal(t, "dev (commit unknown, built unknown, "+runtime.Version()+")", info.String())
+}
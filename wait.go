@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	flagWaitFor = kingpin.
+			Flag("wait-for", "dependency to wait on before starting, repeatable: backend, outbox, or any host:port").
+			Envar("WAIT_FOR").Strings()
+	flagWaitTimeout = kingpin.
+			Flag("wait-timeout", "how long to wait on --wait-for before giving up").
+			Envar("WAIT_TIMEOUT").Default("1m").Duration()
+)
+
+// waitTargets are the checks for each --wait-for in names, nil once the
+// dependency can be reached
+func waitTargets(names []string, config *Config) (map[string]readyCheck, error) {
+	targets := map[string]readyCheck{}
+	for _, name := range names {
+		switch name {
+		case "backend":
+			backends := configBackends(config)
+			targets[name] = func(ctx context.Context) error { return checkBackends(ctx, backends) }
+		case "outbox":
+			if *flagOutbox == nil {
+				return nil, fmt.Errorf("--wait-for outbox needs --outbox")
+			}
+			addr := (*flagOutbox).Host
+			if (*flagOutbox).Port() == "" {
+				addr = net.JoinHostPort(addr, "5432")
+			}
+			targets[name] = dialCheck(addr)
+		default:
+			if _, _, err := net.SplitHostPort(name); err != nil {
+				return nil, fmt.Errorf("--wait-for %s: not backend, outbox or a host:port", name)
+			}
+			targets[name] = dialCheck(name)
+		}
+	}
+	return targets, nil
+}
+
+func dialCheck(addr string) readyCheck {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// waitFor retries every target each interval until they all pass, failing
+// with what is still down once ctx is done
+func waitFor(ctx context.Context, targets map[string]readyCheck, interval time.Duration) error {
+	down := map[string]error{}
+	for name := range targets {
+		down[name] = nil
+	}
+	for {
+		for name := range down {
+			attempt, cancel := context.WithTimeout(ctx, interval)
+			err := targets[name](attempt)
+			cancel()
+			if err == nil {
+				delete(down, name)
+				log.Printf("%s is up", name)
+				continue
+			}
+			if down[name] == nil {
+				log.Printf("waiting on %s: %v", name, err)
+			}
+			down[name] = err
+		}
+		if len(down) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			var still []string
+			for name, err := range down {
+				still = append(still, fmt.Sprintf("%s (%v)", name, err))
+			}
+			sort.Strings(still)
+			return fmt.Errorf("gave up waiting on %s", strings.Join(still, ", "))
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitTargets(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	config := &Config{Backend: "http://" + l.Addr().String()}
+
+	targets, err := waitTargets([]string{"backend", l.Addr().String()}, config)
+	require.NoError(t, err)
+	assert.Len(t, targets, 2)
+	assert.NoError(t, targets[l.Addr().String()](context.Background()))
+
+	_, err = waitTargets([]string{"redis"}, config)
+	assert.EqualError(t, err, "--wait-for redis: not backend, outbox or a host:port")
+	_, err = waitTargets([]string{"outbox"}, config)
+	assert.EqualError(t, err, "--wait-for outbox needs --outbox")
+}
+
+func TestWaitFor(t *testing.T) {
+	tries := 0
+	targets := map[string]readyCheck{
+		"up": func(ctx context.Context) error { return nil },
+		"slow": func(ctx context.Context) error {
+			if tries++; tries < 3 {
+				return errors.New("refused")
+			}
+			return nil
+		},
+	}
+	require.NoError(t, waitFor(context.Background(), targets, time.Millisecond))
+	assert.Equal(t, 3, tries)
+
+	targets["down"] = func(ctx context.Context) error { return errors.New("refused") }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, waitFor(ctx, targets, time.Millisecond), "gave up waiting on down (refused)")
+}
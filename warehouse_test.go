@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenWarehouse(t *testing.T) {
+	for raw, expErr := range map[string]string{
+		"clickhouse://default:pw@localhost:8123/slack.events": "",
+		"clickhouse://localhost:8123/events":                  "",
+		"clickhouse://localhost:8123/":                        `bad clickhouse table ""`,
+		"clickhouse://localhost:8123/events;drop":             `bad clickhouse table "events;drop"`,
+		"bigquery://project/dataset.table":                    `no warehouse driver for "bigquery"`,
+	} {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		_, err = OpenWarehouse(u)
+		if expErr == "" {
+			assert.NoError(t, err, raw)
+		} else {
+			assert.EqualError(t, err, expErr, raw)
+		}
+	}
+}
+
+func TestWarehouseSink(t *testing.T) {
+	var loaded []WarehouseRow
+	failing := true
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "INSERT INTO slack.events FORMAT JSONEachRow", r.URL.Query().Get("query"))
+		assert.Equal(t, "default", r.Header.Get("X-ClickHouse-User"))
+		assert.Equal(t, "pw", r.Header.Get("X-ClickHouse-Key"))
+		if failing {
+			http.Error(w, "Code: 60. Table slack.events doesn't exist.", http.StatusNotFound)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var row WarehouseRow
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+			loaded = append(loaded, row)
+		}
+	}))
+	defer ch.Close()
+
+	u, err := url.Parse(ch.URL)
+	require.NoError(t, err)
+	u.Scheme = "clickhouse"
+	u.User = url.UserPassword("default", "pw")
+	u.Path = "/slack.events"
+	w, err := OpenWarehouse(u)
+	require.NoError(t, err)
+
+	sink := NewWarehouseSink(w, 2)
+	d := &Delivery{
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       []byte(`{"type":"event_callback","team_id":"T1","event_id":"Ev1","event":{"type":"message","channel":"C1","user":"U1"}}`),
+		ReceivedAt: time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, sink.Send(context.Background(), d))
+	require.NoError(t, sink.Send(context.Background(), &Delivery{Body: []byte("junk")}))
+
+	select {
+	case <-sink.full:
+	default:
+		t.Fatal("sink should be full after a batch")
+	}
+
+	assert.EqualError(t, sink.Flush(context.Background()),
+		"clickhouse returned 404: Code: 60. Table slack.events doesn't exist.")
+	assert.Empty(t, loaded)
+
+	failing = false
+	require.NoError(t, sink.Flush(context.Background()))
+	require.Len(t, loaded, 2)
+	assert.Equal(t, WarehouseRow{
+		ReceivedAt: d.ReceivedAt,
+		Kind:       PayloadEvent,
+		Type:       "message",
+		ID:         "Ev1",
+		TeamID:     "T1",
+		ChannelID:  "C1",
+		UserID:     "U1",
+		Body:       string(d.Body),
+	}, loaded[0])
+	assert.Equal(t, WarehouseRow{Body: "junk"}, loaded[1])
+
+	// nothing left to load
+	require.NoError(t, sink.Flush(context.Background()))
+	assert.Len(t, loaded, 2)
+}